@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 
 	"github.com/spf13/cobra"
-	"github.com/stevehiehn/declaragent/internal/engine"
-	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 var dryRunInputs []string
@@ -17,22 +17,12 @@ var dryRunCmd = &cobra.Command{
 	Short: "Show what would be executed without running",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		p, err := plan.LoadFile(args[0])
+		eng := newEngine(cmd.Context())
+		p, err := eng.LoadPlan(args[0])
 		if err != nil {
 			return err
 		}
-		inputs := parseInputs(dryRunInputs)
-		for name, inp := range p.Inputs {
-			if _, ok := inputs[name]; !ok && inp.Default != "" {
-				inputs[name] = inp.Default
-			}
-		}
-		if err := plan.Validate(p, inputs); err != nil {
-			return err
-		}
-
-		ctx := engine.NewRunContext(".", inputs, false)
-		result, err := engine.Execute(p, ctx, engine.ModeDryRun)
+		result, err := eng.DryRun(cmd.Context(), p, parseInputs(dryRunInputs))
 		if err != nil {
 			return err
 		}
@@ -43,19 +33,57 @@ var dryRunCmd = &cobra.Command{
 
 		fmt.Printf("Dry-run: %s\n\n", p.Name)
 		for _, sr := range result.Steps {
-			fmt.Printf("Step: %s [%s]\n", sr.ID, sr.Status)
-			if sr.DryRunInfo != "" {
-				fmt.Printf("  %s\n", sr.DryRunInfo)
-			}
-			if sr.Command != "" && sr.DryRunInfo == "" {
-				fmt.Printf("  Would run: %s\n", sr.Command)
+			printDryRunStep(sr)
+		}
+		if len(result.Rollback) > 0 {
+			fmt.Println("Rollback (if a step fails, most recent step first):")
+			fmt.Println()
+			for _, sr := range result.Rollback {
+				printDryRunStep(sr)
 			}
+		}
+		if len(result.Finally) > 0 {
+			fmt.Println("Finally (always runs):")
 			fmt.Println()
+			for _, sr := range result.Finally {
+				printDryRunStep(sr)
+			}
 		}
 		return nil
 	},
 }
 
+func printDryRunStep(sr declaragent.StepResult) {
+	fmt.Printf("Step: %s [%s]\n", sr.ID, sr.Status)
+	if sr.Condition != "" {
+		fmt.Printf("  If: %s => %s\n", sr.Condition, sr.ConditionResult)
+		if sr.ConditionNote != "" {
+			fmt.Printf("    (%s)\n", sr.ConditionNote)
+		}
+	}
+	if sr.DryRunInfo != "" {
+		fmt.Printf("  %s\n", sr.DryRunInfo)
+	}
+	if sr.Command != "" && sr.DryRunInfo == "" {
+		fmt.Printf("  Would run: %s\n", sr.Command)
+	}
+	var nested []declaragent.StepResult
+	if sr.Plan != nil {
+		nested = slices.Concat(sr.Plan.Steps, sr.Plan.Finally)
+	}
+	for _, c := range slices.Concat(sr.Children, nested) {
+		detail := c.DryRunInfo
+		if detail == "" {
+			detail = c.Command
+		}
+		if c.Status == "skipped_condition" {
+			detail = "condition is false"
+		}
+		fmt.Printf("  %s [%s]: %s\n", c.ID, c.Status, detail)
+	}
+	fmt.Println()
+}
+
 func init() {
 	dryRunCmd.Flags().StringArrayVar(&dryRunInputs, "input", nil, "Input values (key=value)")
 	rootCmd.AddCommand(dryRunCmd)
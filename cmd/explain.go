@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
-	"github.com/stevehiehn/declaragent/internal/engine"
-	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 var explainInputs []string
@@ -17,23 +19,12 @@ var explainCmd = &cobra.Command{
 	Short: "Show resolved plan steps without executing",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		p, err := plan.LoadFile(args[0])
+		eng := newEngine(cmd.Context())
+		p, err := eng.LoadPlan(args[0])
 		if err != nil {
 			return err
 		}
-		inputs := parseInputs(explainInputs)
-		// Apply defaults
-		for name, inp := range p.Inputs {
-			if _, ok := inputs[name]; !ok && inp.Default != "" {
-				inputs[name] = inp.Default
-			}
-		}
-		if err := plan.Validate(p, inputs); err != nil {
-			return err
-		}
-
-		ctx := engine.NewRunContext(".", inputs, false)
-		result, err := engine.Execute(p, ctx, engine.ModeExplain)
+		result, err := eng.Explain(cmd.Context(), p, parseInputs(explainInputs))
 		if err != nil {
 			return err
 		}
@@ -48,22 +39,72 @@ var explainCmd = &cobra.Command{
 		}
 		fmt.Println()
 		for _, sr := range result.Steps {
-			fmt.Printf("Step: %s\n", sr.ID)
-			if sr.Description != "" {
-				fmt.Printf("  Description: %s\n", sr.Description)
-			}
-			if sr.Command != "" {
-				fmt.Printf("  Command: %s\n", sr.Command)
-			}
-			if sr.DryRunInfo != "" {
-				fmt.Printf("  Info: %s\n", sr.DryRunInfo)
+			printExplainStep(sr)
+		}
+		if len(result.Rollback) > 0 {
+			fmt.Println("Rollback (if a step fails, most recent step first):")
+			fmt.Println()
+			for _, sr := range result.Rollback {
+				printExplainStep(sr)
 			}
+		}
+		if len(result.Finally) > 0 {
+			fmt.Println("Finally (always runs):")
 			fmt.Println()
+			for _, sr := range result.Finally {
+				printExplainStep(sr)
+			}
 		}
 		return nil
 	},
 }
 
+func printExplainStep(sr declaragent.StepResult) {
+	fmt.Printf("Step: %s\n", sr.ID)
+	if sr.Description != "" {
+		fmt.Printf("  Description: %s\n", sr.Description)
+	}
+	if sr.Condition != "" {
+		fmt.Printf("  If: %s => %s\n", sr.Condition, sr.ConditionResult)
+		if sr.ConditionNote != "" {
+			fmt.Printf("    (%s)\n", sr.ConditionNote)
+		}
+	}
+	if len(sr.Argv) > 0 {
+		quoted := make([]string, len(sr.Argv))
+		for i, arg := range sr.Argv {
+			quoted[i] = strconv.Quote(arg)
+		}
+		fmt.Printf("  Exec: [%s]\n", strings.Join(quoted, ", "))
+	} else if sr.Command != "" {
+		fmt.Printf("  Command: %s\n", sr.Command)
+	}
+	if sr.DryRunInfo != "" {
+		fmt.Printf("  Info: %s\n", sr.DryRunInfo)
+	}
+	if len(sr.Children) > 0 {
+		fmt.Printf("  Expands to %d steps:\n", len(sr.Children))
+		for _, c := range sr.Children {
+			detail := c.Command
+			if c.ConditionResult == "false" {
+				detail = "skipped, condition is false"
+			}
+			fmt.Printf("    %s: %s\n", c.ID, detail)
+		}
+	}
+	if sr.Plan != nil {
+		fmt.Printf("  Runs %d steps:\n", len(sr.Plan.Steps)+len(sr.Plan.Finally))
+		for _, c := range slices.Concat(sr.Plan.Steps, sr.Plan.Finally) {
+			detail := c.Command
+			if c.ConditionResult == "false" {
+				detail = "skipped, condition is false"
+			}
+			fmt.Printf("    %s: %s\n", c.ID, detail)
+		}
+	}
+	fmt.Println()
+}
+
 func init() {
 	explainCmd.Flags().StringArrayVar(&explainInputs, "input", nil, "Input values (key=value)")
 	rootCmd.AddCommand(explainCmd)
@@ -1,6 +1,24 @@
 package cmd
 
-import "strings"
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
+)
+
+// interruptContext returns a context that is cancelled on the first Ctrl-C,
+// which stops running steps instead of leaving them behind. Once it is
+// cancelled Ctrl-C is no longer caught, so a second one kills the process
+// even while finally or rollback steps are running.
+func interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
+}
 
 // parseInputs converts ["key=value", ...] to a map.
 func parseInputs(raw []string) map[string]string {
@@ -13,3 +31,46 @@ func parseInputs(raw []string) map[string]string {
 	}
 	return m
 }
+
+// newEngine returns an engine with opts and the plugin actions found in the
+// --plugin-dir directories. Plugins are not looked for on PATH, since loading
+// one runs it. Plugins that cannot be loaded are reported as warnings.
+func newEngine(ctx context.Context, opts ...declaragent.Option) *declaragent.Engine {
+	eng := declaragent.New(opts...)
+	if len(pluginDirs) == 0 {
+		return eng
+	}
+	if err := eng.LoadPlugins(ctx, pluginDirs...); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", line)
+		}
+	}
+	return eng
+}
+
+// runOptions returns the options of run and resume, allowing destructive
+// steps when approve is set. Without --json the output of steps is shown as
+// they run.
+func runOptions(approve bool, maxParallel int) []declaragent.Option {
+	opts := []declaragent.Option{declaragent.WithMaxParallel(maxParallel)}
+	if approve {
+		opts = append(opts, declaragent.WithApprover(declaragent.ApproveAll))
+	}
+	if !jsonOutput {
+		opts = append(opts, declaragent.WithObserver(printStepOutput))
+	}
+	return opts
+}
+
+// printStepOutput shows each line a step prints, prefixed with the step ID,
+// on stdout or stderr as the step printed it.
+func printStepOutput(e declaragent.Event) {
+	if e.Type != declaragent.EventStepOutput {
+		return
+	}
+	w := os.Stdout
+	if e.Stream == "stderr" {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "[%s] %s\n", e.StepID, e.Line)
+}
@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/stevehiehn/declaragent/internal/mcp"
@@ -19,12 +18,12 @@ var mcpCmd = &cobra.Command{
 	Short: "Start MCP server (stdio or SSE transport)",
 	Args:  cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		wd, _ := os.Getwd()
+		eng := newEngine(cmd.Context())
 		switch mcpTransport {
 		case "stdio":
-			return mcp.ServeStdio(wd, mcpPlansDir)
+			return mcp.ServeStdio(eng, mcpPlansDir)
 		case "sse":
-			return mcp.ServeSSE(mcpPort, wd, mcpPlansDir)
+			return mcp.ServeSSE(mcpPort, eng, mcpPlansDir)
 		default:
 			return fmt.Errorf("unknown transport %q (must be stdio or sse)", mcpTransport)
 		}
@@ -36,4 +35,4 @@ func init() {
 	mcpCmd.Flags().StringVar(&mcpTransport, "transport", "stdio", "Transport mode: stdio or sse")
 	mcpCmd.Flags().IntVar(&mcpPort, "port", 19100, "Port for SSE transport (default 19100)")
 	rootCmd.AddCommand(mcpCmd)
-}
\ No newline at end of file
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
+)
+
+var (
+	resumeInputs      []string
+	resumePlan        string
+	resumeApprove     bool
+	resumeMaxParallel int
+)
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume <run_id>",
+	Short: "Continue a failed run from the step that failed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		eng := newEngine(cmd.Context(), runOptions(resumeApprove, resumeMaxParallel)...)
+		prev, err := eng.LoadRun(args[0])
+		if err != nil {
+			return err
+		}
+
+		file := resumePlan
+		if file == "" {
+			file = prev.Meta.PlanPath
+		}
+		p, err := eng.LoadPlan(file)
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := interruptContext(cmd.Context())
+		defer stop()
+
+		// Secret inputs are not stored with the run and must be given again
+		result, err := eng.Resume(ctx, p, prev, parseInputs(resumeInputs))
+		if err != nil {
+			return err
+		}
+
+		return printRunResult(p, result)
+	},
+}
+
+func init() {
+	resumeCmd.Flags().StringArrayVar(&resumeInputs, "input", nil, "Input values (key=value), e.g. secret inputs, which are not stored with the run")
+	resumeCmd.Flags().StringVar(&resumePlan, "plan", "", "Plan file, if it has moved since the original run")
+	resumeCmd.Flags().BoolVar(&resumeApprove, "approve", false, "Allow destructive steps")
+	resumeCmd.Flags().IntVar(&resumeMaxParallel, "max-parallel", declaragent.DefaultMaxParallel, "Maximum number of steps to run at once (0 = no limit)")
+	rootCmd.AddCommand(resumeCmd)
+}
@@ -7,7 +7,10 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var jsonOutput bool
+var (
+	jsonOutput bool
+	pluginDirs []string
+)
 
 var rootCmd = &cobra.Command{
 	Use:   "declaragent",
@@ -17,6 +20,7 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Output raw JSON")
+	rootCmd.PersistentFlags().StringArrayVar(&pluginDirs, "plugin-dir", nil, "Directory to load declaragent-action-* plugins from (repeatable)")
 }
 
 // Execute runs the root command.
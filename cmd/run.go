@@ -3,16 +3,18 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 
 	"github.com/spf13/cobra"
-	"github.com/stevehiehn/declaragent/internal/engine"
-	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 var (
-	runInputs  []string
-	runApprove bool
+	runInputs      []string
+	runApprove     bool
+	runMaxParallel int
 )
 
 var runCmd = &cobra.Command{
@@ -20,49 +22,57 @@ var runCmd = &cobra.Command{
 	Short: "Execute a plan",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		p, err := plan.LoadFile(args[0])
+		eng := newEngine(cmd.Context(), runOptions(runApprove, runMaxParallel)...)
+		p, err := eng.LoadPlan(args[0])
 		if err != nil {
 			return err
 		}
-		inputs := parseInputs(runInputs)
-		for name, inp := range p.Inputs {
-			if _, ok := inputs[name]; !ok && inp.Default != "" {
-				inputs[name] = inp.Default
-			}
-		}
-		if err := plan.Validate(p, inputs); err != nil {
-			return err
-		}
 
-		wd, _ := os.Getwd()
-		ctx := engine.NewRunContext(wd, inputs, runApprove)
-		result, err := engine.Execute(p, ctx, engine.ModeRun)
+		ctx, stop := interruptContext(cmd.Context())
+		defer stop()
+
+		result, err := eng.Run(ctx, p, parseInputs(runInputs))
 		if err != nil {
 			return err
 		}
 
-		if jsonOutput {
-			return json.NewEncoder(os.Stdout).Encode(result)
-		}
+		return printRunResult(p, result)
+	},
+}
+
+// printRunResult reports the outcome of run or resume.
+func printRunResult(p *declaragent.Plan, result *declaragent.Result) error {
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
 
-		if result.Success {
-			fmt.Printf("Plan %q completed successfully.\n", p.Name)
-		} else {
-			fmt.Printf("Plan %q failed at step %q.\n", p.Name, result.FailedStepID)
-			for _, e := range result.Errors {
-				fmt.Printf("  Error: %s\n", e.Message)
-				if e.Hint != "" {
-					fmt.Printf("  Hint: %s\n", e.Hint)
-				}
+	if result.Success {
+		fmt.Printf("Plan %q completed successfully.\n", p.Name)
+		for _, name := range slices.Sorted(maps.Keys(result.Outputs)) {
+			fmt.Printf("  %s: %s\n", name, result.Outputs[name])
+		}
+	} else {
+		fmt.Printf("Plan %q failed at step %q.\n", p.Name, result.FailedStepID)
+		for _, e := range result.Errors {
+			fmt.Printf("  Error: %s\n", e.Message)
+			if e.Hint != "" {
+				fmt.Printf("  Hint: %s\n", e.Hint)
 			}
 		}
-		fmt.Printf("Run ID: %s\n", result.RunID)
-		return nil
-	},
+		if len(result.Rollback) > 0 {
+			fmt.Println("  Rollback:")
+			for _, sr := range result.Rollback {
+				fmt.Printf("    %s: %s\n", sr.ID, sr.Status)
+			}
+		}
+	}
+	fmt.Printf("Run ID: %s\n", result.RunID)
+	return nil
 }
 
 func init() {
 	runCmd.Flags().StringArrayVar(&runInputs, "input", nil, "Input values (key=value)")
 	runCmd.Flags().BoolVar(&runApprove, "approve", false, "Allow destructive steps")
+	runCmd.Flags().IntVar(&runMaxParallel, "max-parallel", declaragent.DefaultMaxParallel, "Maximum number of steps to run at once (0 = no limit)")
 	rootCmd.AddCommand(runCmd)
 }
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema of plan files",
+	Long:  "Print a JSON Schema (draft 2020-12) of plan YAML files, for editors and for agents writing plans.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(newEngine(cmd.Context()).JSONSchema())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
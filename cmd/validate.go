@@ -6,7 +6,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
-	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 var validateCmd = &cobra.Command{
@@ -14,22 +14,30 @@ var validateCmd = &cobra.Command{
 	Short: "Validate a plan file",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		p, err := plan.LoadFile(args[0])
-		if err != nil {
-			return err
+		eng := newEngine(cmd.Context())
+		p, err := eng.LoadPlan(args[0])
+		if err == nil {
+			err = eng.Validate(p, nil)
 		}
-		if err := plan.Validate(p, nil); err != nil {
-			if jsonOutput {
-				json.NewEncoder(os.Stdout).Encode(map[string]any{"valid": false, "error": err.Error()})
-			} else {
-				fmt.Fprintf(os.Stderr, "Validation failed: %s\n", err)
-			}
+		if err != nil {
+			reportInvalid(err)
 			os.Exit(1)
 		}
+		warnings := declaragent.Lint(p)
 		if jsonOutput {
-			json.NewEncoder(os.Stdout).Encode(map[string]any{"valid": true})
+			out := map[string]any{"valid": true}
+			if len(warnings) > 0 {
+				out["warnings"] = warnings
+			}
+			json.NewEncoder(os.Stdout).Encode(out)
 		} else {
 			fmt.Println("Plan is valid.")
+			for _, w := range warnings {
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", w.Message)
+				if w.Hint != "" {
+					fmt.Fprintf(os.Stderr, "  Hint: %s\n", w.Hint)
+				}
+			}
 		}
 		return nil
 	},
@@ -38,3 +46,30 @@ var validateCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(validateCmd)
 }
+
+// reportInvalid prints every problem in err, which may be a list of them.
+func reportInvalid(err error) {
+	problems := declaragent.Errors(err)
+	if len(problems) == 0 {
+		// Not a plan problem, e.g. the file could not be read
+		problems = []*declaragent.RunError{{Type: declaragent.ErrorValidation, Message: err.Error()}}
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(map[string]any{"valid": false, "errors": problems, "error": err.Error()})
+		return
+	}
+	if len(problems) == 1 {
+		fmt.Fprintf(os.Stderr, "Validation failed: %s\n", problems[0])
+		if hint := problems[0].Hint; hint != "" {
+			fmt.Fprintf(os.Stderr, "  Hint: %s\n", hint)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Validation failed with %d problems:\n", len(problems))
+	for _, e := range problems {
+		fmt.Fprintf(os.Stderr, "  %s\n", e)
+		if e.Hint != "" {
+			fmt.Fprintf(os.Stderr, "    Hint: %s\n", e.Hint)
+		}
+	}
+}
@@ -372,3 +372,42 @@ func runGit(t *testing.T, dir string, args ...string) {
 		t.Fatalf("git %v: %s: %v", args, out, err)
 	}
 }
+
+func TestShellInjectionIsQuotedE2E(t *testing.T) {
+	dir := t.TempDir()
+	writePlan(t, dir, "plan.yaml", `
+name: injection
+inputs:
+  name:
+    required: true
+steps:
+  - id: bare
+    run: echo hello ${{inputs.name}}
+    outputs:
+      out: stdout
+  - id: quoted
+    run: echo "hello ${{inputs.name}}"
+    outputs:
+      out: stdout
+`)
+	p := loadPlan(t, filepath.Join(dir, "plan.yaml"))
+	evil := `x"; touch pwned; echo "$(touch pwned2)` + "`touch pwned3`"
+	ctx := engine.NewRunContext(dir, map[string]string{"name": evil}, false)
+	result, err := engine.Execute(p, ctx, engine.ModeRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got %v", result.Errors)
+	}
+	for _, f := range []string{"pwned", "pwned2", "pwned3"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			t.Fatalf("input was executed as shell: %s exists", f)
+		}
+	}
+	for _, sr := range result.Steps {
+		if got := sr.Outputs["out"]; got != "hello "+evil {
+			t.Errorf("step %s: expected the input echoed literally, got %q", sr.ID, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"fmt"
 	"os"
 )
@@ -8,11 +9,23 @@ import (
 // EnvGet implements env.get action.
 type EnvGet struct{}
 
-func (e *EnvGet) Execute(params map[string]string) (map[string]string, error) {
-	name := params["name"]
-	if name == "" {
-		return nil, fmt.Errorf("env.get: missing required param 'name'")
+func (e *EnvGet) Spec() Spec {
+	return Spec{
+		Name:        "env.get",
+		Description: "Read an environment variable",
+		Params: []Param{
+			{Name: "name", Required: true, Description: "Environment variable to read"},
+			{Name: "secret", Type: TypeBoolean, Description: "true masks the value as *** in results, artifacts and output"},
+		},
+		Outputs: []string{"value"},
 	}
+}
+
+func (e *EnvGet) Execute(_ context.Context, params map[string]string) (map[string]string, error) {
+	if err := e.Spec().Check(params); err != nil {
+		return nil, err
+	}
+	name := params["name"]
 	val, ok := os.LookupEnv(name)
 	if !ok {
 		return nil, fmt.Errorf("env.get: environment variable %q not set", name)
@@ -21,5 +34,16 @@ func (e *EnvGet) Execute(params map[string]string) (map[string]string, error) {
 }
 
 func (e *EnvGet) DryRun(params map[string]string) string {
+	if params["secret"] == "true" {
+		return fmt.Sprintf("Would read secret environment variable %q", params["name"])
+	}
 	return fmt.Sprintf("Would read environment variable %q", params["name"])
 }
+
+// SecretOutputs marks the value as a secret when the secret param is "true".
+func (e *EnvGet) SecretOutputs(params map[string]string) []string {
+	if params["secret"] == "true" {
+		return []string{"value"}
+	}
+	return nil
+}
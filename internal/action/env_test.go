@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"os"
 	"testing"
 )
@@ -10,7 +11,7 @@ func TestEnvGetExistingVar(t *testing.T) {
 	defer os.Unsetenv("DECLARAGENT_TEST_VAR")
 
 	eg := &EnvGet{}
-	out, err := eg.Execute(map[string]string{"name": "DECLARAGENT_TEST_VAR"})
+	out, err := eg.Execute(context.Background(), map[string]string{"name": "DECLARAGENT_TEST_VAR"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -22,7 +23,7 @@ func TestEnvGetExistingVar(t *testing.T) {
 func TestEnvGetMissingVarError(t *testing.T) {
 	os.Unsetenv("DECLARAGENT_NONEXISTENT_VAR")
 	eg := &EnvGet{}
-	_, err := eg.Execute(map[string]string{"name": "DECLARAGENT_NONEXISTENT_VAR"})
+	_, err := eg.Execute(context.Background(), map[string]string{"name": "DECLARAGENT_NONEXISTENT_VAR"})
 	if err == nil {
 		t.Fatal("expected error for missing env var")
 	}
@@ -35,3 +36,13 @@ func TestEnvGetDryRun(t *testing.T) {
 		t.Fatal("expected non-empty dry run description")
 	}
 }
+
+func TestEnvGetSecretOutputs(t *testing.T) {
+	eg := &EnvGet{}
+	if got := eg.SecretOutputs(map[string]string{"name": "X", "secret": "true"}); len(got) != 1 || got[0] != "value" {
+		t.Errorf("expected value to be secret, got %v", got)
+	}
+	if got := eg.SecretOutputs(map[string]string{"name": "X"}); got != nil {
+		t.Errorf("expected no secret outputs, got %v", got)
+	}
+}
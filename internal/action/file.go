@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,15 +10,24 @@ import (
 // FileWrite implements file.write action.
 type FileWrite struct{}
 
-func (f *FileWrite) Execute(params map[string]string) (map[string]string, error) {
-	path := params["path"]
-	content := params["content"]
-	if path == "" {
-		return nil, fmt.Errorf("file.write: missing required param 'path'")
+func (f *FileWrite) Spec() Spec {
+	return Spec{
+		Name:        "file.write",
+		Description: "Write content to a file, replacing what it held",
+		Params: []Param{
+			{Name: "path", Required: true, Type: TypeFile, Description: "File to write, created with its directories if missing"},
+			{Name: "content", Required: true, Description: "Content of the file"},
+		},
+		Outputs: []string{"path"},
 	}
-	if content == "" {
-		return nil, fmt.Errorf("file.write: missing required param 'content'")
+}
+
+func (f *FileWrite) Execute(_ context.Context, params map[string]string) (map[string]string, error) {
+	if err := f.Spec().Check(params); err != nil {
+		return nil, err
 	}
+	path := params["path"]
+	content := params["content"]
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return nil, fmt.Errorf("file.write: %w", err)
 	}
@@ -34,15 +44,24 @@ func (f *FileWrite) DryRun(params map[string]string) string {
 // FileAppend implements file.append action.
 type FileAppend struct{}
 
-func (f *FileAppend) Execute(params map[string]string) (map[string]string, error) {
-	path := params["path"]
-	content := params["content"]
-	if path == "" {
-		return nil, fmt.Errorf("file.append: missing required param 'path'")
+func (f *FileAppend) Spec() Spec {
+	return Spec{
+		Name:        "file.append",
+		Description: "Append content to a file",
+		Params: []Param{
+			{Name: "path", Required: true, Type: TypeFile, Description: "File to append to, created with its directories if missing"},
+			{Name: "content", Required: true, Description: "Content added to the end of the file"},
+		},
+		Outputs: []string{"path"},
 	}
-	if content == "" {
-		return nil, fmt.Errorf("file.append: missing required param 'content'")
+}
+
+func (f *FileAppend) Execute(_ context.Context, params map[string]string) (map[string]string, error) {
+	if err := f.Spec().Check(params); err != nil {
+		return nil, err
 	}
+	path := params["path"]
+	content := params["content"]
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return nil, fmt.Errorf("file.append: %w", err)
 	}
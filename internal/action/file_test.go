@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -10,7 +11,7 @@ func TestFileWriteCreatesFile(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "out.txt")
 	fw := &FileWrite{}
-	_, err := fw.Execute(map[string]string{"path": path, "content": "hello"})
+	_, err := fw.Execute(context.Background(), map[string]string{"path": path, "content": "hello"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -25,7 +26,7 @@ func TestFileWriteOverwrites(t *testing.T) {
 	path := filepath.Join(dir, "out.txt")
 	os.WriteFile(path, []byte("old"), 0o644)
 	fw := &FileWrite{}
-	_, err := fw.Execute(map[string]string{"path": path, "content": "new"})
+	_, err := fw.Execute(context.Background(), map[string]string{"path": path, "content": "new"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -39,7 +40,7 @@ func TestFileWriteReturnsPath(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "out.txt")
 	fw := &FileWrite{}
-	out, err := fw.Execute(map[string]string{"path": path, "content": "x"})
+	out, err := fw.Execute(context.Background(), map[string]string{"path": path, "content": "x"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -52,7 +53,7 @@ func TestFileAppendCreatesFile(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "out.txt")
 	fa := &FileAppend{}
-	_, err := fa.Execute(map[string]string{"path": path, "content": "hello"})
+	_, err := fa.Execute(context.Background(), map[string]string{"path": path, "content": "hello"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -67,7 +68,7 @@ func TestFileAppendAppends(t *testing.T) {
 	path := filepath.Join(dir, "out.txt")
 	os.WriteFile(path, []byte("aaa"), 0o644)
 	fa := &FileAppend{}
-	_, err := fa.Execute(map[string]string{"path": path, "content": "bbb"})
+	_, err := fa.Execute(context.Background(), map[string]string{"path": path, "content": "bbb"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -79,11 +80,11 @@ func TestFileAppendAppends(t *testing.T) {
 
 func TestFileWriteMissingParamsErrors(t *testing.T) {
 	fw := &FileWrite{}
-	_, err := fw.Execute(map[string]string{"content": "x"})
+	_, err := fw.Execute(context.Background(), map[string]string{"content": "x"})
 	if err == nil {
 		t.Fatal("expected error for missing path")
 	}
-	_, err = fw.Execute(map[string]string{"path": "/tmp/x"})
+	_, err = fw.Execute(context.Background(), map[string]string{"path": "/tmp/x"})
 	if err == nil {
 		t.Fatal("expected error for missing content")
 	}
@@ -91,11 +92,11 @@ func TestFileWriteMissingParamsErrors(t *testing.T) {
 
 func TestFileAppendMissingParamsErrors(t *testing.T) {
 	fa := &FileAppend{}
-	_, err := fa.Execute(map[string]string{"content": "x"})
+	_, err := fa.Execute(context.Background(), map[string]string{"content": "x"})
 	if err == nil {
 		t.Fatal("expected error for missing path")
 	}
-	_, err = fa.Execute(map[string]string{"path": "/tmp/x"})
+	_, err = fa.Execute(context.Background(), map[string]string{"path": "/tmp/x"})
 	if err == nil {
 		t.Fatal("expected error for missing content")
 	}
@@ -1,31 +1,56 @@
 package action
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
 )
 
+// DefaultHTTPTimeout bounds a request whose context has no deadline.
+const DefaultHTTPTimeout = 60 * time.Second
+
 // HTTPAction executes an HTTP request.
 type HTTPAction struct {
 	client *http.Client
 }
 
-// NewHTTPAction creates an HTTP action with a default timeout.
+// NewHTTPAction creates an HTTP action. Requests are bounded by their
+// context, or by DefaultHTTPTimeout when the context has no deadline.
 func NewHTTPAction() *HTTPAction {
 	return &HTTPAction{
-		client: &http.Client{Timeout: 60 * time.Second},
+		client: &http.Client{},
+	}
+}
+
+func (h *HTTPAction) Spec() Spec {
+	return Spec{
+		Name:        "http",
+		Description: "Send an HTTP request, like an http: step",
+		Params: []Param{
+			{Name: "url", Required: true, Description: "URL to request"},
+			{Name: "method", Description: "HTTP method; default GET"},
+			{Name: "body", Description: "Request body; Content-Type defaults to application/json"},
+			{Name: "header_", Prefix: true, Description: "Request header, e.g. header_Authorization"},
+		},
+		Outputs: []string{"stdout", "status_code"},
 	}
 }
 
 // Execute sends the HTTP request and returns the response body as stdout output.
-func (h *HTTPAction) Execute(params map[string]string) (map[string]string, error) {
-	url := params["url"]
-	if url == "" {
-		return nil, fmt.Errorf("http: url is required")
+func (h *HTTPAction) Execute(ctx context.Context, params map[string]string) (map[string]string, error) {
+	if err := h.Spec().Check(params); err != nil {
+		return nil, err
 	}
+	url := params["url"]
 
 	method := params["method"]
 	if method == "" {
@@ -37,7 +62,13 @@ func (h *HTTPAction) Execute(params map[string]string) (map[string]string, error
 		bodyReader = strings.NewReader(body)
 	}
 
-	req, err := http.NewRequest(method, url, bodyReader)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultHTTPTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("http: failed to create request: %w", err)
 	}
@@ -56,7 +87,20 @@ func (h *HTTPAction) Execute(params map[string]string) (map[string]string, error
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("http: request failed: %w", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &dagerrors.RunError{
+				Type:      dagerrors.Timeout,
+				Message:   fmt.Sprintf("http: request timed out: %v", err),
+				Retryable: true,
+			}
+		}
+		if errors.Is(err, context.Canceled) {
+			return nil, &dagerrors.RunError{
+				Type:    dagerrors.Cancelled,
+				Message: fmt.Sprintf("http: request cancelled: %v", err),
+			}
+		}
+		return nil, requestError(err)
 	}
 	defer resp.Body.Close()
 
@@ -66,7 +110,7 @@ func (h *HTTPAction) Execute(params map[string]string) (map[string]string, error
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("http: %d %s", resp.StatusCode, string(respBody))
+		return nil, statusError(resp.StatusCode, string(respBody))
 	}
 
 	return map[string]string{
@@ -83,3 +127,37 @@ func (h *HTTPAction) DryRun(params map[string]string) string {
 	}
 	return fmt.Sprintf("Would send %s request to %s", method, params["url"])
 }
+
+// requestError classifies a request that got no response. Timeouts and
+// refused or reset connections are transient and marked retryable; bad URLs,
+// TLS failures and the like would fail again.
+func requestError(err error) *dagerrors.RunError {
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return &dagerrors.RunError{
+			Type:      dagerrors.Transient,
+			Message:   fmt.Sprintf("http: request failed: %v", err),
+			Retryable: true,
+		}
+	}
+	return &dagerrors.RunError{
+		Type:    dagerrors.StepFailed,
+		Message: fmt.Sprintf("http: request failed: %v", err),
+	}
+}
+
+// statusError classifies an HTTP error response. Rate limiting and gateway
+// errors are transient and marked retryable.
+func statusError(code int, body string) *dagerrors.RunError {
+	e := &dagerrors.RunError{
+		Type:    dagerrors.StepFailed,
+		Code:    strconv.Itoa(code),
+		Message: fmt.Sprintf("http: %d %s", code, body),
+	}
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		e.Type = dagerrors.Transient
+		e.Retryable = true
+	}
+	return e
+}
@@ -1,10 +1,16 @@
 package action
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
 )
 
 func TestHTTPActionGET(t *testing.T) {
@@ -17,7 +23,7 @@ func TestHTTPActionGET(t *testing.T) {
 	defer server.Close()
 
 	act := NewHTTPAction()
-	outputs, err := act.Execute(map[string]string{
+	outputs, err := act.Execute(context.Background(), map[string]string{
 		"url":    server.URL,
 		"method": "GET",
 	})
@@ -48,7 +54,7 @@ func TestHTTPActionPOST(t *testing.T) {
 	defer server.Close()
 
 	act := NewHTTPAction()
-	outputs, err := act.Execute(map[string]string{
+	outputs, err := act.Execute(context.Background(), map[string]string{
 		"url":                  server.URL,
 		"method":               "POST",
 		"body":                 `{"data":"test"}`,
@@ -70,7 +76,7 @@ func TestHTTPActionError(t *testing.T) {
 	defer server.Close()
 
 	act := NewHTTPAction()
-	_, err := act.Execute(map[string]string{
+	_, err := act.Execute(context.Background(), map[string]string{
 		"url": server.URL,
 	})
 	if err == nil {
@@ -80,7 +86,7 @@ func TestHTTPActionError(t *testing.T) {
 
 func TestHTTPActionMissingURL(t *testing.T) {
 	act := NewHTTPAction()
-	_, err := act.Execute(map[string]string{})
+	_, err := act.Execute(context.Background(), map[string]string{})
 	if err == nil {
 		t.Fatal("expected error for missing URL")
 	}
@@ -96,7 +102,7 @@ func TestHTTPActionDefaultMethod(t *testing.T) {
 	defer server.Close()
 
 	act := NewHTTPAction()
-	_, err := act.Execute(map[string]string{"url": server.URL})
+	_, err := act.Execute(context.Background(), map[string]string{"url": server.URL})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -109,3 +115,66 @@ func TestHTTPActionDryRun(t *testing.T) {
 		t.Errorf("unexpected dry run output: %s", result)
 	}
 }
+
+func TestHTTPActionClassifiesRetryableStatus(t *testing.T) {
+	for code, retryable := range map[int]bool{429: true, 502: true, 503: true, 504: true, 500: false, 404: false} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		_, err := NewHTTPAction().Execute(context.Background(), map[string]string{"url": server.URL})
+		server.Close()
+
+		var runErr *dagerrors.RunError
+		if !errors.As(err, &runErr) {
+			t.Fatalf("%d: expected *RunError, got %T", code, err)
+		}
+		if runErr.Retryable != retryable {
+			t.Errorf("%d: expected retryable=%v, got %v", code, retryable, runErr.Retryable)
+		}
+		if runErr.Code != strconv.Itoa(code) {
+			t.Errorf("%d: expected code %d, got %q", code, code, runErr.Code)
+		}
+	}
+}
+
+func TestHTTPActionConnectionErrorIsRetryable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	_, err := NewHTTPAction().Execute(context.Background(), map[string]string{"url": url})
+	var runErr *dagerrors.RunError
+	if !errors.As(err, &runErr) || !runErr.Retryable || runErr.Type != dagerrors.Transient {
+		t.Fatalf("expected retryable transient error, got %v", err)
+	}
+}
+
+func TestHTTPActionPermanentRequestErrorIsNotRetryable(t *testing.T) {
+	for _, url := range []string{"ftp://example.com/file", "http://%zz"} {
+		_, err := NewHTTPAction().Execute(context.Background(), map[string]string{"url": url})
+		var runErr *dagerrors.RunError
+		if errors.As(err, &runErr) && (runErr.Retryable || runErr.Type == dagerrors.Transient) {
+			t.Errorf("%s: expected a permanent error, got %+v", url, runErr)
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", url)
+		}
+	}
+}
+
+func TestHTTPActionHonoursContextDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := NewHTTPAction().Execute(ctx, map[string]string{"url": server.URL})
+	var runErr *dagerrors.RunError
+	if !errors.As(err, &runErr) || runErr.Type != dagerrors.Timeout || !runErr.Retryable {
+		t.Fatalf("expected retryable timeout error, got %v", err)
+	}
+}
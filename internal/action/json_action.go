@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -10,15 +11,24 @@ import (
 // JSONGet implements json.get action.
 type JSONGet struct{}
 
-func (j *JSONGet) Execute(params map[string]string) (map[string]string, error) {
-	file := params["file"]
-	path := params["path"]
-	if file == "" {
-		return nil, fmt.Errorf("json.get: missing required param 'file'")
+func (j *JSONGet) Spec() Spec {
+	return Spec{
+		Name:        "json.get",
+		Description: "Read a value from a JSON file",
+		Params: []Param{
+			{Name: "file", Required: true, Type: TypeFile, Description: "JSON file to read"},
+			{Name: "path", Required: true, Description: "Dot-separated keys of the value, e.g. spec.replicas"},
+		},
+		Outputs: []string{"value"},
 	}
-	if path == "" {
-		return nil, fmt.Errorf("json.get: missing required param 'path'")
+}
+
+func (j *JSONGet) Execute(_ context.Context, params map[string]string) (map[string]string, error) {
+	if err := j.Spec().Check(params); err != nil {
+		return nil, err
 	}
+	file := params["file"]
+	path := params["path"]
 
 	data, err := os.ReadFile(file)
 	if err != nil {
@@ -45,16 +55,26 @@ func (j *JSONGet) DryRun(params map[string]string) string {
 // JSONSet implements json.set action.
 type JSONSet struct{}
 
-func (j *JSONSet) Execute(params map[string]string) (map[string]string, error) {
+func (j *JSONSet) Spec() Spec {
+	return Spec{
+		Name:        "json.set",
+		Description: "Set a value in a JSON file",
+		Params: []Param{
+			{Name: "file", Required: true, Type: TypeFile, Description: "JSON file to update, created if missing"},
+			{Name: "path", Required: true, Description: "Dot-separated keys of the value, e.g. spec.replicas"},
+			{Name: "value", Description: "Value to set, as a string"},
+		},
+		Outputs: []string{"file"},
+	}
+}
+
+func (j *JSONSet) Execute(_ context.Context, params map[string]string) (map[string]string, error) {
+	if err := j.Spec().Check(params); err != nil {
+		return nil, err
+	}
 	file := params["file"]
 	path := params["path"]
 	value := params["value"]
-	if file == "" {
-		return nil, fmt.Errorf("json.set: missing required param 'file'")
-	}
-	if path == "" {
-		return nil, fmt.Errorf("json.set: missing required param 'path'")
-	}
 
 	var obj map[string]any
 	data, err := os.ReadFile(file)
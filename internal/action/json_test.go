@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -19,7 +20,7 @@ func TestJSONGetTopLevelKey(t *testing.T) {
 	dir := t.TempDir()
 	path := writeJSON(t, dir, map[string]any{"version": "1.0"})
 	jg := &JSONGet{}
-	out, err := jg.Execute(map[string]string{"file": path, "path": "version"})
+	out, err := jg.Execute(context.Background(), map[string]string{"file": path, "path": "version"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -32,7 +33,7 @@ func TestJSONGetNestedKey(t *testing.T) {
 	dir := t.TempDir()
 	path := writeJSON(t, dir, map[string]any{"a": map[string]any{"b": "deep"}})
 	jg := &JSONGet{}
-	out, err := jg.Execute(map[string]string{"file": path, "path": "a.b"})
+	out, err := jg.Execute(context.Background(), map[string]string{"file": path, "path": "a.b"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -45,7 +46,7 @@ func TestJSONGetMissingKeyError(t *testing.T) {
 	dir := t.TempDir()
 	path := writeJSON(t, dir, map[string]any{"a": "b"})
 	jg := &JSONGet{}
-	_, err := jg.Execute(map[string]string{"file": path, "path": "nope"})
+	_, err := jg.Execute(context.Background(), map[string]string{"file": path, "path": "nope"})
 	if err == nil {
 		t.Fatal("expected error for missing key")
 	}
@@ -53,7 +54,7 @@ func TestJSONGetMissingKeyError(t *testing.T) {
 
 func TestJSONGetMissingFileError(t *testing.T) {
 	jg := &JSONGet{}
-	_, err := jg.Execute(map[string]string{"file": "/nonexistent/file.json", "path": "x"})
+	_, err := jg.Execute(context.Background(), map[string]string{"file": "/nonexistent/file.json", "path": "x"})
 	if err == nil {
 		t.Fatal("expected error for missing file")
 	}
@@ -63,7 +64,7 @@ func TestJSONSetTopLevelKey(t *testing.T) {
 	dir := t.TempDir()
 	path := writeJSON(t, dir, map[string]any{"a": "1"})
 	js := &JSONSet{}
-	_, err := js.Execute(map[string]string{"file": path, "path": "b", "value": "2"})
+	_, err := js.Execute(context.Background(), map[string]string{"file": path, "path": "b", "value": "2"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -79,7 +80,7 @@ func TestJSONSetNestedKeyCreatesIntermediates(t *testing.T) {
 	dir := t.TempDir()
 	path := writeJSON(t, dir, map[string]any{})
 	js := &JSONSet{}
-	_, err := js.Execute(map[string]string{"file": path, "path": "a.b.c", "value": "deep"})
+	_, err := js.Execute(context.Background(), map[string]string{"file": path, "path": "a.b.c", "value": "deep"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -97,7 +98,7 @@ func TestJSONSetCreatesFileIfNotExists(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "new.json")
 	js := &JSONSet{}
-	_, err := js.Execute(map[string]string{"file": path, "path": "key", "value": "val"})
+	_, err := js.Execute(context.Background(), map[string]string{"file": path, "path": "key", "value": "val"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -113,7 +114,7 @@ func TestJSONSetPreservesExistingKeys(t *testing.T) {
 	dir := t.TempDir()
 	path := writeJSON(t, dir, map[string]any{"existing": "keep"})
 	js := &JSONSet{}
-	_, err := js.Execute(map[string]string{"file": path, "path": "new", "value": "added"})
+	_, err := js.Execute(context.Background(), map[string]string{"file": path, "path": "new", "value": "added"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -0,0 +1,220 @@
+package action
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stevehiehn/declaragent/internal/runner"
+)
+
+// PluginPrefix starts the file names of plugin executables, e.g.
+// declaragent-action-jira.
+const PluginPrefix = "declaragent-action-"
+
+// pluginTimeout bounds describe and dry-run calls.
+const pluginTimeout = 10 * time.Second
+
+// Plugin is an action implemented by an executable, in any language, that
+// takes the call as its only argument:
+//
+//	describe  prints its spec as JSON: name, description, params, outputs
+//	          and secret_outputs, the outputs to mask
+//	execute   reads {"params": {...}} on stdin and prints {"outputs": {...}}
+//	dry-run   reads {"params": {...}} on stdin and prints {"description": "..."}
+//
+// A call fails if the executable exits non-zero; it may print
+// {"error": "..."} to say why, otherwise its stderr is used. Params of type
+// file are absolute paths.
+type Plugin struct {
+	Path          string
+	spec          Spec
+	secretOutputs []string
+}
+
+// pluginDescription is the output of describe.
+type pluginDescription struct {
+	Spec
+	SecretOutputs []string `json:"secret_outputs,omitempty"`
+}
+
+// pluginRequest is the input of execute and dry-run.
+type pluginRequest struct {
+	Params map[string]string `json:"params"`
+}
+
+// pluginResponse is the output of execute and dry-run, and of failed calls.
+type pluginResponse struct {
+	Outputs     map[string]json.RawMessage `json:"outputs"`
+	Description string                     `json:"description"`
+	Error       string                     `json:"error"`
+}
+
+// FindPlugins returns the plugin executables in dirs. Like a shell looking
+// through PATH, a name found in an earlier directory hides the same name in
+// later ones.
+func FindPlugins(dirs []string) []string {
+	seen := map[string]bool{}
+	var paths []string
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		// Relative paths would be looked up on PATH when run
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if !strings.HasPrefix(name, PluginPrefix) || seen[name] {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			// Follows symlinks, e.g. those of package managers
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+				continue
+			}
+			seen[name] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// LoadPlugin asks the executable at path to describe itself. A plugin that
+// gives no name is named after its file, less PluginPrefix.
+func LoadPlugin(ctx context.Context, path string) (*Plugin, error) {
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	out, err := callPlugin(ctx, path, path, "describe", nil)
+	if err != nil {
+		return nil, err
+	}
+	var desc pluginDescription
+	if err := json.Unmarshal(out, &desc); err != nil {
+		return nil, fmt.Errorf("%s describe: invalid JSON: %w", path, err)
+	}
+	if desc.Name == "" {
+		desc.Name = strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), PluginPrefix), ".exe")
+	}
+	return &Plugin{Path: path, spec: desc.Spec, secretOutputs: desc.SecretOutputs}, nil
+}
+
+func (p *Plugin) Spec() Spec {
+	return p.spec
+}
+
+// Execute runs the plugin's execute call. Outputs that are not JSON strings
+// are returned as JSON, e.g. 3 or ["a","b"].
+func (p *Plugin) Execute(ctx context.Context, params map[string]string) (map[string]string, error) {
+	if err := p.spec.Check(params); err != nil {
+		return nil, err
+	}
+	out, err := callPlugin(ctx, p.Path, p.spec.Name, "execute", params)
+	if err != nil {
+		return nil, err
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("%s: invalid output: %w", p.spec.Name, err)
+	}
+	outputs := make(map[string]string, len(resp.Outputs))
+	for name, raw := range resp.Outputs {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			outputs[name] = s
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return nil, fmt.Errorf("%s: output %q: %w", p.spec.Name, name, err)
+		}
+		outputs[name] = buf.String()
+	}
+	return outputs, nil
+}
+
+// DryRun runs the plugin's dry-run call, falling back to a generic
+// description if it fails.
+func (p *Plugin) DryRun(params map[string]string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	out, err := callPlugin(ctx, p.Path, p.spec.Name, "dry-run", params)
+	if err == nil {
+		var resp pluginResponse
+		if err = json.Unmarshal(out, &resp); err == nil && resp.Description != "" {
+			return resp.Description
+		}
+	}
+	msg := fmt.Sprintf("Would run plugin %s", p.Path)
+	if err != nil {
+		msg += fmt.Sprintf(" (dry-run failed: %v)", err)
+	}
+	return msg
+}
+
+// SecretOutputs returns the outputs the plugin declares secret.
+func (p *Plugin) SecretOutputs(map[string]string) []string {
+	return p.secretOutputs
+}
+
+// LoadPlugins registers the plugins FindPlugins finds in dirs. Plugins that
+// fail to describe themselves, or whose names are taken, are left out and
+// reported in the error; the others are registered regardless.
+func (r *Registry) LoadPlugins(ctx context.Context, dirs []string) error {
+	var errs []error
+	for _, path := range FindPlugins(dirs) {
+		p, err := LoadPlugin(ctx, path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := r.Register(p); err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// callPlugin runs call of the plugin at path, named label in errors, and
+// returns its stdout. Unless call is describe, params are sent on stdin.
+func callPlugin(ctx context.Context, path, label, call string, params map[string]string) ([]byte, error) {
+	cmd := runner.Command(ctx, path, call)
+	if call != "describe" {
+		if params == nil {
+			params = map[string]string{}
+		}
+		data, err := json.Marshal(pluginRequest{Params: params})
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin = bytes.NewReader(data)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		var resp pluginResponse
+		if json.Unmarshal(stdout.Bytes(), &resp) == nil && resp.Error != "" {
+			msg = resp.Error
+		}
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s %s: %s", label, call, msg)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,127 @@
+package action
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePlugin writes a plugin executable named declaragent-action-<name>
+// to dir, running script with sh.
+func writePlugin(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin scripts need sh")
+	}
+	path := filepath.Join(dir, PluginPrefix+name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const greetPlugin = `case "$1" in
+describe)
+  echo '{"description": "Greet someone", "params": [{"name": "who", "required": true}, {"name": "times", "type": "integer"}], "outputs": ["greeting", "count"], "secret_outputs": ["greeting"]}' ;;
+execute)
+  who=$(sed 's/.*"who":"\([^"]*\)".*/\1/')
+  [ "$who" = "nobody" ] && { echo '{"error": "no one to greet"}'; exit 1; }
+  echo "{\"outputs\": {\"greeting\": \"hello $who\", \"count\": 1}}" ;;
+dry-run)
+  echo '{"description": "Would greet"}' ;;
+esac
+`
+
+func TestLoadPlugin(t *testing.T) {
+	path := writePlugin(t, t.TempDir(), "greet", greetPlugin)
+	p, err := LoadPlugin(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	spec := p.Spec()
+	if spec.Name != "greet" || spec.Description != "Greet someone" || len(spec.Params) != 2 {
+		t.Fatalf("unexpected spec %+v", spec)
+	}
+	if got := p.SecretOutputs(nil); len(got) != 1 || got[0] != "greeting" {
+		t.Errorf("expected greeting to be secret, got %v", got)
+	}
+
+	out, err := p.Execute(context.Background(), map[string]string{"who": "world"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out["greeting"] != "hello world" || out["count"] != "1" {
+		t.Errorf("unexpected outputs %v", out)
+	}
+	if got := p.DryRun(map[string]string{"who": "world"}); got != "Would greet" {
+		t.Errorf("unexpected dry-run %q", got)
+	}
+}
+
+func TestPluginErrors(t *testing.T) {
+	path := writePlugin(t, t.TempDir(), "greet", greetPlugin)
+	p, err := LoadPlugin(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Execute(context.Background(), map[string]string{"who": "nobody"}); err == nil || err.Error() != "greet execute: no one to greet" {
+		t.Errorf("expected the plugin's error, got %v", err)
+	}
+	if _, err := p.Execute(context.Background(), map[string]string{"who": "x", "times": "two"}); err == nil || !strings.Contains(err.Error(), `"two" is not a valid integer`) {
+		t.Errorf("expected a type error, got %v", err)
+	}
+
+	bad := writePlugin(t, t.TempDir(), "bad", "echo 'broken' >&2; exit 2\n")
+	if _, err := LoadPlugin(context.Background(), bad); err == nil || !strings.Contains(err.Error(), "describe: broken") {
+		t.Errorf("expected describe to fail with stderr, got %v", err)
+	}
+}
+
+func TestPluginKilledWithItsChildren(t *testing.T) {
+	path := writePlugin(t, t.TempDir(), "slow", `case "$1" in
+describe) echo '{}' ;;
+execute) (sleep 5; echo late) & wait ;;
+esac
+`)
+	p, err := LoadPlugin(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The subshell inherits stdout; if it survived, the call would wait for it.
+	start := time.Now()
+	if _, err := p.Execute(ctx, nil); err == nil {
+		t.Error("expected the killed plugin to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected process group to be killed, took %s", elapsed)
+	}
+}
+
+func TestRegistryLoadPlugins(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	writePlugin(t, first, "greet", greetPlugin)
+	writePlugin(t, second, "greet", "exit 1\n")
+	writePlugin(t, second, "file", `echo '{"name": "file.write"}'`+"\n")
+	if err := os.WriteFile(filepath.Join(second, PluginPrefix+"notes"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry()
+	err := r.LoadPlugins(context.Background(), []string{first, second})
+	if err == nil || !strings.Contains(err.Error(), `action "file.write" is already registered`) {
+		t.Errorf("expected the clashing plugin to be reported, got %v", err)
+	}
+	if !r.Known("greet") {
+		t.Error("expected greet from the first directory")
+	}
+	if r.Known("notes") {
+		t.Error("expected non-executable files to be ignored")
+	}
+}
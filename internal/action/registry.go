@@ -1,27 +1,67 @@
 package action
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
 
 // Action is the interface for built-in actions.
+// Execute must stop and return an error once ctx is done. Spec describes the
+// params the action takes and the outputs Execute returns.
 type Action interface {
-	Execute(params map[string]string) (outputs map[string]string, err error)
+	Execute(ctx context.Context, params map[string]string) (outputs map[string]string, err error)
 	DryRun(params map[string]string) string
+	Spec() Spec
 }
 
-var registry = map[string]Action{}
+// SecretOutputs is implemented by actions that can return credentials.
+// It names the outputs whose values must be masked for the given params.
+type SecretOutputs interface {
+	SecretOutputs(params map[string]string) []string
+}
+
+// Registry holds the actions plans can use, by name. It is not safe for
+// concurrent use while actions are being registered.
+type Registry struct {
+	actions map[string]Action
+}
 
-func init() {
-	registry["file.write"] = &FileWrite{}
-	registry["file.append"] = &FileAppend{}
-	registry["json.get"] = &JSONGet{}
-	registry["json.set"] = &JSONSet{}
-	registry["env.get"] = &EnvGet{}
-	registry["http"] = NewHTTPAction()
+// NewRegistry returns a registry holding the built-in actions.
+func NewRegistry() *Registry {
+	r := &Registry{actions: map[string]Action{}}
+	for _, a := range []Action{&FileWrite{}, &FileAppend{}, &JSONGet{}, &JSONSet{}, &EnvGet{}, NewHTTPAction()} {
+		r.actions[a.Spec().Name] = a
+	}
+	return r
+}
+
+// Register adds a to r under the name its spec gives. Names cannot be
+// registered twice.
+func (r *Registry) Register(a Action) error {
+	spec := a.Spec()
+	if spec.Name == "" {
+		return fmt.Errorf("action has no name")
+	}
+	if _, ok := r.actions[spec.Name]; ok {
+		return fmt.Errorf("action %q is already registered", spec.Name)
+	}
+	for _, p := range spec.Params {
+		if p.Name == "" {
+			return fmt.Errorf("action %q has a param without a name", spec.Name)
+		}
+		if !slices.Contains(paramTypes, p.ParamType()) {
+			return fmt.Errorf("action %q: param %q has unknown type %q", spec.Name, p.Name, p.Type)
+		}
+	}
+	r.actions[spec.Name] = a
+	return nil
 }
 
 // Get returns an action by name.
-func Get(name string) (Action, error) {
-	a, ok := registry[name]
+func (r *Registry) Get(name string) (Action, error) {
+	a, ok := r.actions[name]
 	if !ok {
 		return nil, fmt.Errorf("unknown action %q", name)
 	}
@@ -29,7 +69,21 @@ func Get(name string) (Action, error) {
 }
 
 // Known returns true if the action name is registered.
-func Known(name string) bool {
-	_, ok := registry[name]
+func (r *Registry) Known(name string) bool {
+	_, ok := r.actions[name]
 	return ok
 }
+
+// Names returns the names of the registered actions, sorted.
+func (r *Registry) Names() []string {
+	return slices.Sorted(maps.Keys(r.actions))
+}
+
+// Specs returns the specs of the registered actions, sorted by name.
+func (r *Registry) Specs() []Spec {
+	specs := make([]Spec, 0, len(r.actions))
+	for _, name := range r.Names() {
+		specs = append(specs, r.actions[name].Spec())
+	}
+	return specs
+}
@@ -0,0 +1,114 @@
+package action
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Param types
+const (
+	TypeString  = "string"
+	TypeFile    = "file" // a path, taken from the run's working directory when relative
+	TypeBoolean = "boolean"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+)
+
+// Param describes a with: key an action accepts.
+type Param struct {
+	Name        string `json:"name"`
+	Required    bool   `json:"required,omitempty"`
+	Type        string `json:"type,omitempty"` // one of the Type constants; empty means TypeString
+	Description string `json:"description,omitempty"`
+	Prefix      bool   `json:"prefix,omitempty"` // Name is a prefix, e.g. header_ for header_<name>
+}
+
+var paramTypes = []string{TypeString, TypeFile, TypeBoolean, TypeInteger, TypeNumber}
+
+// ParamType returns the type of p, defaulting to TypeString.
+func (p Param) ParamType() string {
+	if p.Type == "" {
+		return TypeString
+	}
+	return p.Type
+}
+
+// Matches reports whether the with: key is p.
+func (p Param) Matches(key string) bool {
+	if p.Prefix {
+		return strings.HasPrefix(key, p.Name) && len(key) > len(p.Name)
+	}
+	return key == p.Name
+}
+
+// CheckValue reports whether value suits the type of p.
+func (p Param) CheckValue(value string) error {
+	var err error
+	switch p.ParamType() {
+	case TypeBoolean:
+		_, err = strconv.ParseBool(value)
+	case TypeInteger:
+		_, err = strconv.Atoi(value)
+	case TypeNumber:
+		_, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a valid %s", value, p.ParamType())
+	}
+	return nil
+}
+
+// Spec describes an action: what it does, the params it takes and the
+// outputs it returns.
+type Spec struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Params      []Param  `json:"params,omitempty"`
+	Outputs     []string `json:"outputs,omitempty"`
+}
+
+// Param returns the param of s the with: key is for.
+func (s Spec) Param(key string) (Param, bool) {
+	i := slices.IndexFunc(s.Params, func(p Param) bool { return p.Matches(key) })
+	if i < 0 {
+		return Param{}, false
+	}
+	return s.Params[i], true
+}
+
+// Check returns an error if params lacks a required param, holds one s does
+// not declare, or holds a value of the wrong type. Required params must not
+// be empty.
+func (s Spec) Check(params map[string]string) error {
+	for _, p := range s.Params {
+		if p.Required && !p.Prefix && params[p.Name] == "" {
+			return fmt.Errorf("%s: missing required param %q", s.Name, p.Name)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(params)) {
+		p, ok := s.Param(key)
+		if !ok {
+			return fmt.Errorf("%s: unknown param %q", s.Name, key)
+		}
+		if err := p.CheckValue(params[key]); err != nil {
+			return fmt.Errorf("%s: param %q: %w", s.Name, key, err)
+		}
+	}
+	return nil
+}
+
+// ParamNames returns the names of the params of s, with prefixes written
+// as e.g. header_<name>.
+func (s Spec) ParamNames() []string {
+	names := make([]string, len(s.Params))
+	for i, p := range s.Params {
+		names[i] = p.Name
+		if p.Prefix {
+			names[i] += "<name>"
+		}
+	}
+	return names
+}
@@ -0,0 +1,84 @@
+package action
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSpecCheck(t *testing.T) {
+	spec := NewHTTPAction().Spec()
+	tests := []struct {
+		params map[string]string
+		want   string
+	}{
+		{map[string]string{"url": "https://example.com", "header_Accept": "text/plain"}, ""},
+		{map[string]string{"method": "POST"}, `http: missing required param "url"`},
+		{map[string]string{"url": "https://example.com", "verb": "POST"}, `http: unknown param "verb"`},
+		{map[string]string{"url": "https://example.com", "header_": "x"}, `http: unknown param "header_"`},
+	}
+	for _, tt := range tests {
+		err := spec.Check(tt.params)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", tt.params, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%v: expected %q, got %v", tt.params, tt.want, err)
+		}
+	}
+
+	err := (&EnvGet{}).Spec().Check(map[string]string{"name": "HOME", "secret": "yes"})
+	if err == nil || !strings.Contains(err.Error(), `"yes" is not a valid boolean`) {
+		t.Errorf("expected type error, got %v", err)
+	}
+}
+
+func TestRegistryDescribesActions(t *testing.T) {
+	r := NewRegistry()
+	specs := r.Specs()
+	if len(specs) != len(r.Names()) {
+		t.Fatalf("expected a spec per action, got %d", len(specs))
+	}
+	for _, spec := range specs {
+		if !r.Known(spec.Name) || spec.Description == "" || len(spec.Outputs) == 0 {
+			t.Errorf("incomplete spec %+v", spec)
+		}
+		for _, p := range spec.Params {
+			if p.Description == "" {
+				t.Errorf("%s: param %s has no description", spec.Name, p.Name)
+			}
+		}
+	}
+}
+
+// stubAction is an action defined outside the built-ins.
+type stubAction struct{ name string }
+
+func (a stubAction) Execute(ctx context.Context, params map[string]string) (map[string]string, error) {
+	return map[string]string{"key": params["key"]}, nil
+}
+
+func (a stubAction) DryRun(params map[string]string) string { return "Would stub" }
+
+func (a stubAction) Spec() Spec {
+	return Spec{Name: a.name, Params: []Param{{Name: "key", Required: true}}, Outputs: []string{"key"}}
+}
+
+func TestRegistryRegister(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(stubAction{"jira.transition"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.Known("jira.transition") || NewRegistry().Known("jira.transition") {
+		t.Error("expected the action in this registry only")
+	}
+	if err := r.Register(stubAction{"file.write"}); err == nil || err.Error() != `action "file.write" is already registered` {
+		t.Errorf("expected duplicate name error, got %v", err)
+	}
+	if err := r.Register(stubAction{}); err == nil {
+		t.Error("expected error for an action without a name")
+	}
+}
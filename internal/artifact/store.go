@@ -10,18 +10,43 @@ import (
 // Store manages artifact storage for a run.
 type Store struct {
 	RunID   string
-	BaseDir string // defaults to .declaragent/runs/<run_id>
+	BaseDir string // <root>/<run_id>
 }
 
-// New creates a store for a given run ID, rooted at workDir.
-func New(runID, workDir string) (*Store, error) {
-	base := filepath.Join(workDir, ".declaragent", "runs", runID)
+// DefaultRoot returns the directory holding the runs started in workDir.
+func DefaultRoot(workDir string) string {
+	return filepath.Join(workDir, ".declaragent", "runs")
+}
+
+// New creates a store for a given run ID under root, the directory holding
+// one directory per run.
+func New(runID, root string) (*Store, error) {
+	base := filepath.Join(root, runID)
 	if err := os.MkdirAll(filepath.Join(base, "steps"), 0o755); err != nil {
 		return nil, fmt.Errorf("creating artifact dir: %w", err)
 	}
 	return &Store{RunID: runID, BaseDir: base}, nil
 }
 
+// Open returns the store of an existing run under root.
+func Open(runID, root string) (*Store, error) {
+	base := filepath.Join(root, runID)
+	if _, err := os.Stat(base); err != nil {
+		return nil, fmt.Errorf("run %q not found: %w", runID, err)
+	}
+	return &Store{RunID: runID, BaseDir: base}, nil
+}
+
+// Nested returns the store for the plan run by step stepID, kept under
+// plans/<stepID> with the same layout as a run.
+func (s *Store) Nested(stepID string) (*Store, error) {
+	base := filepath.Join(s.BaseDir, "plans", stepID)
+	if err := os.MkdirAll(filepath.Join(base, "steps"), 0o755); err != nil {
+		return nil, fmt.Errorf("creating artifact dir: %w", err)
+	}
+	return &Store{RunID: s.RunID, BaseDir: base}, nil
+}
+
 // WriteStepOutput writes stdout/stderr for a step.
 func (s *Store) WriteStepOutput(stepID, stdout, stderr string) error {
 	if stdout != "" {
@@ -37,11 +62,105 @@ func (s *Store) WriteStepOutput(stepID, stdout, stderr string) error {
 	return nil
 }
 
+// WriteAttemptOutput writes stdout/stderr for one attempt of a retried step
+// to steps/<step_id>/attempt-<n>.{stdout,stderr}.
+func (s *Store) WriteAttemptOutput(stepID string, attempt int, stdout, stderr string) error {
+	dir := filepath.Join(s.BaseDir, "steps", stepID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	prefix := filepath.Join(dir, fmt.Sprintf("attempt-%d", attempt))
+	if stdout != "" {
+		if err := os.WriteFile(prefix+".stdout", []byte(stdout), 0o644); err != nil {
+			return err
+		}
+	}
+	if stderr != "" {
+		if err := os.WriteFile(prefix+".stderr", []byte(stderr), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutputFile is an output file of a step written as the step runs. It is
+// created on the first write, so output that stays empty leaves no file.
+type OutputFile struct {
+	path string
+	f    *os.File
+	err  error
+}
+
+// StepOutputFile returns steps/<step_id>.<stream>, where stream is stdout or
+// stderr, for the output of a running step. The output of an earlier
+// attempt is removed.
+func (s *Store) StepOutputFile(stepID, stream string) *OutputFile {
+	path := filepath.Join(s.BaseDir, "steps", stepID+"."+stream)
+	_ = os.Remove(path)
+	return &OutputFile{path: path}
+}
+
+// AttemptOutputFile returns steps/<step_id>/attempt-<n>.<stream> for the
+// output of one attempt of a retried step as it runs.
+func (s *Store) AttemptOutputFile(stepID string, attempt int, stream string) *OutputFile {
+	return &OutputFile{path: filepath.Join(s.BaseDir, "steps", stepID, fmt.Sprintf("attempt-%d.%s", attempt, stream))}
+}
+
+func (o *OutputFile) Write(p []byte) (int, error) {
+	if o.f == nil && o.err == nil {
+		if o.err = os.MkdirAll(filepath.Dir(o.path), 0o755); o.err == nil {
+			o.f, o.err = os.Create(o.path)
+		}
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+	return o.f.Write(p)
+}
+
+// Close closes the file, if anything was written to it.
+func (o *OutputFile) Close() error {
+	if o.f == nil {
+		return nil
+	}
+	return o.f.Close()
+}
+
 // WriteResult writes the final result JSON.
 func (s *Store) WriteResult(result any) error {
-	data, err := json.MarshalIndent(result, "", "  ")
+	return s.writeJSON("result.json", result)
+}
+
+// ReadResult decodes result.json into v.
+func (s *Store) ReadResult(v any) error {
+	return s.readJSON("result.json", v)
+}
+
+// WriteMeta writes run.json, which describes how the run was started.
+func (s *Store) WriteMeta(meta any) error {
+	return s.writeJSON("run.json", meta)
+}
+
+// ReadMeta decodes run.json into v.
+func (s *Store) ReadMeta(v any) error {
+	return s.readJSON("run.json", v)
+}
+
+func (s *Store) writeJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(s.BaseDir, "result.json"), data, 0o644)
+	return os.WriteFile(filepath.Join(s.BaseDir, name), data, 0o644)
+}
+
+func (s *Store) readJSON(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(s.BaseDir, name))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return nil
 }
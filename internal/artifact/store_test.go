@@ -13,6 +13,9 @@ func TestNewCreatesRunDir(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
+	if store.BaseDir != filepath.Join(dir, "run-123") {
+		t.Errorf("unexpected base dir %s", store.BaseDir)
+	}
 	stepsDir := filepath.Join(store.BaseDir, "steps")
 	info, err := os.Stat(stepsDir)
 	if err != nil {
@@ -59,3 +62,85 @@ func TestWriteResult(t *testing.T) {
 		t.Errorf("expected status 'ok', got %q", obj["status"])
 	}
 }
+
+func TestWriteAttemptOutput(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := New("run-att", dir)
+
+	if err := store.WriteAttemptOutput("s1", 2, "out-2", "err-2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stdout, _ := os.ReadFile(filepath.Join(store.BaseDir, "steps", "s1", "attempt-2.stdout"))
+	if string(stdout) != "out-2" {
+		t.Errorf("expected stdout 'out-2', got %q", string(stdout))
+	}
+	stderr, _ := os.ReadFile(filepath.Join(store.BaseDir, "steps", "s1", "attempt-2.stderr"))
+	if string(stderr) != "err-2" {
+		t.Errorf("expected stderr 'err-2', got %q", string(stderr))
+	}
+}
+
+func TestOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := New("run-out", dir)
+	if err := store.WriteStepOutput("s1", "earlier attempt", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := store.StepOutputFile("s1", "stdout")
+	if _, err := os.Stat(filepath.Join(store.BaseDir, "steps", "s1.stdout")); !os.IsNotExist(err) {
+		t.Errorf("expected the earlier output to be removed, got %v", err)
+	}
+	stdout.Write([]byte("line 1\n"))
+	stdout.Write([]byte("line 2\n"))
+	stdout.Close()
+	attempt := store.AttemptOutputFile("s1", 3, "stderr")
+	attempt.Write([]byte("oops\n"))
+	attempt.Close()
+	if err := store.AttemptOutputFile("s1", 3, "stdout").Close(); err != nil {
+		t.Errorf("unexpected error closing an unused file: %v", err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(store.BaseDir, "steps", "s1.stdout"))
+	if string(data) != "line 1\nline 2\n" {
+		t.Errorf("unexpected stdout %q", data)
+	}
+	data, _ = os.ReadFile(filepath.Join(store.BaseDir, "steps", "s1", "attempt-3.stderr"))
+	if string(data) != "oops\n" {
+		t.Errorf("unexpected attempt stderr %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(store.BaseDir, "steps", "s1", "attempt-3.stdout")); !os.IsNotExist(err) {
+		t.Errorf("expected no file for empty output, got %v", err)
+	}
+}
+
+func TestMetaAndResultRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := New("run-rt", dir)
+	if err := store.WriteMeta(map[string]string{"plan_hash": "abc"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.WriteResult(map[string]bool{"success": false}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opened, err := Open("run-rt", dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var meta map[string]string
+	if err := opened.ReadMeta(&meta); err != nil || meta["plan_hash"] != "abc" {
+		t.Errorf("expected plan_hash abc, got %v (%v)", meta, err)
+	}
+	var result map[string]bool
+	if err := opened.ReadResult(&result); err != nil || result["success"] {
+		t.Errorf("expected success false, got %v (%v)", result, err)
+	}
+}
+
+func TestOpenMissingRun(t *testing.T) {
+	if _, err := Open("no-such-run", t.TempDir()); err == nil {
+		t.Fatal("expected error for missing run")
+	}
+}
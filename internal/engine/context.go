@@ -1,29 +1,169 @@
 package engine
 
 import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/google/uuid"
+	"github.com/stevehiehn/declaragent/internal/action"
+	"github.com/stevehiehn/declaragent/internal/artifact"
+	"github.com/stevehiehn/declaragent/internal/plan"
 	"github.com/stevehiehn/declaragent/internal/template"
 )
 
+// DefaultMaxParallel is the number of steps NewRunContext allows to run at once.
+const DefaultMaxParallel = 4
+
+// ApprovalRequest describes a destructive step about to run.
+type ApprovalRequest struct {
+	RunID   string
+	Plan    string
+	Step    plan.Step
+	Command string // the resolved command or request, or what the action would do
+}
+
+// Approver decides whether a destructive step may run. It is called from
+// the goroutine running the step, so it may be called for several steps at
+// once.
+type Approver func(ctx context.Context, req ApprovalRequest) bool
+
 // RunContext holds state for a plan execution.
 type RunContext struct {
-	RunID    string
-	WorkDir  string
-	Inputs   map[string]string
-	TmplCtx  *template.Context
-	Approve  bool // allow destructive steps
+	RunID        string
+	WorkDir      string
+	ArtifactRoot string // directory holding one directory per run; empty means .declaragent/runs in WorkDir
+	StartedAt    time.Time
+	Inputs       map[string]string
+	TmplCtx      *template.Context
+	Approve      bool     // allow destructive steps
+	Approver     Approver // asked about each destructive step unless Approve is set
+	MaxParallel  int      // max steps running at once; 0 means no limit
+	Actions      *action.Registry
+	Observers    []Observer // told about the progress of the run, steps of plans that uses: steps call included
+
+	plan         *plan.Plan      // set by Execute; uses: paths are relative to its file
+	store        *artifact.Store // set by Execute in run mode
+	parent       *RunContext     // set by scoped
+	mu           sync.Mutex
+	emitMu       sync.Mutex            // held while observers are told about an event
+	placeholders map[string]bool       // steps whose outputs are only known at run time
+	prior        map[string]StepResult // finished steps of the run being resumed
+	slots        chan struct{}         // one per step running, see slotPool
+	secrets      []string              // values to mask, longest first
+	redactor     *strings.Replacer
+}
+
+// markPlaceholder records that stepID was explained or dry-run rather than
+// executed, so its outputs and status are stand-ins.
+func (c *RunContext) markPlaceholder(stepID string) {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.placeholders == nil {
+		c.placeholders = map[string]bool{}
+	}
+	c.placeholders[stepID] = true
+}
+
+// placeholderRefs returns the steps referenced by s whose values are placeholders.
+func (c *RunContext) placeholderRefs(s string) []string {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for _, id := range template.StepRefs(s) {
+		if c.placeholders[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// root returns the context that holds the state shared by the whole run.
+func (c *RunContext) root() *RunContext {
+	if c.parent != nil {
+		return c.parent
+	}
+	return c
+}
+
+// slotPool returns the slots of the run, MaxParallel of them, or nil when
+// there is no limit. Each step schedule starts holds one, except a parallel
+// foreach or matrix step, whose children each take one instead.
+func (c *RunContext) slotPool() chan struct{} {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots == nil && c.MaxParallel > 0 {
+		c.slots = make(chan struct{}, c.MaxParallel)
+	}
+	return c.slots
+}
+
+// scoped returns a context that resolves templates with tmpl, such as the
+// scope of one item of a foreach or matrix step, and shares everything else
+// with c.
+func (c *RunContext) scoped(tmpl *template.Context) *RunContext {
+	return &RunContext{
+		RunID:        c.RunID,
+		WorkDir:      c.WorkDir,
+		ArtifactRoot: c.ArtifactRoot,
+		StartedAt:    c.StartedAt,
+		Inputs:       c.Inputs,
+		TmplCtx:      tmpl,
+		Approve:      c.Approve,
+		Approver:     c.Approver,
+		MaxParallel:  c.MaxParallel,
+		Actions:      c.Actions,
+		plan:         c.plan,
+		store:        c.store,
+		parent:       c.root(),
+	}
+}
+
+// approved reports whether the destructive step may run. Unless Approve is
+// set, the Approver is asked in run mode; explain and dry-run show the step
+// as it would run once approved. command is shown to the Approver.
+func (c *RunContext) approved(ctx context.Context, step plan.Step, mode Mode, command string) bool {
+	switch {
+	case c.Approve:
+		return true
+	case c.Approver == nil:
+		return false
+	case mode != ModeRun:
+		return true
+	}
+	return c.Approver(ctx, ApprovalRequest{
+		RunID:   c.RunID,
+		Plan:    c.plan.Name,
+		Step:    step,
+		Command: c.Redact(command),
+	})
+}
+
+// artifactRoot returns the directory the run's artifacts go under.
+func (c *RunContext) artifactRoot() string {
+	if c.ArtifactRoot != "" {
+		return c.ArtifactRoot
+	}
+	return artifact.DefaultRoot(c.WorkDir)
 }
 
 // NewRunContext creates a new execution context.
 func NewRunContext(workDir string, inputs map[string]string, approve bool) *RunContext {
 	return &RunContext{
-		RunID:   uuid.New().String(),
-		WorkDir: workDir,
-		Inputs:  inputs,
+		RunID:     uuid.New().String(),
+		WorkDir:   workDir,
+		StartedAt: time.Now(),
+		Inputs:    inputs,
 		TmplCtx: &template.Context{
 			Inputs:      inputs,
 			StepOutputs: map[string]map[string]string{},
 		},
-		Approve: approve,
+		Approve:     approve,
+		MaxParallel: DefaultMaxParallel,
+		Actions:     action.NewRegistry(),
 	}
 }
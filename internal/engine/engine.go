@@ -1,14 +1,22 @@
 package engine
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/stevehiehn/declaragent/internal/action"
 	"github.com/stevehiehn/declaragent/internal/artifact"
 	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+	"github.com/stevehiehn/declaragent/internal/extract"
 	"github.com/stevehiehn/declaragent/internal/plan"
 	"github.com/stevehiehn/declaragent/internal/runner"
 	"github.com/stevehiehn/declaragent/internal/template"
@@ -24,48 +32,62 @@ const (
 )
 
 // Execute runs a plan in the given mode.
-func Execute(p *plan.Plan, ctx *RunContext, mode Mode) (*Result, error) {
+func Execute(p *plan.Plan, rc *RunContext, mode Mode) (*Result, error) {
+	return ExecuteContext(context.Background(), p, rc, mode)
+}
+
+// ExecuteContext runs a plan in the given mode. Cancelling ctx, or reaching
+// its deadline or the plan's timeout, kills running steps and starts no new
+// ones.
+func ExecuteContext(ctx context.Context, p *plan.Plan, rc *RunContext, mode Mode) (*Result, error) {
+	if p.Timeout > 0 && mode == ModeRun {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
 	result := &Result{
-		RunID:   ctx.RunID,
+		RunID:   rc.RunID,
 		Success: true,
 		Outputs: map[string]string{},
 	}
 
-	var store *artifact.Store
-	if mode == ModeRun {
-		var err error
-		store, err = artifact.New(ctx.RunID, ctx.WorkDir)
-		if err != nil {
-			return nil, err
+	for name, inp := range p.Inputs {
+		if inp.Secret {
+			rc.AddSecret(rc.Inputs[name])
 		}
-		result.Artifacts = []string{store.BaseDir}
 	}
+	rc.TmplCtx.Filtered = rc.maskFiltered
+	setContextFields(p, rc)
+	rc.plan = p
 
-	failed := false
-	for _, step := range p.Steps {
-		if failed {
-			result.Steps = append(result.Steps, StepResult{ID: step.ID, Status: "skipped"})
-			continue
+	// A nested run of a uses: step comes with its own store
+	store := rc.store
+	if mode == ModeRun {
+		if store == nil {
+			var err error
+			store, err = artifact.New(rc.RunID, rc.artifactRoot())
+			if err != nil {
+				return nil, err
+			}
 		}
-
-		sr, err := executeStep(step, ctx, mode)
-		if err != nil {
-			return nil, err
+		result.Artifacts = []string{store.BaseDir}
+		rc.store = store
+		if rc.prior == nil {
+			_ = store.WriteMeta(newRunMeta(p, rc))
 		}
+	}
 
-		result.Steps = append(result.Steps, *sr)
+	rc.emit(Event{Type: EventRunStarted}, mode)
 
+	record := func(step plan.Step, sr *StepResult) {
 		if sr.Status == "failed" || sr.Status == "blocked" {
 			result.Success = false
-			result.FailedStepID = step.ID
-			failed = true
+			if result.FailedStepID == "" {
+				result.FailedStepID = step.ID
+			}
 			if sr.Status == "failed" {
-				result.Errors = append(result.Errors, dagerrors.RunError{
-					Type:    dagerrors.StepFailed,
-					StepID:  step.ID,
-					Message: fmt.Sprintf("step %q failed with exit code %d", step.ID, sr.ExitCode),
-					Hint:    fmt.Sprintf("Check %s for details", sr.StderrRef),
-				})
+				result.Errors = append(result.Errors, stepError(sr))
 			} else {
 				result.Errors = append(result.Errors, dagerrors.RunError{
 					Type:    dagerrors.SideEffectBlocked,
@@ -77,89 +99,574 @@ func Execute(p *plan.Plan, ctx *RunContext, mode Mode) (*Result, error) {
 		}
 
 		// Store artifacts for run mode
-		if mode == ModeRun && store != nil && sr.Status == "success" {
-			_ = store.WriteStepOutput(step.ID, sr.StdoutRef, sr.StderrRef)
+		if mode == ModeRun && store != nil && sr.Status == "success" && !sr.streamed {
+			_ = store.WriteStepOutput(step.ID, rc.Redact(sr.StdoutRef), rc.Redact(sr.StderrRef))
+		}
+	}
+
+	results, err := schedule(ctx, p, rc, mode, record)
+	if err != nil {
+		return nil, err
+	}
+	result.Steps = results
+
+	// The run may have ended between steps, leaving later steps unstarted
+	if ctx.Err() != nil && result.Success && hasSkipped(results) {
+		result.Success = false
+		result.Errors = append(result.Errors, interruptedError(ctx, p))
+	}
+
+	// Later phases see the outcome of the main steps through run.*
+	if mode == ModeRun {
+		rc.TmplCtx.SetRun("status", runStatus(result))
+		rc.TmplCtx.SetRun("failed_step", result.FailedStepID)
+	} else {
+		rc.TmplCtx.SetRun("status", "<run.status>")
+		rc.TmplCtx.SetRun("failed_step", "<run.failed_step>")
+	}
+	fillMissingOutputs(rc, p.Steps)
+
+	if steps := rollbackSteps(p, result, mode); len(steps) > 0 {
+		rollback, err := runRollback(ctx, rc, mode, steps, record)
+		if err != nil {
+			return nil, err
+		}
+		result.Rollback = rollback
+	}
+
+	if len(p.Finally) > 0 {
+		finally, err := runFinally(ctx, p, rc, mode, record)
+		if err != nil {
+			return nil, err
+		}
+		result.Finally = finally
+		fillMissingOutputs(rc, p.Finally)
+	}
+
+	for name, tmpl := range p.Outputs {
+		value, err := template.Resolve(tmpl, rc.TmplCtx)
+		if err != nil {
+			return nil, fmt.Errorf("resolving plan output %q: %w", name, err)
 		}
+		result.Outputs[name] = value
 	}
 
+	rc.redactResult(result)
 	if mode == ModeRun && store != nil {
 		_ = store.WriteResult(result)
 	}
+	rc.emit(Event{Type: EventRunFinished, Result: result}, mode)
 
 	return result, nil
 }
 
-func executeStep(step plan.Step, ctx *RunContext, mode Mode) (*StepResult, error) {
+// stepDone carries a finished step back to the scheduler.
+type stepDone struct {
+	index int
+	sr    *StepResult
+	err   error
+}
+
+// schedule runs the steps of p as soon as their dependencies have succeeded,
+// keeping at most rc.MaxParallel steps, counting the children of parallel
+// foreach and matrix steps, in flight. onDone is called from the
+// scheduling goroutine for every finished step, so it needs no locking.
+// Once any step fails or is blocked, or ctx is done, no new steps are started;
+// steps that never ran are reported as skipped. Results are returned in plan
+// order.
+func schedule(ctx context.Context, p *plan.Plan, rc *RunContext, mode Mode, onDone func(plan.Step, *StepResult)) ([]StepResult, error) {
+	deps := p.Dependencies()
+	index := make(map[string]int, len(p.Steps))
+	for i, s := range p.Steps {
+		index[s.ID] = i
+	}
+	pending := make([]int, len(p.Steps))
+	dependents := make([][]int, len(p.Steps))
+	for i, s := range p.Steps {
+		pending[i] = len(deps[s.ID])
+		for _, d := range deps[s.ID] {
+			dependents[index[d]] = append(dependents[index[d]], i)
+		}
+	}
+
+	// Steps finished by the run being resumed count as done up front
+	results := make([]*StepResult, len(p.Steps))
+	for i, s := range p.Steps {
+		prev, ok := rc.prior[s.ID]
+		if !ok {
+			continue
+		}
+		prev.Resumed = true
+		results[i] = &prev
+		for name, value := range prev.Outputs {
+			rc.TmplCtx.SetOutput(s.ID, name, value)
+		}
+		setStepFields(rc, &prev)
+		for _, j := range dependents[i] {
+			pending[j]--
+		}
+	}
+	var ready []int
+	for i := range p.Steps {
+		if pending[i] == 0 && results[i] == nil {
+			ready = append(ready, i)
+		}
+	}
+
+	done := make(chan stepDone)
+	slots := rc.slotPool()
+	running := 0
+	stop := false
+	var execErr error
+
+	// start runs the first ready step, in plan order so runs stay
+	// reproducible. slot is the slot it holds, if any.
+	start := func(slot chan struct{}) {
+		i := ready[0]
+		ready = ready[1:]
+		running++
+		rc.stepStarted(p.Steps[i].ID, "steps", mode)
+		go func() {
+			sr, err := executeStep(ctx, p.Steps[i], rc, mode)
+			if slot != nil {
+				<-slot
+			}
+			done <- stepDone{index: i, sr: sr, err: err}
+		}()
+	}
+	for {
+		if ctx.Err() != nil {
+			stop = true
+		}
+		var slot chan struct{}
+		if !stop && len(ready) > 0 {
+			sort.Ints(ready)
+			if s := p.Steps[ready[0]]; slots == nil || s.Parallel && s.Expanded() {
+				start(nil)
+				continue
+			}
+			slot = slots
+		}
+		if slot == nil && running == 0 {
+			break
+		}
+
+		var d stepDone
+		select {
+		case slot <- struct{}{}:
+			start(slot)
+			continue
+		case d = <-done:
+		}
+		running--
+		if d.err != nil {
+			if execErr == nil {
+				execErr = d.err
+			}
+			stop = true
+			continue
+		}
+		results[d.index] = d.sr
+		setStepFields(rc, d.sr)
+		onDone(p.Steps[d.index], d.sr)
+		rc.stepFinished(d.sr, "steps", mode)
+		if d.sr.Status == "failed" || d.sr.Status == "blocked" {
+			stop = true
+			continue
+		}
+		for _, j := range dependents[d.index] {
+			pending[j]--
+			if pending[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+	if execErr != nil {
+		return nil, execErr
+	}
+
+	ordered := make([]StepResult, len(p.Steps))
+	for i, s := range p.Steps {
+		if results[i] == nil {
+			ordered[i] = StepResult{ID: s.ID, Status: "skipped"}
+			setStepFields(rc, &ordered[i])
+			continue
+		}
+		ordered[i] = *results[i]
+	}
+	return ordered, nil
+}
+
+// rollbackSteps returns the rollbacks to run, most recently finished step
+// first. In run mode these are the rollbacks of succeeded steps once the run
+// has failed; explain and dry-run show the whole chain.
+func rollbackSteps(p *plan.Plan, result *Result, mode Mode) []plan.Step {
+	if mode == ModeRun && result.Success {
+		return nil
+	}
+	byID := make(map[string]plan.Step, len(p.Steps))
+	for _, s := range p.Steps {
+		byID[s.ID] = s
+	}
+	var done []StepResult
+	for i := len(result.Steps) - 1; i >= 0; i-- {
+		sr := result.Steps[i]
+		if byID[sr.ID].Rollback == nil {
+			continue
+		}
+		switch {
+		case mode == ModeRun && sr.Status == "success":
+		case mode != ModeRun && sr.Status != "skipped_condition" && sr.Status != "skipped":
+		default:
+			continue
+		}
+		done = append(done, sr)
+	}
+	sort.SliceStable(done, func(a, b int) bool {
+		return done[a].EndedAt.After(done[b].EndedAt)
+	})
+
+	steps := make([]plan.Step, len(done))
+	for i, sr := range done {
+		steps[i] = byID[sr.ID].RollbackStep()
+	}
+	return steps
+}
+
+// cleanupTimeout bounds finally and rollback steps without a timeout: that
+// run after the run was cancelled or timed out, so a hung one cannot keep the
+// run from finishing.
+var cleanupTimeout = 5 * time.Minute
+
+// cleanupStep returns step with cleanupTimeout as its timeout if ctx is done
+// and it has none of its own.
+func cleanupStep(ctx context.Context, step plan.Step) plan.Step {
+	if ctx.Err() != nil && step.Timeout == 0 {
+		step.Timeout = cleanupTimeout
+	}
+	return step
+}
+
+// runRollback runs rollback steps one after another. A failed rollback does
+// not stop the others. Like finally steps, they run even when ctx was
+// cancelled or timed out.
+func runRollback(ctx context.Context, rc *RunContext, mode Mode, steps []plan.Step, record func(plan.Step, *StepResult)) ([]StepResult, error) {
+	cleanupCtx := context.WithoutCancel(ctx)
+	results := make([]StepResult, 0, len(steps))
+	for _, step := range steps {
+		rc.stepStarted(step.ID, "rollback", mode)
+		sr, err := executeStep(cleanupCtx, cleanupStep(ctx, step), rc, mode)
+		if err != nil {
+			return nil, err
+		}
+		setStepFields(rc, sr)
+		record(step, sr)
+		rc.stepFinished(sr, "rollback", mode)
+		results = append(results, *sr)
+	}
+	return results, nil
+}
+
+// fillMissingOutputs gives the outputs of steps that did not succeed empty
+// values, so finally steps and plan outputs can still reference them.
+func fillMissingOutputs(rc *RunContext, steps []plan.Step) {
+	for _, s := range steps {
+		for _, name := range outputNames(s, rc) {
+			if _, ok := rc.TmplCtx.StepOutputs[s.ID][name]; !ok {
+				rc.TmplCtx.SetOutput(s.ID, name, "")
+			}
+		}
+	}
+}
+
+// runFinally runs the finally steps one after another. They run even when
+// ctx was cancelled or timed out, and are then bounded by cleanupTimeout
+// unless they have their own timeout.
+func runFinally(ctx context.Context, p *plan.Plan, rc *RunContext, mode Mode, record func(plan.Step, *StepResult)) ([]StepResult, error) {
+	cleanupCtx := context.WithoutCancel(ctx)
+	results := make([]StepResult, 0, len(p.Finally))
+	for _, step := range p.Finally {
+		rc.stepStarted(step.ID, "finally", mode)
+		sr, err := executeStep(cleanupCtx, cleanupStep(ctx, step), rc, mode)
+		if err != nil {
+			return nil, err
+		}
+		setStepFields(rc, sr)
+		record(step, sr)
+		rc.stepFinished(sr, "finally", mode)
+		results = append(results, *sr)
+	}
+	return results, nil
+}
+
+// setContextFields makes the run, plan and allowed environment variables
+// available to templates.
+func setContextFields(p *plan.Plan, rc *RunContext) {
+	workDir := rc.WorkDir
+	if abs, err := filepath.Abs(workDir); err == nil {
+		workDir = abs
+	}
+	rc.TmplCtx.SetRun("id", rc.RunID)
+	rc.TmplCtx.SetRun("workdir", workDir)
+	rc.TmplCtx.SetRun("started_at", rc.StartedAt.UTC().Format(time.RFC3339))
+
+	rc.TmplCtx.Plan = map[string]string{"name": p.Name}
+	rc.TmplCtx.Env = map[string]string{}
+	for _, name := range p.EnvNames() {
+		rc.TmplCtx.Env[name] = os.Getenv(name)
+	}
+	for _, name := range p.SecretEnv {
+		rc.AddSecret(os.Getenv(name))
+	}
+}
+
+// setStepFields makes the status, exit code and duration of a finished step
+// available to templates. Explained and dry-run steps stand in as successful;
+// steps that did not run report exit code 0 and duration 0s.
+func setStepFields(rc *RunContext, sr *StepResult) {
+	status := sr.Status
+	if status == "explain" || status == "dry-run" {
+		status = "success"
+	}
+	duration := sr.Duration
+	if duration == "" {
+		duration = "0s"
+	}
+	rc.TmplCtx.SetStatus(sr.ID, status)
+	rc.TmplCtx.SetStepField(sr.ID, "exit_code", strconv.Itoa(sr.ExitCode))
+	rc.TmplCtx.SetStepField(sr.ID, "duration", duration)
+}
+
+// runStatus summarises the main steps for ${{run.status}}: success, failed
+// or blocked.
+func runStatus(result *Result) string {
+	if result.Success {
+		return "success"
+	}
+	for _, sr := range result.Steps {
+		if sr.ID == result.FailedStepID && sr.Status == "blocked" {
+			return "blocked"
+		}
+	}
+	return "failed"
+}
+
+func executeStep(ctx context.Context, step plan.Step, rc *RunContext, mode Mode) (*StepResult, error) {
+	// The params of a step template are resolved once, before expansion
+	if step.Args != nil {
+		params := make(map[string]string, len(step.Args))
+		for name, value := range step.Args {
+			resolved, err := template.Resolve(value, rc.TmplCtx)
+			if err != nil {
+				return nil, fmt.Errorf("resolving param %q for step %q: %w", name, step.ID, err)
+			}
+			params[name] = resolved
+		}
+		rc = rc.scoped(rc.TmplCtx.WithParams(params))
+		step.Args = nil
+	}
+	if step.Expanded() {
+		return executeExpanded(ctx, step, rc, mode)
+	}
 	sr := &StepResult{ID: step.ID, Description: step.Description}
 
+	if step.If != "" {
+		run, err := evaluateCondition(step, rc, mode, sr)
+		if err != nil {
+			return nil, err
+		}
+		if !run {
+			sr.Status = "skipped_condition"
+			// Skipped steps produce empty outputs so later templates still resolve
+			for _, name := range outputNames(step, rc) {
+				setOutput(rc, sr, name, "")
+			}
+			return sr, nil
+		}
+	}
+
 	if step.Run != "" {
-		return executeRunStep(step, ctx, mode, sr)
+		return executeRunStep(ctx, step, rc, mode, sr)
+	}
+	if len(step.Exec) > 0 {
+		return executeExecStep(ctx, step, rc, mode, sr)
 	}
 	if step.HTTP != nil {
-		return executeHTTPStep(step, ctx, mode, sr)
+		return executeHTTPStep(ctx, step, rc, mode, sr)
+	}
+	if step.Uses != "" {
+		return executeUsesStep(ctx, step, rc, mode, sr)
 	}
-	return executeActionStep(step, ctx, mode, sr)
+	return executeActionStep(ctx, step, rc, mode, sr)
 }
 
-func executeRunStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
-	resolved, err := template.Resolve(step.Run, ctx.TmplCtx)
+func executeRunStep(ctx context.Context, step plan.Step, rc *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
+	resolved, err := template.ResolveShell(step.Run, rc.TmplCtx)
 	if err != nil {
 		return nil, fmt.Errorf("resolving template for step %q: %w", step.ID, err)
 	}
 	sr.Command = resolved
+	return executeProcess(ctx, step, rc, mode, sr, func(ctx context.Context, opts runner.Options) *runner.ShellResult {
+		return runner.Run(ctx, resolved, opts)
+	})
+}
+
+// executeExecStep runs the argv of step without a shell. Each argument is
+// resolved on its own, so values are passed as they are, without quoting.
+func executeExecStep(ctx context.Context, step plan.Step, rc *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
+	argv := make([]string, len(step.Exec))
+	for i, arg := range step.Exec {
+		resolved, err := template.Resolve(arg, rc.TmplCtx)
+		if err != nil {
+			return nil, fmt.Errorf("resolving exec argument %d for step %q: %w", i, step.ID, err)
+		}
+		argv[i] = resolved
+	}
+	sr.Argv = argv
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = template.ShellQuote(arg)
+	}
+	sr.Command = strings.Join(quoted, " ")
+	return executeProcess(ctx, step, rc, mode, sr, func(ctx context.Context, opts runner.Options) *runner.ShellResult {
+		return runner.Exec(ctx, argv, opts)
+	})
+}
 
+// processOptions resolves the env:, dir: and stdin: of step. Variables in
+// the env: of the step are set over those of the plan, which are set over
+// declaragent's own environment, or only CleanEnvVars and the plan's
+// EnvNames with clean_env. A dir: that leaves the working directory is a
+// *dagerrors.RunError unless the step allows it.
+func processOptions(step plan.Step, rc *RunContext) (runner.Options, error) {
+	opts := runner.Options{Dir: rc.WorkDir}
+	if step.Dir != "" {
+		dir, err := template.Resolve(step.Dir, rc.TmplCtx)
+		if err != nil {
+			return opts, fmt.Errorf("resolving dir for step %q: %w", step.ID, err)
+		}
+		if dir != "" && !step.AllowOutsideWorkdir && !filepath.IsLocal(dir) {
+			return opts, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				StepID:  step.ID,
+				Message: fmt.Sprintf("dir %q is outside the working directory", dir),
+				Hint:    "Use a relative path without .., or set allow_outside_workdir: true",
+			}
+		}
+		if !filepath.IsAbs(dir) && rc.WorkDir != "" {
+			dir = filepath.Join(rc.WorkDir, dir)
+		}
+		opts.Dir = dir
+	}
+
+	p := rc.plan
+	if p.CleanEnv || len(p.Env) > 0 || len(step.Env) > 0 {
+		if p.CleanEnv {
+			opts.Env = []string{}
+			for _, name := range slices.Concat(plan.CleanEnvVars, p.EnvNames()) {
+				if value, ok := os.LookupEnv(name); ok {
+					opts.Env = append(opts.Env, name+"="+value)
+				}
+			}
+		} else {
+			opts.Env = os.Environ()
+		}
+		// Later values of a variable win
+		for _, env := range []map[string]string{p.Env, step.Env} {
+			for _, name := range slices.Sorted(maps.Keys(env)) {
+				value, err := template.Resolve(env[name], rc.TmplCtx)
+				if err != nil {
+					return opts, fmt.Errorf("resolving env %q for step %q: %w", name, step.ID, err)
+				}
+				opts.Env = append(opts.Env, name+"="+value)
+			}
+		}
+	}
+
+	stdin, err := template.Resolve(step.Stdin, rc.TmplCtx)
+	if err != nil {
+		return opts, fmt.Errorf("resolving stdin for step %q: %w", step.ID, err)
+	}
+	opts.Stdin = stdin
+	return opts, nil
+}
+
+// executeProcess runs a run: or exec: step, whose resolved command is in
+// sr.Command, by calling start for each attempt.
+func executeProcess(ctx context.Context, step plan.Step, rc *RunContext, mode Mode, sr *StepResult, start func(context.Context, runner.Options) *runner.ShellResult) (*StepResult, error) {
+	opts, err := processOptions(step, rc)
+	var runErr *dagerrors.RunError
+	if errors.As(err, &runErr) {
+		sr.Status = "failed"
+		sr.err = runErr
+		return sr, nil
+	} else if err != nil {
+		return nil, err
+	}
+	resolved := sr.Command
 	if mode == ModeExplain {
 		sr.Status = "explain"
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
-	if step.Destructive && !ctx.Approve {
+	if step.Destructive && !rc.approved(ctx, step, mode, resolved) {
 		sr.Status = "blocked"
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
 	if mode == ModeDryRun {
 		sr.Status = "dry-run"
 		sr.DryRunInfo = fmt.Sprintf("Would run: %s", resolved)
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
 	// ModeRun
-	start := time.Now()
-	shellResult := runner.Run(resolved, ctx.WorkDir)
-	sr.Duration = time.Since(start).Round(time.Millisecond).String()
-	sr.ExitCode = shellResult.ExitCode
-	sr.StdoutRef = shellResult.Stdout
-	sr.StderrRef = shellResult.Stderr
-
-	if shellResult.ExitCode != 0 {
+	n := 0
+	a := runAttempts(ctx, step, rc, sr, func(ctx context.Context) attempt {
+		n++
+		out := rc.streamOutput(step, n)
+		defer out.close()
+		opts := opts
+		opts.OnLine = out.line
+		r := start(ctx, opts)
+		return attempt{stdout: r.Stdout, stderr: r.Stderr, exitCode: r.ExitCode, truncated: r.Truncated, streamed: true}
+	})
+	sr.ExitCode = a.exitCode
+	sr.StdoutRef = a.stdout
+	sr.StderrRef = a.stderr
+	sr.OutputTruncated = len(a.truncated) > 0
+	sr.streamed = true
+
+	values := map[string]string{
+		"stdout":    a.stdout,
+		"stderr":    a.stderr,
+		"exit_code": strconv.Itoa(a.exitCode),
+	}
+	if a.failed() {
 		sr.Status = "failed"
+		sr.err = a.err
+		// Keep what can be extracted, e.g. the exit code, for finally steps
+		// and plan outputs
+		_ = extractOutputs(step, rc, sr, values, a.truncated, true)
 		return sr, nil
 	}
 
 	sr.Status = "success"
 
-	// Extract outputs
-	if step.Outputs != nil {
-		if ctx.TmplCtx.StepOutputs[step.ID] == nil {
-			ctx.TmplCtx.StepOutputs[step.ID] = map[string]string{}
-		}
-		for name, source := range step.Outputs {
-			if source == "stdout" {
-				ctx.TmplCtx.StepOutputs[step.ID][name] = strings.TrimSpace(shellResult.Stdout)
-			}
-		}
+	if err := extractOutputs(step, rc, sr, values, a.truncated, true); err != nil {
+		sr.Status = "failed"
+		sr.err = err
 	}
 
 	return sr, nil
 }
 
-func executeHTTPStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
+func executeHTTPStep(ctx context.Context, step plan.Step, rc *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
 	// Resolve templates in HTTP fields
-	resolvedURL, err := template.Resolve(step.HTTP.URL, ctx.TmplCtx)
+	resolvedURL, err := template.Resolve(step.HTTP.URL, rc.TmplCtx)
 	if err != nil {
 		return nil, fmt.Errorf("resolving url for step %q: %w", step.ID, err)
 	}
@@ -172,20 +679,20 @@ func executeHTTPStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResult)
 
 	if mode == ModeExplain {
 		sr.Status = "explain"
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
-	if step.Destructive && !ctx.Approve {
+	if step.Destructive && !rc.approved(ctx, step, mode, sr.Command) {
 		sr.Status = "blocked"
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
 	if mode == ModeDryRun {
 		sr.Status = "dry-run"
 		sr.DryRunInfo = fmt.Sprintf("Would send %s to %s", method, resolvedURL)
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
@@ -196,7 +703,7 @@ func executeHTTPStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResult)
 	}
 
 	if step.HTTP.Body != "" {
-		resolvedBody, err := template.Resolve(step.HTTP.Body, ctx.TmplCtx)
+		resolvedBody, err := template.Resolve(step.HTTP.Body, rc.TmplCtx)
 		if err != nil {
 			return nil, fmt.Errorf("resolving body for step %q: %w", step.ID, err)
 		}
@@ -204,7 +711,7 @@ func executeHTTPStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResult)
 	}
 
 	for k, v := range step.HTTP.Headers {
-		resolvedHeader, err := template.Resolve(v, ctx.TmplCtx)
+		resolvedHeader, err := template.Resolve(v, rc.TmplCtx)
 		if err != nil {
 			return nil, fmt.Errorf("resolving header %q for step %q: %w", k, step.ID, err)
 		}
@@ -212,37 +719,38 @@ func executeHTTPStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResult)
 	}
 
 	// Execute via the http action
-	act, _ := action.Get("http")
-	start := time.Now()
-	outputs, err := act.Execute(params)
-	sr.Duration = time.Since(start).Round(time.Millisecond).String()
+	act, _ := rc.Actions.Get("http")
+	var outputs map[string]string
+	a := runAttempts(ctx, step, rc, sr, func(ctx context.Context) attempt {
+		var err error
+		outputs, err = act.Execute(ctx, params)
+		if err != nil {
+			return attempt{stderr: err.Error(), err: err}
+		}
+		return attempt{stdout: outputs["stdout"]}
+	})
 
-	if err != nil {
+	if a.failed() {
 		sr.Status = "failed"
-		sr.StderrRef = err.Error()
+		sr.StderrRef = a.stderr
+		sr.err = a.err
 		return sr, nil
 	}
 
 	sr.Status = "success"
 	sr.StdoutRef = outputs["stdout"]
 
-	// Extract outputs (stdout is the response body)
-	if step.Outputs != nil {
-		if ctx.TmplCtx.StepOutputs[step.ID] == nil {
-			ctx.TmplCtx.StepOutputs[step.ID] = map[string]string{}
-		}
-		for name, source := range step.Outputs {
-			if val, ok := outputs[source]; ok {
-				ctx.TmplCtx.StepOutputs[step.ID][name] = strings.TrimSpace(val)
-			}
-		}
+	// stdout is the response body
+	if err := extractOutputs(step, rc, sr, outputs, nil, true); err != nil {
+		sr.Status = "failed"
+		sr.err = err
 	}
 
 	return sr, nil
 }
 
-func executeActionStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
-	act, err := action.Get(step.Action)
+func executeActionStep(ctx context.Context, step plan.Step, rc *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
+	act, err := rc.Actions.Get(step.Action)
 	if err != nil {
 		return nil, &dagerrors.RunError{Type: dagerrors.ToolNotFound, StepID: step.ID, Message: err.Error()}
 	}
@@ -250,13 +758,14 @@ func executeActionStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResul
 	// Resolve templates in params
 	resolvedParams := map[string]string{}
 	for k, v := range step.Params {
-		resolved, err := template.Resolve(v, ctx.TmplCtx)
+		resolved, err := template.Resolve(v, rc.TmplCtx)
 		if err != nil {
 			return nil, fmt.Errorf("resolving param %q for step %q: %w", k, step.ID, err)
 		}
 		// Resolve relative file paths against workdir
-		if (k == "path" || k == "file") && !filepath.IsAbs(resolved) && ctx.WorkDir != "" {
-			resolved = filepath.Join(ctx.WorkDir, resolved)
+		param, _ := act.Spec().Param(k)
+		if param.Type == action.TypeFile && !filepath.IsAbs(resolved) && rc.WorkDir != "" {
+			resolved = filepath.Join(rc.WorkDir, resolved)
 		}
 		resolvedParams[k] = resolved
 	}
@@ -265,61 +774,202 @@ func executeActionStep(step plan.Step, ctx *RunContext, mode Mode, sr *StepResul
 		sr.Status = "explain"
 		sr.Command = fmt.Sprintf("action: %s", step.Action)
 		sr.DryRunInfo = act.DryRun(resolvedParams)
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
-	if step.Destructive && !ctx.Approve {
+	if step.Destructive && !rc.approved(ctx, step, mode, act.DryRun(resolvedParams)) {
 		sr.Status = "blocked"
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
 	if mode == ModeDryRun {
 		sr.Status = "dry-run"
 		sr.DryRunInfo = act.DryRun(resolvedParams)
-		registerPlaceholderOutputs(step, ctx)
+		registerPlaceholderOutputs(step, rc)
 		return sr, nil
 	}
 
 	// ModeRun
-	start := time.Now()
-	outputs, err := act.Execute(resolvedParams)
-	sr.Duration = time.Since(start).Round(time.Millisecond).String()
+	var outputs map[string]string
+	a := runAttempts(ctx, step, rc, sr, func(ctx context.Context) attempt {
+		var err error
+		outputs, err = act.Execute(ctx, resolvedParams)
+		if err != nil {
+			return attempt{stderr: err.Error(), err: err}
+		}
+		return attempt{}
+	})
 
-	if err != nil {
+	if a.failed() {
 		sr.Status = "failed"
-		sr.StderrRef = err.Error()
+		sr.StderrRef = a.stderr
+		sr.err = a.err
 		return sr, nil
 	}
 
 	sr.Status = "success"
 
-	// Register outputs
-	if step.Outputs != nil {
-		if ctx.TmplCtx.StepOutputs[step.ID] == nil {
-			ctx.TmplCtx.StepOutputs[step.ID] = map[string]string{}
+	if sa, ok := act.(action.SecretOutputs); ok {
+		for _, name := range sa.SecretOutputs(resolvedParams) {
+			rc.AddSecret(outputs[name])
+		}
+	}
+	if err := extractOutputs(step, rc, sr, outputs, nil, false); err != nil {
+		sr.Status = "failed"
+		sr.err = err
+	}
+
+	return sr, nil
+}
+
+func hasSkipped(results []StepResult) bool {
+	for _, sr := range results {
+		if sr.Status == "skipped" {
+			return true
 		}
-		for name, source := range step.Outputs {
-			if val, ok := outputs[source]; ok {
-				ctx.TmplCtx.StepOutputs[step.ID][name] = val
+	}
+	return false
+}
+
+// interruptedError explains why a run stopped before all steps started.
+func interruptedError(ctx context.Context, p *plan.Plan) dagerrors.RunError {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return dagerrors.RunError{
+			Type:    dagerrors.Cancelled,
+			Message: "run was cancelled before all steps started",
+			Hint:    "Resume the run to start the remaining steps",
+		}
+	}
+	msg := "run deadline exceeded before all steps started"
+	if p.Timeout > 0 {
+		msg = fmt.Sprintf("plan timeout of %s exceeded before all steps started", p.Timeout)
+	}
+	return dagerrors.RunError{
+		Type:    dagerrors.Timeout,
+		Message: msg,
+		Hint:    "Raise the plan timeout: or split the plan",
+	}
+}
+
+// evaluateCondition decides whether step should run and records the outcome
+// on sr. In explain and dry-run modes a condition that depends on placeholder
+// outputs cannot be decided yet; it is reported as unknown and the step is
+// shown as if it would run.
+func evaluateCondition(step plan.Step, rc *RunContext, mode Mode, sr *StepResult) (bool, error) {
+	sr.Condition = step.If
+	if mode != ModeRun {
+		if pending := rc.placeholderRefs(step.If); len(pending) > 0 {
+			sr.ConditionResult = "unknown"
+			sr.ConditionNote = fmt.Sprintf("depends on %s, only known at run time", describeSteps(pending))
+			return true, nil
+		}
+		if template.UsesRunOutcome(step.If) {
+			sr.ConditionResult = "unknown"
+			sr.ConditionNote = "depends on the outcome of the run, only known at run time"
+			return true, nil
+		}
+	}
+
+	ok, err := template.EvalCondition(step.If, rc.TmplCtx)
+	if err != nil {
+		return false, fmt.Errorf("evaluating condition for step %q: %w", step.ID, err)
+	}
+	sr.ConditionResult = fmt.Sprintf("%t", ok)
+	if resolved, err := template.Resolve(step.If, rc.TmplCtx); err == nil && resolved != step.If {
+		sr.ConditionNote = "evaluated as: " + resolved
+	}
+	return ok, nil
+}
+
+func describeSteps(ids []string) string {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = fmt.Sprintf("%q", id)
+	}
+	if len(ids) == 1 {
+		return "step " + quoted[0]
+	}
+	return "steps " + strings.Join(quoted, ", ")
+}
+
+// extractOutputs sets the outputs of step from the raw values it produced,
+// trimming surrounding whitespace if trim is set. Outputs of the values in
+// truncated, which kept only their end, fail rather than come from part of
+// the output. It extracts every output it can and returns the first failure,
+// e.g. a regex that does not match.
+func extractOutputs(step plan.Step, rc *RunContext, sr *StepResult, values map[string]string, truncated []string, trim bool) error {
+	var firstErr error
+	for _, name := range slices.Sorted(maps.Keys(step.Outputs)) {
+		source := step.Outputs[name]
+		value, err := extractOutput(source, values)
+		hint := fmt.Sprintf("Check the source %q against the step's output", source)
+		if spec, perr := extract.Parse(source); perr == nil && slices.Contains(truncated, spec.Source) {
+			err = fmt.Errorf("%s was cut to its last %d bytes", spec.Source, runner.MaxOutput)
+			hint = "Print less, or write long output to a file and read it from there"
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = &dagerrors.RunError{
+					Type:    dagerrors.StepFailed,
+					StepID:  step.ID,
+					Message: fmt.Sprintf("extracting output %q: %v", name, err),
+					Hint:    hint,
+				}
 			}
+			continue
+		}
+		if trim {
+			value = strings.TrimSpace(value)
 		}
+		setOutput(rc, sr, name, value)
 	}
+	return firstErr
+}
 
-	return sr, nil
+func extractOutput(source string, values map[string]string) (string, error) {
+	spec, err := extract.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	return spec.Apply(values[spec.Source])
+}
+
+// setOutput makes an output of sr available to later steps and records it
+// in the result so a resumed run can restore it.
+func setOutput(rc *RunContext, sr *StepResult, name, value string) {
+	rc.TmplCtx.SetOutput(sr.ID, name, value)
+	if sr.Outputs == nil {
+		sr.Outputs = map[string]string{}
+	}
+	sr.Outputs[name] = value
 }
 
 // registerPlaceholderOutputs sets placeholder values for outputs so subsequent
 // steps can resolve templates in explain/dry-run modes.
-func registerPlaceholderOutputs(step plan.Step, ctx *RunContext) {
-	if len(step.Outputs) == 0 {
+func registerPlaceholderOutputs(step plan.Step, rc *RunContext) {
+	rc.markPlaceholder(step.ID)
+	if step.Uses != "" {
+		for _, name := range outputNames(step, rc) {
+			rc.TmplCtx.SetOutput(step.ID, name, fmt.Sprintf("<%s.%s>", step.ID, name))
+		}
 		return
 	}
-	if ctx.TmplCtx.StepOutputs[step.ID] == nil {
-		ctx.TmplCtx.StepOutputs[step.ID] = map[string]string{}
-	}
 	for name, source := range step.Outputs {
-		ctx.TmplCtx.StepOutputs[step.ID][name] = fmt.Sprintf("<%s.%s>", step.ID, source)
+		rc.TmplCtx.SetOutput(step.ID, name, fmt.Sprintf("<%s.%s>", step.ID, source))
+	}
+}
+
+// outputNames returns the names of the outputs step produces: those under
+// its outputs:, or for a uses: step the outputs of the plan it calls.
+func outputNames(step plan.Step, rc *RunContext) []string {
+	if step.Uses == "" {
+		return slices.Sorted(maps.Keys(step.Outputs))
+	}
+	callee, err := plan.LoadUses(rc.plan, step.Uses)
+	if err != nil {
+		return nil
 	}
+	return slices.Sorted(maps.Keys(callee.Outputs))
 }
@@ -1,9 +1,25 @@
 package engine
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stevehiehn/declaragent/internal/action"
+	"github.com/stevehiehn/declaragent/internal/artifact"
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
 	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/internal/runner"
 	"github.com/stevehiehn/declaragent/internal/template"
 )
 
@@ -22,6 +38,7 @@ func makeCtx(t *testing.T, inputs map[string]string, approve bool) *RunContext {
 			StepOutputs: map[string]map[string]string{},
 		},
 		Approve: approve,
+		Actions: action.NewRegistry(),
 	}
 }
 
@@ -72,6 +89,230 @@ func TestRunModeExecutesAndCollectsOutputs(t *testing.T) {
 	}
 }
 
+func TestExecStepRunsWithoutShell(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"msg": {}},
+		Steps: []plan.Step{
+			{ID: "echo", Exec: []string{"printf", "%s", "${{ inputs.msg }}"}, Outputs: map[string]string{"out": "stdout"}},
+			{
+				ID:      "env",
+				Exec:    []string{"sh", "-c", `pwd; echo "$GREETING"; cat`},
+				Env:     map[string]string{"GREETING": "hi ${{ steps.echo.outputs.out }}"},
+				Dir:     "sub",
+				Stdin:   "${{ plan.name }}",
+				Outputs: map[string]string{"out": "stdout"},
+			},
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"msg": "it's $HOME; exit 1"}, false)
+	if err := os.Mkdir(filepath.Join(ctx.WorkDir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got %+v", result.Errors)
+	}
+	if got := result.Steps[0].Outputs["out"]; got != "it's $HOME; exit 1" {
+		t.Errorf("expected the argument untouched, got %q", got)
+	}
+	want := filepath.Join(ctx.WorkDir, "sub") + "\nhi it's $HOME; exit 1\ntest"
+	if got := result.Steps[1].Outputs["out"]; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if argv := result.Steps[0].Argv; len(argv) != 3 || argv[2] != "it's $HOME; exit 1" {
+		t.Errorf("expected the resolved argv, got %q", argv)
+	}
+}
+
+func TestExecStepExplainAndFailure(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"token": {Secret: true}},
+		Steps:  []plan.Step{{ID: "call", Exec: []string{"declaragent-no-such-program", "${{ inputs.token }}", "a b"}}},
+	}
+	ctx := makeCtx(t, map[string]string{"token": "abc123"}, false)
+	result, err := Execute(p, ctx, ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sr := result.Steps[0]
+	if sr.Command != "declaragent-no-such-program *** 'a b'" {
+		t.Errorf("unexpected command %q", sr.Command)
+	}
+	if len(sr.Argv) != 3 || sr.Argv[1] != "***" {
+		t.Errorf("expected masked argv, got %q", sr.Argv)
+	}
+
+	ctx = makeCtx(t, map[string]string{"token": "abc123"}, false)
+	result, err = Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.Steps[0].ExitCode != 127 {
+		t.Errorf("expected exit code 127, got %+v", result.Steps[0])
+	}
+}
+
+func TestRunStepQuotesInputsInsideSubstitutions(t *testing.T) {
+	p := &plan.Plan{
+		Name:  "test",
+		Steps: []plan.Step{{ID: "s1", Run: `echo "$(printf %s ${{inputs.x}})"`, Outputs: map[string]string{"out": "stdout"}}},
+	}
+	ctx := makeCtx(t, map[string]string{"x": "a; echo PWNED"}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ctx.TmplCtx.StepOutputs["s1"]["out"]; !result.Success || got != "a; echo PWNED" {
+		t.Errorf("expected the input to be printed literally, got %q (%v)", got, result.Errors)
+	}
+}
+
+func TestRunStepEnvDirAndStdin(t *testing.T) {
+	t.Setenv("DECLARAGENT_TEST_INHERITED", "inherited")
+	t.Setenv("DECLARAGENT_TEST_ALLOWED", "allowed")
+	p := &plan.Plan{
+		Name:     "test",
+		Inputs:   map[string]plan.Input{"region": {}},
+		AllowEnv: []string{"DECLARAGENT_TEST_ALLOWED"},
+		Env:      map[string]string{"REGION": "${{ inputs.region }}", "LEVEL": "plan"},
+		Steps: []plan.Step{
+			{
+				ID:      "show",
+				Run:     `echo "$REGION $LEVEL ${DECLARAGENT_TEST_INHERITED:-none}"; basename "$PWD"; cat`,
+				Env:     map[string]string{"LEVEL": "step"},
+				Dir:     "sub",
+				Stdin:   "${{ plan.name }}",
+				Outputs: map[string]string{"out": "stdout"},
+			},
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"region": "eu"}, false)
+	if err := os.Mkdir(filepath.Join(ctx.WorkDir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[0].Outputs["out"]; got != "eu step inherited\nsub\ntest" {
+		t.Errorf("unexpected output %q", got)
+	}
+
+	p.CleanEnv = true
+	p.Steps[0].Run = `echo "${DECLARAGENT_TEST_INHERITED:-none} $DECLARAGENT_TEST_ALLOWED $LEVEL"`
+	p.Steps[0].Dir, p.Steps[0].Stdin = "", ""
+	ctx = makeCtx(t, map[string]string{"region": "eu"}, false)
+	result, err = Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[0].Outputs["out"]; got != "none allowed step" {
+		t.Errorf("expected a clean environment, got %q", got)
+	}
+}
+
+func TestRunStepDirMustStayInWorkDir(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"dir": {}},
+		Steps:  []plan.Step{{ID: "s1", Run: "pwd", Dir: "${{ inputs.dir }}"}},
+	}
+	ctx := makeCtx(t, map[string]string{"dir": "../elsewhere"}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Message, "outside the working directory") {
+		t.Errorf("expected the step to fail, got %+v", result.Errors)
+	}
+
+	p.Steps[0].AllowOutsideWorkdir = true
+	ctx = makeCtx(t, map[string]string{"dir": ".."}, false)
+	result, err = Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success || strings.TrimSpace(result.Steps[0].StdoutRef) != filepath.Dir(ctx.WorkDir) {
+		t.Errorf("expected the step to run in the parent directory, got %+v", result.Steps[0])
+	}
+}
+
+func TestRunStepStreamsOutput(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "build", Run: "echo compiling; sleep 0.1; echo warning >&2; head -c 1100000 /dev/zero | tr '\\0' x; echo; exit 3"},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	steps := filepath.Join(ctx.WorkDir, ".declaragent", "runs", "test-run", "steps")
+	var lines []string
+	ctx.Observers = []Observer{func(e Event) {
+		if e.Type != EventStepOutput || len(lines) > 1 {
+			return
+		}
+		lines = append(lines, e.Stream+" "+e.Line)
+		// The line is in the artifact store by the time observers hear of it
+		data, _ := os.ReadFile(filepath.Join(steps, "build."+e.Stream))
+		if !strings.HasSuffix(string(data), e.Line+"\n") {
+			t.Errorf("expected %q in the artifact store already, got %q", e.Line, data)
+		}
+	}}
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(lines, []string{"stdout compiling", "stderr warning"}) {
+		t.Errorf("unexpected output events %q", lines)
+	}
+
+	sr := result.Steps[0]
+	if sr.Status != "failed" || len(sr.StdoutRef) != runner.MaxOutput || !sr.OutputTruncated || sr.StderrRef != "warning\n" {
+		t.Errorf("expected the end of the output in the failed step, got %d bytes (truncated %v), stderr %q", len(sr.StdoutRef), sr.OutputTruncated, sr.StderrRef)
+	}
+	info, err := os.Stat(filepath.Join(steps, "build.stdout"))
+	if err != nil || info.Size() != int64(len("compiling\n")+1100000+1) {
+		t.Errorf("expected all the output of the failed step in the artifact store, got %v (%v)", info, err)
+	}
+}
+
+func TestOutputsOfTruncatedStreamFail(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:      "noisy",
+				Run:     `head -c 1100000 /dev/zero | tr '\0' x >&2; echo '{"v": 1}'`,
+				Outputs: map[string]string{"v": "stdout | json:$.v"},
+			},
+			{
+				ID:      "long",
+				Run:     `echo '{"v": 1}'; head -c 1100000 /dev/zero | tr '\0' x; echo; echo '{"v": 2}'`,
+				Outputs: map[string]string{"v": "stdout | lines[-1] | json:$.v"},
+			},
+		},
+	}
+	result, err := Execute(p, makeCtx(t, nil, false), ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if noisy := result.Steps[0]; noisy.Status != "success" || noisy.Outputs["v"] != "1" || !noisy.OutputTruncated {
+		t.Errorf("expected the output from the untruncated stdout, got %+v", noisy)
+	}
+	long := result.Steps[1]
+	if long.Status != "failed" || long.Outputs["v"] != "" || len(result.Errors) != 1 {
+		t.Fatalf("expected extracting from the truncated stdout to fail, got %+v", long)
+	}
+	if msg := result.Errors[0].Message; !strings.Contains(msg, `extracting output "v": stdout was cut to its last`) {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
 func TestRunModeFailFast(t *testing.T) {
 	p := &plan.Plan{
 		Name: "test",
@@ -216,3 +457,1311 @@ func TestMixedShellAndActionSteps(t *testing.T) {
 		}
 	}
 }
+
+func TestIndependentStepsRunInParallel(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "a", Run: "sleep 0.3", Needs: []string{}},
+			{ID: "b", Run: "sleep 0.3", Needs: []string{}},
+			{ID: "c", Run: "sleep 0.3", Needs: []string{}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	start := time.Now()
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, errors: %v", result.Errors)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("expected steps to overlap, took %s", elapsed)
+	}
+}
+
+func TestMaxParallelLimitsConcurrency(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "a", Run: "sleep 0.2", Needs: []string{}},
+			{ID: "b", Run: "sleep 0.2", Needs: []string{}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	ctx.MaxParallel = 1
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a, b := result.Steps[0], result.Steps[1]
+	if b.StartedAt.Before(a.EndedAt) {
+		t.Errorf("expected b to start after a ended with max-parallel 1 (a ended %s, b started %s)", a.EndedAt, b.StartedAt)
+	}
+}
+
+func TestDAGResultsKeepPlanOrderAndTimestamps(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "slow", Run: "sleep 0.2", Needs: []string{}},
+			{ID: "fast", Run: "echo fast", Needs: []string{}},
+			{ID: "after", Run: "echo ${{steps.slow.outputs.v}}", Needs: []string{"slow", "fast"}},
+		},
+	}
+	p.Steps[0].Outputs = map[string]string{"v": "stdout"}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, id := range []string{"slow", "fast", "after"} {
+		sr := result.Steps[i]
+		if sr.ID != id {
+			t.Errorf("expected step %d to be %q, got %q", i, id, sr.ID)
+		}
+		if sr.StartedAt.IsZero() || sr.EndedAt.Before(sr.StartedAt) {
+			t.Errorf("step %s: bad timestamps %s .. %s", sr.ID, sr.StartedAt, sr.EndedAt)
+		}
+	}
+	if result.Steps[2].StartedAt.Before(result.Steps[0].EndedAt) {
+		t.Error("expected dependent step to start after its dependency ended")
+	}
+}
+
+func TestDAGFailureSkipsDependents(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "bad", Run: "exit 3", Needs: []string{}},
+			{ID: "child", Run: "echo child", Needs: []string{"bad"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.FailedStepID != "bad" {
+		t.Fatalf("expected failure at 'bad', got success=%v failed=%q", result.Success, result.FailedStepID)
+	}
+	if result.Steps[1].Status != "skipped" {
+		t.Errorf("expected child skipped, got %q", result.Steps[1].Status)
+	}
+}
+
+func TestConditionFalseSkipsStep(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"branch": {}},
+		Steps: []plan.Step{
+			{ID: "deploy", Run: "echo deploying", If: "${{inputs.branch}} == 'main'", Outputs: map[string]string{"out": "stdout"}},
+			{ID: "report", Run: "echo [${{steps.deploy.outputs.out}}] ${{steps.deploy.status}}", Outputs: map[string]string{"out": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"branch": "feature"}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, errors: %v", result.Errors)
+	}
+	if result.Steps[0].Status != "skipped_condition" {
+		t.Errorf("expected skipped_condition, got %q", result.Steps[0].Status)
+	}
+	if result.Steps[0].ConditionResult != "false" {
+		t.Errorf("expected condition result false, got %q", result.Steps[0].ConditionResult)
+	}
+	if got := ctx.TmplCtx.StepOutputs["report"]["out"]; got != "[] skipped_condition" {
+		t.Errorf("expected '[] skipped_condition', got %q", got)
+	}
+}
+
+func TestConditionTrueRunsStep(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "build", Run: "echo built", Outputs: map[string]string{"log": "stdout"}},
+			{ID: "notify", Run: "echo notify", If: "${{steps.build.outputs.log}}"},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Steps[1].Status != "success" || result.Steps[1].ConditionResult != "true" {
+		t.Errorf("expected notify to run, got status %q condition %q", result.Steps[1].Status, result.Steps[1].ConditionResult)
+	}
+}
+
+func TestExplainConditionOnPlaceholderIsUnknown(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"branch": {}},
+		Steps: []plan.Step{
+			{ID: "build", Run: "echo built", Outputs: map[string]string{"log": "stdout"}},
+			{ID: "notify", Run: "echo notify", If: "${{steps.build.outputs.log}} != ''"},
+			{ID: "deploy", Run: "echo deploy", If: "${{inputs.branch}} == 'main'"},
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"branch": "main"}, false)
+	result, err := Execute(p, ctx, ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	notify := result.Steps[1]
+	if notify.ConditionResult != "unknown" || notify.Status != "explain" {
+		t.Errorf("expected unknown condition on explained step, got %q / %q", notify.ConditionResult, notify.Status)
+	}
+	if !strings.Contains(notify.ConditionNote, `"build"`) {
+		t.Errorf("expected note to name step build, got %q", notify.ConditionNote)
+	}
+	deploy := result.Steps[2]
+	if deploy.ConditionResult != "true" || deploy.ConditionNote != "evaluated as: main == 'main'" {
+		t.Errorf("expected evaluated condition, got %q (%q)", deploy.ConditionResult, deploy.ConditionNote)
+	}
+}
+
+func TestRetryShellStepUntilSuccess(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:      "flaky",
+				Run:     `n=$(cat count 2>/dev/null || echo 0); n=$((n+1)); echo $n > count; echo "try $n"; [ $n -ge 3 ]`,
+				Outputs: map[string]string{"out": "stdout"},
+				Retry:   &plan.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, errors: %v", result.Errors)
+	}
+	attempts := result.Steps[0].Attempts
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	if attempts[0].Status != "failed" || !attempts[0].Retryable || attempts[2].Status != "success" {
+		t.Errorf("unexpected attempts: %+v", attempts)
+	}
+	if ctx.TmplCtx.StepOutputs["flaky"]["out"] != "try 3" {
+		t.Errorf("expected output from final attempt, got %q", ctx.TmplCtx.StepOutputs["flaky"]["out"])
+	}
+	data, err := os.ReadFile(filepath.Join(result.Artifacts[0], "steps", "flaky", "attempt-1.stdout"))
+	if err != nil || strings.TrimSpace(string(data)) != "try 1" {
+		t.Errorf("expected attempt-1 artifact with 'try 1', got %q (%v)", data, err)
+	}
+}
+
+func TestRetryStopsOnUnlistedExitCode(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:    "fail",
+				Run:   "exit 2",
+				Retry: &plan.RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, OnExitCodes: []int{75}},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success {
+		t.Fatal("expected failure")
+	}
+	if n := len(result.Steps[0].Attempts); n != 1 {
+		t.Errorf("expected a single attempt for unlisted exit code, got %d", n)
+	}
+}
+
+func TestRetryHTTPTransientStatus(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:    "call",
+				HTTP:  &plan.HTTPRequest{URL: srv.URL},
+				Retry: &plan.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success after retries, errors: %v", result.Errors)
+	}
+	if n := len(result.Steps[0].Attempts); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestRetryActionHTTPNotFoundIsNotRetried(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:     "call",
+				Action: "http",
+				Params: map[string]string{"url": srv.URL},
+				Retry:  &plan.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || calls.Load() != 1 || len(result.Steps[0].Attempts) != 1 {
+		t.Errorf("expected one failed attempt, got %d calls and %+v", calls.Load(), result.Steps[0].Attempts)
+	}
+}
+
+func TestHTTPTransientFailureReportedRetryable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:    "call",
+				HTTP:  &plan.HTTPRequest{URL: srv.URL},
+				Retry: &plan.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || len(result.Errors) != 1 {
+		t.Fatalf("expected one error, got success=%v errors=%v", result.Success, result.Errors)
+	}
+	e := result.Errors[0]
+	if e.Type != dagerrors.Transient || !e.Retryable || e.Code != "429" {
+		t.Errorf("expected retryable TRANSIENT 429 error, got %+v", e)
+	}
+}
+
+func TestStepTimeoutKillsCommand(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "hang", Run: "sleep 30", Timeout: 100 * time.Millisecond},
+			{ID: "after", Run: "echo never"},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	start := time.Now()
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("step was not killed on timeout, took %s", elapsed)
+	}
+	if result.Success || result.FailedStepID != "hang" {
+		t.Fatalf("expected failure at hang, got success=%v failed=%q", result.Success, result.FailedStepID)
+	}
+	if result.Steps[1].Status != "skipped" {
+		t.Errorf("expected after to be skipped, got %q", result.Steps[1].Status)
+	}
+	e := result.Errors[0]
+	if e.Type != dagerrors.Timeout || !e.Retryable {
+		t.Errorf("expected retryable TIMEOUT error, got %+v", e)
+	}
+}
+
+func TestStepTimeoutAppliesPerAttempt(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:      "slow-once",
+				Run:     `if [ -f seen ]; then echo ok; else touch seen; sleep 30; fi`,
+				Timeout: 200 * time.Millisecond,
+				Retry:   &plan.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success on second attempt, errors: %v", result.Errors)
+	}
+	attempts := result.Steps[0].Attempts
+	if len(attempts) != 2 || !strings.Contains(attempts[0].Error, "timed out") {
+		t.Errorf("expected a timed out first attempt, got %+v", attempts)
+	}
+}
+
+func TestPlanTimeoutStopsRun(t *testing.T) {
+	p := &plan.Plan{
+		Name:    "test",
+		Timeout: 200 * time.Millisecond,
+		Steps: []plan.Step{
+			{ID: "s1", Run: "sleep 30", Retry: &plan.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}},
+			{ID: "s2", Run: "echo never"},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	start := time.Now()
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("plan timeout did not stop the run, took %s", elapsed)
+	}
+	if result.Success {
+		t.Fatal("expected failure")
+	}
+	if n := len(result.Steps[0].Attempts); n != 1 {
+		t.Errorf("expected no retries after the plan timed out, got %d attempts", n)
+	}
+	if result.Errors[0].Type != dagerrors.Timeout || result.Steps[1].Status != "skipped" {
+		t.Errorf("expected TIMEOUT and skipped s2, got %+v / %q", result.Errors[0], result.Steps[1].Status)
+	}
+}
+
+func TestCancelledContextStopsRun(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "s1", Run: "sleep 30"},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	result, err := ExecuteContext(cancelCtx, p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.Errors[0].Type != dagerrors.Cancelled {
+		t.Fatalf("expected CANCELLED failure, got success=%v errors=%v", result.Success, result.Errors)
+	}
+	e := result.Errors[0]
+	if e.Message != `step "s1" failed: run was cancelled` || e.Hint != "Resume the run to continue from this step" {
+		t.Errorf("unexpected message or hint: %q, %q", e.Message, e.Hint)
+	}
+}
+
+func TestCancelledBeforeStartSkipsAllSteps(t *testing.T) {
+	p := &plan.Plan{
+		Name:  "test",
+		Steps: []plan.Step{{ID: "s1", Run: "echo hi"}},
+	}
+	ctx := makeCtx(t, nil, false)
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := ExecuteContext(cancelCtx, p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.Steps[0].Status != "skipped" {
+		t.Fatalf("expected skipped step and failure, got success=%v status=%q", result.Success, result.Steps[0].Status)
+	}
+	if result.Errors[0].Type != dagerrors.Cancelled {
+		t.Errorf("expected CANCELLED error, got %+v", result.Errors[0])
+	}
+}
+
+const resumePlanYAML = `
+name: resumable
+steps:
+  - id: once
+    run: echo ran >> once.log; echo token-1
+    outputs:
+      token: stdout
+  - id: flaky
+    run: test -f ready
+  - id: use
+    run: echo "using ${{steps.once.outputs.token}}"
+    outputs:
+      out: stdout
+`
+
+func TestResumeSkipsSucceededSteps(t *testing.T) {
+	ctx := makeCtx(t, nil, false)
+	planPath := filepath.Join(ctx.WorkDir, "plan.yaml")
+	os.WriteFile(planPath, []byte(resumePlanYAML), 0o644)
+	p, err := plan.LoadFile(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.Success || first.FailedStepID != "flaky" {
+		t.Fatalf("expected failure at flaky, got success=%v failed=%q", first.Success, first.FailedStepID)
+	}
+
+	os.WriteFile(filepath.Join(ctx.WorkDir, "ready"), nil, 0o644)
+	prev, err := LoadRun(artifact.DefaultRoot(ctx.WorkDir), first.RunID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rc := makeCtx(t, nil, false)
+	rc.WorkDir = ctx.WorkDir
+	result, err := Resume(context.Background(), p, rc, prev)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success || result.RunID != first.RunID {
+		t.Fatalf("expected success in run %q, got success=%v run=%q errors=%v", first.RunID, result.Success, result.RunID, result.Errors)
+	}
+	if !result.Steps[0].Resumed || result.Steps[1].Resumed {
+		t.Errorf("expected only the first step to be carried over, got %+v", result.Steps)
+	}
+	log, _ := os.ReadFile(filepath.Join(ctx.WorkDir, "once.log"))
+	if strings.Count(string(log), "ran") != 1 {
+		t.Errorf("expected the succeeded step to run once, log: %q", log)
+	}
+	if got := rc.TmplCtx.StepOutputs["use"]["out"]; got != "using token-1" {
+		t.Errorf("expected restored output to flow into later steps, got %q", got)
+	}
+}
+
+func TestResumeRerunsRolledBackSteps(t *testing.T) {
+	ctx := makeCtx(t, nil, false)
+	planPath := filepath.Join(ctx.WorkDir, "plan.yaml")
+	os.WriteFile(planPath, []byte(`name: rollback-resume
+steps:
+  - id: other
+    run: echo other >> other.log
+  - id: create
+    run: echo created >> state.log
+    rollback:
+      run: echo "undo ${{steps.create.status}}" >> state.log
+  - id: keep
+    run: echo kept >> state.log
+    needs: [create]
+  - id: deploy
+    run: test -f ready
+    needs: [keep]
+`), 0o644)
+	p, err := plan.LoadFile(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.Success || len(first.Rollback) != 1 {
+		t.Fatalf("expected a failed run with one rollback, got %+v", first)
+	}
+
+	os.WriteFile(filepath.Join(ctx.WorkDir, "ready"), nil, 0o644)
+	prev, err := LoadRun(artifact.DefaultRoot(ctx.WorkDir), first.RunID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rc := makeCtx(t, nil, false)
+	rc.WorkDir = ctx.WorkDir
+	result, err := Resume(context.Background(), p, rc, prev)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success || !result.Steps[0].Resumed || result.Steps[1].Resumed || result.Steps[2].Resumed {
+		t.Fatalf("expected the rolled back step and the step needing it to run again, got %+v", result.Steps)
+	}
+	log, _ := os.ReadFile(filepath.Join(ctx.WorkDir, "state.log"))
+	if string(log) != "created\nkept\nundo success\ncreated\nkept\n" {
+		t.Errorf("unexpected state log %q", log)
+	}
+	if log, _ := os.ReadFile(filepath.Join(ctx.WorkDir, "other.log")); string(log) != "other\n" {
+		t.Errorf("expected the unrelated step to run once, got %q", log)
+	}
+}
+
+func TestResumeRefusesChangedPlan(t *testing.T) {
+	ctx := makeCtx(t, nil, false)
+	planPath := filepath.Join(ctx.WorkDir, "plan.yaml")
+	os.WriteFile(planPath, []byte(resumePlanYAML), 0o644)
+	p, _ := plan.LoadFile(planPath)
+	first, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	os.WriteFile(planPath, []byte(resumePlanYAML+"\n# edited\n"), 0o644)
+	changed, _ := plan.LoadFile(planPath)
+	prev, err := LoadRun(artifact.DefaultRoot(ctx.WorkDir), first.RunID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = Resume(context.Background(), changed, makeCtx(t, nil, false), prev)
+	var runErr *dagerrors.RunError
+	if !errors.As(err, &runErr) || runErr.Type != dagerrors.PreconditionFailed {
+		t.Fatalf("expected PRECONDITION_FAILED, got %v", err)
+	}
+}
+
+func TestResumeRefusesChangedCalledPlan(t *testing.T) {
+	ctx := makeCtx(t, nil, false)
+	planPath := filepath.Join(ctx.WorkDir, "plan.yaml")
+	calleePath := filepath.Join(ctx.WorkDir, "callee.yaml")
+	os.WriteFile(planPath, []byte("name: caller\nsteps:\n  - id: call\n    uses: callee.yaml\n"), 0o644)
+	os.WriteFile(calleePath, []byte("name: callee\nsteps:\n  - id: a\n    run: echo a\n"), 0o644)
+	p, _ := plan.LoadFile(planPath)
+	first, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	os.WriteFile(calleePath, []byte("name: callee\nsteps:\n  - id: a\n    run: echo b\n"), 0o644)
+	changed, _ := plan.LoadFile(planPath)
+	prev, err := LoadRun(artifact.DefaultRoot(ctx.WorkDir), first.RunID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = Resume(context.Background(), changed, makeCtx(t, nil, false), prev)
+	var runErr *dagerrors.RunError
+	if !errors.As(err, &runErr) || runErr.Type != dagerrors.PreconditionFailed {
+		t.Fatalf("expected PRECONDITION_FAILED, got %v", err)
+	}
+}
+
+func TestFinallyRunsAfterFailure(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "lock", Run: "echo lock-1", Outputs: map[string]string{"id": "stdout"}},
+			{ID: "deploy", Run: "exit 1"},
+			{ID: "notify", Run: "echo never", Outputs: map[string]string{"msg": "stdout"}},
+		},
+		Finally: []plan.Step{
+			{ID: "unlock", Run: "echo ${{run.status}} ${{run.failed_step}} ${{steps.lock.outputs.id}} [${{steps.notify.outputs.msg}}]", Outputs: map[string]string{"out": "stdout"}},
+			{ID: "report", Run: "echo ${{steps.notify.status}}", Outputs: map[string]string{"out": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.FailedStepID != "deploy" {
+		t.Fatalf("expected failure at deploy, got success=%v failed=%q", result.Success, result.FailedStepID)
+	}
+	if len(result.Finally) != 2 || result.Finally[0].Status != "success" {
+		t.Fatalf("expected finally steps to run, got %+v", result.Finally)
+	}
+	if got := ctx.TmplCtx.StepOutputs["unlock"]["out"]; got != "failed deploy lock-1 []" {
+		t.Errorf("unexpected finally output %q", got)
+	}
+	if got := ctx.TmplCtx.StepOutputs["report"]["out"]; got != "skipped" {
+		t.Errorf("expected skipped status of notify, got %q", got)
+	}
+}
+
+func TestFinallyFailureFailsRun(t *testing.T) {
+	p := &plan.Plan{
+		Name:    "test",
+		Steps:   []plan.Step{{ID: "s1", Run: "echo ok"}},
+		Finally: []plan.Step{{ID: "cleanup", Run: "exit 3"}, {ID: "after", Run: "echo still runs"}},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.FailedStepID != "cleanup" {
+		t.Errorf("expected failure at cleanup, got success=%v failed=%q", result.Success, result.FailedStepID)
+	}
+	if result.Finally[1].Status != "success" {
+		t.Errorf("expected later finally step to still run, got %q", result.Finally[1].Status)
+	}
+}
+
+func TestFinallyRunsAfterCancellation(t *testing.T) {
+	p := &plan.Plan{
+		Name:    "test",
+		Steps:   []plan.Step{{ID: "s1", Run: "sleep 30"}},
+		Finally: []plan.Step{{ID: "cleanup", Run: "echo ${{run.status}}", Outputs: map[string]string{"out": "stdout"}}},
+	}
+	ctx := makeCtx(t, nil, false)
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	result, err := ExecuteContext(cancelCtx, p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Finally[0].Status != "success" || ctx.TmplCtx.StepOutputs["cleanup"]["out"] != "failed" {
+		t.Errorf("expected cleanup to run after cancellation, got %+v", result.Finally)
+	}
+}
+
+func TestCleanupTimeoutBoundsFinallyAfterCancellation(t *testing.T) {
+	defer func(d time.Duration) { cleanupTimeout = d }(cleanupTimeout)
+	cleanupTimeout = 200 * time.Millisecond
+
+	p := &plan.Plan{
+		Name:  "test",
+		Steps: []plan.Step{{ID: "s1", Run: "sleep 30"}},
+		Finally: []plan.Step{
+			{ID: "hung", Run: "sleep 30"},
+			{ID: "bounded", Run: "sleep 0.5 && echo done", Timeout: 5 * time.Second},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	result, err := ExecuteContext(cancelCtx, p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the hung finally step to be stopped, took %s", elapsed)
+	}
+	timedOut := slices.ContainsFunc(result.Errors, func(e dagerrors.RunError) bool {
+		return e.StepID == "hung" && e.Type == dagerrors.Timeout
+	})
+	if result.Finally[0].Status != "failed" || !timedOut {
+		t.Errorf("expected hung to time out, got %+v %+v", result.Finally[0], result.Errors)
+	}
+	if result.Finally[1].Status != "success" {
+		t.Errorf("expected bounded to keep its own timeout, got %+v", result.Finally[1])
+	}
+}
+
+func TestExplainFinallyConditionOnRunIsUnknown(t *testing.T) {
+	p := &plan.Plan{
+		Name:    "test",
+		Steps:   []plan.Step{{ID: "s1", Run: "echo hi"}},
+		Finally: []plan.Step{{ID: "alert", Run: "echo alert", If: "${{run.status}} == 'failed'"}},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Finally) != 1 || result.Finally[0].ConditionResult != "unknown" {
+		t.Errorf("expected unknown condition in finally, got %+v", result.Finally)
+	}
+}
+
+func TestRollbackRunsInReverseOnFailure(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:       "create",
+				Run:      "echo res-1",
+				Outputs:  map[string]string{"id": "stdout"},
+				Rollback: &plan.Step{Run: "echo delete ${{steps.create.outputs.id}} >> undo.log"},
+			},
+			{ID: "plain", Run: "echo no rollback"},
+			{
+				ID:       "tag",
+				Run:      "echo tagged",
+				Rollback: &plan.Step{Run: "echo untag >> undo.log"},
+			},
+			{ID: "deploy", Run: "exit 1", Rollback: &plan.Step{Run: "echo never >> undo.log"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.FailedStepID != "deploy" {
+		t.Fatalf("expected failure at deploy, got success=%v failed=%q", result.Success, result.FailedStepID)
+	}
+	if len(result.Rollback) != 2 || result.Rollback[0].ID != "tag.rollback" || result.Rollback[1].ID != "create.rollback" {
+		t.Fatalf("expected rollback of tag then create, got %+v", result.Rollback)
+	}
+	for _, sr := range result.Rollback {
+		if sr.Status != "success" {
+			t.Errorf("expected rollback %s to succeed, got %q", sr.ID, sr.Status)
+		}
+	}
+	log, _ := os.ReadFile(filepath.Join(ctx.WorkDir, "undo.log"))
+	if string(log) != "untag\ndelete res-1\n" {
+		t.Errorf("unexpected rollback log %q", log)
+	}
+}
+
+func TestRollbackNotRunOnSuccess(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "s1", Run: "echo ok", Rollback: &plan.Step{Run: "echo undo"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success || len(result.Rollback) != 0 {
+		t.Errorf("expected success without rollback, got %+v", result.Rollback)
+	}
+}
+
+func TestFailedRollbackContinues(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "a", Run: "echo a", Rollback: &plan.Step{Run: "echo undo-a > undo.log"}},
+			{ID: "b", Run: "echo b", Rollback: &plan.Step{Run: "exit 4"}},
+			{ID: "c", Run: "exit 1"},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Rollback) != 2 || result.Rollback[0].Status != "failed" || result.Rollback[1].Status != "success" {
+		t.Fatalf("expected failed b rollback then a rollback, got %+v", result.Rollback)
+	}
+	if result.FailedStepID != "c" || len(result.Errors) != 2 {
+		t.Errorf("expected failure at c with a rollback error, got %q %v", result.FailedStepID, result.Errors)
+	}
+}
+
+func TestExplainShowsRollbackChain(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "a", Run: "echo a", Outputs: map[string]string{"id": "stdout"}, Rollback: &plan.Step{Run: "undo ${{steps.a.outputs.id}}"}},
+			{ID: "b", Run: "echo b", Rollback: &plan.Step{Run: "undo b"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Rollback) != 2 || result.Rollback[0].Command != "undo b" || result.Rollback[1].Command != "undo '<a.stdout>'" {
+		t.Errorf("unexpected rollback chain %+v", result.Rollback)
+	}
+}
+
+func TestPlanOutputsResolvedAtEnd(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"env": {}},
+		Steps: []plan.Step{
+			{ID: "build", Run: "echo v1.2", Outputs: map[string]string{"version": "stdout"}},
+		},
+		Finally: []plan.Step{
+			{ID: "cleanup", Run: "echo cleaned", Outputs: map[string]string{"msg": "stdout"}},
+		},
+		Outputs: map[string]string{
+			"release": "${{steps.build.outputs.version}}-${{inputs.env}}",
+			"status":  "${{run.status}}",
+			"cleanup": "${{steps.cleanup.outputs.msg}}",
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"env": "prod"}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"release": "v1.2-prod", "status": "success", "cleanup": "cleaned"}
+	for k, v := range want {
+		if result.Outputs[k] != v {
+			t.Errorf("output %s: expected %q, got %q", k, v, result.Outputs[k])
+		}
+	}
+}
+
+func TestPlanOutputsEmptyForFailedSteps(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "fail", Run: "exit 1"},
+			{ID: "after", Run: "echo x", Outputs: map[string]string{"out": "stdout"}},
+		},
+		Outputs: map[string]string{"value": "${{steps.after.outputs.out}}"},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v, ok := result.Outputs["value"]; !ok || v != "" {
+		t.Errorf("expected empty value output, got %q (present=%v)", v, ok)
+	}
+}
+
+func TestOutputExtractionPipes(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:  "probe",
+				Run: `echo '{"items":[{"name":"api"}]}'; echo "built v2.3 ok" >&2`,
+				Outputs: map[string]string{
+					"name":    "stdout | json:$.items[0].name",
+					"version": `stderr | regex:(v\d+\.\d+)`,
+					"code":    "exit_code",
+				},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, errors: %v", result.Errors)
+	}
+	want := map[string]string{"name": "api", "version": "v2.3", "code": "0"}
+	for k, v := range want {
+		if got := ctx.TmplCtx.StepOutputs["probe"][k]; got != v {
+			t.Errorf("output %s: expected %q, got %q", k, v, got)
+		}
+	}
+}
+
+func TestOutputExtractionFailureFailsStep(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "probe", Run: "echo no version here", Outputs: map[string]string{"v": `stdout | regex:v\d+`}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.Steps[0].Status != "failed" {
+		t.Fatalf("expected failed step, got %+v", result.Steps[0])
+	}
+	if !strings.Contains(result.Errors[0].Message, "did not match") {
+		t.Errorf("expected extraction error, got %q", result.Errors[0].Message)
+	}
+}
+
+func TestFailedStepKeepsExitCodeOutput(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "test", Run: "exit 3", Outputs: map[string]string{"code": "exit_code"}},
+		},
+		Outputs: map[string]string{"code": "${{steps.test.outputs.code}}"},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Outputs["code"] != "3" {
+		t.Errorf("expected exit code 3 in plan outputs, got %q", result.Outputs["code"])
+	}
+}
+
+func TestHTTPOutputJSONPath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"release":{"tag":"v9"}}`))
+	}))
+	defer srv.Close()
+
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{
+				ID:      "fetch",
+				HTTP:    &plan.HTTPRequest{URL: srv.URL},
+				Outputs: map[string]string{"tag": "stdout | json:$.release.tag", "status": "status_code"},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	if _, err := Execute(p, ctx, ModeRun); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ctx.TmplCtx.StepOutputs["fetch"]; got["tag"] != "v9" || got["status"] != "200" {
+		t.Errorf("unexpected outputs %v", got)
+	}
+}
+
+func TestSecretInputsAreRedacted(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"token": {Secret: true}},
+		Steps: []plan.Step{
+			{ID: "echo", Run: "echo auth=${{inputs.token}}; echo token ${{inputs.token}} >&2", Outputs: map[string]string{"out": "stdout"}},
+			{ID: "fail", Run: "echo bad ${{inputs.token}} >&2; exit 1"},
+		},
+		Outputs: map[string]string{"header": "${{steps.echo.outputs.out}}"},
+	}
+	ctx := makeCtx(t, map[string]string{"token": "s3cr3t-value"}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ctx.TmplCtx.StepOutputs["echo"]["out"]; got != "auth=s3cr3t-value" {
+		t.Errorf("expected later steps to see the real value, got %q", got)
+	}
+	sr := result.Steps[0]
+	if sr.StdoutRef != "auth=***\n" || sr.Outputs["out"] != "auth=***" || !sr.Redacted {
+		t.Errorf("expected masked stdout and outputs, got %+v", sr)
+	}
+	if result.Outputs["header"] != "auth=***" {
+		t.Errorf("expected masked plan output, got %q", result.Outputs["header"])
+	}
+
+	var files []string
+	filepath.Walk(result.Artifacts[0], func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) < 3 {
+		t.Fatalf("expected artifact files, got %v", files)
+	}
+	for _, f := range files {
+		data, _ := os.ReadFile(f)
+		if strings.Contains(string(data), "s3cr3t-value") {
+			t.Errorf("secret leaked into %s: %s", f, data)
+		}
+	}
+	var meta RunMeta
+	data, _ := os.ReadFile(filepath.Join(result.Artifacts[0], "run.json"))
+	json.Unmarshal(data, &meta)
+	if _, ok := meta.Inputs["token"]; ok {
+		t.Errorf("expected secret input to be left out of run.json, got %v", meta.Inputs)
+	}
+}
+
+func TestSecretExplainIsRedacted(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"token": {Secret: true}},
+		Steps:  []plan.Step{{ID: "call", Run: "curl -H 'Authorization: ${{inputs.token}}' example.com"}},
+	}
+	ctx := makeCtx(t, map[string]string{"token": "abc123"}, false)
+	result, err := Execute(p, ctx, ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cmd := result.Steps[0].Command; strings.Contains(cmd, "abc123") || !strings.Contains(cmd, "Authorization: ***") {
+		t.Errorf("expected masked command, got %q", cmd)
+	}
+}
+
+func TestSecretEnvGetIsRedacted(t *testing.T) {
+	t.Setenv("DECLARAGENT_TEST_TOKEN", "env-secret")
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "token", Action: "env.get", Params: map[string]string{"name": "DECLARAGENT_TEST_TOKEN", "secret": "true"}, Outputs: map[string]string{"v": "value"}},
+			{ID: "use", Run: "echo using ${{steps.token.outputs.v}}", Outputs: map[string]string{"out": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[1].Outputs["out"]; got != "using ***" {
+		t.Errorf("expected masked output, got %q", got)
+	}
+	if got := result.Steps[0].Outputs["v"]; got != "***" {
+		t.Errorf("expected masked env value, got %q", got)
+	}
+}
+
+func TestSecretEnvIsRedacted(t *testing.T) {
+	t.Setenv("DECLARAGENT_TEST_TOKEN", "env-s3cr3t")
+	p := &plan.Plan{
+		Name:      "test",
+		SecretEnv: []string{"DECLARAGENT_TEST_TOKEN"},
+		Steps: []plan.Step{
+			{ID: "call", Run: "echo token=${{ env.DECLARAGENT_TEST_TOKEN }}", Outputs: map[string]string{"out": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ctx.TmplCtx.StepOutputs["call"]["out"]; got != "token=env-s3cr3t" {
+		t.Errorf("expected the step to see the real value, got %q", got)
+	}
+	sr := result.Steps[0]
+	if sr.Command != "echo token=***" || sr.Outputs["out"] != "token=***" {
+		t.Errorf("expected masked command and outputs, got %+v", sr)
+	}
+	data, err := os.ReadFile(filepath.Join(result.Artifacts[0], "result.json"))
+	if err != nil || !strings.Contains(string(data), "token=***") || strings.Contains(string(data), "env-s3cr3t") {
+		t.Errorf("expected the value masked in result.json, got %s (%v)", data, err)
+	}
+}
+
+func TestFilteredSecretsAreRedacted(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"token": {Secret: true}},
+		Steps: []plan.Step{
+			{ID: "call", Run: "echo auth=${{ inputs.token | base64 }} ${{ inputs.token | upper | urlencode }}", Outputs: map[string]string{"out": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"token": "s3cr3t/x"}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ctx.TmplCtx.StepOutputs["call"]["out"]; got != "auth=czNjcjN0L3g= S3CR3T%2FX" {
+		t.Errorf("expected the step to see the real values, got %q", got)
+	}
+	sr := result.Steps[0]
+	if sr.Command != "echo auth=*** ***" || sr.Outputs["out"] != "auth=*** ***" {
+		t.Errorf("expected masked command and outputs, got %+v", sr)
+	}
+	data, err := os.ReadFile(filepath.Join(result.Artifacts[0], "result.json"))
+	if err != nil || strings.Contains(string(data), "czNjcjN0L3g=") || strings.Contains(string(data), "S3CR3T") {
+		t.Errorf("expected filtered values masked in result.json, got %s (%v)", data, err)
+	}
+}
+
+func TestResumeRerunsStepsWithRedactedOutputs(t *testing.T) {
+	ctx := makeCtx(t, nil, false)
+	planPath := filepath.Join(ctx.WorkDir, "plan.yaml")
+	os.WriteFile(planPath, []byte(`
+name: secret-resume
+inputs:
+  token:
+    secret: true
+    required: true
+steps:
+  - id: login
+    run: echo session-${{inputs.token}}
+    outputs:
+      session: stdout
+  - id: gate
+    run: test -f ready
+  - id: use
+    run: echo ${{steps.login.outputs.session}}
+    outputs:
+      out: stdout
+`), 0o644)
+	p, _ := plan.LoadFile(planPath)
+	ctx.Inputs["token"] = "t0k"
+	first, err := Execute(p, ctx, ModeRun)
+	if err != nil || first.Success {
+		t.Fatalf("expected failed run, got %v %+v", err, first)
+	}
+
+	os.WriteFile(filepath.Join(ctx.WorkDir, "ready"), nil, 0o644)
+	prev, err := LoadRun(artifact.DefaultRoot(ctx.WorkDir), first.RunID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rc := makeCtx(t, map[string]string{"token": "t0k"}, false)
+	rc.WorkDir = ctx.WorkDir
+	result, err := Resume(context.Background(), p, rc, prev)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success || result.Steps[0].Resumed {
+		t.Fatalf("expected login to run again, got %+v", result.Steps[0])
+	}
+	if got := rc.TmplCtx.StepOutputs["use"]["out"]; got != "session-t0k" {
+		t.Errorf("expected real session value, got %q", got)
+	}
+}
+
+func TestContextNamespacesInRun(t *testing.T) {
+	t.Setenv("DECLARAGENT_TEST_USER", "ada")
+	p := &plan.Plan{
+		Name:     "ctx",
+		AllowEnv: []string{"DECLARAGENT_TEST_USER"},
+		Steps: []plan.Step{
+			{ID: "first", Run: "exit 0"},
+			{ID: "report", Run: "echo ${{plan.name}} ${{run.id}} ${{env.DECLARAGENT_TEST_USER}} ${{steps.first.status}} ${{steps.first.exit_code}}",
+				Outputs: map[string]string{"line": "stdout"}},
+			{ID: "timing", Run: "echo ${{steps.first.duration}} ${{run.workdir}} ${{run.started_at}}",
+				Outputs: map[string]string{"line": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	ctx.StartedAt = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[1].Outputs["line"]; got != "ctx test-run ada success 0" {
+		t.Errorf("unexpected report %q", got)
+	}
+	fields := strings.Fields(result.Steps[2].Outputs["line"])
+	if len(fields) != 3 || !strings.HasSuffix(fields[0], "s") || fields[1] != ctx.WorkDir || fields[2] != "2026-01-02T03:04:05Z" {
+		t.Errorf("unexpected timing %q", result.Steps[2].Outputs["line"])
+	}
+}
+
+func TestExplainShowsContextPlaceholders(t *testing.T) {
+	p := &plan.Plan{
+		Name: "ctx",
+		Steps: []plan.Step{
+			{ID: "build", Run: "make"},
+			{ID: "notify", Run: "notify ${{steps.build.status}} ${{steps.build.exit_code}} ${{steps.build.duration}} ${{plan.name}}"},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	result, err := Execute(p, ctx, ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[1].Command; got != "notify success 0 0s ctx" {
+		t.Errorf("unexpected command %q", got)
+	}
+}
+
+func TestTemplateParamsResolveInStepScope(t *testing.T) {
+	dir := t.TempDir()
+	lib := `
+templates:
+  greet:
+    params:
+      who: {required: true}
+      punct: {default: "!"}
+    run: echo "hi ${{ params.who }}${{ params.punct }} ${{ item }}"
+    outputs:
+      line: stdout
+`
+	if err := os.WriteFile(filepath.Join(dir, "lib.yaml"), []byte(lib), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data := `
+name: main
+imports: [lib.yaml]
+inputs:
+  name: {required: true}
+steps:
+  - id: greet
+    template: greet
+    foreach: [a, b]
+    with:
+      who: ${{ inputs.name }}
+`
+	if err := os.WriteFile(filepath.Join(dir, "main.yaml"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := plan.LoadFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Validate(p, nil); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	result, err := Execute(p, makeCtx(t, map[string]string{"name": "$USER"}, false), ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[0].Outputs["line"]; got != `["hi $USER! a","hi $USER! b"]` {
+		t.Errorf("unexpected outputs %q", got)
+	}
+}
+
+func TestActionFileParamsResolveAgainstWorkDir(t *testing.T) {
+	ctx := makeCtx(t, nil, false)
+	if err := os.WriteFile(filepath.Join(ctx.WorkDir, "app.json"), []byte(`{"version":"1.2"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "get", Action: "json.get", Params: map[string]string{"file": "app.json", "path": "version"}, Outputs: map[string]string{"v": "value"}},
+		},
+	}
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success || result.Steps[0].Outputs["v"] != "1.2" {
+		t.Fatalf("expected the file, not the key path, to be resolved, got %+v", result.Steps[0])
+	}
+}
+
+func TestObserversSeeMaskedEvents(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"token": {Secret: true}},
+		Steps: []plan.Step{
+			{ID: "echo", Run: "echo auth=${{inputs.token}}", Outputs: map[string]string{"out": "stdout"}},
+		},
+		Finally: []plan.Step{{ID: "cleanup", Run: "true"}},
+	}
+	ctx := makeCtx(t, map[string]string{"token": "s3cr3t-value"}, false)
+	var events []Event
+	ctx.Observers = []Observer{func(e Event) { events = append(events, e) }}
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s %s %s", e.Type, e.Phase, e.StepID))
+		if e.RunID != "test-run" || e.Plan != "test" || e.Mode != "run" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+	want := []string{"run_started  ", "step_started steps echo", "step_output  echo", "step_finished steps echo", "step_started finally cleanup", "step_finished finally cleanup", "run_finished  "}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected events:\n%s", strings.Join(got, "\n"))
+	}
+	if e := events[2]; e.Stream != "stdout" || e.Line != "auth=***" {
+		t.Errorf("expected masked output in event, got %+v", e)
+	}
+	if step := events[3].Step; step.Outputs["out"] != "auth=***" || !step.Redacted {
+		t.Errorf("expected masked step in event, got %+v", step)
+	}
+	// Masking the event's copy leaves the result to be masked on its own
+	if sr := result.Steps[0]; sr.Outputs["out"] != "auth=***" || !sr.Redacted {
+		t.Errorf("expected masked result, got %+v", sr)
+	}
+	if events[6].Result != result {
+		t.Error("expected run_finished to carry the result")
+	}
+}
@@ -0,0 +1,99 @@
+package engine
+
+import "time"
+
+// EventType names what an Event reports.
+type EventType string
+
+const (
+	EventRunStarted   EventType = "run_started"
+	EventStepStarted  EventType = "step_started"
+	EventStepOutput   EventType = "step_output"
+	EventStepFinished EventType = "step_finished"
+	EventRunFinished  EventType = "run_finished"
+)
+
+// Event reports the progress of a run.
+type Event struct {
+	Type   EventType   `json:"type"`
+	RunID  string      `json:"run_id"`
+	Plan   string      `json:"plan"`
+	Mode   string      `json:"mode"` // explain, dry-run or run
+	StepID string      `json:"step_id,omitempty"`
+	Phase  string      `json:"phase,omitempty"`  // steps, rollback or finally; not set for step_output
+	Stream string      `json:"stream,omitempty"` // stdout or stderr, for step_output
+	Line   string      `json:"line,omitempty"`   // for step_output, with secrets masked
+	Time   time.Time   `json:"time"`
+	Step   *StepResult `json:"step,omitempty"`   // for step_finished, with secrets masked
+	Result *Result     `json:"result,omitempty"` // for run_finished
+}
+
+// Observer is told about each event of a run. Observers are called one at a
+// time, in the order of the events, and block the run while they do. A
+// step_output event reports a line printed by a run: or exec: step, as the
+// step prints it.
+type Observer func(Event)
+
+// String returns the name of m used in events and results.
+func (m Mode) String() string {
+	switch m {
+	case ModeExplain:
+		return "explain"
+	case ModeDryRun:
+		return "dry-run"
+	}
+	return "run"
+}
+
+// emit tells the observers of c about e.
+func (c *RunContext) emit(e Event, mode Mode) {
+	if len(c.Observers) == 0 {
+		return
+	}
+	e.RunID = c.RunID
+	e.Plan = c.plan.Name
+	e.Mode = mode.String()
+	// Steps running at once report their output from their own goroutines
+	c.emitMu.Lock()
+	defer c.emitMu.Unlock()
+	e.Time = time.Now()
+	for _, o := range c.Observers {
+		o(e)
+	}
+}
+
+// stepStarted and stepFinished report a step of the given phase.
+func (c *RunContext) stepStarted(step string, phase string, mode Mode) {
+	c.emit(Event{Type: EventStepStarted, StepID: step, Phase: phase}, mode)
+}
+
+func (c *RunContext) stepFinished(sr *StepResult, phase string, mode Mode) {
+	if len(c.Observers) == 0 {
+		return
+	}
+	masked := c.redactedStep(*sr)
+	c.emit(Event{Type: EventStepFinished, StepID: sr.ID, Phase: phase, Step: &masked}, mode)
+}
+
+// forward reports e, an event of the plan that the uses: step stepID calls,
+// as an event of c, with stepID and a slash before the IDs of the called
+// plan's steps. The called plan's run_started and run_finished are left out.
+func (c *RunContext) forward(stepID string, e Event, mode Mode) {
+	if e.Type == EventRunStarted || e.Type == EventRunFinished {
+		return
+	}
+	e.StepID = stepID + "/" + e.StepID
+	if e.Step != nil {
+		step := *e.Step
+		step.ID = e.StepID
+		e.Step = &step
+	}
+	c.emit(e, mode)
+}
+
+// stepOutput reports line, already masked, printed to stream by a running
+// step. Steps of a foreach or matrix report it as steps of the run.
+func (c *RunContext) stepOutput(stepID, stream, line string) {
+	c = c.root()
+	c.emit(Event{Type: EventStepOutput, StepID: stepID, Stream: stream, Line: line}, ModeRun)
+}
@@ -0,0 +1,279 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/internal/template"
+)
+
+// itemKeyRe matches item values that can be used as is in child step IDs.
+var itemKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.,=-]{1,64}$`)
+
+// expansion is one item of a foreach or matrix step.
+type expansion struct {
+	step plan.Step         // the step for this item, with an ID like deploy[api]
+	tmpl *template.Context // resolves item and matrix.* for this item
+}
+
+// executeExpanded runs a foreach or matrix step as one child step per item,
+// one at a time or, with parallel:, as many at once as rc.MaxParallel allows
+// next to the other steps of the run. The step
+// fails if any child fails, and each of its outputs is a JSON array of the
+// children's values, in item order. In explain and dry-run modes a list that
+// depends on placeholder outputs is not expanded.
+func executeExpanded(ctx context.Context, step plan.Step, rc *RunContext, mode Mode) (*StepResult, error) {
+	sr := &StepResult{ID: step.ID, Description: step.Description}
+
+	if mode != ModeRun {
+		if pending := rc.placeholderRefs(expansionSource(step)); len(pending) > 0 {
+			sr.Status = "explain"
+			if mode == ModeDryRun {
+				sr.Status = "dry-run"
+			}
+			sr.DryRunInfo = fmt.Sprintf("Expands once %s has run", describeSteps(pending))
+			registerPlaceholderOutputs(step, rc)
+			return sr, nil
+		}
+	}
+
+	items, err := expandStep(step, rc)
+	if err != nil {
+		return nil, fmt.Errorf("expanding step %q: %w", step.ID, err)
+	}
+
+	sr.StartedAt = time.Now()
+	children, err := runChildren(ctx, step, items, rc, mode)
+	if err != nil {
+		return nil, err
+	}
+	sr.Children = children
+	if mode == ModeRun {
+		sr.EndedAt = time.Now()
+		sr.Duration = sr.EndedAt.Sub(sr.StartedAt).Round(time.Millisecond).String()
+	} else {
+		sr.StartedAt = time.Time{}
+	}
+
+	sr.Status = expandedStatus(mode, children)
+	for i := range children {
+		c := &children[i]
+		if c.Status == "failed" {
+			sr.ExitCode = c.ExitCode
+			e := stepError(c)
+			sr.err = &e
+			break
+		}
+	}
+
+	if mode != ModeRun {
+		registerPlaceholderOutputs(step, rc)
+		return sr, nil
+	}
+	for _, name := range outputNames(step, rc) {
+		values := make([]string, len(children))
+		for i, c := range children {
+			values[i] = c.Outputs[name]
+		}
+		data, _ := json.Marshal(values)
+		setOutput(rc, sr, name, string(data))
+	}
+	return sr, nil
+}
+
+// expansionSource returns the templates the items of step come from.
+func expansionSource(step plan.Step) string {
+	var parts []string
+	if step.Foreach != nil {
+		parts = append(parts, step.Foreach.Template)
+		parts = append(parts, step.Foreach.Items...)
+	}
+	for _, name := range slices.Sorted(maps.Keys(step.Matrix)) {
+		parts = append(parts, step.Matrix[name].Template)
+		parts = append(parts, step.Matrix[name].Items...)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// expandStep returns the child steps of a foreach or matrix step. Matrix
+// combinations vary the last list, by name, fastest.
+func expandStep(step plan.Step, rc *RunContext) ([]expansion, error) {
+	var (
+		keys   [][]string // values naming each child
+		scopes []*template.Context
+	)
+	if step.Foreach != nil {
+		items, err := resolveItems(*step.Foreach, rc)
+		if err != nil {
+			return nil, fmt.Errorf("foreach: %w", err)
+		}
+		for _, item := range items {
+			keys = append(keys, []string{item})
+			scopes = append(scopes, rc.TmplCtx.Scope(item, nil))
+		}
+	} else {
+		combos := []map[string]string{{}}
+		names := slices.Sorted(maps.Keys(step.Matrix))
+		for _, name := range names {
+			items, err := resolveItems(step.Matrix[name], rc)
+			if err != nil {
+				return nil, fmt.Errorf("matrix %s: %w", name, err)
+			}
+			var next []map[string]string
+			for _, combo := range combos {
+				for _, item := range items {
+					c := maps.Clone(combo)
+					c[name] = item
+					next = append(next, c)
+				}
+			}
+			combos = next
+		}
+		for _, combo := range combos {
+			key := make([]string, len(names))
+			for i, name := range names {
+				key[i] = combo[name]
+			}
+			keys = append(keys, key)
+			scopes = append(scopes, rc.TmplCtx.Scope("", combo))
+		}
+	}
+
+	seen := map[string]bool{}
+	children := make([]expansion, len(keys))
+	for i, key := range keys {
+		id := strings.Join(key, ",")
+		if !itemKeyRe.MatchString(id) || seen[id] {
+			id = strconv.Itoa(i)
+		}
+		seen[id] = true
+
+		child := step
+		child.ID = fmt.Sprintf("%s[%s]", step.ID, id)
+		child.Foreach, child.Matrix, child.Parallel = nil, nil, false
+		child.Rollback = nil
+		children[i] = expansion{step: child, tmpl: scopes[i]}
+	}
+	return children, nil
+}
+
+// resolveItems returns the items of list, resolving templates against rc.
+func resolveItems(list plan.ItemList, rc *RunContext) ([]string, error) {
+	if list.Template != "" {
+		value, err := template.Resolve(list.Template, rc.TmplCtx)
+		if err != nil {
+			return nil, err
+		}
+		return plan.ParseItems(value), nil
+	}
+	items := make([]string, len(list.Items))
+	for i, item := range list.Items {
+		value, err := template.Resolve(item, rc.TmplCtx)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = value
+	}
+	return items, nil
+}
+
+// runChildren executes the children of step and returns their results in
+// item order. Once a child fails or is blocked, or ctx is done, no more
+// children are started; those that never ran are reported as skipped.
+func runChildren(ctx context.Context, step plan.Step, children []expansion, rc *RunContext, mode Mode) ([]StepResult, error) {
+	// Without parallel: the children run in turn in the slot of the step.
+	// With it the step holds no slot, and each child takes one of the run's.
+	sem := make(chan struct{}, 1)
+	if step.Parallel {
+		sem = rc.slotPool()
+		if sem == nil {
+			sem = make(chan struct{}, max(len(children), 1))
+		}
+	}
+
+	results := make([]*StepResult, len(children))
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		stop    bool
+		execErr error
+	)
+	for i, child := range children {
+		sem <- struct{}{}
+		mu.Lock()
+		halt := stop || ctx.Err() != nil
+		mu.Unlock()
+		if halt {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			crc := rc.scoped(child.tmpl)
+			sr, err := executeStep(ctx, child.step, crc, mode)
+			if err == nil && mode == ModeRun && rc.store != nil && sr.Status == "success" && !sr.streamed {
+				_ = rc.store.WriteStepOutput(sr.ID, rc.Redact(sr.StdoutRef), rc.Redact(sr.StderrRef))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if execErr == nil {
+					execErr = err
+				}
+				stop = true
+				return
+			}
+			results[i] = sr
+			if sr.Status == "failed" || sr.Status == "blocked" {
+				stop = true
+			}
+		}()
+	}
+	wg.Wait()
+	if execErr != nil {
+		return nil, execErr
+	}
+
+	ordered := make([]StepResult, len(children))
+	for i, child := range children {
+		if results[i] == nil {
+			ordered[i] = StepResult{ID: child.step.ID, Status: "skipped"}
+			continue
+		}
+		ordered[i] = *results[i]
+	}
+	return ordered, nil
+}
+
+// expandedStatus sums up the children of a foreach or matrix step.
+func expandedStatus(mode Mode, children []StepResult) string {
+	for _, c := range children {
+		if c.Status == "failed" || c.Status == "blocked" {
+			return c.Status
+		}
+	}
+	switch mode {
+	case ModeExplain:
+		return "explain"
+	case ModeDryRun:
+		return "dry-run"
+	}
+	if len(children) > 0 && !slices.ContainsFunc(children, func(c StepResult) bool {
+		return c.Status != "skipped_condition"
+	}) {
+		return "skipped_condition"
+	}
+	return "success"
+}
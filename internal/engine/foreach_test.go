@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevehiehn/declaragent/internal/plan"
+)
+
+func TestForeachRunsEachItem(t *testing.T) {
+	p := &plan.Plan{
+		Name:   "test",
+		Inputs: map[string]plan.Input{"services": {Type: plan.TypeArray}},
+		Steps: []plan.Step{
+			{ID: "deploy", Foreach: &plan.ItemList{Template: "${{ inputs.services }}"}, Run: "echo deployed ${{ item }}",
+				Outputs: map[string]string{"msg": "stdout"}},
+			{ID: "report", Run: "echo ${{ steps.deploy.outputs.msg }}", Outputs: map[string]string{"all": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"services": `["api","web"]`}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deploy := result.Steps[0]
+	if deploy.Status != "success" || len(deploy.Children) != 2 {
+		t.Fatalf("expected 2 successful children, got %+v", deploy)
+	}
+	if deploy.Children[0].ID != "deploy[api]" || deploy.Children[1].ID != "deploy[web]" {
+		t.Errorf("unexpected child IDs %q, %q", deploy.Children[0].ID, deploy.Children[1].ID)
+	}
+	if got := deploy.Outputs["msg"]; got != `["deployed api","deployed web"]` {
+		t.Errorf("unexpected aggregated output %q", got)
+	}
+	if got := result.Steps[1].Outputs["all"]; got != `["deployed api","deployed web"]` {
+		t.Errorf("unexpected report %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(result.Artifacts[0], "steps", "deploy[web].stdout")); err != nil {
+		t.Errorf("expected child artifact: %v", err)
+	}
+}
+
+func TestMatrixExpandsCombinations(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{{
+			ID: "grid",
+			Matrix: map[string]plan.ItemList{
+				"env":    {Items: []string{"dev", "prod"}},
+				"region": {Items: []string{"eu", "us"}},
+			},
+			If:      "${{ matrix.env }} == 'prod' || ${{ matrix.region }} == 'eu'",
+			Run:     "echo ${{ matrix.env }}-${{ matrix.region }}",
+			Outputs: map[string]string{"where": "stdout"},
+		}},
+	}
+	result, err := Execute(p, makeCtx(t, nil, false), ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	grid := result.Steps[0]
+	var ids []string
+	for _, c := range grid.Children {
+		ids = append(ids, c.ID+"="+c.Status)
+	}
+	want := "grid[dev,eu]=success grid[dev,us]=skipped_condition grid[prod,eu]=success grid[prod,us]=success"
+	if strings.Join(ids, " ") != want {
+		t.Errorf("unexpected children %v", ids)
+	}
+	if got := grid.Outputs["where"]; got != `["dev-eu","","prod-eu","prod-us"]` {
+		t.Errorf("unexpected aggregated output %q", got)
+	}
+}
+
+func TestForeachStopsAtFailedItem(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "check", Foreach: &plan.ItemList{Items: []string{"0", "3", "0"}}, Run: "exit ${{ item }}"},
+			{ID: "after", Run: "echo after"},
+		},
+	}
+	result, err := Execute(p, makeCtx(t, nil, false), ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	check := result.Steps[0]
+	if result.Success || check.Status != "failed" || check.ExitCode != 3 {
+		t.Fatalf("expected failed step with exit code 3, got %+v", check)
+	}
+	// Duplicate items fall back to their index
+	if check.Children[1].ID != "check[3]" || check.Children[2].ID != "check[2]" || check.Children[2].Status != "skipped" {
+		t.Errorf("unexpected children %+v", check.Children)
+	}
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Message, `step "check[3]" failed with exit code 3`) {
+		t.Errorf("expected error naming the failed item, got %+v", result.Errors)
+	}
+	if result.Steps[1].Status != "skipped" {
+		t.Errorf("expected later step to be skipped, got %q", result.Steps[1].Status)
+	}
+}
+
+func TestForeachParallel(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{{
+			ID:       "wait",
+			Foreach:  &plan.ItemList{Items: []string{"a", "b", "c"}},
+			Parallel: true,
+			Run:      "sleep 0.3",
+		}},
+	}
+	ctx := makeCtx(t, nil, false)
+	ctx.MaxParallel = 3
+	start := time.Now()
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got %+v", result.Errors)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("expected items to run in parallel, took %s", elapsed)
+	}
+}
+
+func TestMaxParallelCountsForeachChildren(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "other", Run: "sleep 0.2", Needs: []string{}},
+			{
+				ID:       "wait",
+				Foreach:  &plan.ItemList{Items: []string{"a", "b", "c"}},
+				Parallel: true,
+				Run:      "sleep 0.2",
+				Needs:    []string{},
+			},
+		},
+	}
+	ctx := makeCtx(t, nil, false)
+	ctx.MaxParallel = 2
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got %+v", result.Errors)
+	}
+	steps := append([]StepResult{result.Steps[0]}, result.Steps[1].Children...)
+	for _, s := range steps {
+		running := 0
+		for _, o := range steps {
+			if !o.StartedAt.After(s.StartedAt) && o.EndedAt.After(s.StartedAt) {
+				running++
+			}
+		}
+		if running > 2 {
+			t.Fatalf("expected at most 2 steps at once, %d were running when %s started", running, s.ID)
+		}
+	}
+}
+
+func TestExplainForeach(t *testing.T) {
+	p := &plan.Plan{
+		Name: "test",
+		Steps: []plan.Step{
+			{ID: "list", Run: "ls", Outputs: map[string]string{"files": "stdout"}},
+			{ID: "static", Foreach: &plan.ItemList{Items: []string{"a", "b"}}, Run: "echo ${{ item }}", Outputs: map[string]string{"out": "stdout"}},
+			{ID: "dynamic", Foreach: &plan.ItemList{Template: "${{ steps.list.outputs.files }}"}, Run: "cat ${{ item }}"},
+			{ID: "use", Run: "echo ${{ steps.static.outputs.out }}"},
+		},
+	}
+	result, err := Execute(p, makeCtx(t, nil, false), ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	static := result.Steps[1]
+	if len(static.Children) != 2 || static.Children[1].Command != "echo b" {
+		t.Errorf("expected static list to be expanded, got %+v", static.Children)
+	}
+	dynamic := result.Steps[2]
+	if len(dynamic.Children) != 0 || !strings.Contains(dynamic.DryRunInfo, `step "list"`) {
+		t.Errorf("expected dynamic list to wait for step list, got %+v", dynamic)
+	}
+	if got := result.Steps[3].Command; got != "echo '<static.stdout>'" {
+		t.Errorf("unexpected command %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"io"
+	"strings"
+
+	"github.com/stevehiehn/declaragent/internal/artifact"
+	"github.com/stevehiehn/declaragent/internal/plan"
+)
+
+// outputStream takes the output of one attempt of a run: or exec: step line
+// by line as it is printed, masks secrets in it, and passes it on to the
+// observers of the run and to the artifact store.
+type outputStream struct {
+	rc     *RunContext
+	stepID string
+	files  map[string][]*artifact.OutputFile // by stream
+}
+
+// streamOutput returns the stream of attempt n of step. In the artifact
+// store its output goes to steps/<step_id>.{stdout,stderr}, replacing that
+// of earlier attempts, and with a retry policy to
+// steps/<step_id>/attempt-<n>.{stdout,stderr} as well.
+func (c *RunContext) streamOutput(step plan.Step, n int) *outputStream {
+	o := &outputStream{rc: c, stepID: step.ID, files: map[string][]*artifact.OutputFile{}}
+	if c.store == nil {
+		return o
+	}
+	for _, stream := range []string{"stdout", "stderr"} {
+		o.files[stream] = append(o.files[stream], c.store.StepOutputFile(step.ID, stream))
+		if step.Retry != nil {
+			o.files[stream] = append(o.files[stream], c.store.AttemptOutputFile(step.ID, n, stream))
+		}
+	}
+	return o
+}
+
+// line handles a line printed to stream, a runner.Options.OnLine.
+func (o *outputStream) line(stream, line string) {
+	line = o.rc.Redact(line)
+	for _, f := range o.files[stream] {
+		_, _ = io.WriteString(f, line)
+	}
+	o.rc.stepOutput(o.stepID, stream, strings.TrimSuffix(line, "\n"))
+}
+
+func (o *outputStream) close() {
+	for _, files := range o.files {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+}
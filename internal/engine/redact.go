@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+	"github.com/stevehiehn/declaragent/internal/template"
+)
+
+// Redacted replaces secret values in results, artifacts and output.
+const Redacted = "***"
+
+// AddSecret records a value that must not appear in results or artifacts.
+func (c *RunContext) AddSecret(value string) {
+	if value == "" {
+		return
+	}
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slices.Contains(c.secrets, value) {
+		return
+	}
+	// Commands carry the value as quoted by ResolveShell
+	for _, v := range append([]string{value}, template.ShellForms(value)...) {
+		if !slices.Contains(c.secrets, v) {
+			c.secrets = append(c.secrets, v)
+		}
+	}
+	// Longest first, so a secret containing another is masked whole
+	slices.SortFunc(c.secrets, func(a, b string) int { return cmp.Compare(len(b), len(a)) })
+	pairs := make([]string, 0, 2*len(c.secrets))
+	for _, s := range c.secrets {
+		pairs = append(pairs, s, Redacted)
+	}
+	c.redactor = strings.NewReplacer(pairs...)
+}
+
+// maskFiltered is the template Filtered hook. It records the result of a
+// filter applied to a secret, such as ${{ inputs.token | base64 }}, as a
+// secret too.
+func (c *RunContext) maskFiltered(in, out string) {
+	if in != out && c.Redact(in) != in {
+		c.AddSecret(out)
+	}
+}
+
+// secretValues returns the values recorded with AddSecret.
+func (c *RunContext) secretValues() []string {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.secrets)
+}
+
+// Redact masks every recorded secret in s.
+func (c *RunContext) Redact(s string) string {
+	c = c.root()
+	c.mu.Lock()
+	r := c.redactor
+	c.mu.Unlock()
+	if r == nil || s == "" {
+		return s
+	}
+	return r.Replace(s)
+}
+
+// redactResult masks secrets throughout result before it is stored or
+// returned. Steps, outputs and errors are copied rather than changed in
+// place, so results already handed to observers are left alone.
+func (c *RunContext) redactResult(result *Result) {
+	result.Steps = c.redactedSteps(result.Steps)
+	result.Rollback = c.redactedSteps(result.Rollback)
+	result.Finally = c.redactedSteps(result.Finally)
+	outputs := make(map[string]string, len(result.Outputs))
+	for name, value := range result.Outputs {
+		outputs[name] = c.Redact(value)
+	}
+	result.Outputs = outputs
+	result.Errors = slices.Clone(result.Errors)
+	for i := range result.Errors {
+		c.redactError(&result.Errors[i])
+	}
+}
+
+func (c *RunContext) redactedSteps(steps []StepResult) []StepResult {
+	steps = slices.Clone(steps)
+	for i := range steps {
+		steps[i] = c.redactedStep(steps[i])
+	}
+	return steps
+}
+
+// redactedStep returns sr with secrets masked.
+func (c *RunContext) redactedStep(sr StepResult) StepResult {
+	sr.StdoutRef = c.Redact(sr.StdoutRef)
+	sr.StderrRef = c.Redact(sr.StderrRef)
+	sr.Command = c.Redact(sr.Command)
+	if sr.Argv != nil {
+		argv := make([]string, len(sr.Argv))
+		for i, arg := range sr.Argv {
+			argv[i] = c.Redact(arg)
+		}
+		sr.Argv = argv
+	}
+	sr.DryRunInfo = c.Redact(sr.DryRunInfo)
+	sr.ConditionNote = c.Redact(sr.ConditionNote)
+	if sr.Outputs != nil {
+		outputs := make(map[string]string, len(sr.Outputs))
+		for name, value := range sr.Outputs {
+			outputs[name] = c.Redact(value)
+			if outputs[name] != value {
+				sr.Redacted = true
+			}
+		}
+		sr.Outputs = outputs
+	}
+	sr.Children = c.redactedSteps(sr.Children)
+	if sr.Plan != nil {
+		nested := *sr.Plan
+		c.redactResult(&nested)
+		sr.Plan = &nested
+	}
+	sr.Attempts = slices.Clone(sr.Attempts)
+	for i := range sr.Attempts {
+		sr.Attempts[i].Error = c.Redact(sr.Attempts[i].Error)
+	}
+	return sr
+}
+
+func (c *RunContext) redactError(e *dagerrors.RunError) {
+	e.Message = c.Redact(e.Message)
+	e.Hint = c.Redact(e.Hint)
+}
@@ -1,27 +1,60 @@
 package engine
 
-import dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+import (
+	"time"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+)
 
 // Result is the structured output of a plan execution.
 type Result struct {
-	RunID        string            `json:"run_id"`
-	Success      bool              `json:"success"`
-	FailedStepID string            `json:"failed_step_id,omitempty"`
-	Steps        []StepResult      `json:"steps"`
-	Outputs      map[string]string `json:"outputs,omitempty"`
-	Artifacts    []string          `json:"artifacts,omitempty"`
+	RunID        string               `json:"run_id"`
+	Success      bool                 `json:"success"`
+	FailedStepID string               `json:"failed_step_id,omitempty"`
+	Steps        []StepResult         `json:"steps"`
+	Rollback     []StepResult         `json:"rollback,omitempty"` // most recently finished step first
+	Finally      []StepResult         `json:"finally,omitempty"`
+	Outputs      map[string]string    `json:"outputs,omitempty"`
+	Artifacts    []string             `json:"artifacts,omitempty"`
 	Errors       []dagerrors.RunError `json:"errors,omitempty"`
 }
 
 // StepResult describes the outcome of a single step.
 type StepResult struct {
-	ID          string `json:"id"`
-	Status      string `json:"status"` // success, failed, skipped, blocked, dry-run
-	ExitCode    int    `json:"exit_code,omitempty"`
-	StdoutRef   string `json:"stdout_ref,omitempty"`
-	StderrRef   string `json:"stderr_ref,omitempty"`
-	Duration    string `json:"duration,omitempty"`
-	Description string `json:"description,omitempty"` // for explain/dry-run
-	Command     string `json:"command,omitempty"`      // resolved command for explain
-	DryRunInfo  string `json:"dry_run_info,omitempty"` // for dry-run of actions
+	ID              string            `json:"id"`
+	Status          string            `json:"status"` // success, failed, skipped, skipped_condition, blocked, dry-run
+	ExitCode        int               `json:"exit_code,omitempty"`
+	StdoutRef       string            `json:"stdout_ref,omitempty"`
+	StderrRef       string            `json:"stderr_ref,omitempty"`
+	OutputTruncated bool              `json:"output_truncated,omitempty"` // stdout_ref and stderr_ref keep only the end of long output
+	Duration        string            `json:"duration,omitempty"`
+	Description     string            `json:"description,omitempty"`      // for explain/dry-run
+	Command         string            `json:"command,omitempty"`          // resolved command for explain
+	Argv            []string          `json:"argv,omitempty"`             // resolved program and arguments of an exec step
+	DryRunInfo      string            `json:"dry_run_info,omitempty"`     // for dry-run of actions
+	Condition       string            `json:"condition,omitempty"`        // the step's if: expression
+	ConditionResult string            `json:"condition_result,omitempty"` // true, false or unknown
+	ConditionNote   string            `json:"condition_note,omitempty"`   // evaluated form, or why it is unknown
+	StartedAt       time.Time         `json:"started_at,omitzero"`
+	EndedAt         time.Time         `json:"ended_at,omitzero"`
+	Attempts        []Attempt         `json:"attempts,omitempty"` // every try of a step with retry:
+	Outputs         map[string]string `json:"outputs,omitempty"`  // values of the step's outputs:
+	Resumed         bool              `json:"resumed,omitempty"`  // carried over from the run being resumed
+	Redacted        bool              `json:"redacted,omitempty"` // some outputs had secrets masked
+	Children        []StepResult      `json:"children,omitempty"` // one per item of a foreach or matrix step
+	Plan            *Result           `json:"plan,omitempty"`     // the run of the plan a uses: step calls
+
+	err      error // underlying failure, used to classify Result.Errors
+	streamed bool  // output was written to the artifact store as it was printed
+}
+
+// Attempt records one try of a step that has a retry policy.
+type Attempt struct {
+	Number    int       `json:"number"`
+	Status    string    `json:"status"` // success, failed
+	ExitCode  int       `json:"exit_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Retryable bool      `json:"retryable,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
 }
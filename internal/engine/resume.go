@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stevehiehn/declaragent/internal/artifact"
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+	"github.com/stevehiehn/declaragent/internal/plan"
+)
+
+// RunMeta describes how a run was started. It is stored as run.json next to
+// result.json so the run can be resumed.
+type RunMeta struct {
+	RunID     string            `json:"run_id"`
+	PlanName  string            `json:"plan_name"`
+	PlanPath  string            `json:"plan_path,omitempty"`
+	PlanHash  string            `json:"plan_hash,omitempty"`
+	Inputs    map[string]string `json:"inputs,omitempty"`
+	StartedAt time.Time         `json:"started_at"`
+}
+
+// newRunMeta describes the run started by rc. Secret inputs are left out;
+// they must be given again to resume the run.
+func newRunMeta(p *plan.Plan, rc *RunContext) RunMeta {
+	inputs := map[string]string{}
+	for name, value := range rc.Inputs {
+		if !p.Inputs[name].Secret {
+			inputs[name] = value
+		}
+	}
+	return RunMeta{
+		RunID:     rc.RunID,
+		PlanName:  p.Name,
+		PlanPath:  p.Path,
+		PlanHash:  p.Hash,
+		Inputs:    inputs,
+		StartedAt: rc.StartedAt,
+	}
+}
+
+// PreviousRun is a run loaded back from its artifact directory.
+type PreviousRun struct {
+	Meta   RunMeta
+	Result Result
+}
+
+// LoadRun reads the metadata and result of run runID under root, the
+// directory holding the runs, e.g. artifact.DefaultRoot of the working
+// directory.
+func LoadRun(root, runID string) (*PreviousRun, error) {
+	store, err := artifact.Open(runID, root)
+	if err != nil {
+		return nil, &dagerrors.RunError{
+			Type:    dagerrors.PreconditionFailed,
+			Message: err.Error(),
+			Hint:    "Run IDs are listed under " + root,
+		}
+	}
+	var prev PreviousRun
+	if err := store.ReadMeta(&prev.Meta); err != nil {
+		return nil, &dagerrors.RunError{
+			Type:    dagerrors.PreconditionFailed,
+			Message: fmt.Sprintf("run %q cannot be resumed: %v", runID, err),
+		}
+	}
+	if err := store.ReadResult(&prev.Result); err != nil {
+		return nil, &dagerrors.RunError{
+			Type:    dagerrors.PreconditionFailed,
+			Message: fmt.Sprintf("run %q has no result to resume from: %v", runID, err),
+		}
+	}
+	return &prev, nil
+}
+
+// CheckPlan reports whether p is the plan the run was started with.
+func (r *PreviousRun) CheckPlan(p *plan.Plan) error {
+	if r.Meta.PlanHash == "" || p.Hash != r.Meta.PlanHash {
+		return &dagerrors.RunError{
+			Type:    dagerrors.PreconditionFailed,
+			Message: fmt.Sprintf("plan file %s has changed since run %q", r.Meta.PlanPath, r.Meta.RunID),
+			Hint:    "Start a new run with declaragent run, or restore the original plan",
+		}
+	}
+	return nil
+}
+
+// Resume continues a failed run. Steps that succeeded or were skipped by
+// their condition keep their results and outputs; every other step runs
+// again, writing into the original run's artifact directory. Steps whose
+// outputs held secrets were stored masked, and steps whose rollback ran
+// were undone, so they run again too, as do the steps needing any step that
+// runs again.
+func Resume(ctx context.Context, p *plan.Plan, rc *RunContext, prev *PreviousRun) (*Result, error) {
+	if err := prev.CheckPlan(p); err != nil {
+		return nil, err
+	}
+	if prev.Result.Success {
+		return nil, &dagerrors.RunError{
+			Type:    dagerrors.PreconditionFailed,
+			Message: fmt.Sprintf("run %q already succeeded", prev.Meta.RunID),
+		}
+	}
+
+	rc.RunID = prev.Meta.RunID
+	rc.StartedAt = prev.Meta.StartedAt
+	rolledBack := map[string]bool{}
+	for _, sr := range prev.Result.Rollback {
+		// A failed rollback may have undone part of the step
+		if sr.Status == "success" || sr.Status == "failed" {
+			rolledBack[strings.TrimSuffix(sr.ID, ".rollback")] = true
+		}
+	}
+	rc.prior = map[string]StepResult{}
+	for _, sr := range prev.Result.Steps {
+		if (sr.Status == "success" || sr.Status == "skipped_condition") && !sr.Redacted && !rolledBack[sr.ID] {
+			rc.prior[sr.ID] = sr
+		}
+	}
+	// A step needing one that runs again runs again too, with its new outputs
+	deps := p.Dependencies()
+	for changed := true; changed; {
+		changed = false
+		for id := range rc.prior {
+			for _, d := range deps[id] {
+				if _, ok := rc.prior[d]; !ok {
+					delete(rc.prior, id)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return ExecuteContext(ctx, p, rc, ModeRun)
+}
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"time"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+	"github.com/stevehiehn/declaragent/internal/plan"
+)
+
+// attempt is the outcome of one try of a step in run mode.
+type attempt struct {
+	stdout   string
+	stderr   string
+	exitCode int
+	err      error // failure reported by an action or the http client
+
+	truncated []string // stdout or stderr, if they lost their beginning to runner.MaxOutput
+	streamed  bool     // the output went to the artifact store as it was printed
+}
+
+func (a attempt) failed() bool {
+	return a.exitCode != 0 || a.err != nil
+}
+
+// runAttempts calls try once, or repeatedly as allowed by step.Retry, until
+// it succeeds or fails in a way that should not be retried. Each try gets its
+// own step.Timeout; no further tries are made once ctx is done. With a retry
+// policy every try is recorded in sr.Attempts and its output is kept in the
+// artifact store. It returns the last attempt.
+func runAttempts(ctx context.Context, step plan.Step, rc *RunContext, sr *StepResult, try func(context.Context) attempt) attempt {
+	sr.StartedAt = time.Now()
+	defer func() {
+		sr.EndedAt = time.Now()
+		sr.Duration = sr.EndedAt.Sub(sr.StartedAt).Round(time.Millisecond).String()
+	}()
+
+	policy := step.Retry
+	for n := 1; ; n++ {
+		start := time.Now()
+		a := tryWithTimeout(ctx, step, try)
+		if policy == nil {
+			return a
+		}
+
+		rec := Attempt{
+			Number:    n,
+			Status:    "success",
+			ExitCode:  a.exitCode,
+			StartedAt: start,
+			Duration:  time.Since(start).Round(time.Millisecond).String(),
+		}
+		retryable := false
+		if a.failed() {
+			retryable = shouldRetry(step, a)
+			rec.Status = "failed"
+			rec.Retryable = retryable
+			if a.err != nil {
+				rec.Error = a.err.Error()
+			}
+		}
+		sr.Attempts = append(sr.Attempts, rec)
+		if rc.store != nil && !a.streamed {
+			_ = rc.store.WriteAttemptOutput(step.ID, n, rc.Redact(a.stdout), rc.Redact(a.stderr))
+		}
+
+		if !retryable || n >= policy.MaxAttempts || ctx.Err() != nil {
+			return a
+		}
+		if !sleep(ctx, jitter(policy.Delay(n), policy.Jitter)) {
+			return a
+		}
+	}
+}
+
+// tryWithTimeout runs one try under step.Timeout. A try that fails because
+// its context ended is reported as a timeout or cancellation rather than by
+// whatever error the interrupted command or request produced.
+func tryWithTimeout(ctx context.Context, step plan.Step, try func(context.Context) attempt) attempt {
+	tctx := ctx
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+
+	a := try(tctx)
+	if !a.failed() || tctx.Err() == nil {
+		return a
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		a.err = &dagerrors.RunError{
+			Type:    dagerrors.Cancelled,
+			Message: "run was cancelled",
+			Hint:    "Resume the run to continue from this step",
+		}
+	case ctx.Err() != nil:
+		a.err = &dagerrors.RunError{
+			Type:    dagerrors.Timeout,
+			Message: "run deadline exceeded",
+			Hint:    "Raise the plan timeout: or shorten the steps before this one",
+		}
+	default:
+		a.err = &dagerrors.RunError{
+			Type:      dagerrors.Timeout,
+			Message:   fmt.Sprintf("timed out after %s", step.Timeout),
+			Retryable: true,
+			Hint:      "Raise the step timeout: or add a retry: policy",
+		}
+	}
+	return a
+}
+
+// sleep waits for d, returning false if ctx ends first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shouldRetry reports whether a failed attempt is worth another try under
+// step.Retry. Errors marked retryable always are.
+func shouldRetry(step plan.Step, a attempt) bool {
+	var runErr *dagerrors.RunError
+	if errors.As(a.err, &runErr) {
+		if runErr.Retryable {
+			return true
+		}
+		if code, err := strconv.Atoi(runErr.Code); err == nil && slices.Contains(step.Retry.OnHTTPStatus, code) {
+			return true
+		}
+	}
+	if step.SendsHTTP() {
+		return false
+	}
+	if (step.Run != "" || len(step.Exec) > 0) && len(step.Retry.OnExitCodes) > 0 {
+		return slices.Contains(step.Retry.OnExitCodes, a.exitCode)
+	}
+	return true
+}
+
+// jitter randomises d by up to ±fraction of its length.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration(float64(d)*fraction*(2*rand.Float64()-1))
+}
+
+// stepError describes a failed step for Result.Errors, keeping the type,
+// code and retryability of the underlying error when there is one.
+func stepError(sr *StepResult) dagerrors.RunError {
+	e := dagerrors.RunError{
+		Type:    dagerrors.StepFailed,
+		StepID:  sr.ID,
+		Message: fmt.Sprintf("step %q failed with exit code %d", sr.ID, sr.ExitCode),
+	}
+	if sr.StderrRef != "" {
+		e.Hint = fmt.Sprintf("Check %s for details", sr.StderrRef)
+	}
+	var cause *dagerrors.RunError
+	if errors.As(sr.err, &cause) {
+		e.Type = cause.Type
+		e.Code = cause.Code
+		e.Retryable = cause.Retryable
+		e.Message = fmt.Sprintf("step %q failed: %s", sr.ID, cause.Message)
+		if cause.Hint != "" {
+			e.Hint = cause.Hint
+		}
+	}
+	if n := len(sr.Attempts); n > 1 {
+		e.Message += fmt.Sprintf(" (after %d attempts)", n)
+	}
+	return e
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/internal/template"
+)
+
+// executeUsesStep runs the plan a uses: step calls, in the same mode, with
+// the step's with: values as its inputs. The plan's outputs become the
+// step's outputs and its results are kept in sr.Plan; in run mode its
+// artifacts go under plans/<step id> of the run's directory. Explain and
+// dry-run show the called plan's steps but stand in placeholders for its
+// outputs.
+func executeUsesStep(ctx context.Context, step plan.Step, rc *RunContext, mode Mode, sr *StepResult) (*StepResult, error) {
+	callee, err := plan.LoadUses(rc.plan, step.Uses)
+	if err != nil {
+		return nil, fmt.Errorf("loading plan for step %q: %w", step.ID, err)
+	}
+	inputs := map[string]string{}
+	for k, v := range step.Params {
+		resolved, err := template.Resolve(v, rc.TmplCtx)
+		if err != nil {
+			return nil, fmt.Errorf("resolving input %q for step %q: %w", k, step.ID, err)
+		}
+		inputs[k] = resolved
+	}
+	for name, inp := range callee.Inputs {
+		if _, ok := inputs[name]; !ok && inp.Default != "" {
+			inputs[name] = inp.Default
+		}
+	}
+	sr.Command = fmt.Sprintf("uses: %s (%s)", step.Uses, callee.Name)
+
+	if mode != ModeExplain && step.Destructive && !rc.approved(ctx, step, mode, sr.Command) {
+		sr.Status = "blocked"
+		registerPlaceholderOutputs(step, rc)
+		return sr, nil
+	}
+
+	if mode != ModeRun {
+		result, err := runSubPlan(ctx, step, callee, inputs, rc, mode)
+		if err != nil {
+			return nil, err
+		}
+		sr.Plan = result
+		sr.Status = "explain"
+		if mode == ModeDryRun {
+			sr.Status = "dry-run"
+		}
+		if !result.Success {
+			sr.Status = runStatus(result)
+		}
+		registerPlaceholderOutputs(step, rc)
+		return sr, nil
+	}
+
+	// ModeRun
+	if err := plan.ValidateWith(callee, inputs, rc.Actions); err != nil {
+		sr.Status = "failed"
+		sr.err = err
+		return sr, nil
+	}
+	var (
+		result  *Result
+		execErr error
+	)
+	a := runAttempts(ctx, step, rc, sr, func(ctx context.Context) attempt {
+		result, execErr = runSubPlan(ctx, step, callee, inputs, rc, mode)
+		if execErr != nil || result.Success || runStatus(result) == "blocked" || len(result.Errors) == 0 {
+			return attempt{}
+		}
+		e := result.Errors[0]
+		return attempt{err: &e}
+	})
+	if execErr != nil {
+		return nil, execErr
+	}
+	sr.Plan = result
+	for _, c := range result.Steps {
+		if c.ID == result.FailedStepID {
+			sr.ExitCode = c.ExitCode
+		}
+	}
+
+	switch {
+	case a.failed():
+		sr.Status = "failed"
+		sr.err = a.err
+	case !result.Success:
+		sr.Status = "blocked"
+	default:
+		sr.Status = "success"
+	}
+	// A failed plan still resolves its outputs, for finally steps and plan
+	// outputs of the caller
+	for _, name := range slices.Sorted(maps.Keys(result.Outputs)) {
+		value := result.Outputs[name]
+		setOutput(rc, sr, name, value)
+		// The nested run has already masked its secrets, so mark the step
+		// for resume to run again
+		if strings.Contains(value, Redacted) {
+			sr.Redacted = true
+		}
+	}
+	return sr, nil
+}
+
+// runSubPlan executes callee for step as a nested run sharing the run ID,
+// working directory, approval, secrets and observers of rc. Secrets the
+// nested run learns are masked in the caller's results too.
+func runSubPlan(ctx context.Context, step plan.Step, callee *plan.Plan, inputs map[string]string, rc *RunContext, mode Mode) (*Result, error) {
+	child := NewRunContext(rc.WorkDir, inputs, rc.Approve)
+	child.RunID = rc.RunID
+	child.StartedAt = rc.StartedAt
+	child.Approver = rc.Approver
+	child.MaxParallel = rc.MaxParallel
+	child.Actions = rc.Actions
+	if root := rc.root(); len(root.Observers) > 0 {
+		child.Observers = []Observer{func(e Event) { root.forward(step.ID, e, mode) }}
+	}
+	if mode == ModeRun && rc.store != nil {
+		store, err := rc.store.Nested(step.ID)
+		if err != nil {
+			return nil, err
+		}
+		child.store = store
+	}
+	for _, s := range rc.secretValues() {
+		child.AddSecret(s)
+	}
+	result, err := ExecuteContext(ctx, callee, child, mode)
+	for _, s := range child.secretValues() {
+		rc.AddSecret(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running %s for step %q: %w", step.Uses, step.ID, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevehiehn/declaragent/internal/plan"
+)
+
+// writeSubPlan writes a plan called by the tests' uses: steps into dir.
+func writeSubPlan(t *testing.T, dir string) {
+	t.Helper()
+	data := `
+name: greet
+inputs:
+  who: {required: true}
+  code: {type: integer, default: "0"}
+  token: {secret: true, default: hunter2}
+steps:
+  - id: hello
+    run: echo "hello ${{ inputs.who }} ${{ inputs.token }}"; exit ${{ inputs.code }}
+    outputs:
+      line: stdout
+outputs:
+  message: ${{ steps.hello.outputs.line }}
+`
+	if err := os.MkdirAll(filepath.Join(dir, "common"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "common", "greet.yaml"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsesRunsSubPlan(t *testing.T) {
+	dir := t.TempDir()
+	writeSubPlan(t, dir)
+	p := &plan.Plan{
+		Name: "main",
+		Path: filepath.Join(dir, "main.yaml"),
+		Steps: []plan.Step{
+			{ID: "greet", Uses: "common/greet.yaml", Params: map[string]string{"who": "${{ inputs.name }}"}},
+			{ID: "show", Run: "echo got ${{ steps.greet.outputs.message }}", Outputs: map[string]string{"out": "stdout"}},
+		},
+	}
+	ctx := makeCtx(t, map[string]string{"name": "ada"}, false)
+	result, err := Execute(p, ctx, ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got %+v", result.Errors)
+	}
+
+	greet := result.Steps[0]
+	if greet.Outputs["message"] != "hello ada ***" || !greet.Redacted {
+		t.Errorf("expected masked output marked redacted, got %+v", greet)
+	}
+	if greet.Plan == nil || len(greet.Plan.Steps) != 1 || greet.Plan.Steps[0].ID != "hello" {
+		t.Fatalf("expected nested result, got %+v", greet.Plan)
+	}
+	if got := result.Steps[1].Outputs["out"]; got != "got hello ada ***" {
+		t.Errorf("unexpected output %q", got)
+	}
+
+	nested := filepath.Join(result.Artifacts[0], "plans", "greet")
+	if greet.Plan.Artifacts[0] != nested {
+		t.Errorf("expected nested artifacts in %s, got %v", nested, greet.Plan.Artifacts)
+	}
+	stdout, err := os.ReadFile(filepath.Join(nested, "steps", "hello.stdout"))
+	if err != nil {
+		t.Fatalf("expected nested step artifact: %v", err)
+	}
+	if strings.Contains(string(stdout), "hunter2") {
+		t.Errorf("secret input leaked into nested artifact: %q", stdout)
+	}
+}
+
+func TestUsesStreamsNestedSteps(t *testing.T) {
+	dir := t.TempDir()
+	writeSubPlan(t, dir)
+	p := &plan.Plan{
+		Name:  "main",
+		Path:  filepath.Join(dir, "main.yaml"),
+		Steps: []plan.Step{{ID: "greet", Uses: "common/greet.yaml", Params: map[string]string{"who": "ada"}}},
+	}
+	ctx := makeCtx(t, nil, false)
+	var events []string
+	ctx.Observers = []Observer{func(e Event) {
+		event := string(e.Type) + " " + e.Plan + " " + e.StepID
+		switch {
+		case e.Type == EventStepOutput:
+			event += " " + e.Line
+		case e.Step != nil:
+			event += " " + e.Step.ID
+		}
+		events = append(events, event)
+	}}
+	if _, err := Execute(p, ctx, ModeRun); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"run_started main ",
+		"step_started main greet",
+		"step_started main greet/hello",
+		"step_output main greet/hello hello ada ***",
+		"step_finished main greet/hello greet/hello",
+		"step_finished main greet greet",
+		"run_finished main ",
+	}
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected events %q", events)
+	}
+}
+
+func TestUsesFailureFailsStep(t *testing.T) {
+	dir := t.TempDir()
+	writeSubPlan(t, dir)
+	p := &plan.Plan{
+		Name: "main",
+		Path: filepath.Join(dir, "main.yaml"),
+		Steps: []plan.Step{
+			{ID: "greet", Uses: "common/greet.yaml", Params: map[string]string{"who": "bob", "code": "3"}},
+			{ID: "after", Run: "echo never"},
+		},
+		Finally: []plan.Step{
+			{ID: "report", Run: "echo ${{ steps.greet.status }} ${{ steps.greet.outputs.message }}", Outputs: map[string]string{"out": "stdout"}},
+		},
+	}
+	result, err := Execute(p, makeCtx(t, nil, false), ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.FailedStepID != "greet" {
+		t.Fatalf("expected greet to fail the run, got %+v", result)
+	}
+	greet := result.Steps[0]
+	if greet.Status != "failed" || greet.ExitCode != 3 {
+		t.Errorf("expected failed step with exit code 3, got %+v", greet)
+	}
+	if msg := result.Errors[0].Message; !strings.Contains(msg, `step "greet" failed: step "hello" failed with exit code 3`) {
+		t.Errorf("unexpected error message %q", msg)
+	}
+	if result.Steps[1].Status != "skipped" {
+		t.Errorf("expected later step skipped, got %s", result.Steps[1].Status)
+	}
+	if got := result.Finally[0].Outputs["out"]; got != "failed hello bob ***" {
+		t.Errorf("unexpected finally output %q", got)
+	}
+
+	// Values the called plan rejects fail the step before it runs
+	p.Steps[0].Params["code"] = "three"
+	result, err = Execute(p, makeCtx(t, nil, false), ModeRun)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg := result.Errors[0].Message; !strings.Contains(msg, `invalid value for input "code"`) {
+		t.Errorf("unexpected error message %q", msg)
+	}
+}
+
+func TestUsesExplainShowsNestedSteps(t *testing.T) {
+	dir := t.TempDir()
+	writeSubPlan(t, dir)
+	p := &plan.Plan{
+		Name: "main",
+		Path: filepath.Join(dir, "main.yaml"),
+		Steps: []plan.Step{
+			{ID: "greet", Uses: "common/greet.yaml", Params: map[string]string{"who": "ada"}},
+			{ID: "show", Run: "echo ${{ steps.greet.outputs.message }}"},
+		},
+	}
+	result, err := Execute(p, makeCtx(t, nil, false), ModeExplain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	greet := result.Steps[0]
+	if greet.Status != "explain" || greet.Plan == nil {
+		t.Fatalf("expected explained nested plan, got %+v", greet)
+	}
+	if got := greet.Plan.Steps[0].Command; got != `echo "hello ada ***"; exit 0` {
+		t.Errorf("unexpected nested command %q", got)
+	}
+	if got := result.Steps[1].Command; got != "echo '<greet.message>'" {
+		t.Errorf("unexpected command %q", got)
+	}
+}
@@ -1,6 +1,10 @@
 package errors
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // Error type constants
 const (
@@ -23,13 +27,85 @@ type RunError struct {
 	StepID    string `json:"step_id,omitempty"`
 	Retryable bool   `json:"retryable"`
 	Hint      string `json:"hint,omitempty"`
+	File      string `json:"file,omitempty"`   // plan file the problem is in
+	Line      int    `json:"line,omitempty"`   // 1-based; 0 when unknown
+	Column    int    `json:"column,omitempty"` // 1-based; 0 when unknown
 }
 
 func (e *RunError) Error() string {
+	msg := fmt.Sprintf("[%s] %s", e.Type, e.Message)
 	if e.StepID != "" {
-		return fmt.Sprintf("[%s] step %s: %s", e.Type, e.StepID, e.Message)
+		msg = fmt.Sprintf("[%s] step %s: %s", e.Type, e.StepID, e.Message)
+	}
+	if pos := e.Position(); pos != "" {
+		return pos + ": " + msg
+	}
+	return msg
+}
+
+// Position returns where the problem is, as file:line:column, leaving out
+// the parts that are unknown.
+func (e *RunError) Position() string {
+	pos := e.File
+	if e.Line == 0 {
+		return pos
+	}
+	if pos == "" {
+		pos = "line "
+	} else {
+		pos += ":"
+	}
+	pos += fmt.Sprint(e.Line)
+	if e.Column > 0 {
+		pos += fmt.Sprintf(":%d", e.Column)
+	}
+	return pos
+}
+
+// ErrorList holds several problems reported at once, such as everything
+// wrong with a plan.
+type ErrorList []*RunError
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (l ErrorList) Unwrap() []error {
+	errs := make([]error, len(l))
+	for i, e := range l {
+		errs[i] = e
+	}
+	return errs
+}
+
+// Join returns nil for no problems, the problem itself for one, and an
+// ErrorList for more.
+func Join(errs []*RunError) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return ErrorList(errs)
+}
+
+// All returns the problems in err: those of an ErrorList, or err itself. It
+// returns nil if err holds no RunError.
+func All(err error) []*RunError {
+	var list ErrorList
+	if errors.As(err, &list) {
+		return list
+	}
+	var re *RunError
+	if errors.As(err, &re) {
+		return []*RunError{re}
 	}
-	return fmt.Sprintf("[%s] %s", e.Type, e.Message)
+	return nil
 }
 
 func NewValidationError(msg, hint string) *RunError {
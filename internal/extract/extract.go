@@ -0,0 +1,247 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pipeSepRe finds the | that starts the next pipe. Requiring a pipe keyword
+// after it lets regex patterns use | for alternation.
+var pipeSepRe = regexp.MustCompile(`\|\s*(regex:|json:|lines\[)`)
+
+var linesRe = regexp.MustCompile(`^lines\[(-?\d+)\]$`)
+
+// Spec is a parsed output source such as
+//
+//	stdout
+//	stdout | regex:(v\d+\.\d+)
+//	stdout | json:$.items[0].name
+//	stderr | lines[-1]
+//
+// It names a raw value of the step (stdout, stderr, exit_code or an action
+// output) followed by any number of pipes, applied left to right.
+type Spec struct {
+	Source string // raw value the pipes start from
+	pipes  []pipe
+}
+
+type pipe interface {
+	apply(value string) (string, error)
+}
+
+// Parse parses an output source.
+func Parse(s string) (*Spec, error) {
+	locs := pipeSepRe.FindAllStringIndex(s, -1)
+	end := len(s)
+	if len(locs) > 0 {
+		end = locs[0][0]
+	}
+	spec := &Spec{Source: strings.TrimSpace(s[:end])}
+	if spec.Source == "" {
+		return nil, fmt.Errorf("missing source before |")
+	}
+	if strings.Contains(spec.Source, "|") {
+		return nil, fmt.Errorf("unknown pipe in %q (use regex:, json: or lines[N])", s)
+	}
+	for i, loc := range locs {
+		end := len(s)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		p, err := parsePipe(strings.TrimSpace(s[loc[0]+1 : end]))
+		if err != nil {
+			return nil, err
+		}
+		spec.pipes = append(spec.pipes, p)
+	}
+	return spec, nil
+}
+
+func parsePipe(s string) (pipe, error) {
+	switch {
+	case strings.HasPrefix(s, "regex:"):
+		re, err := regexp.Compile(strings.TrimPrefix(s, "regex:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return regexPipe{re: re}, nil
+	case strings.HasPrefix(s, "json:"):
+		path, err := parseJSONPath(strings.TrimPrefix(s, "json:"))
+		if err != nil {
+			return nil, err
+		}
+		return path, nil
+	default:
+		m := linesRe.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("invalid pipe %q (expected lines[N])", s)
+		}
+		n, _ := strconv.Atoi(m[1])
+		return linesPipe{index: n}, nil
+	}
+}
+
+// Apply runs the pipes of s over value, the raw value of s.Source.
+func (s *Spec) Apply(value string) (string, error) {
+	for _, p := range s.pipes {
+		var err error
+		value, err = p.apply(value)
+		if err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+// regexPipe yields the first capture group of the first match, or the whole
+// match when the pattern has no groups.
+type regexPipe struct {
+	re *regexp.Regexp
+}
+
+func (p regexPipe) apply(value string) (string, error) {
+	m := p.re.FindStringSubmatch(value)
+	if m == nil {
+		return "", fmt.Errorf("regex %q did not match", p.re)
+	}
+	if len(m) > 1 {
+		return m[1], nil
+	}
+	return m[0], nil
+}
+
+// linesPipe yields one line; negative indexes count from the end.
+type linesPipe struct {
+	index int
+}
+
+func (p linesPipe) apply(value string) (string, error) {
+	lines := strings.Split(strings.TrimRight(value, "\r\n"), "\n")
+	i := p.index
+	if i < 0 {
+		i += len(lines)
+	}
+	if i < 0 || i >= len(lines) {
+		return "", fmt.Errorf("lines[%d] out of range (%d lines)", p.index, len(lines))
+	}
+	return strings.TrimRight(lines[i], "\r"), nil
+}
+
+// jsonPath is a JSONPath subset: $ followed by .key, ['key'] and [N]
+// selectors, where a negative N counts from the end of an array.
+type jsonPath struct {
+	expr     string
+	segments []any // string for object keys, int for array indexes
+}
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	p := jsonPath{expr: expr}
+	if !strings.HasPrefix(expr, "$") {
+		return p, fmt.Errorf("json path %q must start with $", expr)
+	}
+	rest := expr[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			n := strings.IndexAny(rest[1:], ".[")
+			if n < 0 {
+				n = len(rest) - 1
+			}
+			key := rest[1 : n+1]
+			if key == "" {
+				return p, fmt.Errorf("json path %q has an empty key", expr)
+			}
+			p.segments = append(p.segments, key)
+			rest = rest[n+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return p, fmt.Errorf("json path %q has an unclosed [", expr)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				p.segments = append(p.segments, inner[1:len(inner)-1])
+			} else {
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return p, fmt.Errorf("json path %q: invalid index %q", expr, inner)
+				}
+				p.segments = append(p.segments, n)
+			}
+			rest = rest[end+1:]
+		default:
+			return p, fmt.Errorf("json path %q: unexpected %q", expr, rest[0])
+		}
+	}
+	return p, nil
+}
+
+func (p jsonPath) apply(value string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", fmt.Errorf("json %s: value is not JSON: %w", p.expr, err)
+	}
+	for _, seg := range p.segments {
+		switch seg := seg.(type) {
+		case string:
+			obj, ok := v.(map[string]any)
+			if !ok {
+				return "", fmt.Errorf("json %s: cannot select %q from %s", p.expr, seg, jsonKind(v))
+			}
+			if v, ok = obj[seg]; !ok {
+				return "", fmt.Errorf("json %s: no key %q", p.expr, seg)
+			}
+		case int:
+			arr, ok := v.([]any)
+			if !ok {
+				return "", fmt.Errorf("json %s: cannot index %s", p.expr, jsonKind(v))
+			}
+			i := seg
+			if i < 0 {
+				i += len(arr)
+			}
+			if i < 0 || i >= len(arr) {
+				return "", fmt.Errorf("json %s: index %d out of range (%d items)", p.expr, seg, len(arr))
+			}
+			v = arr[i]
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return "", err
+		}
+		return strings.TrimRight(buf.String(), "\n"), nil
+	}
+}
+
+func jsonKind(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case string:
+		return "a string"
+	case nil:
+		return "null"
+	default:
+		return "a scalar"
+	}
+}
@@ -0,0 +1,100 @@
+package extract
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSource(t *testing.T) {
+	spec, err := Parse("stdout")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spec.Source != "stdout" || len(spec.pipes) != 0 {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+	v, _ := spec.Apply("raw")
+	if v != "raw" {
+		t.Errorf("expected raw value, got %q", v)
+	}
+}
+
+func TestApplyPipes(t *testing.T) {
+	doc := `{"items":[{"name":"api","replicas":3,"ready":true,"tags":["a","b"]},{"name":"web","owner":null}],"odd key":"x"}`
+	tests := []struct {
+		source string
+		value  string
+		want   string
+	}{
+		{"stdout | regex:(v\\d+\\.\\d+)", "release v1.24 ready", "v1.24"},
+		{"stdout | regex:v\\d+", "release v1.24 ready", "v1"},
+		{"stdout | regex:(alpha|beta)-\\d", "channel beta-2", "beta"},
+		{"stdout | json:$.items[0].name", doc, "api"},
+		{"stdout | json:$.items[0].replicas", doc, "3"},
+		{"stdout | json:$.items[0].ready", doc, "true"},
+		{"stdout | json:$.items[0].tags", doc, `["a","b"]`},
+		{"stdout | json:$.items[-1].name", doc, "web"},
+		{"stdout | json:$.items[1].owner", doc, ""},
+		{"stdout | json:$['odd key']", doc, "x"},
+		{"stdout | lines[0]", "first\nsecond\nthird\n", "first"},
+		{"stderr | lines[-1]", "first\nsecond\nthird\n", "third"},
+		{"stdout | json:$.items[1] | json:$.name", doc, "web"},
+		{"stdout | lines[1] | regex:=(\\w+)", "a=1\nb=two\n", "two"},
+	}
+	for _, tt := range tests {
+		spec, err := Parse(tt.source)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", tt.source, err)
+			continue
+		}
+		got, err := spec.Apply(tt.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.source, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.source, tt.want, got)
+		}
+	}
+}
+
+func TestParseRejectsBadSources(t *testing.T) {
+	for _, source := range []string{
+		"",
+		"| lines[0]",
+		"stdout | grep foo",
+		"stdout | regex:(",
+		"stdout | json:items",
+		"stdout | json:$.items[x]",
+		"stdout | lines[first]",
+	} {
+		if _, err := Parse(source); err == nil {
+			t.Errorf("%q: expected parse error", source)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		value  string
+		want   string
+	}{
+		{"stdout | regex:v\\d+", "no version", "did not match"},
+		{"stdout | json:$.a", "not json", "not JSON"},
+		{"stdout | json:$.a", `{"b":1}`, `no key "a"`},
+		{"stdout | json:$[3]", `[1,2]`, "out of range"},
+		{"stdout | json:$.a.b", `{"a":[1]}`, "cannot select"},
+		{"stdout | lines[5]", "one\ntwo", "out of range"},
+	}
+	for _, tt := range tests {
+		spec, err := Parse(tt.source)
+		if err != nil {
+			t.Fatalf("%s: unexpected parse error: %v", tt.source, err)
+		}
+		_, err = spec.Apply(tt.value)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.source, tt.want, err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package mcp
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,6 +12,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 // helper to call dispatch and return response
@@ -30,7 +33,7 @@ func callDispatch(t *testing.T, method string, params any, workDir, plansDir str
 		Method:  method,
 		Params:  rawParams,
 	}
-	resp := dispatch(req, workDir, plansDir)
+	resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir(workDir)), plansDir, nil)
 	resp.JSONRPC = "2.0"
 	resp.ID = req.ID
 	return resp
@@ -173,6 +176,9 @@ steps:
 	if !strings.Contains(text, "multiple") {
 		t.Fatalf("expected validation error about multiple, got %q", text)
 	}
+	if resp.Result.(map[string]any)["isError"] != true {
+		t.Errorf("expected an error result, got %#v", resp.Result)
+	}
 }
 
 func TestLLMCallsPlanExplainE2E(t *testing.T) {
@@ -233,11 +239,13 @@ func TestLLMCallsPlanSchemaE2E(t *testing.T) {
 		"arguments": map[string]any{},
 	}, "", "")
 	text := responseText(t, resp)
-	if !strings.Contains(text, "name: string") {
-		t.Fatalf("expected schema content, got %q", text)
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(text), &schema); err != nil {
+		t.Fatalf("expected a JSON Schema, got %q", text)
 	}
-	if !strings.Contains(text, "steps:") {
-		t.Fatalf("expected 'steps:' in schema, got %q", text)
+	props, _ := schema["properties"].(map[string]any)
+	if props["steps"] == nil || props["name"] == nil {
+		t.Fatalf("expected name and steps in schema, got %q", text)
 	}
 }
 
@@ -251,8 +259,8 @@ func TestMCPInitializeProtocolE2E(t *testing.T) {
 		t.Fatalf("unexpected error: %s", resp.Error.Message)
 	}
 	m := resp.Result.(map[string]any)
-	if m["protocolVersion"] != "2024-11-05" {
-		t.Fatalf("expected protocol version 2024-11-05, got %v", m["protocolVersion"])
+	if m["protocolVersion"] != "2025-06-18" {
+		t.Fatalf("expected protocol version 2025-06-18, got %v", m["protocolVersion"])
 	}
 	caps, ok := m["capabilities"].(map[string]any)
 	if !ok {
@@ -411,6 +419,7 @@ func TestMCPToolsListIncludesAllBuiltinsE2E(t *testing.T) {
 		"plan.explain":  true,
 		"plan.dry_run":  true,
 		"plan.run":      true,
+		"plan.resume":   true,
 		"plan.schema":   true,
 	}
 	for name := range builtinNames {
@@ -425,8 +434,8 @@ func TestMCPToolsListIncludesAllBuiltinsE2E(t *testing.T) {
 			t.Errorf("builtin tool %q not found in tools/list", name)
 		}
 	}
-	if len(tools) != 5 {
-		t.Errorf("expected exactly 5 builtin tools, got %d", len(tools))
+	if len(tools) != 6 {
+		t.Errorf("expected exactly 6 builtin tools, got %d", len(tools))
 	}
 }
 
@@ -460,9 +469,9 @@ steps:
 	if !names["beta"] {
 		t.Error("expected 'beta' tool")
 	}
-	// 5 builtins + 2 plan tools
-	if len(tools) != 7 {
-		t.Errorf("expected 7 tools, got %d", len(tools))
+	// 6 builtins + 2 plan tools
+	if len(tools) != 8 {
+		t.Errorf("expected 8 tools, got %d", len(tools))
 	}
 }
 
@@ -515,7 +524,7 @@ func TestMCPUnknownToolReturnsErrorE2E(t *testing.T) {
 
 func TestMCPServerStartsAndListensE2E(t *testing.T) {
 	s := &SSEServer{
-		workDir:  t.TempDir(),
+		eng:      declaragent.New(declaragent.WithWorkDir(t.TempDir())),
 		plansDir: "",
 		clients:  make(map[string]*sseClient),
 	}
@@ -544,7 +553,7 @@ func TestMCPServerStartsAndListensE2E(t *testing.T) {
 
 func TestMCPSSEClientConnectsE2E(t *testing.T) {
 	s := &SSEServer{
-		workDir:  t.TempDir(),
+		eng:      declaragent.New(declaragent.WithWorkDir(t.TempDir())),
 		plansDir: "",
 		clients:  make(map[string]*sseClient),
 	}
@@ -595,7 +604,7 @@ func TestMCPSSEClientConnectsE2E(t *testing.T) {
 
 func TestMCPSSEToolsCallViaHTTPE2E(t *testing.T) {
 	s := &SSEServer{
-		workDir:  t.TempDir(),
+		eng:      declaragent.New(declaragent.WithWorkDir(t.TempDir())),
 		plansDir: "",
 		clients:  make(map[string]*sseClient),
 	}
@@ -627,7 +636,156 @@ func TestMCPSSEToolsCallViaHTTPE2E(t *testing.T) {
 	b, _ := json.Marshal(m["tools"])
 	var tools []map[string]any
 	json.Unmarshal(b, &tools)
-	if len(tools) != 5 {
-		t.Fatalf("expected 5 builtin tools, got %d", len(tools))
+	if len(tools) != 6 {
+		t.Fatalf("expected 6 builtin tools, got %d", len(tools))
+	}
+}
+
+func TestLLMResumesFailedRunE2E(t *testing.T) {
+	dir := t.TempDir()
+	writePlanFile(t, dir, "resume.yaml", `
+name: resume-test
+steps:
+  - id: first
+    run: echo first >> first.log
+  - id: second
+    run: test -f ready
+`)
+	resp := callDispatch(t, "tools/call", map[string]any{
+		"name":      "plan.run",
+		"arguments": map[string]any{"file": filepath.Join(dir, "resume.yaml")},
+	}, dir, "")
+	var first struct {
+		RunID   string `json:"run_id"`
+		Success bool   `json:"success"`
+	}
+	if err := json.Unmarshal([]byte(responseText(t, resp)), &first); err != nil || first.Success {
+		t.Fatalf("expected failed run, got %+v (%v)", first, err)
+	}
+	if resp.Result.(map[string]any)["isError"] != true {
+		t.Errorf("expected the failed run to be an error result, got %#v", resp.Result)
+	}
+
+	os.WriteFile(filepath.Join(dir, "ready"), nil, 0o644)
+	resp = callDispatch(t, "tools/call", map[string]any{
+		"name":      "plan.resume",
+		"arguments": map[string]any{"run_id": first.RunID},
+	}, dir, "")
+	text := responseText(t, resp)
+	if !strings.Contains(text, `"success": true`) || !strings.Contains(text, `"resumed": true`) {
+		t.Fatalf("expected resumed success, got %q", text)
+	}
+	if _, ok := resp.Result.(map[string]any)["isError"]; ok {
+		t.Errorf("expected the resumed run not to be an error result, got %#v", resp.Result)
+	}
+	log, _ := os.ReadFile(filepath.Join(dir, "first.log"))
+	if string(log) != "first\n" {
+		t.Errorf("expected first step to run once, log: %q", log)
+	}
+}
+
+func TestMCPPlanToolReturnsStructuredOutputsE2E(t *testing.T) {
+	dir := t.TempDir()
+	plansDir := t.TempDir()
+	writePlanFile(t, plansDir, "version.yaml", `
+name: version
+steps:
+  - id: read
+    run: echo 1.4.2
+    outputs:
+      v: stdout
+outputs:
+  version: ${{steps.read.outputs.v}}
+`)
+	resp := callDispatch(t, "tools/list", nil, dir, plansDir)
+	b, _ := json.Marshal(resp.Result.(map[string]any)["tools"])
+	var tools []map[string]any
+	json.Unmarshal(b, &tools)
+	var schema map[string]any
+	for _, tool := range tools {
+		if tool["name"] == "version" {
+			schema, _ = tool["outputSchema"].(map[string]any)
+		}
+	}
+	if schema == nil || schema["properties"].(map[string]any)["version"] == nil {
+		t.Fatalf("expected outputSchema with version property, got %v", schema)
+	}
+
+	resp = callDispatch(t, "tools/call", map[string]any{
+		"name":      "version",
+		"arguments": map[string]any{},
+	}, dir, plansDir)
+	structured, ok := resp.Result.(map[string]any)["structuredContent"].(map[string]string)
+	if !ok || structured["version"] != "1.4.2" {
+		t.Fatalf("expected structuredContent with version 1.4.2, got %#v", resp.Result)
+	}
+}
+
+func TestMCPPlanToolTypedInputsE2E(t *testing.T) {
+	dir := t.TempDir()
+	plansDir := t.TempDir()
+	writePlanFile(t, plansDir, "scale.yaml", `
+name: scale
+inputs:
+  replicas:
+    type: integer
+    required: true
+    min: 1
+    max: 10
+  env:
+    enum: [dev, prod]
+    default: dev
+  services:
+    type: array
+  token:
+    secret: true
+steps:
+  - id: s1
+    run: echo "${{inputs.env}} ${{inputs.replicas}} ${{inputs.services}}"
+`)
+	resp := callDispatch(t, "tools/list", nil, dir, plansDir)
+	b, _ := json.Marshal(resp.Result.(map[string]any)["tools"])
+	var tools []map[string]any
+	json.Unmarshal(b, &tools)
+	var props map[string]any
+	for _, tool := range tools {
+		if tool["name"] == "scale" {
+			props = tool["inputSchema"].(map[string]any)["properties"].(map[string]any)
+		}
+	}
+	if props == nil {
+		t.Fatal("tool 'scale' not found")
+	}
+	replicas := props["replicas"].(map[string]any)
+	if replicas["type"] != "integer" || replicas["minimum"] != float64(1) || replicas["maximum"] != float64(10) {
+		t.Errorf("unexpected replicas schema %v", replicas)
+	}
+	env := props["env"].(map[string]any)
+	if enum, _ := env["enum"].([]any); len(enum) != 2 || env["default"] != "dev" {
+		t.Errorf("unexpected env schema %v", env)
+	}
+	if props["services"].(map[string]any)["type"] != "array" {
+		t.Errorf("unexpected services schema %v", props["services"])
+	}
+	if props["token"].(map[string]any)["writeOnly"] != true {
+		t.Errorf("expected secret input to be writeOnly, got %v", props["token"])
+	}
+
+	resp = callDispatch(t, "tools/call", map[string]any{
+		"name":      "scale",
+		"arguments": map[string]any{"replicas": 3, "services": []string{"api", "web"}},
+	}, dir, plansDir)
+	text := responseText(t, resp)
+	if !strings.Contains(text, `dev 3 [\"api\",\"web\"]`) {
+		t.Fatalf("expected typed arguments in output, got %q", text)
+	}
+
+	resp = callDispatch(t, "tools/call", map[string]any{
+		"name":      "scale",
+		"arguments": map[string]any{"replicas": 30},
+	}, dir, plansDir)
+	text = responseText(t, resp)
+	if !strings.Contains(text, "VALIDATION_ERROR") || !strings.Contains(text, "above the maximum of 10") {
+		t.Fatalf("expected validation error, got %q", text)
 	}
 }
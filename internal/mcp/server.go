@@ -2,10 +2,13 @@ package mcp
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 // JSONRPCRequest is a JSON-RPC 2.0 request.
@@ -24,14 +27,27 @@ type JSONRPCResponse struct {
 	Error   *RPCError `json:"error,omitempty"`
 }
 
+// JSONRPCNotification is a JSON-RPC 2.0 notification: a request that
+// expects no response.
+type JSONRPCNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+// notifier sends a notification to the client whose request is being
+// handled.
+type notifier func(method string, params any)
+
 // RPCError is a JSON-RPC error object.
 type RPCError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
 
-// ServeStdio runs the MCP stdio server (reads JSON-RPC from stdin, writes to stdout).
-func ServeStdio(workDir string, plansDir string) error {
+// ServeStdio runs the MCP stdio server (reads JSON-RPC from stdin, writes to
+// stdout), running plans with eng.
+func ServeStdio(eng *declaragent.Engine, plansDir string) error {
 	scanner := bufio.NewScanner(os.Stdin)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
@@ -46,7 +62,12 @@ func ServeStdio(workDir string, plansDir string) error {
 			continue
 		}
 
-		resp := dispatch(req, workDir, plansDir)
+		// Requests are handled one at a time, so notifications about one
+		// cannot interleave with a response
+		notify := func(method string, params any) {
+			writeMessage(os.Stdout, &JSONRPCNotification{JSONRPC: "2.0", Method: method, Params: params})
+		}
+		resp := dispatch(context.Background(), req, eng, plansDir, notify)
 		resp.JSONRPC = "2.0"
 		resp.ID = req.ID
 		writeResponse(os.Stdout, resp)
@@ -55,6 +76,10 @@ func ServeStdio(workDir string, plansDir string) error {
 }
 
 func writeResponse(w io.Writer, resp *JSONRPCResponse) {
-	data, _ := json.Marshal(resp)
+	writeMessage(w, resp)
+}
+
+func writeMessage(w io.Writer, msg any) {
+	data, _ := json.Marshal(msg)
 	fmt.Fprintf(w, "%s\n", data)
 }
@@ -1,11 +1,15 @@
 package mcp
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 func TestInitializeResponse(t *testing.T) {
@@ -14,7 +18,7 @@ func TestInitializeResponse(t *testing.T) {
 		ID:      1,
 		Method:  "initialize",
 	}
-	resp := dispatch(req, "/tmp", "")
+	resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir("/tmp")), "", nil)
 	if resp.Error != nil {
 		t.Fatalf("unexpected error: %v", resp.Error)
 	}
@@ -22,7 +26,7 @@ func TestInitializeResponse(t *testing.T) {
 	if !ok {
 		t.Fatal("expected map result")
 	}
-	if m["protocolVersion"] != "2024-11-05" {
+	if m["protocolVersion"] != "2025-06-18" {
 		t.Errorf("unexpected protocol version: %v", m["protocolVersion"])
 	}
 	serverInfo, _ := m["serverInfo"].(map[string]any)
@@ -37,7 +41,7 @@ func TestToolsList(t *testing.T) {
 		ID:      2,
 		Method:  "tools/list",
 	}
-	resp := dispatch(req, "/tmp", "")
+	resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir("/tmp")), "", nil)
 	if resp.Error != nil {
 		t.Fatalf("unexpected error: %v", resp.Error)
 	}
@@ -83,7 +87,7 @@ func TestToolCallValidate(t *testing.T) {
 		Method:  "tools/call",
 		Params:  params,
 	}
-	resp := dispatch(req, dir, "")
+	resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir(dir)), "", nil)
 	if resp.Error != nil {
 		t.Fatalf("unexpected error: %v", resp.Error)
 	}
@@ -99,7 +103,7 @@ func TestToolsListIncludesPlans(t *testing.T) {
 	os.WriteFile(planFile, []byte("name: greet\ndescription: Say hello\ninputs:\n  name:\n    default: World\nsteps:\n  - id: s1\n    run: echo hello\n"), 0o644)
 
 	req := JSONRPCRequest{JSONRPC: "2.0", ID: 10, Method: "tools/list"}
-	resp := dispatch(req, "/tmp", dir)
+	resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir("/tmp")), dir, nil)
 	if resp.Error != nil {
 		t.Fatalf("unexpected error: %v", resp.Error)
 	}
@@ -131,7 +135,7 @@ func TestShippedPlanExecution(t *testing.T) {
 	})
 
 	req := JSONRPCRequest{JSONRPC: "2.0", ID: 11, Method: "tools/call", Params: params}
-	resp := dispatch(req, dir, dir)
+	resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir(dir)), dir, nil)
 	if resp.Error != nil {
 		t.Fatalf("unexpected error: %v", resp.Error)
 	}
@@ -141,13 +145,79 @@ func TestShippedPlanExecution(t *testing.T) {
 	}
 }
 
+func TestToolCallReportsProgress(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "build.yaml"), []byte("name: build\nsteps:\n  - id: compile\n    run: echo compiling; echo done\n"), 0o644)
+
+	var messages []string
+	notify := func(method string, params any) {
+		p := params.(map[string]any)
+		if method != "notifications/progress" || p["progressToken"] != "tok-1" || p["progress"] != len(messages)+1 {
+			t.Errorf("unexpected notification %s %v", method, params)
+		}
+		messages = append(messages, p["message"].(string))
+	}
+	call := func(meta map[string]any) {
+		params, _ := json.Marshal(map[string]any{
+			"name":      "plan.run",
+			"arguments": map[string]any{"file": "build.yaml"},
+			"_meta":     meta,
+		})
+		req := JSONRPCRequest{JSONRPC: "2.0", ID: 12, Method: "tools/call", Params: params}
+		if resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir(dir)), "", notify); resp.Error != nil {
+			t.Fatalf("unexpected error: %v", resp.Error)
+		}
+	}
+
+	call(nil)
+	if len(messages) != 0 {
+		t.Errorf("expected no progress without a progress token, got %q", messages)
+	}
+	call(map[string]any{"progressToken": "tok-1"})
+	want := []string{"compile: started", "[compile] compiling", "[compile] done", "compile: success"}
+	if strings.Join(messages, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected progress %q", messages)
+	}
+}
+
+func TestToolCallMaxParallelZeroMeansNoLimit(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "wait.yaml"), []byte("name: wait\nsteps:\n  - id: a\n    run: sleep 0.2\n    needs: []\n  - id: b\n    run: sleep 0.2\n    needs: []\n"), 0o644)
+	eng := declaragent.New(declaragent.WithWorkDir(dir), declaragent.WithMaxParallel(1))
+
+	type step struct {
+		StartedAt time.Time `json:"started_at"`
+		EndedAt   time.Time `json:"ended_at"`
+	}
+	run := func(args map[string]any) []step {
+		params, _ := json.Marshal(map[string]any{"name": "plan.run", "arguments": args})
+		req := JSONRPCRequest{JSONRPC: "2.0", ID: 13, Method: "tools/call", Params: params}
+		resp := dispatch(context.Background(), req, eng, "", nil)
+		content := resp.Result.(map[string]any)["content"].([]map[string]any)
+		var result struct {
+			Steps []step `json:"steps"`
+		}
+		if err := json.Unmarshal([]byte(content[0]["text"].(string)), &result); err != nil || len(result.Steps) != 2 {
+			t.Fatalf("unexpected result %v (%v)", content, err)
+		}
+		return result.Steps
+	}
+
+	if steps := run(map[string]any{"file": "wait.yaml"}); steps[1].StartedAt.Before(steps[0].EndedAt) {
+		t.Error("expected the engine's limit of 1 without max_parallel")
+	}
+	if steps := run(map[string]any{"file": "wait.yaml", "max_parallel": 0}); !steps[1].StartedAt.Before(steps[0].EndedAt) {
+		t.Error("expected max_parallel 0 to lift the limit")
+	}
+}
+
 func TestMalformedJSONError(t *testing.T) {
 	req := JSONRPCRequest{
 		JSONRPC: "2.0",
 		ID:      4,
 		Method:  "nonexistent/method",
 	}
-	resp := dispatch(req, "/tmp", "")
+	resp := dispatch(context.Background(), req, declaragent.New(declaragent.WithWorkDir("/tmp")), "", nil)
 	if resp.Error == nil {
 		t.Fatal("expected error for unknown method")
 	}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"sync"
+
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 // sseClient represents a connected SSE client.
@@ -17,17 +19,18 @@ type sseClient struct {
 
 // SSEServer holds state for the SSE transport.
 type SSEServer struct {
-	workDir  string
+	eng      *declaragent.Engine
 	plansDir string
 	mu       sync.Mutex
 	clients  map[string]*sseClient
 	nextID   int
 }
 
-// ServeSSE starts the MCP server with SSE transport on the given port.
-func ServeSSE(port int, workDir, plansDir string) error {
+// ServeSSE starts the MCP server with SSE transport on the given port,
+// running plans with eng.
+func ServeSSE(port int, eng *declaragent.Engine, plansDir string) error {
 	s := &SSEServer{
-		workDir:  workDir,
+		eng:      eng,
 		plansDir: plansDir,
 		clients:  make(map[string]*sseClient),
 	}
@@ -122,23 +125,40 @@ func (s *SSEServer) handleMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := dispatch(req, s.workDir, s.plansDir)
+	var client *sseClient
+	if sessionID != "" {
+		s.mu.Lock()
+		client = s.clients[sessionID]
+		s.mu.Unlock()
+	}
+
+	// Notifications go over the SSE stream, waiting for room rather than
+	// dropping progress
+	var notify notifier
+	if client != nil {
+		notify = func(method string, params any) {
+			data, _ := json.Marshal(&JSONRPCNotification{JSONRPC: "2.0", Method: method, Params: params})
+			select {
+			case client.events <- data:
+			case <-client.done:
+			case <-r.Context().Done():
+			}
+		}
+	}
+
+	// A client that disconnects cancels any plan its request started
+	resp := dispatch(r.Context(), req, s.eng, s.plansDir, notify)
 	resp.JSONRPC = "2.0"
 	resp.ID = req.ID
 
 	respData, _ := json.Marshal(resp)
 
 	// If there's a connected SSE client, send via SSE stream
-	if sessionID != "" {
-		s.mu.Lock()
-		client, ok := s.clients[sessionID]
-		s.mu.Unlock()
-		if ok {
-			select {
-			case client.events <- respData:
-			default:
-				log.Printf("[DeclarAgent] SSE client %s buffer full, dropping message", sessionID)
-			}
+	if client != nil {
+		select {
+		case client.events <- respData:
+		default:
+			log.Printf("[DeclarAgent] SSE client %s buffer full, dropping message", sessionID)
 		}
 	}
 
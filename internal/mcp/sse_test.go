@@ -9,13 +9,15 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 func startTestSSEServer(t *testing.T) int {
 	t.Helper()
 	port := 19200 + int(time.Now().UnixNano()%100)
 	go func() {
-		if err := ServeSSE(port, t.TempDir(), ""); err != nil {
+		if err := ServeSSE(port, declaragent.New(declaragent.WithWorkDir(t.TempDir())), ""); err != nil {
 			// Server stopped
 		}
 	}()
@@ -111,7 +113,7 @@ func TestMessageEndpoint(t *testing.T) {
 	if !ok {
 		t.Fatal("expected map result")
 	}
-	if m["protocolVersion"] != "2024-11-05" {
+	if m["protocolVersion"] != "2025-06-18" {
 		t.Errorf("unexpected protocol version: %v", m["protocolVersion"])
 	}
 }
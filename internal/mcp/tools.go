@@ -1,21 +1,30 @@
 package mcp
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
-	"github.com/stevehiehn/declaragent/internal/engine"
 	"github.com/stevehiehn/declaragent/internal/plan"
+	"github.com/stevehiehn/declaragent/pkg/declaragent"
 )
 
 type toolDef struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	InputSchema any    `json:"inputSchema"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	InputSchema  any    `json:"inputSchema"`
+	OutputSchema any    `json:"outputSchema,omitempty"`
 }
 
+// maxParallelSchema describes the max_parallel argument of plan.run and
+// plan.resume.
+var maxParallelSchema = map[string]any{"type": "integer", "minimum": 0, "description": "Maximum number of steps to run at once; 0 means no limit"}
+
 var builtinTools = []toolDef{
 	{Name: "plan.validate", Description: "Validate a plan YAML file", InputSchema: map[string]any{
 		"type": "object", "properties": map[string]any{"file": map[string]any{"type": "string"}}, "required": []string{"file"}}},
@@ -24,8 +33,10 @@ var builtinTools = []toolDef{
 	{Name: "plan.dry_run", Description: "Dry-run a plan", InputSchema: map[string]any{
 		"type": "object", "properties": map[string]any{"file": map[string]any{"type": "string"}, "inputs": map[string]any{"type": "object"}}, "required": []string{"file"}}},
 	{Name: "plan.run", Description: "Execute a plan", InputSchema: map[string]any{
-		"type": "object", "properties": map[string]any{"file": map[string]any{"type": "string"}, "inputs": map[string]any{"type": "object"}, "approve": map[string]any{"type": "boolean"}}, "required": []string{"file"}}},
-	{Name: "plan.schema", Description: "Return the plan YAML schema", InputSchema: map[string]any{
+		"type": "object", "properties": map[string]any{"file": map[string]any{"type": "string"}, "inputs": map[string]any{"type": "object"}, "approve": map[string]any{"type": "boolean"}, "max_parallel": maxParallelSchema}, "required": []string{"file"}}},
+	{Name: "plan.resume", Description: "Resume a failed run, skipping steps that already succeeded", InputSchema: map[string]any{
+		"type": "object", "properties": map[string]any{"run_id": map[string]any{"type": "string"}, "inputs": map[string]any{"type": "object", "description": "Secret inputs, which are not stored with the run"}, "approve": map[string]any{"type": "boolean"}, "max_parallel": maxParallelSchema}, "required": []string{"run_id"}}},
+	{Name: "plan.schema", Description: "Return the JSON Schema of plan YAML files", InputSchema: map[string]any{
 		"type": "object", "properties": map[string]any{}}},
 }
 
@@ -58,18 +69,12 @@ func planToToolDef(p *plan.Plan) toolDef {
 	var required []string
 
 	for name, inp := range p.Inputs {
-		prop := map[string]any{"type": "string"}
-		if inp.Description != "" {
-			prop["description"] = inp.Description
-		}
-		if inp.Default != "" {
-			prop["default"] = inp.Default
-		}
-		properties[name] = prop
+		properties[name] = inputSchema(inp)
 		if inp.Required {
 			required = append(required, name)
 		}
 	}
+	sort.Strings(required)
 
 	schema := map[string]any{
 		"type":       "object",
@@ -85,17 +90,92 @@ func planToToolDef(p *plan.Plan) toolDef {
 	}
 
 	return toolDef{
-		Name:        p.Name,
-		Description: desc,
-		InputSchema: schema,
+		Name:         p.Name,
+		Description:  desc,
+		InputSchema:  schema,
+		OutputSchema: outputSchema(p),
+	}
+}
+
+// inputSchema describes one plan input as a JSON Schema property, with its
+// enum values and default in their typed form.
+func inputSchema(inp plan.Input) map[string]any {
+	prop := map[string]any{}
+	typ := inp.InputType()
+	if typ != plan.TypeJSON {
+		prop["type"] = typ
+	}
+	if inp.Description != "" {
+		prop["description"] = inp.Description
+	}
+	if inp.Default != "" {
+		if v, err := inp.ParseValue(inp.Default); err == nil {
+			prop["default"] = v
+		}
+	}
+	if len(inp.Enum) > 0 {
+		enum := make([]any, 0, len(inp.Enum))
+		for _, e := range inp.Enum {
+			if v, err := inp.ParseValue(e); err == nil {
+				enum = append(enum, v)
+			}
+		}
+		prop["enum"] = enum
+	}
+	if inp.Pattern != "" {
+		prop["pattern"] = inp.Pattern
+	}
+	minKey, maxKey := "minimum", "maximum"
+	switch typ {
+	case plan.TypeString:
+		minKey, maxKey = "minLength", "maxLength"
+	case plan.TypeArray:
+		minKey, maxKey = "minItems", "maxItems"
+	}
+	if inp.Min != nil {
+		prop[minKey] = *inp.Min
+	}
+	if inp.Max != nil {
+		prop[maxKey] = *inp.Max
+	}
+	if inp.Secret {
+		prop["writeOnly"] = true
+	}
+	return prop
+}
+
+// outputSchema describes the structured content returned by a plan tool: an
+// object holding the plan's outputs. It is nil for plans without outputs.
+func outputSchema(p *plan.Plan) any {
+	if len(p.Outputs) == 0 {
+		return nil
+	}
+	properties := map[string]any{}
+	required := make([]string, 0, len(p.Outputs))
+	for name := range p.Outputs {
+		properties[name] = map[string]any{"type": "string"}
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
 	}
 }
 
-func dispatch(req JSONRPCRequest, workDir string, plansDir string) *JSONRPCResponse {
+// protocolVersion is the MCP version the server speaks, the first to define
+// the outputSchema of tools and the structuredContent of their results.
+const protocolVersion = "2025-06-18"
+
+// dispatch handles one JSON-RPC request with eng. Plans run by tool calls
+// stop when ctx is cancelled. Their progress is sent with notify, which may
+// be nil, when the call asks for it.
+func dispatch(ctx context.Context, req JSONRPCRequest, eng *declaragent.Engine, plansDir string, notify notifier) *JSONRPCResponse {
 	switch req.Method {
 	case "initialize":
 		return &JSONRPCResponse{Result: map[string]any{
-			"protocolVersion": "2024-11-05",
+			"protocolVersion": protocolVersion,
 			"capabilities":    map[string]any{"tools": map[string]any{}},
 			"serverInfo":      map[string]any{"name": "declaragent", "version": "0.2.0"},
 		}}
@@ -104,7 +184,7 @@ func dispatch(req JSONRPCRequest, workDir string, plansDir string) *JSONRPCRespo
 		allTools = append(allTools, loadPlanTools(plansDir)...)
 		return &JSONRPCResponse{Result: map[string]any{"tools": allTools}}
 	case "tools/call":
-		return handleToolCall(req.Params, workDir, plansDir)
+		return handleToolCall(ctx, req.Params, eng, plansDir, notify)
 	case "notifications/initialized":
 		return &JSONRPCResponse{Result: map[string]any{}}
 	case "ping":
@@ -117,76 +197,112 @@ func dispatch(req JSONRPCRequest, workDir string, plansDir string) *JSONRPCRespo
 type toolCallParams struct {
 	Name      string          `json:"name"`
 	Arguments json.RawMessage `json:"arguments"`
+	Meta      struct {
+		ProgressToken any `json:"progressToken"`
+	} `json:"_meta"`
 }
 
-func handleToolCall(params json.RawMessage, workDir string, plansDir string) *JSONRPCResponse {
+func handleToolCall(ctx context.Context, params json.RawMessage, eng *declaragent.Engine, plansDir string, notify notifier) *JSONRPCResponse {
 	var tc toolCallParams
 	if err := json.Unmarshal(params, &tc); err != nil {
 		return &JSONRPCResponse{Error: &RPCError{Code: -32602, Message: "Invalid params"}}
 	}
+	if tc.Meta.ProgressToken != nil && notify != nil {
+		eng = eng.With(declaragent.WithObserver(progressObserver(tc.Meta.ProgressToken, notify)))
+	}
 
 	var args struct {
-		File    string            `json:"file"`
-		Inputs  map[string]string `json:"inputs"`
-		Approve bool              `json:"approve"`
+		File        string                     `json:"file"`
+		RunID       string                     `json:"run_id"`
+		Inputs      map[string]json.RawMessage `json:"inputs"`
+		Approve     bool                       `json:"approve"`
+		MaxParallel *int                       `json:"max_parallel"`
 	}
 	json.Unmarshal(tc.Arguments, &args)
-	if args.Inputs == nil {
-		args.Inputs = map[string]string{}
+	inputs := inputValues(args.Inputs)
+
+	// approve and max_parallel apply to this call only
+	run := eng
+	if args.Approve {
+		run = run.With(declaragent.WithApprover(declaragent.ApproveAll))
+	}
+	if args.MaxParallel != nil {
+		run = run.With(declaragent.WithMaxParallel(*args.MaxParallel))
 	}
 
 	switch tc.Name {
 	case "plan.validate":
-		return toolValidate(args.File, workDir)
+		return toolValidate(eng, args.File)
 	case "plan.explain":
-		return toolExecute(args.File, args.Inputs, workDir, engine.ModeExplain, false)
+		return toolExecute(ctx, eng, args.File, inputs, eng.Explain)
 	case "plan.dry_run":
-		return toolExecute(args.File, args.Inputs, workDir, engine.ModeDryRun, false)
+		return toolExecute(ctx, eng, args.File, inputs, eng.DryRun)
 	case "plan.run":
-		return toolExecute(args.File, args.Inputs, workDir, engine.ModeRun, args.Approve)
+		return toolExecute(ctx, run, args.File, inputs, run.Run)
+	case "plan.resume":
+		return toolResume(ctx, run, args.RunID, inputs)
 	case "plan.schema":
-		return &JSONRPCResponse{Result: toolContent(schemaText)}
+		var buf strings.Builder
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(eng.JSONSchema())
+		return &JSONRPCResponse{Result: toolContent(buf.String())}
 	default:
 		// Check if it matches a shipped plan name
-		return toolExecuteShippedPlan(tc.Name, tc.Arguments, workDir, plansDir)
+		return toolExecuteShippedPlan(ctx, tc.Name, tc.Arguments, eng, plansDir)
 	}
 }
 
-func toolValidate(file, workDir string) *JSONRPCResponse {
-	p, err := plan.LoadFile(resolvePath(file, workDir))
+func toolValidate(eng *declaragent.Engine, file string) *JSONRPCResponse {
+	p, err := eng.LoadPlan(file)
 	if err != nil {
-		return &JSONRPCResponse{Result: toolContent(err.Error())}
+		return &JSONRPCResponse{Result: toolError(err.Error())}
+	}
+	if err := eng.Validate(p, map[string]string{}); err != nil {
+		return &JSONRPCResponse{Result: toolError("Validation failed: " + err.Error())}
 	}
-	if err := plan.Validate(p, map[string]string{}); err != nil {
-		return &JSONRPCResponse{Result: toolContent("Validation failed: " + err.Error())}
+	text := "Plan is valid."
+	for _, w := range declaragent.Lint(p) {
+		text += "\nWarning: " + w.String()
 	}
-	return &JSONRPCResponse{Result: toolContent("Plan is valid.")}
+	return &JSONRPCResponse{Result: toolContent(text)}
 }
 
-func toolExecute(file string, inputs map[string]string, workDir string, mode engine.Mode, approve bool) *JSONRPCResponse {
-	p, err := plan.LoadFile(resolvePath(file, workDir))
+// toolExecute loads file and explains, dry-runs or runs it with execute, a
+// method of eng.
+func toolExecute(ctx context.Context, eng *declaragent.Engine, file string, inputs map[string]string, execute func(context.Context, *declaragent.Plan, map[string]string) (*declaragent.Result, error)) *JSONRPCResponse {
+	p, err := eng.LoadPlan(file)
 	if err != nil {
-		return &JSONRPCResponse{Result: toolContent(err.Error())}
+		return &JSONRPCResponse{Result: toolError(err.Error())}
 	}
-	for name, inp := range p.Inputs {
-		if _, ok := inputs[name]; !ok && inp.Default != "" {
-			inputs[name] = inp.Default
-		}
+	result, err := execute(ctx, p, inputs)
+	if err != nil {
+		return &JSONRPCResponse{Result: toolError(err.Error())}
+	}
+	return &JSONRPCResponse{Result: toolResult(result)}
+}
+
+// toolResume resumes run runID. inputs supplies the secret inputs, which are
+// not stored with the run.
+func toolResume(ctx context.Context, eng *declaragent.Engine, runID string, inputs map[string]string) *JSONRPCResponse {
+	prev, err := eng.LoadRun(runID)
+	if err != nil {
+		return &JSONRPCResponse{Result: toolError(err.Error())}
 	}
-	if err := plan.Validate(p, inputs); err != nil {
-		return &JSONRPCResponse{Result: toolContent(err.Error())}
+	p, err := eng.LoadPlan(prev.Meta.PlanPath)
+	if err != nil {
+		return &JSONRPCResponse{Result: toolError(err.Error())}
 	}
-	ctx := engine.NewRunContext(workDir, inputs, approve)
-	result, err := engine.Execute(p, ctx, mode)
+	result, err := eng.Resume(ctx, p, prev, inputs)
 	if err != nil {
-		return &JSONRPCResponse{Result: toolContent(err.Error())}
+		return &JSONRPCResponse{Result: toolError(err.Error())}
 	}
-	data, _ := json.MarshalIndent(result, "", "  ")
-	return &JSONRPCResponse{Result: toolContent(string(data))}
+	return &JSONRPCResponse{Result: toolResult(result)}
 }
 
 // toolExecuteShippedPlan finds a plan by name in plansDir and executes it.
-func toolExecuteShippedPlan(name string, rawArgs json.RawMessage, workDir string, plansDir string) *JSONRPCResponse {
+func toolExecuteShippedPlan(ctx context.Context, name string, rawArgs json.RawMessage, eng *declaragent.Engine, plansDir string) *JSONRPCResponse {
 	if plansDir == "" {
 		return &JSONRPCResponse{Error: &RPCError{Code: -32602, Message: "Unknown tool: " + name}}
 	}
@@ -197,38 +313,48 @@ func toolExecuteShippedPlan(name string, rawArgs json.RawMessage, workDir string
 		return &JSONRPCResponse{Error: &RPCError{Code: -32602, Message: "Unknown tool: " + name}}
 	}
 
-	p, err := plan.LoadFile(planFile)
+	p, err := eng.LoadPlan(planFile)
 	if err != nil {
-		return &JSONRPCResponse{Result: toolContent(err.Error())}
+		return &JSONRPCResponse{Result: toolError(err.Error())}
 	}
 
 	// Parse inputs from arguments
-	var inputs map[string]string
+	var args map[string]json.RawMessage
 	if rawArgs != nil {
-		json.Unmarshal(rawArgs, &inputs)
-	}
-	if inputs == nil {
-		inputs = map[string]string{}
+		json.Unmarshal(rawArgs, &args)
 	}
 
-	// Apply defaults
-	for inputName, inp := range p.Inputs {
-		if _, ok := inputs[inputName]; !ok && inp.Default != "" {
-			inputs[inputName] = inp.Default
-		}
+	result, err := eng.Run(ctx, p, inputValues(args))
+	if err != nil {
+		return &JSONRPCResponse{Result: toolError(err.Error())}
 	}
-
-	if err := plan.Validate(p, inputs); err != nil {
-		return &JSONRPCResponse{Result: toolContent(err.Error())}
+	content := toolResult(result)
+	if len(p.Outputs) > 0 && result.Success {
+		content["structuredContent"] = result.Outputs
 	}
+	return &JSONRPCResponse{Result: content}
+}
 
-	ctx := engine.NewRunContext(workDir, inputs, false)
-	result, err := engine.Execute(p, ctx, engine.ModeRun)
-	if err != nil {
-		return &JSONRPCResponse{Result: toolContent(err.Error())}
+// inputValues converts tool arguments to plan input values. Strings are
+// passed through; numbers and booleans keep their JSON spelling, and arrays
+// and objects are passed as compact JSON. Null arguments are dropped.
+func inputValues(args map[string]json.RawMessage) map[string]string {
+	inputs := map[string]string{}
+	for name, raw := range args {
+		var s string
+		switch {
+		case json.Unmarshal(raw, &s) == nil:
+			inputs[name] = s
+		case string(raw) == "null":
+		default:
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, raw); err != nil {
+				continue
+			}
+			inputs[name] = buf.String()
+		}
 	}
-	data, _ := json.MarshalIndent(result, "", "  ")
-	return &JSONRPCResponse{Result: toolContent(string(data))}
+	return inputs
 }
 
 // findPlanFile searches plansDir for a plan with the given name.
@@ -253,37 +379,48 @@ func findPlanFile(name string, plansDir string) string {
 	return ""
 }
 
+// progressObserver sends notifications/progress for token as steps start,
+// print output and finish.
+func progressObserver(token any, notify notifier) declaragent.Observer {
+	progress := 0
+	return func(e declaragent.Event) {
+		var message string
+		switch e.Type {
+		case declaragent.EventStepStarted:
+			message = fmt.Sprintf("%s: started", e.StepID)
+		case declaragent.EventStepOutput:
+			message = fmt.Sprintf("[%s] %s", e.StepID, e.Line)
+		case declaragent.EventStepFinished:
+			message = fmt.Sprintf("%s: %s", e.StepID, e.Step.Status)
+		default:
+			return
+		}
+		progress++
+		notify("notifications/progress", map[string]any{
+			"progressToken": token,
+			"progress":      progress,
+			"message":       message,
+		})
+	}
+}
+
 func toolContent(text string) map[string]any {
 	return map[string]any{"content": []map[string]any{{"type": "text", "text": text}}}
 }
 
-func resolvePath(file, workDir string) string {
-	if filepath.IsAbs(file) {
-		return file
-	}
-	return filepath.Join(workDir, file)
+// toolError returns text as the result of a tool call that failed.
+func toolError(text string) map[string]any {
+	content := toolContent(text)
+	content["isError"] = true
+	return content
 }
 
-const schemaText = `Plan YAML Schema:
-  name: string (required)
-  description: string (optional)
-  inputs:
-    <name>:
-      required: bool
-      description: string
-      default: string
-  steps:
-    - id: string (required, unique)
-      name: string (human-readable step label)
-      run: string (shell command)
-      action: string (built-in action name)
-      with: map[string]string (for actions)
-      http:
-        url: string (required)
-        method: string (default: GET)
-        headers: map[string]string
-        body: string (template-resolved)
-      outputs:
-        <name>: stdout
-      destructive: bool
-  Note: Each step must have exactly one of: run, action, or http`
+// toolResult returns result as JSON text, marked as an error unless the run
+// succeeded.
+func toolResult(result *declaragent.Result) map[string]any {
+	data, _ := json.MarshalIndent(result, "", "  ")
+	if !result.Success {
+		return toolError(string(data))
+	}
+	return toolContent(string(data))
+}
@@ -0,0 +1,261 @@
+package plan
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Pos is a 1-based line and column in a plan file.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+var (
+	unmarshalerType = reflect.TypeFor[yaml.Unmarshaler]()
+	yamlLineRe      = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+)
+
+// decoder records where each key and list item of a YAML document sits, by
+// path, e.g. steps[2].outputs.version, and collects the keys its target
+// type does not know.
+type decoder struct {
+	file      string
+	positions map[string]Pos
+	errs      []*dagerrors.RunError
+}
+
+// decodeStrict decodes the YAML in data into out, which must be a pointer
+// to a struct, rejecting unknown fields. It returns the position of every
+// key and list item, and every problem found, as a *dagerrors.RunError or a
+// dagerrors.ErrorList. file names data in error messages.
+func decodeStrict(data []byte, out any, file string) (map[string]Pos, error) {
+	d := &decoder{file: file, positions: map[string]Pos{}}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, dagerrors.Join(d.yamlErrors(err))
+	}
+	if len(doc.Content) == 0 {
+		return d.positions, nil
+	}
+	root := doc.Content[0]
+	where := "plan"
+	if _, ok := out.(*library); ok {
+		where = "library"
+	}
+	d.walk(root, reflect.TypeOf(out).Elem(), "", where)
+	if err := root.Decode(out); err != nil {
+		d.errs = append(d.errs, d.yamlErrors(err)...)
+	}
+	return d.positions, dagerrors.Join(d.errs)
+}
+
+// walk visits node, decoded into a value of type t found at path. where
+// describes the value in messages, e.g. step "build".
+func (d *decoder) walk(node *yaml.Node, t reflect.Type, path, where string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Struct:
+			d.walkStruct(node, t, path, where)
+		case reflect.Map:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				sub := join(path, key.Value)
+				d.positions[sub] = Pos{key.Line, key.Column}
+				noun := strings.TrimSuffix(path[strings.LastIndex(path, ".")+1:], "s")
+				desc := fmt.Sprintf("%s %q", noun, key.Value)
+				if strings.Contains(path, ".") {
+					desc += " of " + where
+				}
+				d.walk(value, t.Elem(), sub, desc)
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		for i, item := range node.Content {
+			sub := fmt.Sprintf("%s[%d]", path, i)
+			d.positions[sub] = Pos{item.Line, item.Column}
+			desc := sub
+			if t.Elem() == reflect.TypeFor[Step]() {
+				if id := mappingValue(item, "id"); id != "" {
+					desc = fmt.Sprintf("step %q", id)
+				}
+			}
+			d.walk(item, t.Elem(), sub, desc)
+		}
+	}
+}
+
+// walkStruct visits the keys of a mapping decoded into the struct type t.
+func (d *decoder) walkStruct(node *yaml.Node, t reflect.Type, path, where string) {
+	fields := map[string]reflect.Type{}
+	collectFields(t, fields)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Value == "<<" {
+			// Merged mappings hold fields of the same struct
+			if value.Kind == yaml.SequenceNode {
+				for _, m := range value.Content {
+					d.walkStruct(m, t, path, where)
+				}
+			} else {
+				d.walkStruct(value, t, path, where)
+			}
+			continue
+		}
+		ft, ok := fields[key.Value]
+		if !ok {
+			d.unknownField(key, where, fields)
+			continue
+		}
+		sub := join(path, key.Value)
+		d.positions[sub] = Pos{key.Line, key.Column}
+		// Entries of a map are described by their key, e.g. input "env"
+		desc := key.Value + " of " + where
+		switch {
+		case ft.Kind() == reflect.Map:
+			desc = where
+		case path == "":
+			desc = key.Value
+		}
+		d.walk(value, ft, sub, desc)
+	}
+}
+
+// unknownField reports key, which none of fields matches.
+func (d *decoder) unknownField(key *yaml.Node, where string, fields map[string]reflect.Type) {
+	names := slices.Sorted(maps.Keys(fields))
+	hint := "Known fields: " + strings.Join(names, ", ")
+	best := 3
+	for _, name := range names {
+		if dist := editDistance(key.Value, name); dist < best {
+			best = dist
+			hint = fmt.Sprintf("Did you mean %q?", name)
+		}
+	}
+	d.errs = append(d.errs, &dagerrors.RunError{
+		Type:    dagerrors.ValidationError,
+		Message: fmt.Sprintf("unknown field %q in %s", key.Value, where),
+		Hint:    hint,
+		File:    d.file,
+		Line:    key.Line,
+		Column:  key.Column,
+	})
+}
+
+// yamlErrors turns a parse or decode error of the yaml package into
+// problems with the line they are on.
+func (d *decoder) yamlErrors(err error) []*dagerrors.RunError {
+	msgs := []string{err.Error()}
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	}
+	errs := make([]*dagerrors.RunError, len(msgs))
+	for i, msg := range msgs {
+		e := &dagerrors.RunError{Type: dagerrors.ValidationError, File: d.file}
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			msg = m[2]
+		}
+		e.Message = "parsing YAML: " + strings.TrimPrefix(msg, "yaml: ")
+		errs[i] = e
+	}
+	return errs
+}
+
+// collectFields records the YAML keys of struct type t and the types they
+// decode into, following inline fields.
+func collectFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("yaml")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(opts, "inline") {
+			collectFields(f.Type, fields)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+}
+
+// mappingValue returns the scalar value of key in the mapping node, or "".
+func mappingValue(node *yaml.Node, key string) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key && node.Content[i+1].Kind == yaml.ScalarNode {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// locate sets the file of err to that of p and its line and column to the
+// position of path, or of the nearest enclosing value p knows the position
+// of, e.g. steps[1] for steps[1].retry.max_attempts of a step whose retry
+// comes from a template.
+func (p *Plan) locate(err *dagerrors.RunError, path string) {
+	err.File = p.file
+	for path != "" {
+		if pos, ok := p.positions[path]; ok {
+			err.Line, err.Column = pos.Line, pos.Column
+			return
+		}
+		cut := max(strings.LastIndexAny(path, ".["), 0)
+		path = path[:cut]
+	}
+}
@@ -0,0 +1,111 @@
+package plan
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+)
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	_, err := Load([]byte(`
+name: typos
+steps:
+  - id: build
+    run: make
+    ouputs:
+      version: stdout
+  - id: deploy
+    distructive: true
+    run: ./deploy.sh
+    rollback:
+      run: ./undo.sh
+      colour: red
+    http:
+      url: https://example.com
+      methd: POST
+templates:
+  notify:
+    run: echo
+    params:
+      channel: {requried: true}
+`))
+	problems := dagerrors.All(err)
+	want := []struct {
+		msg, hint string
+		line, col int
+	}{
+		{`unknown field "ouputs" in step "build"`, `Did you mean "outputs"?`, 6, 5},
+		{`unknown field "distructive" in step "deploy"`, `Did you mean "destructive"?`, 9, 5},
+		{`unknown field "colour" in rollback of step "deploy"`, "Known fields: action,", 13, 7},
+		{`unknown field "methd" in http of step "deploy"`, `Did you mean "method"?`, 16, 7},
+		{`unknown field "requried" in param "channel" of template "notify"`, `Did you mean "required"?`, 21, 17},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got %v", len(want), err)
+	}
+	for i, w := range want {
+		e := problems[i]
+		if e.Message != w.msg || !strings.HasPrefix(e.Hint, w.hint) || e.Line != w.line || e.Column != w.col {
+			t.Errorf("problem %d: got %q (hint %q) at %d:%d, want %q at %d:%d", i, e.Message, e.Hint, e.Line, e.Column, w.msg, w.line, w.col)
+		}
+	}
+}
+
+func TestLoadReportsYAMLErrorsWithLines(t *testing.T) {
+	_, err := Load([]byte("name: x\ntimeout: soon\nsteps:\n  - id: a\n    run: echo\n    retry: {max_attempts: many}\n"))
+	problems := dagerrors.All(err)
+	if len(problems) != 2 || problems[0].Line != 2 || problems[1].Line != 6 {
+		t.Fatalf("expected decode errors on lines 2 and 6, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "line 2: [VALIDATION_ERROR] parsing YAML: cannot unmarshal") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestLoadFileReportsFileInErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"plan.yaml": "name: x\nsteps: []\n"})
+	_, err := LoadFile(filepath.Join(dir, "plan.yaml"))
+	re, ok := err.(*dagerrors.RunError)
+	if !ok || re.Line != 2 || !strings.HasSuffix(re.File, "plan.yaml") || re.Message != "plan has no steps" {
+		t.Fatalf("expected positioned error, got %v", err)
+	}
+
+	dir = writeFiles(t, map[string]string{
+		"lib.yaml":  "templates:\n  t:\n    rnu: echo\n",
+		"plan.yaml": "name: x\nimports: [lib.yaml]\nsteps:\n  - id: a\n    template: t\n",
+	})
+	_, err = LoadFile(filepath.Join(dir, "plan.yaml"))
+	problems := dagerrors.All(err)
+	if len(problems) != 1 || !strings.HasSuffix(problems[0].File, "lib.yaml") || problems[0].Line != 3 {
+		t.Fatalf("expected the problem in the imported file, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "import lib.yaml: ") {
+		t.Errorf("expected the import in the message, got %q", err)
+	}
+}
+
+func TestValidateReportsLoadProblemsWithTheRest(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"plan.yaml": `name: x
+steps:
+  - id: a
+    rnu: echo
+  - id: b
+    run: echo
+    needs: [missing]
+`})
+	p, err := LoadFile(filepath.Join(dir, "plan.yaml"))
+	if p == nil || len(dagerrors.All(err)) != 1 {
+		t.Fatalf("expected the plan with one problem, got %v", err)
+	}
+	problems := dagerrors.All(Validate(p, nil))
+	var messages []string
+	for _, e := range problems {
+		messages = append(messages, e.Message)
+	}
+	if !slices.Contains(messages, `unknown field "rnu" in step "a"`) || !slices.Contains(messages, `step "b" needs unknown step "missing"`) {
+		t.Fatalf("expected the unknown field and the missing dependency, got %v", problems)
+	}
+}
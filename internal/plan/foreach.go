@@ -0,0 +1,65 @@
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ItemList is what a foreach: or matrix: entry expands over: a YAML list,
+// or a template that resolves to a JSON array or to one item per line.
+type ItemList struct {
+	Items    []string // list literal; items may contain templates
+	Template string   // template resolved when the step starts
+}
+
+// UnmarshalYAML accepts a list of scalars or a single template string.
+func (l *ItemList) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		return node.Decode(&l.Items)
+	case yaml.ScalarNode:
+		return node.Decode(&l.Template)
+	}
+	return fmt.Errorf("line %d: expected a list or a template string", node.Line)
+}
+
+// Expanded reports whether s runs once per item of foreach: or per
+// combination of matrix:.
+func (s Step) Expanded() bool {
+	return s.Foreach != nil || len(s.Matrix) > 0
+}
+
+// ParseItems splits the resolved value of an ItemList template into items.
+// A JSON array yields its elements, with non-string elements as JSON text;
+// anything else yields its non-empty lines.
+func ParseItems(value string) []string {
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	var arr []any
+	if err := dec.Decode(&arr); err == nil && !dec.More() {
+		items := make([]string, 0, len(arr))
+		for _, v := range arr {
+			if s, ok := v.(string); ok {
+				items = append(items, s)
+				continue
+			}
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			_ = enc.Encode(v)
+			items = append(items, strings.TrimRight(buf.String(), "\n"))
+		}
+		return items
+	}
+	var items []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items
+}
@@ -0,0 +1,77 @@
+package plan
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadForeachAndMatrix(t *testing.T) {
+	p, err := Load([]byte(`
+name: expand
+steps:
+  - id: list
+    run: ls
+    outputs:
+      files: stdout
+  - id: each
+    foreach: ${{ steps.list.outputs.files }}
+    run: cat ${{ item }}
+  - id: deploy
+    foreach: [api, web]
+    parallel: true
+    run: deploy ${{ item }}
+  - id: grid
+    matrix:
+      env: [dev, prod]
+      region: ${{ steps.list.outputs.files }}
+    run: echo ${{ matrix.env }}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := p.Steps[1].Foreach; got == nil || got.Template != "${{ steps.list.outputs.files }}" || got.Items != nil {
+		t.Errorf("expected foreach template, got %+v", got)
+	}
+	if got := p.Steps[2].Foreach; got == nil || !slices.Equal(got.Items, []string{"api", "web"}) || !p.Steps[2].Parallel {
+		t.Errorf("expected foreach list with parallel, got %+v", got)
+	}
+	grid := p.Steps[3]
+	if !slices.Equal(grid.Matrix["env"].Items, []string{"dev", "prod"}) || grid.Matrix["region"].Template == "" {
+		t.Errorf("unexpected matrix %+v", grid.Matrix)
+	}
+	if !grid.Expanded() || p.Steps[0].Expanded() {
+		t.Error("expected only foreach and matrix steps to be expanded")
+	}
+}
+
+func TestLoadForeachRejectsMapping(t *testing.T) {
+	_, err := Load([]byte(`
+name: bad
+steps:
+  - id: each
+    foreach: {a: b}
+    run: echo
+`))
+	if err == nil || !strings.Contains(err.Error(), "expected a list or a template string") {
+		t.Fatalf("expected foreach error, got %v", err)
+	}
+}
+
+func TestParseItems(t *testing.T) {
+	cases := []struct {
+		value string
+		want  []string
+	}{
+		{`["api", "web"]`, []string{"api", "web"}},
+		{`[1, {"a": "<b>"}, true]`, []string{"1", `{"a":"<b>"}`, "true"}},
+		{"api\n\n  web  \n", []string{"api", "web"}},
+		{`[not json`, []string{"[not json"}},
+		{"", nil},
+	}
+	for _, tc := range cases {
+		if got := ParseItems(tc.value); !slices.Equal(got, tc.want) {
+			t.Errorf("%q: expected %q, got %q", tc.value, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package plan
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+)
+
+// HasNeeds reports whether any step declares explicit dependencies.
+func (p *Plan) HasNeeds() bool {
+	for _, s := range p.Steps {
+		if s.Needs != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Dependencies returns stepID → IDs of the steps it must wait for.
+// Plans without any needs: run sequentially, so each step depends on the one
+// before it. Once a plan uses needs:, only the declared edges apply.
+func (p *Plan) Dependencies() map[string][]string {
+	deps := make(map[string][]string, len(p.Steps))
+	explicit := p.HasNeeds()
+	for i, s := range p.Steps {
+		switch {
+		case explicit:
+			deps[s.ID] = append([]string(nil), s.Needs...)
+		case i > 0:
+			deps[s.ID] = []string{p.Steps[i-1].ID}
+		default:
+			deps[s.ID] = nil
+		}
+	}
+	return deps
+}
+
+// Ancestors returns every step that transitively runs before stepID.
+func Ancestors(deps map[string][]string, stepID string) map[string]bool {
+	seen := map[string]bool{}
+	stack := append([]string(nil), deps[stepID]...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		stack = append(stack, deps[id]...)
+	}
+	return seen
+}
+
+// findCycle returns the step IDs forming a dependency cycle, or nil.
+// Steps are visited in plan order so the reported cycle is deterministic.
+func findCycle(p *Plan, deps map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var path []string
+	var cycle []string
+
+	var visit func(id string) bool
+	visit = func(id string) bool {
+		state[id] = visiting
+		path = append(path, id)
+		for _, dep := range deps[id] {
+			switch state[dep] {
+			case visiting:
+				for i, pid := range path {
+					if pid == dep {
+						cycle = append(append([]string(nil), path[i:]...), dep)
+						return true
+					}
+				}
+			case unvisited:
+				if _, ok := deps[dep]; ok && visit(dep) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = visited
+		return false
+	}
+
+	for _, s := range p.Steps {
+		if state[s.ID] == unvisited && visit(s.ID) {
+			return cycle
+		}
+	}
+	return nil
+}
+
+func formatCycle(cycle []string) string {
+	return strings.Join(cycle, " -> ")
+}
+
+// checkNeeds validates needs: entries and the resulting dependency graph.
+func (v *validator) checkNeeds() {
+	p := v.p
+	for i, s := range p.Steps {
+		path := fmt.Sprintf("steps[%d].needs", i)
+		seen := map[string]bool{}
+		for j, dep := range s.Needs {
+			at := fmt.Sprintf("%s[%d]", path, j)
+			switch _, known := v.seen[dep]; {
+			case dep == s.ID:
+				v.add(at, &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q needs itself", s.ID),
+				})
+			case !known:
+				v.add(at, &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q needs unknown step %q", s.ID, dep),
+				})
+			case seen[dep]:
+				v.add(at, &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q lists %q in needs more than once", s.ID, dep),
+				})
+			}
+			seen[dep] = true
+		}
+	}
+	// Dependencies are keyed by step ID, so duplicate IDs, reported
+	// elsewhere, would show up as false cycles
+	ids := map[string]bool{}
+	for _, s := range p.Steps {
+		if ids[s.ID] {
+			return
+		}
+		ids[s.ID] = true
+	}
+	if cycle := findCycle(p, p.Dependencies()); cycle != nil {
+		i := slices.IndexFunc(p.Steps, func(s Step) bool { return s.ID == cycle[0] })
+		v.add(fmt.Sprintf("steps[%d].needs", i), &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: "dependency cycle: " + formatCycle(cycle),
+			Hint:    "Remove one of the needs: entries to break the cycle",
+		})
+	}
+}
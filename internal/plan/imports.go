@@ -0,0 +1,246 @@
+package plan
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+)
+
+// StepTemplate is a reusable step, defined under templates: in a plan or in
+// a file the plan imports. A step uses it with template: <name>.
+type StepTemplate struct {
+	Step   `yaml:",inline"`
+	Params map[string]Input `yaml:"params,omitempty"` // values given by the with: of steps using the template
+
+	Source string `yaml:"-"` // file:line of the definition, for error messages
+}
+
+// library is a file listed under imports:.
+type library struct {
+	Imports   []string                `yaml:"imports,omitempty"`
+	Templates map[string]StepTemplate `yaml:"templates,omitempty"`
+}
+
+// resolveTemplates loads the imports of p, read from path (empty when p was
+// not loaded from a file), and applies the templates to the steps that use
+// one. Afterwards p.Templates holds every template p can use. The returned
+// bytes are the contents of the imported files, in load order.
+//
+// Precedence, highest first: fields set on the step itself, the plan's own
+// templates:, then its imports, a later import overriding an earlier one.
+// A library's own templates likewise override the ones it imports.
+func resolveTemplates(p *Plan, path string) ([]byte, error) {
+	root := "."
+	if path != "" {
+		root = filepath.Dir(path)
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	var imported []byte
+	var stack []string
+	if path != "" {
+		stack = append(stack, path)
+	}
+	own := library{Imports: p.Imports, Templates: p.Templates}
+	templates, err := collectTemplates(own, p.positions, path, root, stack, &imported)
+	if err != nil {
+		return nil, err
+	}
+	p.Templates = templates
+
+	var errs []*dagerrors.RunError
+	for _, kind := range []string{"steps", "finally"} {
+		steps := p.Steps
+		if kind == "finally" {
+			steps = p.Finally
+		}
+		errs = append(errs, applyTemplates(p, steps, kind)...)
+	}
+	if err := dagerrors.Join(errs); err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
+
+// collectTemplates returns the templates defined in lib, the file at path
+// whose keys are at positions, together with those it imports. stack holds
+// the files that led to it, so an import cycle is caught.
+func collectTemplates(lib library, positions map[string]Pos, path, root string, stack []string, imported *[]byte) (map[string]StepTemplate, error) {
+	dir := root
+	if path != "" {
+		dir = filepath.Dir(path)
+	}
+	all := map[string]StepTemplate{}
+	for _, imp := range lib.Imports {
+		file := imp
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		if slices.Contains(stack, file) {
+			chain := append(slices.Clone(stack[slices.Index(stack, file):]), file)
+			for i, f := range chain {
+				chain[i] = relPath(root, f)
+			}
+			return nil, fmt.Errorf("import cycle %s", strings.Join(chain, " -> "))
+		}
+		libData, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("import %s: %w", imp, err)
+		}
+		var sub library
+		subPositions, err := decodeStrict(libData, &sub, displayPath(file))
+		if err != nil {
+			return nil, fmt.Errorf("import %s: %w", imp, err)
+		}
+		*imported = append(*imported, libData...)
+		libTemplates, err := collectTemplates(sub, subPositions, file, root, append(stack, file), imported)
+		if err != nil {
+			return nil, fmt.Errorf("import %s: %w", imp, err)
+		}
+		maps.Copy(all, libTemplates)
+	}
+
+	var errs []*dagerrors.RunError
+	for _, name := range slices.Sorted(maps.Keys(lib.Templates)) {
+		t := lib.Templates[name]
+		key := "templates." + name
+		line := positions[key].Line
+		t.Source = fmt.Sprintf("line %d", line)
+		if path != "" {
+			t.Source = fmt.Sprintf("%s:%d", relPath(root, path), line)
+		}
+		var problem, field string
+		switch {
+		case t.ID != "":
+			problem, field = "id is not allowed, it comes from the step using the template", "id"
+		case len(t.Needs) > 0:
+			problem, field = "needs is not allowed, it belongs to the step using the template", "needs"
+		case t.Template != "":
+			problem, field = "a template cannot use another template", "template"
+		}
+		if problem != "" {
+			pos := positions[key+"."+field]
+			errs = append(errs, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("template %q (%s): %s", name, t.Source, problem),
+				File:    displayPath(path),
+				Line:    pos.Line,
+				Column:  pos.Column,
+			})
+			continue
+		}
+		all[name] = t
+	}
+	if err := dagerrors.Join(errs); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// applyTemplates replaces each step of p at path (steps or finally) that
+// uses a template, and each rollback that does, with the template merged
+// with its own fields.
+func applyTemplates(p *Plan, steps []Step, path string) []*dagerrors.RunError {
+	var errs []*dagerrors.RunError
+	for i := range steps {
+		s := &steps[i]
+		at := fmt.Sprintf("%s[%d]", path, i)
+		if s.Rollback != nil && s.Rollback.Template != "" {
+			if t, err := lookupTemplate(p, s.Rollback.Template); err != nil {
+				err.Message = fmt.Sprintf("rollback of step %q uses %s", s.ID, err.Message)
+				p.locate(err, at+".rollback.template")
+				errs = append(errs, err)
+			} else {
+				rb := t.apply(*s.Rollback)
+				s.Rollback = &rb
+			}
+		}
+		if s.Template == "" {
+			continue
+		}
+		t, err := lookupTemplate(p, s.Template)
+		if err != nil {
+			err.Message = fmt.Sprintf("step %q uses %s", s.ID, err.Message)
+			p.locate(err, at+".template")
+			errs = append(errs, err)
+			continue
+		}
+		*s = t.apply(*s)
+	}
+	return errs
+}
+
+// lookupTemplate returns the template of p called name.
+func lookupTemplate(p *Plan, name string) (StepTemplate, *dagerrors.RunError) {
+	t, ok := p.Templates[name]
+	if ok {
+		return t, nil
+	}
+	known := "none are defined or imported"
+	if len(p.Templates) > 0 {
+		known = "known: " + strings.Join(slices.Sorted(maps.Keys(p.Templates)), ", ")
+	}
+	return t, &dagerrors.RunError{
+		Type:    dagerrors.ValidationError,
+		Message: fmt.Sprintf("unknown template %q (%s)", name, known),
+	}
+}
+
+// apply returns the step s, which uses t, with t filled in. Every field s
+// sets replaces the template's; with: and outputs: are merged key by key, s
+// winning, while blocks such as http: and retry: are replaced whole. When t
+// declares params, the with: of s supplies them instead, defaults filling
+// the gaps.
+func (t StepTemplate) apply(s Step) Step {
+	var args map[string]string
+	if len(t.Params) > 0 {
+		args = map[string]string{}
+		for name, param := range t.Params {
+			if param.Default != "" {
+				args[name] = param.Default
+			}
+		}
+		maps.Copy(args, s.Params)
+		s.Params = nil
+	}
+
+	out := t.Step
+	dst := reflect.ValueOf(&out).Elem()
+	src := reflect.ValueOf(s)
+	for i := range src.NumField() {
+		field, to := src.Field(i), dst.Field(i)
+		if field.IsZero() || !to.CanSet() {
+			continue
+		}
+		if field.Kind() == reflect.Map && !to.IsNil() {
+			merged := reflect.MakeMap(field.Type())
+			for _, m := range []reflect.Value{to, field} {
+				iter := m.MapRange()
+				for iter.Next() {
+					merged.SetMapIndex(iter.Key(), iter.Value())
+				}
+			}
+			to.Set(merged)
+			continue
+		}
+		to.Set(field)
+	}
+	out.Args = args
+	return out
+}
+
+// relPath returns path relative to root when it lies below it.
+func relPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return rel
+}
@@ -0,0 +1,136 @@
+package plan
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes name → contents into a new directory and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadAppliesImportedTemplates(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"lib/base.yaml": `
+templates:
+  notify:
+    run: echo base
+  post:
+    http:
+      url: https://example.com/hook
+      method: POST
+    with:
+      unused: x
+    outputs:
+      status: status_code
+      body: stdout
+`,
+		"lib/notify.yaml": `
+imports: [base.yaml]
+templates:
+  notify:
+    name: Notify
+    params:
+      channel: {required: true}
+      text: {default: done}
+    run: ./notify.sh ${{ params.channel }} ${{ params.text }}
+`,
+		"main.yaml": `
+name: main
+imports: [lib/notify.yaml]
+templates:
+  post:
+    http:
+      url: https://example.com/local
+    outputs:
+      status: status_code
+steps:
+  - id: tell
+    template: notify
+    with:
+      channel: ops
+  - id: send
+    template: post
+    outputs:
+      code: status_code
+    retry:
+      max_attempts: 2
+`,
+	})
+	p, err := LoadFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tell := p.Steps[0]
+	if tell.Run != "./notify.sh ${{ params.channel }} ${{ params.text }}" || tell.Description != "Notify" {
+		t.Errorf("expected the imported template to override its own import, got %+v", tell)
+	}
+	if tell.Args["channel"] != "ops" || tell.Args["text"] != "done" || tell.Params != nil {
+		t.Errorf("expected with: to supply params with defaults, got args=%v with=%v", tell.Args, tell.Params)
+	}
+
+	send := p.Steps[1]
+	if send.HTTP.URL != "https://example.com/local" {
+		t.Errorf("expected the plan's own template to win, got %q", send.HTTP.URL)
+	}
+	if len(send.Outputs) != 2 || send.Outputs["code"] != "status_code" || send.Retry == nil {
+		t.Errorf("expected step fields merged over the template, got %+v", send)
+	}
+
+	if got := p.Templates["notify"].Source; got != filepath.Join("lib", "notify.yaml")+":4" {
+		t.Errorf("unexpected source %q", got)
+	}
+	if got := p.Templates["post"].Source; got != "main.yaml:5" {
+		t.Errorf("unexpected source %q", got)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "main.yaml"))
+	if p.Hash == Hash(data) {
+		t.Error("expected the hash to cover imported files")
+	}
+}
+
+func TestLoadImportErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml":   "imports: [b.yaml]\n",
+		"b.yaml":   "imports: [a.yaml]\n",
+		"ids.yaml": "templates:\n  x:\n    id: fixed\n    run: echo\n",
+	})
+	tests := []struct {
+		plan string
+		want string
+	}{
+		{"imports: [a.yaml]", "import cycle a.yaml -> b.yaml -> a.yaml"},
+		{"imports: [missing.yaml]", "import missing.yaml: open"},
+		{"imports: [ids.yaml]", `template "x" (ids.yaml:2): id is not allowed`},
+		{"steps:\n  - id: s\n    template: nope\n", `step "s" uses unknown template "nope" (none are defined or imported)`},
+	}
+	for _, tt := range tests {
+		data := "name: bad\n" + tt.plan + "\n"
+		if !strings.Contains(tt.plan, "steps:") {
+			data += "steps:\n  - id: s\n    run: echo\n"
+		}
+		path := filepath.Join(dir, "plan.yaml")
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadFile(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.plan, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Input types.
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+	TypeArray   = "array"
+	TypeJSON    = "json"
+)
+
+var inputTypes = []string{TypeString, TypeInteger, TypeNumber, TypeBoolean, TypeArray, TypeJSON}
+
+// InputType returns the type of in, defaulting to string.
+func (in Input) InputType() string {
+	if in.Type == "" {
+		return TypeString
+	}
+	return in.Type
+}
+
+// ParseValue converts value to the Go value of the input's type: string,
+// int64, float64, bool, []any, or any decoded JSON value.
+func (in Input) ParseValue(value string) (any, error) {
+	switch in.InputType() {
+	case TypeInteger:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", value)
+		}
+		return n, nil
+	case TypeNumber:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return f, nil
+	case TypeBoolean:
+		switch value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%q is not a boolean (use true or false)", value)
+	case TypeArray:
+		var arr []any
+		if err := json.Unmarshal([]byte(value), &arr); err != nil || arr == nil {
+			return nil, fmt.Errorf("%q is not a JSON array", value)
+		}
+		return arr, nil
+	case TypeJSON:
+		var v any
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return nil, fmt.Errorf("%q is not valid JSON", value)
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+// Check reports whether value satisfies the input's type and constraints.
+func (in Input) Check(value string) error {
+	v, err := in.ParseValue(value)
+	if err != nil {
+		return err
+	}
+	if len(in.Enum) > 0 && !slices.Contains(in.Enum, value) {
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(in.Enum, ", "))
+	}
+	if in.Pattern != "" {
+		re, err := regexp.Compile(in.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("%q does not match pattern %s", value, in.Pattern)
+		}
+	}
+
+	var size float64
+	var what string
+	switch v := v.(type) {
+	case int64:
+		size, what = float64(v), "value"
+	case float64:
+		size, what = v, "value"
+	case string:
+		size, what = float64(utf8.RuneCountInString(v)), "length"
+	case []any:
+		size, what = float64(len(v)), "number of items"
+	default:
+		return nil
+	}
+	if in.Min != nil && size < *in.Min {
+		return fmt.Errorf("%s %s is below the minimum of %s", what, formatFloat(size), formatFloat(*in.Min))
+	}
+	if in.Max != nil && size > *in.Max {
+		return fmt.Errorf("%s %s is above the maximum of %s", what, formatFloat(size), formatFloat(*in.Max))
+	}
+	return nil
+}
+
+// checkDecl reports mistakes in the declaration of the input itself.
+func (in Input) checkDecl() error {
+	if !slices.Contains(inputTypes, in.InputType()) {
+		return fmt.Errorf("unknown type %q", in.Type)
+	}
+	if in.Pattern != "" {
+		if in.InputType() != TypeString {
+			return fmt.Errorf("pattern only applies to string inputs")
+		}
+		if _, err := regexp.Compile(in.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	if in.Min != nil || in.Max != nil {
+		switch in.InputType() {
+		case TypeBoolean, TypeJSON:
+			return fmt.Errorf("min and max do not apply to %s inputs", in.InputType())
+		}
+		if in.Min != nil && in.Max != nil && *in.Min > *in.Max {
+			return fmt.Errorf("min %s is greater than max %s", formatFloat(*in.Min), formatFloat(*in.Max))
+		}
+	}
+	for _, e := range in.Enum {
+		if _, err := in.ParseValue(e); err != nil {
+			return fmt.Errorf("enum value %v", err)
+		}
+	}
+	if in.Default != "" {
+		if err := in.Check(in.Default); err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+	}
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
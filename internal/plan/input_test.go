@@ -0,0 +1,86 @@
+package plan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func ptr(f float64) *float64 { return &f }
+
+func TestInputParseValue(t *testing.T) {
+	cases := []struct {
+		typ   string
+		value string
+		want  any
+	}{
+		{"", "hello", "hello"},
+		{TypeInteger, "42", int64(42)},
+		{TypeNumber, "2.5", 2.5},
+		{TypeBoolean, "true", true},
+		{TypeArray, `["a","b"]`, []any{"a", "b"}},
+		{TypeJSON, `{"k":1}`, map[string]any{"k": float64(1)}},
+	}
+	for _, c := range cases {
+		got, err := Input{Type: c.typ}.ParseValue(c.value)
+		if err != nil {
+			t.Errorf("%s %q: unexpected error: %v", c.typ, c.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %q: expected %#v, got %#v", c.typ, c.value, c.want, got)
+		}
+	}
+}
+
+func TestInputCheck(t *testing.T) {
+	cases := []struct {
+		name  string
+		input Input
+		value string
+		err   string
+	}{
+		{"integer ok", Input{Type: TypeInteger, Min: ptr(1), Max: ptr(10)}, "5", ""},
+		{"not integer", Input{Type: TypeInteger}, "5.5", "not an integer"},
+		{"below min", Input{Type: TypeInteger, Min: ptr(1)}, "0", "below the minimum of 1"},
+		{"above max", Input{Type: TypeNumber, Max: ptr(1.5)}, "2", "above the maximum of 1.5"},
+		{"boolean", Input{Type: TypeBoolean}, "yes", "not a boolean"},
+		{"enum ok", Input{Enum: []string{"dev", "prod"}}, "prod", ""},
+		{"enum miss", Input{Enum: []string{"dev", "prod"}}, "qa", "not one of dev, prod"},
+		{"pattern ok", Input{Pattern: `^v\d+$`}, "v2", ""},
+		{"pattern miss", Input{Pattern: `^v\d+$`}, "2", "does not match pattern"},
+		{"string length", Input{Max: ptr(3)}, "abcd", "length 4 is above the maximum of 3"},
+		{"array items", Input{Type: TypeArray, Min: ptr(1)}, `[]`, "number of items 0 is below"},
+		{"not array", Input{Type: TypeArray}, "a,b", "not a JSON array"},
+		{"bad json", Input{Type: TypeJSON}, "{", "not valid JSON"},
+	}
+	for _, c := range cases {
+		err := c.input.Check(c.value)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestInputCheckDecl(t *testing.T) {
+	bad := map[string]Input{
+		"unknown type":      {Type: "date"},
+		"pattern on number": {Type: TypeNumber, Pattern: "1"},
+		"bad pattern":       {Pattern: "("},
+		"min on boolean":    {Type: TypeBoolean, Min: ptr(0)},
+		"min above max":     {Type: TypeInteger, Min: ptr(5), Max: ptr(1)},
+		"bad enum":          {Type: TypeInteger, Enum: []string{"one"}},
+		"bad default":       {Type: TypeInteger, Default: "many"},
+	}
+	for name, in := range bad {
+		if err := in.checkDecl(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if err := (Input{Type: TypeInteger, Enum: []string{"1", "2"}, Default: "2", Min: ptr(1)}).checkDecl(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package plan
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stevehiehn/declaragent/internal/action"
+)
+
+// fieldDocs describes each field of the plan file, by Go type and YAML key.
+var fieldDocs = map[string]string{
+	"Plan.name":        "Name of the plan",
+	"Plan.description": "What the plan does",
+	"Plan.inputs":      "Input parameters, available to templates as ${{ inputs.<name> }}",
+	"Plan.allow_env":   "Environment variables templates may read as ${{ env.NAME }}",
+	"Plan.secret_env":  "Environment variables templates may read as ${{ env.NAME }}, masked in results and artifacts like secret inputs",
+	"Plan.env":         "Environment variables of every run and exec step; templates may use inputs, plan.*, env.* and run.id|workdir|started_at",
+	"Plan.clean_env":   "Run and exec steps inherit only PATH, HOME, USER, LOGNAME, SHELL, TMPDIR, LANG, LC_ALL, TERM, TZ, allow_env and secret_env instead of the whole environment",
+	"Plan.timeout":     "Bounds the whole run, e.g. 10m",
+	"Plan.steps":       "Steps to run; in order unless a step uses needs:",
+	"Plan.finally":     "Steps always run after steps:, in order; they may use ${{ run.status }} and ${{ run.failed_step }}",
+	"Plan.outputs":     "Templates resolved when the run ends, returned in the result's outputs",
+	"Plan.imports":     "Library files whose templates: steps can use, relative to this file",
+	"Plan.templates":   "Named step templates, used by steps with template: <name>",
+
+	"Input.required":    "The input must be given unless it has a default",
+	"Input.description": "What the input is for",
+	"Input.default":     "Value used when the input is not given",
+	"Input.type":        "Type values must have; array means a JSON array",
+	"Input.enum":        "Allowed values",
+	"Input.pattern":     "Regular expression string values must match",
+	"Input.min":         "Minimum value, string length or number of array items",
+	"Input.max":         "Maximum value, string length or number of array items",
+	"Input.secret":      "Mask the value as *** in results, artifacts and output",
+
+	"Step.id":          "Unique step identifier",
+	"Step.name":        "Human-readable step label",
+	"Step.run":         "Shell command; template values are shell-quoted unless piped through raw",
+	"Step.exec":        "Program and arguments to run without a shell; templates are resolved per argument and never quoted",
+	"Step.action":      "Action to run with the with: params",
+	"Step.uses":        "Plan file to run, relative to this file; its outputs become the step's outputs",
+	"Step.with":        "Params of the action, inputs of the plan in uses:, or params of the template",
+	"Step.outputs":     "Values to extract: a source (stdout, stderr, exit_code, status_code or an action output) followed by pipes such as | regex:<pattern>, | json:$.path or | lines[N]",
+	"Step.destructive": "The step only runs with --approve",
+	"Step.needs":       "Steps that must succeed first; the step runs as soon as they have",
+	"Step.if":          "Condition; the step is skipped when it is false, e.g. ${{ inputs.env }} == 'prod'",
+	"Step.retry":       "How to retry a failing step",
+	"Step.timeout":     "Bounds each attempt, e.g. 90s",
+	"Step.rollback":    "Step, without id or needs, that undoes this one if a later step fails; not allowed with foreach or matrix",
+	"Step.foreach":     "Runs the step once per item, available as ${{ item }}: a list, or a template resolving to a JSON array or lines",
+	"Step.matrix":      "Runs the step once per combination of the named lists, available as ${{ matrix.<name> }}",
+	"Step.parallel":    "Runs the items of foreach: or matrix: at once; outputs become JSON arrays",
+	"Step.template":    "Step template to start from; fields set on the step win, with: and outputs: merge",
+	"Step.http":        "HTTP request to send",
+	"Step.env":         "Environment variables of a run or exec step, set over the plan's env",
+	"Step.dir":         "Directory a run or exec step runs in, relative to the working directory and inside it",
+	"Step.stdin":       "Content piped to the process of a run or exec step",
+
+	"Step.allow_outside_workdir": "Lets dir be absolute or lead out of the working directory",
+
+	"StepTemplate.params": "Params steps using the template pass with with:, available as ${{ params.<name> }}",
+
+	"HTTPRequest.url":     "URL to request",
+	"HTTPRequest.method":  "HTTP method; default GET",
+	"HTTPRequest.headers": "Request headers",
+	"HTTPRequest.body":    "Request body",
+
+	"RetryPolicy.max_attempts":    "Total tries, including the first",
+	"RetryPolicy.initial_backoff": "Delay before the first retry; default 1s",
+	"RetryPolicy.max_backoff":     "Longest delay between tries; default 30s",
+	"RetryPolicy.multiplier":      "Growth of the delay after each try; default 2",
+	"RetryPolicy.jitter":          "Fraction of each delay randomised, 0 to 1",
+	"RetryPolicy.on_exit_codes":   "Only retry run and exec steps failing with these exit codes",
+	"RetryPolicy.on_http_status":  "Also retry http and action: http steps failing with these statuses",
+}
+
+// Fields left out of a type's schema because the loader rejects them there
+var omittedFields = map[string]bool{
+	"StepTemplate.id":       true,
+	"StepTemplate.needs":    true,
+	"StepTemplate.template": true,
+}
+
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// scalar is a value YAML may write as a number or boolean, which plans read
+// as a string.
+var scalar = map[string]any{"type": []string{"string", "number", "boolean"}}
+
+const schemaDescription = "A declaragent plan. Strings may hold ${{ expr }} templates, where expr " +
+	"uses references (inputs.x, steps.<id>.outputs.x, steps.<id>.status|exit_code|duration, " +
+	"run.id|workdir|started_at|status|failed_step, plan.name, env.NAME, item, matrix.x, params.x), " +
+	"'strings', numbers, true/false, || (default), &&, !, == != < <= > >=, and filters x | f(args): " +
+	"upper, lower, trim, replace(old,new), split(sep), join(sep), json, base64, sha256, urlencode, raw. " +
+	"Each step has exactly one of run, exec, action, http or uses, or takes it from its template. " +
+	"Without any needs:, steps run in order; once a plan uses needs:, steps run as soon as their dependencies succeed."
+
+// JSONSchema returns a JSON Schema (draft 2020-12) for plan files, built
+// from the plan types, with the params of each action of actions.
+func JSONSchema(actions *action.Registry) map[string]any {
+	defs := map[string]any{}
+	root := structSchema(reflect.TypeFor[Plan](), defs)
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "declaragent plan"
+	root["description"] = schemaDescription
+	root["required"] = []string{"name", "steps"}
+	root["$defs"] = defs
+
+	// Steps of a plan need an id; rollbacks and templates take theirs from
+	// the step they belong to
+	withID := map[string]any{"$ref": "#/$defs/Step", "required": []string{"id"}}
+	props := root["properties"].(map[string]any)
+	for _, key := range []string{"steps", "finally"} {
+		props[key].(map[string]any)["items"] = withID
+	}
+	props["steps"].(map[string]any)["minItems"] = 1
+
+	kinds := []string{"run", "exec", "action", "http", "uses"}
+	step := defs["Step"].(map[string]any)
+	step["anyOf"] = requireOneOf(append(slices.Clone(kinds), "template"))
+	defs["StepTemplate"].(map[string]any)["anyOf"] = requireOneOf(kinds)
+
+	for _, def := range []string{"Step", "StepTemplate"} {
+		fields := defs[def].(map[string]any)["properties"].(map[string]any)
+		fields["action"].(map[string]any)["enum"] = actions.Names()
+	}
+	// Templates check the with: params of their action too, but may leave
+	// required ones to the steps using them
+	var stepRules, templateRules []any
+	for _, spec := range actions.Specs() {
+		def := "action." + spec.Name
+		schema, required := actionSchema(spec)
+		defs[def] = schema
+		ref := "#/$defs/" + def
+		with := map[string]any{"$ref": ref}
+		if len(required) > 0 {
+			with["required"] = required
+		}
+		stepRules = append(stepRules, actionRule(spec.Name, with))
+		templateRules = append(templateRules, actionRule(spec.Name, map[string]any{"$ref": ref}))
+	}
+	step["allOf"] = stepRules
+	defs["StepTemplate"].(map[string]any)["allOf"] = templateRules
+	return root
+}
+
+// actionRule returns the rule that the with: of a step or template running
+// action name matches with.
+func actionRule(name string, with map[string]any) map[string]any {
+	return map[string]any{
+		"if": map[string]any{
+			"properties": map[string]any{"action": map[string]any{"const": name}},
+			"required":   []string{"action"},
+		},
+		"then": map[string]any{
+			"properties": map[string]any{"with": with},
+		},
+	}
+}
+
+// actionSchema returns the schema of the with: of the action spec
+// describes, and the params it requires, which the schema leaves to the
+// rules using it. Templates can stand in for any value.
+func actionSchema(spec action.Spec) (map[string]any, []string) {
+	props := map[string]any{}
+	patterns := map[string]any{}
+	var required []string
+	for _, p := range spec.Params {
+		s := scalar
+		switch p.ParamType() {
+		case action.TypeBoolean, action.TypeInteger, action.TypeNumber:
+			s = map[string]any{"type": []string{p.ParamType(), "string"}}
+		}
+		s = withDescription(s, p.Description)
+		switch {
+		case p.Prefix:
+			patterns["^"+regexp.QuoteMeta(p.Name)] = s
+		case p.Required:
+			required = append(required, p.Name)
+			fallthrough
+		default:
+			props[p.Name] = s
+		}
+	}
+	schema := map[string]any{
+		"type":                 "object",
+		"description":          fmt.Sprintf("Params of the %s action: %s", spec.Name, spec.Description),
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if len(patterns) > 0 {
+		schema["patternProperties"] = patterns
+	}
+	return schema, required
+}
+
+// typeSchema returns the schema of values of type t. Struct types are added
+// to defs and referenced.
+func typeSchema(t reflect.Type, defs map[string]any) map[string]any {
+	switch t {
+	case reflect.TypeFor[time.Duration]():
+		return map[string]any{"type": "string", "pattern": durationPattern}
+	case reflect.TypeFor[ItemList]():
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "array", "items": scalar, "minItems": 1},
+			map[string]any{"type": "string", "description": "Template resolving to a JSON array or one item per line"},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), defs)
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = nil // placeholder, for types that refer to themselves
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{}
+}
+
+// structSchema returns the schema of the struct type t, which allows only
+// the fields t declares.
+func structSchema(t reflect.Type, defs map[string]any) map[string]any {
+	props := map[string]any{}
+	addFields(t, t.Name(), props, defs)
+	return map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+// addFields adds the properties of the fields of t, following inline
+// fields, as fields of owner, the type being described.
+func addFields(t reflect.Type, owner string, props, defs map[string]any) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("yaml")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(opts, "inline") {
+			addFields(f.Type, owner, props, defs)
+			continue
+		}
+		if omittedFields[owner+"."+name] {
+			continue
+		}
+		s := typeSchema(f.Type, defs)
+		switch t.Name() + "." + name {
+		case "Input.default":
+			s = scalar
+		case "Input.enum":
+			s["items"] = scalar
+		case "Input.type":
+			s["enum"] = inputTypes
+		case "Step.with", "Step.env", "Plan.env":
+			s["additionalProperties"] = scalar
+		case "Step.exec":
+			s["items"] = scalar
+			s["minItems"] = 1
+		}
+		props[name] = withDescription(s, fieldDocs[t.Name()+"."+name])
+	}
+}
+
+// withDescription returns a copy of s described by doc.
+func withDescription(s map[string]any, doc string) map[string]any {
+	s = maps.Clone(s)
+	if doc != "" {
+		s["description"] = doc
+	}
+	return s
+}
+
+// requireOneOf returns anyOf alternatives requiring one of keys.
+func requireOneOf(keys []string) []any {
+	alts := make([]any, len(keys))
+	for i, k := range keys {
+		alts[i] = map[string]any{"required": []string{k}}
+	}
+	return alts
+}
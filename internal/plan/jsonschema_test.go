@@ -0,0 +1,86 @@
+package plan
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stevehiehn/declaragent/internal/action"
+)
+
+func TestJSONSchemaDescribesEveryField(t *testing.T) {
+	actions := action.NewRegistry()
+	schema := JSONSchema(actions)
+	if _, err := json.Marshal(schema); err != nil {
+		t.Fatalf("schema does not marshal: %v", err)
+	}
+	if schema["$schema"] != "https://json-schema.org/draft/2020-12/schema" {
+		t.Errorf("unexpected $schema %v", schema["$schema"])
+	}
+
+	objects := map[string]map[string]any{"plan": schema}
+	defs := schema["$defs"].(map[string]any)
+	for name, def := range defs {
+		objects[name] = def.(map[string]any)
+	}
+	for name, obj := range objects {
+		props, _ := obj["properties"].(map[string]any)
+		for key, prop := range props {
+			if prop.(map[string]any)["description"] == nil {
+				t.Errorf("%s.%s has no description", name, key)
+			}
+		}
+	}
+
+	step := defs["Step"].(map[string]any)["properties"].(map[string]any)
+	if got := step["action"].(map[string]any)["enum"]; !slices.Equal(got.([]string), actions.Names()) {
+		t.Errorf("unexpected action enum %v", got)
+	}
+	for _, name := range actions.Names() {
+		if _, ok := defs["action."+name]; !ok {
+			t.Errorf("no with: schema for action %s", name)
+		}
+	}
+	tmpl := defs["StepTemplate"].(map[string]any)["properties"].(map[string]any)
+	if _, ok := tmpl["id"]; ok {
+		t.Error("templates must not allow id")
+	}
+	if _, ok := tmpl["params"]; !ok {
+		t.Error("templates should allow params")
+	}
+}
+
+func TestJSONSchemaActionParams(t *testing.T) {
+	defs := JSONSchema(action.NewRegistry())["$defs"].(map[string]any)
+	write := defs["action.file.write"].(map[string]any)
+	// with: of the steps and templates running file.write
+	withOf := func(def string) map[string]any {
+		for _, rule := range defs[def].(map[string]any)["allOf"].([]any) {
+			rule := rule.(map[string]any)
+			action := rule["if"].(map[string]any)["properties"].(map[string]any)["action"].(map[string]any)
+			if action["const"] == "file.write" {
+				return rule["then"].(map[string]any)["properties"].(map[string]any)["with"].(map[string]any)
+			}
+		}
+		t.Fatalf("no file.write rule for %s", def)
+		return nil
+	}
+	step, tmpl := withOf("Step"), withOf("StepTemplate")
+	if step["$ref"] != "#/$defs/action.file.write" || tmpl["$ref"] != step["$ref"] {
+		t.Errorf("expected steps and templates to check file.write params, got %v and %v", step, tmpl)
+	}
+	if got, _ := step["required"].([]string); !slices.Equal(got, []string{"path", "content"}) {
+		t.Errorf("unexpected required params %v", got)
+	}
+	if _, ok := tmpl["required"]; ok {
+		t.Error("expected templates to leave required params to their steps")
+	}
+	if write["additionalProperties"] != false {
+		t.Error("expected unknown params to be rejected")
+	}
+	data, _ := json.Marshal(defs["action.http"])
+	if !strings.Contains(string(data), `"^header_"`) {
+		t.Errorf("expected header_ params for http, got %s", data)
+	}
+}
@@ -0,0 +1,79 @@
+package plan
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/stevehiehn/declaragent/internal/template"
+)
+
+// nestedShellRe matches the end of a command that hands its next argument
+// to another shell or interpreter: sh -c, bash -lc, eval, ssh host,
+// su user -c, python -c, node -e and the like.
+var nestedShellRe = regexp.MustCompile(`(?:\b(?:ba|da|k|z)?sh(?:\s+-\w+)*\s+-\w*c|\beval|\bssh(?:\s+\S+)+|\bsu(?:\s+\S+)*\s+-c|\b(?:python3?|node|perl|ruby)(?:\s+-\w+)*\s+-[ce])\s*$`)
+
+// Warning is a likely mistake that does not make a plan invalid.
+type Warning struct {
+	StepID  string `json:"step_id,omitempty"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+func (w Warning) String() string {
+	if w.Hint == "" {
+		return w.Message
+	}
+	return w.Message + " (" + w.Hint + ")"
+}
+
+// Lint reports likely mistakes in a valid plan, such as templates whose
+// shell quoting is undone by a nested shell.
+func Lint(p *Plan) []Warning {
+	var warnings []Warning
+	lint := func(s Step) {
+		if s.Run != "" {
+			warnings = append(warnings, lintRun(s)...)
+		}
+	}
+	for _, s := range p.Steps {
+		lint(s)
+		if s.Rollback != nil {
+			lint(s.RollbackStep())
+		}
+	}
+	for _, s := range p.Finally {
+		lint(s)
+	}
+	return warnings
+}
+
+// lintRun checks the templates of a run: command. They are quoted for the
+// shell that runs the command; a shell or interpreter started by the
+// command parses the value again, unquoted.
+func lintRun(s Step) []Warning {
+	refs, unterminated := template.ShellRefs(s.Run)
+	if len(refs) == 0 {
+		return nil
+	}
+	var warnings []Warning
+	if unterminated {
+		warnings = append(warnings, Warning{
+			StepID:  s.ID,
+			Message: fmt.Sprintf("step %q: run: has an unterminated quote, so its templates may not be escaped correctly", s.ID),
+			Hint:    "Close every ' and \" in the command",
+		})
+	}
+	for _, ref := range refs {
+		if ref.Raw || ref.Quote == 0 {
+			continue
+		}
+		if nestedShellRe.MatchString(s.Run[:ref.QuoteStart]) {
+			warnings = append(warnings, Warning{
+				StepID:  s.ID,
+				Message: fmt.Sprintf("step %q: %s is inside a quoted script run by another shell or interpreter, which will interpret its value", s.ID, ref.Source),
+				Hint:    fmt.Sprintf(`Pass it as an argument instead, e.g. sh -c 'echo "$1"' _ %s`, ref.Source),
+			})
+		}
+	}
+	return warnings
+}
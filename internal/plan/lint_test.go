@@ -0,0 +1,43 @@
+package plan
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintWarnsOnNestedShell(t *testing.T) {
+	cases := map[string]bool{
+		`sh -c "deploy ${{inputs.env}}"`:            true,
+		`bash -lc 'echo ${{inputs.env}}'`:           true,
+		`ssh deploy@host "restart ${{inputs.env}}"`: true,
+		`eval "${{inputs.env}}"`:                    true,
+		`python3 -c "print('${{inputs.env}}')"`:     true,
+		`echo "deploying ${{inputs.env}}"`:          false,
+		`sh -c 'deploy "$1"' _ ${{inputs.env}}`:     false,
+		`sh -c "deploy ${{ inputs.env | raw }}"`:    false,
+	}
+	for run, want := range cases {
+		p := &Plan{
+			Name:   "test",
+			Inputs: map[string]Input{"env": {}},
+			Steps:  []Step{{ID: "s1", Run: run}},
+		}
+		warnings := Lint(p)
+		if got := len(warnings) > 0; got != want {
+			t.Errorf("%s: expected warning=%v, got %v", run, want, warnings)
+		}
+	}
+}
+
+func TestLintWarnsOnUnterminatedQuote(t *testing.T) {
+	p := &Plan{
+		Name:    "test",
+		Inputs:  map[string]Input{"env": {}},
+		Steps:   []Step{{ID: "s1", Run: "echo ok"}},
+		Finally: []Step{{ID: "f1", Run: `echo "${{inputs.env}}`}},
+	}
+	warnings := Lint(p)
+	if len(warnings) != 1 || warnings[0].StepID != "f1" || !strings.Contains(warnings[0].Message, "unterminated quote") {
+		t.Fatalf("unexpected warnings %v", warnings)
+	}
+}
@@ -1,32 +1,151 @@
 package plan
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 
-	"gopkg.in/yaml.v3"
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
 )
 
-// LoadFile reads and parses a plan YAML file.
+// LoadFile reads and parses a plan YAML file, recording its absolute path
+// and a hash of its contents and of the plans its uses: steps call. Imports
+// are resolved relative to the file. A plan that parses but has problems,
+// such as unknown fields, is returned along with them, so that Validate can
+// report them together with the rest.
 func LoadFile(path string) (*Plan, error) {
+	return loadFile(path, nil)
+}
+
+// loadFile is LoadFile for a plan called, through uses: steps, by the plans
+// in stack.
+func loadFile(path string, stack []string) (*Plan, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("reading plan file: %w", err)
 	}
-	return Load(data)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	p, err := load(data, path)
+	if p != nil {
+		hashUses(p, append(slices.Clone(stack), path))
+	}
+	return p, err
+}
+
+// hashUses folds the hashes of the plans that the uses: steps of p call
+// into p.Hash, so that editing a called plan changes it too. A plan that
+// cannot be loaded, or that calls one in stack, which Validate reports,
+// adds nothing.
+func hashUses(p *Plan, stack []string) {
+	var steps []Step
+	for _, s := range append(slices.Clone(p.Steps), p.Finally...) {
+		steps = append(steps, s)
+		if s.Rollback != nil {
+			steps = append(steps, s.RollbackStep())
+		}
+	}
+	sums := p.Hash
+	for _, s := range steps {
+		if s.Uses == "" {
+			continue
+		}
+		path := usesPath(p, s.Uses)
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		if slices.Contains(stack, path) {
+			continue
+		}
+		if callee, _ := loadFile(path, stack); callee != nil {
+			sums += "\n" + s.Uses + " " + callee.Hash
+		}
+	}
+	if sums != p.Hash {
+		p.Hash = Hash([]byte(sums))
+	}
+}
+
+// LoadUses loads the plan that a uses: step of p calls. A relative path is
+// taken from the directory of p's file, or from the working directory when p
+// was not loaded from a file.
+func LoadUses(p *Plan, uses string) (*Plan, error) {
+	return LoadFile(usesPath(p, uses))
+}
+
+func usesPath(p *Plan, uses string) string {
+	if !filepath.IsAbs(uses) && p.Path != "" {
+		return filepath.Join(filepath.Dir(p.Path), uses)
+	}
+	return uses
 }
 
-// Load parses plan YAML bytes.
+// Hash returns the hex SHA-256 of plan file contents.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Load parses plan YAML bytes. Imports are resolved relative to the working
+// directory.
 func Load(data []byte) (*Plan, error) {
-	var p Plan
-	if err := yaml.Unmarshal(data, &p); err != nil {
-		return nil, fmt.Errorf("parsing YAML: %w", err)
+	return load(data, "")
+}
+
+// load parses the plan in data, read from path if it is not empty, and
+// applies its step templates. The hash covers imported files too; LoadFile
+// adds the plans called through uses: steps. Problems are returned
+// together, each with its position in the file; unless the YAML itself is
+// broken, with the plan.
+func load(data []byte, path string) (*Plan, error) {
+	p := Plan{file: displayPath(path)}
+	positions, err := decodeStrict(data, &p, p.file)
+	if positions == nil {
+		return nil, err
 	}
+	p.positions = positions
+	errs := dagerrors.All(err)
 	if len(p.Steps) == 0 {
-		return nil, fmt.Errorf("plan has no steps")
+		e := &dagerrors.RunError{Type: dagerrors.ValidationError, Message: "plan has no steps"}
+		p.locate(e, "steps")
+		errs = append(errs, e)
 	}
 	if p.Name == "" {
-		return nil, fmt.Errorf("plan has no name")
+		e := &dagerrors.RunError{Type: dagerrors.ValidationError, Message: "plan has no name"}
+		p.locate(e, "name")
+		errs = append(errs, e)
+	}
+	imported, err := resolveTemplates(&p, path)
+	if err != nil {
+		if more := dagerrors.All(err); more != nil && len(errs) > 0 {
+			err = dagerrors.Join(append(errs, more...))
+		}
+		return nil, err
+	}
+	if path != "" {
+		p.Path = path
+		p.Hash = Hash(append(slices.Clone(data), imported...))
+	}
+	if len(errs) > 0 {
+		p.loadErrs = errs
+		return &p, dagerrors.Join(errs)
 	}
 	return &p, nil
 }
+
+// displayPath returns the absolute path as shown in errors: relative to the
+// working directory when it lies below it.
+func displayPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	return relPath(wd, path)
+}
@@ -1,7 +1,10 @@
 package plan
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoadMinimalPlan(t *testing.T) {
@@ -116,3 +119,123 @@ steps:
 		t.Fatal("expected error for plan with no name")
 	}
 }
+
+func TestLoadParsesNeeds(t *testing.T) {
+	yaml := []byte(`
+name: dag
+steps:
+  - id: build
+    run: make
+    needs: []
+  - id: test
+    run: make test
+    needs: [build]
+`)
+	p, err := Load(yaml)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Steps[0].Needs == nil || len(p.Steps[0].Needs) != 0 {
+		t.Errorf("expected empty non-nil needs on build, got %#v", p.Steps[0].Needs)
+	}
+	if len(p.Steps[1].Needs) != 1 || p.Steps[1].Needs[0] != "build" {
+		t.Errorf("expected test to need build, got %v", p.Steps[1].Needs)
+	}
+	deps := p.Dependencies()
+	if len(deps["build"]) != 0 {
+		t.Errorf("expected build to have no dependencies, got %v", deps["build"])
+	}
+}
+
+func TestDependenciesDefaultToSequential(t *testing.T) {
+	p := &Plan{
+		Name:  "seq",
+		Steps: []Step{{ID: "a"}, {ID: "b"}, {ID: "c"}},
+	}
+	deps := p.Dependencies()
+	if len(deps["a"]) != 0 {
+		t.Errorf("expected a to have no dependencies, got %v", deps["a"])
+	}
+	if len(deps["c"]) != 1 || deps["c"][0] != "b" {
+		t.Errorf("expected c to depend on b, got %v", deps["c"])
+	}
+}
+
+func TestLoadParsesRetryDurations(t *testing.T) {
+	yaml := []byte(`
+name: retry
+steps:
+  - id: s1
+    run: make
+    retry:
+      max_attempts: 4
+      initial_backoff: 500ms
+      max_backoff: 10s
+      jitter: 0.2
+      on_exit_codes: [75]
+`)
+	p, err := Load(yaml)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := p.Steps[0].Retry
+	if r == nil || r.MaxAttempts != 4 || r.InitialBackoff != 500*time.Millisecond || r.MaxBackoff != 10*time.Second {
+		t.Fatalf("unexpected retry policy: %+v", r)
+	}
+}
+
+func TestLoadParsesTimeouts(t *testing.T) {
+	yaml := []byte(`
+name: timeouts
+timeout: 10m
+steps:
+  - id: s1
+    run: kubectl rollout status deploy/api
+    timeout: 90s
+`)
+	p, err := Load(yaml)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Timeout != 10*time.Minute || p.Steps[0].Timeout != 90*time.Second {
+		t.Errorf("unexpected timeouts: plan=%s step=%s", p.Timeout, p.Steps[0].Timeout)
+	}
+}
+
+func TestLoadFileRecordsPathAndHash(t *testing.T) {
+	data := []byte("name: hashed\nsteps:\n  - id: s1\n    run: echo hi\n")
+	path := filepath.Join(t.TempDir(), "plan.yaml")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Path != path {
+		t.Errorf("expected path %q, got %q", path, p.Path)
+	}
+	if p.Hash == "" || p.Hash != Hash(data) {
+		t.Errorf("expected hash of file contents, got %q", p.Hash)
+	}
+}
+
+func TestLoadParsesRollback(t *testing.T) {
+	yaml := []byte(`
+name: rollback
+steps:
+  - id: tag
+    run: git tag v1
+    destructive: true
+    rollback:
+      run: git tag -d v1
+`)
+	p, err := Load(yaml)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rb := p.Steps[0].RollbackStep()
+	if rb.ID != "tag.rollback" || rb.Run != "git tag -d v1" {
+		t.Errorf("unexpected rollback step %+v", rb)
+	}
+}
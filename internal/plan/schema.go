@@ -1,33 +1,109 @@
 package plan
 
+import (
+	"slices"
+	"time"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+)
+
 // Plan is the top-level runbook structure.
 type Plan struct {
-	Name        string           `yaml:"name"`
-	Description string           `yaml:"description,omitempty"`
-	Inputs      map[string]Input `yaml:"inputs,omitempty"`
-	Steps       []Step           `yaml:"steps"`
+	Name        string            `yaml:"name"`
+	Description string            `yaml:"description,omitempty"`
+	Inputs      map[string]Input  `yaml:"inputs,omitempty"`
+	AllowEnv    []string          `yaml:"allow_env,omitempty"`  // environment variables templates may read as env.*
+	SecretEnv   []string          `yaml:"secret_env,omitempty"` // like AllowEnv, but their values are masked like secret inputs
+	Env         map[string]string `yaml:"env,omitempty"`        // environment variables of every run and exec step
+	CleanEnv    bool              `yaml:"clean_env,omitempty"`  // run and exec steps inherit only CleanEnvVars and EnvNames
+	Timeout     time.Duration     `yaml:"timeout,omitempty"`    // bounds the whole run; 0 means none
+	Steps       []Step            `yaml:"steps"`
+	Finally     []Step            `yaml:"finally,omitempty"` // always run after Steps, in order
+	Outputs     map[string]string `yaml:"outputs,omitempty"` // name → template, resolved when the run ends
+	Imports     []string          `yaml:"imports,omitempty"` // files of step templates, relative to this file
+
+	Templates map[string]StepTemplate `yaml:"templates,omitempty"` // after loading, includes imported templates
+
+	Path string `yaml:"-"` // absolute path of the file, set by LoadFile
+	Hash string `yaml:"-"` // SHA-256 of the file contents, set by LoadFile
+
+	file      string                // path of the file as shown in errors
+	positions map[string]Pos        // where each key and list item is, by path
+	loadErrs  []*dagerrors.RunError // problems found parsing the file, reported by Validate too
 }
 
-// Input defines a plan-level input parameter.
+// Input defines a plan-level input parameter. Values are always passed to
+// steps as strings; Type and the constraints decide which strings are valid.
 type Input struct {
-	Required    bool   `yaml:"required,omitempty"`
-	Description string `yaml:"description,omitempty"`
-	Default     string `yaml:"default,omitempty"`
+	Required    bool     `yaml:"required,omitempty"`
+	Description string   `yaml:"description,omitempty"`
+	Default     string   `yaml:"default,omitempty"`
+	Type        string   `yaml:"type,omitempty"`    // string (default), integer, number, boolean, array or json
+	Enum        []string `yaml:"enum,omitempty"`    // allowed values
+	Pattern     string   `yaml:"pattern,omitempty"` // regex a string value must match
+	Min         *float64 `yaml:"min,omitempty"`     // minimum value, string length or array length
+	Max         *float64 `yaml:"max,omitempty"`     // maximum value, string length or array length
+	Secret      bool     `yaml:"secret,omitempty"`
 }
 
 // Step defines a single step in a plan.
-// Exactly one of Run, Action, or HTTP must be set.
+// Exactly one of Run, Exec, Action, HTTP or Uses must be set.
 type Step struct {
-	ID          string            `yaml:"id"`
-	Description string            `yaml:"name,omitempty"`
-	Run         string            `yaml:"run,omitempty"`
-	Action      string            `yaml:"action,omitempty"`
-	Params      map[string]string `yaml:"with,omitempty"`
-	Outputs     map[string]string `yaml:"outputs,omitempty"`
-	Destructive bool              `yaml:"destructive,omitempty"`
+	ID          string              `yaml:"id"`
+	Description string              `yaml:"name,omitempty"`
+	Run         string              `yaml:"run,omitempty"`
+	Exec        []string            `yaml:"exec,omitempty"` // program and arguments, run without a shell
+	Action      string              `yaml:"action,omitempty"`
+	Uses        string              `yaml:"uses,omitempty"` // path of a plan to run, relative to this plan's file
+	Params      map[string]string   `yaml:"with,omitempty"` // action params, or inputs of the plan in Uses
+	Outputs     map[string]string   `yaml:"outputs,omitempty"`
+	Destructive bool                `yaml:"destructive,omitempty"`
+	Needs       []string            `yaml:"needs,omitempty"`
+	If          string              `yaml:"if,omitempty"` // condition; the step is skipped when false
+	Retry       *RetryPolicy        `yaml:"retry,omitempty"`
+	Timeout     time.Duration       `yaml:"timeout,omitempty"`  // per attempt; 0 means none
+	Rollback    *Step               `yaml:"rollback,omitempty"` // undoes the step if a later step fails
+	Foreach     *ItemList           `yaml:"foreach,omitempty"`  // runs the step once per item
+	Matrix      map[string]ItemList `yaml:"matrix,omitempty"`   // runs the step once per combination of the named lists
+	Parallel    bool                `yaml:"parallel,omitempty"` // runs the items of foreach or matrix at once
+	Template    string              `yaml:"template,omitempty"` // step template this step is based on
+	Args        map[string]string   `yaml:"-"`                  // params.* values, set when the template declares params
 
 	// HTTP step fields
 	HTTP *HTTPRequest `yaml:"http,omitempty"`
+
+	// Run and exec step fields
+	Env                 map[string]string `yaml:"env,omitempty"`                   // set over the plan's env
+	Dir                 string            `yaml:"dir,omitempty"`                   // relative to the working directory
+	AllowOutsideWorkdir bool              `yaml:"allow_outside_workdir,omitempty"` // lets Dir leave the working directory
+	Stdin               string            `yaml:"stdin,omitempty"`                 // piped to the process
+}
+
+// CleanEnvVars are the variables run and exec steps inherit from
+// declaragent's environment when the plan sets clean_env.
+var CleanEnvVars = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TMPDIR", "LANG", "LC_ALL", "TERM", "TZ"}
+
+// EnvNames returns the environment variables templates may read as env.*,
+// those of allow_env and of secret_env.
+func (p *Plan) EnvNames() []string {
+	return slices.Concat(p.AllowEnv, p.SecretEnv)
+}
+
+// RollbackStep returns the rollback of s as a step of its own, with the ID
+// "<id>.rollback".
+func (s Step) RollbackStep() Step {
+	rb := *s.Rollback
+	rb.ID = s.ID + ".rollback"
+	if rb.Description == "" {
+		rb.Description = "Roll back " + s.ID
+	}
+	return rb
+}
+
+// SendsHTTP reports whether s is an http: step or an action: http step,
+// whose failures are classified and retried alike.
+func (s Step) SendsHTTP() bool {
+	return s.HTTP != nil || s.Action == "http"
 }
 
 // HTTPRequest defines an HTTP request step.
@@ -37,3 +113,49 @@ type HTTPRequest struct {
 	Headers map[string]string `yaml:"headers,omitempty"`
 	Body    string            `yaml:"body,omitempty"` // template-resolved string
 }
+
+// RetryPolicy controls how a failing step is retried.
+// Transient failures (HTTP 429/502/503/504, timeouts and refused or reset
+// connections) are always retried. Other http and action: http failures are
+// not, except for the statuses in OnHTTPStatus. Shell, exec and other action
+// failures are retried too, unless OnExitCodes narrows run and exec retries
+// to specific exit codes.
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"max_attempts"`              // total tries, including the first
+	InitialBackoff time.Duration `yaml:"initial_backoff,omitempty"` // default: 1s
+	MaxBackoff     time.Duration `yaml:"max_backoff,omitempty"`     // default: 30s
+	Multiplier     float64       `yaml:"multiplier,omitempty"`      // default: 2
+	Jitter         float64       `yaml:"jitter,omitempty"`          // 0–1, fraction of each delay randomised
+	OnExitCodes    []int         `yaml:"on_exit_codes,omitempty"`
+	OnHTTPStatus   []int         `yaml:"on_http_status,omitempty"`
+}
+
+// Retry backoff defaults.
+const (
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultMultiplier     = 2.0
+)
+
+// Delay returns how long to wait after the given failed attempt (1-based),
+// before jitter is applied.
+func (r *RetryPolicy) Delay(attempt int) time.Duration {
+	initial, maxDelay, mult := r.InitialBackoff, r.MaxBackoff, r.Multiplier
+	if initial == 0 {
+		initial = DefaultInitialBackoff
+	}
+	if maxDelay == 0 {
+		maxDelay = DefaultMaxBackoff
+	}
+	if mult == 0 {
+		mult = DefaultMultiplier
+	}
+	d := float64(initial)
+	for i := 1; i < attempt; i++ {
+		d *= mult
+		if d >= float64(maxDelay) {
+			return maxDelay
+		}
+	}
+	return min(time.Duration(d), maxDelay)
+}
@@ -1,202 +1,1185 @@
 package plan
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/stevehiehn/declaragent/internal/action"
 	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+	"github.com/stevehiehn/declaragent/internal/extract"
+	"github.com/stevehiehn/declaragent/internal/template"
 )
 
-var knownActions = map[string]bool{
-	"file.write":  true,
-	"file.append": true,
-	"json.get":    true,
-	"json.set":    true,
-	"env.get":     true,
-	"http":        true,
-}
+// Raw values run and http steps can extract outputs from; action steps use
+// the outputs their action declares
+var (
+	runOutputSources  = []string{"stdout", "stderr", "exit_code"}
+	httpOutputSources = []string{"stdout", "status_code"}
+)
+
+// run.* fields; status and failed_step describe the finished main steps
+var (
+	knownRunFields   = map[string]bool{"id": true, "workdir": true, "started_at": true, "status": true, "failed_step": true}
+	outcomeRunFields = map[string]bool{"status": true, "failed_step": true}
+	knownPlanFields  = map[string]bool{"name": true}
+	knownStepFields  = map[string]bool{"status": true, "exit_code": true, "duration": true}
+)
+
+var matrixNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
 
-var templateRefRe = regexp.MustCompile(`\$\{\{steps\.([^.}]+)\.outputs\.([^}]+)\}\}`)
-var templateInputRe = regexp.MustCompile(`\$\{\{inputs\.([^}]+)\}\}`)
+const runFieldsHint = "Known fields: run.id, run.workdir, run.started_at, run.status, run.failed_step"
 
-// Validate checks a plan for structural correctness.
+// Validate checks a plan for structural correctness, including the plans
+// its uses: steps call. It reports every problem found: one as a
+// *dagerrors.RunError, several as a dagerrors.ErrorList. Problems in a plan
+// loaded from a file carry their position in it. Action steps may use the
+// built-in actions.
 func Validate(p *Plan, providedInputs map[string]string) error {
-	seen := map[string]int{}
-	stepOutputs := map[string]map[string]bool{}
+	return ValidateWith(p, providedInputs, action.NewRegistry())
+}
+
+// ValidateWith is like Validate, with the actions of actions.
+func ValidateWith(p *Plan, providedInputs map[string]string, actions *action.Registry) error {
+	var stack []string
+	if p.Path != "" {
+		stack = append(stack, p.Path)
+	}
+	errs := append(slices.Clone(p.loadErrs), validate(p, providedInputs, stack, actions)...)
+	// Problems of this file first, top to bottom, then those of called plans
+	other := func(e *dagerrors.RunError) int {
+		if e.File == p.file {
+			return 0
+		}
+		return 1
+	}
+	slices.SortStableFunc(errs, func(a, b *dagerrors.RunError) int {
+		return cmp.Or(
+			cmp.Compare(other(a), other(b)),
+			cmp.Compare(a.File, b.File),
+			cmp.Compare(a.Line, b.Line),
+			cmp.Compare(a.Column, b.Column),
+		)
+	})
+	return dagerrors.Join(errs)
+}
+
+// validator collects the problems of a plan.
+type validator struct {
+	p           *Plan
+	actions     *action.Registry
+	seen        map[string]int             // step ID → position in steps followed by finally
+	stepOutputs map[string]map[string]bool // step ID → declared outputs
+	errs        []*dagerrors.RunError
+}
+
+// add records err, found at path in the plan, e.g. steps[1].retry. A
+// problem already reported at the same place is dropped.
+func (v *validator) add(path string, err *dagerrors.RunError) {
+	if err.File == "" && err.Line == 0 {
+		v.p.locate(err, path)
+	}
+	for _, e := range v.errs {
+		if e.Message == err.Message && e.File == err.File && e.Line == err.Line {
+			return
+		}
+	}
+	v.errs = append(v.errs, err)
+}
+
+// validate checks p, which was reached through the plan files in stack.
+func validate(p *Plan, providedInputs map[string]string, stack []string, actions *action.Registry) []*dagerrors.RunError {
+	v := &validator{p: p, actions: actions, seen: map[string]int{}, stepOutputs: map[string]map[string]bool{}}
+
+	v.checkInputs(providedInputs)
 
 	// Check required inputs (skip if providedInputs is nil, e.g. validate-only mode)
 	if providedInputs != nil {
-		for name, inp := range p.Inputs {
-			if inp.Required {
-				if _, ok := providedInputs[name]; !ok {
-					if inp.Default == "" {
-						return &dagerrors.RunError{
-							Type:    dagerrors.ValidationError,
-							Message: fmt.Sprintf("missing required input %q", name),
-							Hint:    fmt.Sprintf("Provide --input %s=<value>", name),
-						}
+		for _, name := range slices.Sorted(maps.Keys(p.Inputs)) {
+			inp := p.Inputs[name]
+			if _, ok := providedInputs[name]; !ok && inp.Required && inp.Default == "" {
+				v.add("", &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("missing required input %q", name),
+					Hint:    fmt.Sprintf("Provide --input %s=<value>", name),
+				})
+			}
+		}
+	}
+
+	if p.Timeout < 0 {
+		v.add("timeout", &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: "plan timeout must not be negative",
+		})
+	}
+
+	v.registerSteps(p.Steps, "steps", "step")
+	v.checkNeeds()
+	v.registerSteps(p.Finally, "finally", "finally step")
+	v.checkUses(stack)
+
+	deps := p.Dependencies()
+	explicitNeeds := p.HasNeeds()
+	for i, s := range p.Steps {
+		path := fmt.Sprintf("steps[%d]", i)
+		scope := stepScope{path: path, index: i, ancestors: Ancestors(deps, s.ID), explicitNeeds: explicitNeeds}
+		v.checkStep(s, scope)
+		if s.Rollback != nil {
+			v.checkRollback(s, scope)
+		}
+	}
+
+	// Finally steps run one after another once every main step is done
+	finished := map[string]bool{}
+	for _, s := range p.Steps {
+		finished[s.ID] = true
+	}
+	for j, s := range p.Finally {
+		path := fmt.Sprintf("finally[%d]", j)
+		if len(s.Needs) > 0 {
+			v.add(path+".needs", &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("finally step %q cannot use needs", s.ID),
+				Hint:    "Finally steps run in order after all main steps",
+			})
+		}
+		if s.Rollback != nil {
+			v.add(path+".rollback", &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("finally step %q cannot have a rollback", s.ID),
+			})
+		}
+		ancestors := maps.Clone(finished)
+		scope := stepScope{path: path, index: len(p.Steps) + j, ancestors: ancestors, finally: true}
+		v.checkStep(s, scope)
+		finished[s.ID] = true
+	}
+
+	v.checkPlanEnv()
+	v.checkPlanOutputs()
+	return v.errs
+}
+
+// checkPlanOutputs validates the plan-level outputs. They are resolved after
+// every step, including finally steps, has finished.
+func (v *validator) checkPlanOutputs() {
+	p := v.p
+	for _, name := range slices.Sorted(maps.Keys(p.Outputs)) {
+		tmpl := p.Outputs[name]
+		path := "outputs." + name
+		where := fmt.Sprintf("plan output %q", name)
+		v.checkTemplates(path, where, tmpl)
+		refs := template.Refs(tmpl)
+		v.checkRefNames(nil, path, where, refs)
+		for _, ref := range refs {
+			switch ref.Namespace {
+			case "steps":
+				if _, ok := v.seen[ref.Step]; !ok {
+					msg := fmt.Sprintf("plan output %q references unknown step %q", name, ref.Step)
+					if knownStepFields[ref.Field] {
+						msg = fmt.Sprintf("plan output %q references %s of unknown step %q", name, ref.Field, ref.Step)
 					}
+					v.add(path, &dagerrors.RunError{
+						Type:    dagerrors.ValidationError,
+						Message: msg,
+					})
+					continue
+				}
+				if ref.Field == "outputs" && !v.stepOutputs[ref.Step][ref.Name] {
+					v.add(path, &dagerrors.RunError{
+						Type:    dagerrors.ValidationError,
+						Message: fmt.Sprintf("plan output %q references non-existent output %q on step %q", name, ref.Name, ref.Step),
+						Hint:    fmt.Sprintf("Declare %q under outputs: of step %q", ref.Name, ref.Step),
+					})
 				}
+			case "run":
+				if !knownRunFields[ref.Name] {
+					v.add(path, &dagerrors.RunError{
+						Type:    dagerrors.ValidationError,
+						Message: fmt.Sprintf("plan output %q references unknown run field %q", name, ref.Name),
+						Hint:    runFieldsHint,
+					})
+				}
+			case "inputs":
+				if _, ok := p.Inputs[ref.Name]; !ok {
+					v.add(path, &dagerrors.RunError{
+						Type:    dagerrors.ValidationError,
+						Message: fmt.Sprintf("plan output %q references unknown input %q", name, ref.Name),
+					})
+				}
+			}
+		}
+	}
+}
+
+// checkInputs checks the input declarations of the plan and, unless
+// provided is nil, the values given for them.
+func (v *validator) checkInputs(provided map[string]string) {
+	for _, name := range slices.Sorted(maps.Keys(v.p.Inputs)) {
+		inp := v.p.Inputs[name]
+		if err := inp.checkDecl(); err != nil {
+			v.add("inputs."+name, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("input %q: %v", name, err),
+				Hint:    "Input types are " + strings.Join(inputTypes, ", ") + "; pattern applies to strings, min/max to numbers, string length and array length",
+			})
+			continue
+		}
+		value, ok := provided[name]
+		if !ok {
+			continue
+		}
+		if err := inp.Check(value); err != nil {
+			msg := err.Error()
+			if inp.Secret && value != "" {
+				// Check shows values quoted with %q, which escapes some characters
+				msg = strings.ReplaceAll(msg, strconv.Quote(value), `"***"`)
+				msg = strings.ReplaceAll(msg, value, "***")
 			}
+			v.add("", &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("invalid value for input %q: %s", name, msg),
+				Hint:    inputHint(name, inp),
+			})
 		}
 	}
+}
+
+// inputHint describes the values input name accepts.
+func inputHint(name string, inp Input) string {
+	var parts []string
+	switch {
+	case len(inp.Enum) > 0:
+		parts = append(parts, "one of "+strings.Join(inp.Enum, ", "))
+	case inp.InputType() == TypeArray:
+		parts = append(parts, `a JSON array, e.g. ["a","b"]`)
+	case inp.InputType() == TypeJSON:
+		parts = append(parts, "a JSON value")
+	default:
+		parts = append(parts, "type "+inp.InputType())
+	}
+	if inp.Pattern != "" {
+		parts = append(parts, "matching "+inp.Pattern)
+	}
+	if inp.Min != nil {
+		parts = append(parts, "min "+formatFloat(*inp.Min))
+	}
+	if inp.Max != nil {
+		parts = append(parts, "max "+formatFloat(*inp.Max))
+	}
+	return fmt.Sprintf("Provide --input %s=<value>: %s", name, strings.Join(parts, ", "))
+}
 
+// checkUses validates the plans called by the uses: steps of the plan and
+// records their outputs as the outputs of those steps. stack holds the files
+// of the plans that led to it, so a plan calling itself is caught.
+func (v *validator) checkUses(stack []string) {
+	p := v.p
+	type usesStep struct {
+		path string
+		step Step
+	}
+	var steps []usesStep
 	for i, s := range p.Steps {
+		steps = append(steps, usesStep{fmt.Sprintf("steps[%d]", i), s})
+	}
+	for j, s := range p.Finally {
+		steps = append(steps, usesStep{fmt.Sprintf("finally[%d]", j), s})
+	}
+	for i, s := range p.Steps {
+		if s.Rollback != nil {
+			steps = append(steps, usesStep{fmt.Sprintf("steps[%d].rollback", i), s.RollbackStep()})
+		}
+	}
+	for _, us := range steps {
+		s, path := us.step, us.path
+		if s.Uses == "" {
+			continue
+		}
+		callee, err := LoadUses(p, s.Uses)
+		if err != nil {
+			v.add(path+".uses", &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: uses: %v", s.ID, err),
+				Hint:    "uses: paths are relative to the file of the calling plan",
+			})
+			continue
+		}
+		chain := append(slices.Clone(stack), callee.Path)
+		if start := slices.Index(stack, callee.Path); start >= 0 {
+			var names []string
+			for _, path := range chain[start:] {
+				names = append(names, filepath.Base(path))
+			}
+			v.add(path+".uses", &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: uses: plan cycle %s", s.ID, strings.Join(names, " -> ")),
+				Hint:    "A plan cannot call itself, directly or through other plans",
+			})
+			continue
+		}
+		// Problems of the called plan keep their position in its file
+		for _, re := range validate(callee, nil, chain, v.actions) {
+			wrapped := *re
+			wrapped.Message = fmt.Sprintf("step %q: %s: %s", s.ID, s.Uses, re.Message)
+			v.add(path+".uses", &wrapped)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(s.Params)) {
+			at := path + ".with." + name
+			inp, ok := callee.Inputs[name]
+			if !ok {
+				hint := s.Uses + " declares no inputs"
+				if len(callee.Inputs) > 0 {
+					hint = "Inputs of " + s.Uses + ": " + strings.Join(slices.Sorted(maps.Keys(callee.Inputs)), ", ")
+				}
+				v.add(at, &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q passes unknown input %q to %s", s.ID, name, s.Uses),
+					Hint:    hint,
+				})
+				continue
+			}
+			// Values without templates are known now
+			if value := s.Params[name]; !strings.Contains(value, "${{") {
+				if err := inp.Check(value); err != nil {
+					v.add(at, &dagerrors.RunError{
+						Type:    dagerrors.ValidationError,
+						Message: fmt.Sprintf("step %q: invalid value for input %q of %s: %v", s.ID, name, s.Uses, err),
+						Hint:    inputHint(name, inp),
+					})
+				}
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(callee.Inputs)) {
+			inp := callee.Inputs[name]
+			if _, ok := s.Params[name]; !ok && inp.Required && inp.Default == "" {
+				v.add(path+".uses", &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q does not pass required input %q to %s", s.ID, name, s.Uses),
+					Hint:    fmt.Sprintf("Add %s to the with: of step %q", name, s.ID),
+				})
+			}
+		}
+
+		if len(callee.Outputs) > 0 {
+			v.stepOutputs[s.ID] = map[string]bool{}
+			for name := range callee.Outputs {
+				v.stepOutputs[s.ID][name] = true
+			}
+		}
+	}
+}
+
+// registerSteps checks the IDs of steps, found at path (steps or finally),
+// and records them, with their outputs, in v.seen and v.stepOutputs.
+func (v *validator) registerSteps(steps []Step, path, kind string) {
+	for i, s := range steps {
+		at := fmt.Sprintf("%s[%d]", path, i)
 		// Duplicate ID check
 		if s.ID == "" {
-			return &dagerrors.RunError{
+			v.add(at, &dagerrors.RunError{
 				Type:    dagerrors.ValidationError,
-				Message: fmt.Sprintf("step at index %d has no id", i),
-			}
+				Message: fmt.Sprintf("%s at index %d has no id", kind, i),
+			})
+			continue
 		}
-		if _, dup := seen[s.ID]; dup {
-			return &dagerrors.RunError{
+		if _, dup := v.seen[s.ID]; dup {
+			v.add(at+".id", &dagerrors.RunError{
 				Type:    dagerrors.ValidationError,
 				Message: fmt.Sprintf("duplicate step id %q", s.ID),
+			})
+			continue
+		}
+		v.seen[s.ID] = len(v.seen)
+
+		// Register outputs
+		if len(s.Outputs) > 0 {
+			v.stepOutputs[s.ID] = map[string]bool{}
+			for k := range s.Outputs {
+				v.stepOutputs[s.ID][k] = true
 			}
 		}
-		seen[s.ID] = i
+	}
+}
+
+// checkRollback validates the rollback of s. A rollback only runs after s
+// succeeded, so it may use the outputs of s and of everything s depends on.
+// Steps run once per item have none, since it would not know which items to
+// undo.
+func (v *validator) checkRollback(s Step, scope stepScope) {
+	rb := s.Rollback
+	path := scope.path + ".rollback"
+	var problem, field string
+	switch {
+	case rb.ID != "":
+		problem, field = "id is not allowed, it is always "+s.RollbackStep().ID, "id"
+	case len(rb.Needs) > 0:
+		problem, field = "needs is not allowed", "needs"
+	case rb.Rollback != nil:
+		problem, field = "a rollback cannot have its own rollback", "rollback"
+	}
+	if problem != "" {
+		v.add(path+"."+field, &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: rollback: %s", s.ID, problem),
+		})
+	}
+	if s.Expanded() {
+		v.add(path, &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: foreach and matrix steps cannot have a rollback", s.ID),
+			Hint:    "Undo the items in a finally: step that checks ${{run.status}}",
+		})
+	}
+	if _, dup := v.seen[s.RollbackStep().ID]; dup {
+		v.add(path, &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("duplicate step id %q", s.RollbackStep().ID),
+			Hint:    fmt.Sprintf("The rollback of step %q uses this id", s.ID),
+		})
+	}
+
+	scope.path = path
+	scope.ancestors = maps.Clone(scope.ancestors)
+	scope.ancestors[s.ID] = true
+	v.checkStep(s.RollbackStep(), scope)
+}
+
+// stepScope describes where a step sits in the plan.
+type stepScope struct {
+	path          string          // e.g. steps[2] or finally[0].rollback
+	index         int             // position in steps followed by finally
+	ancestors     map[string]bool // steps guaranteed to finish first
+	explicitNeeds bool
+	finally       bool
+}
+
+// checkOutputs validates the output sources of s.
+func (v *validator) checkOutputs(s Step, path string) {
+	var sources []string
+	switch {
+	case s.Run != "" || len(s.Exec) > 0:
+		sources = runOutputSources
+	case s.HTTP != nil:
+		sources = httpOutputSources
+	default:
+		if act, err := v.actions.Get(s.Action); err == nil {
+			sources = act.Spec().Outputs
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Outputs)) {
+		at := path + ".outputs." + name
+		spec, err := extract.Parse(s.Outputs[name])
+		if err != nil {
+			v.add(at, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: output %q: %v", s.ID, name, err),
+				Hint:    "Sources look like: stdout | regex:(v\\d+) or stdout | json:$.items[0].name or stdout | lines[0]",
+			})
+			continue
+		}
+		if !slices.Contains(sources, spec.Source) {
+			v.add(at, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: output %q has unknown source %q", s.ID, name, spec.Source),
+				Hint:    "Available sources for this step: " + strings.Join(sources, ", "),
+			})
+		}
+	}
+}
+
+// isForward reports whether the step at idx runs after this one in a way
+// needs: cannot change: later in a sequential plan, or in finally.
+func (sc stepScope) isForward(p *Plan, idx int) bool {
+	if idx < sc.index {
+		return false
+	}
+	return sc.finally || !sc.explicitNeeds || idx >= len(p.Steps)
+}
+
+// checkStep validates s. Errors in a step based on a template say where the
+// template is defined.
+func (v *validator) checkStep(s Step, scope stepScope) {
+	before := len(v.errs)
+	v.checkStepFields(s, scope)
+	t, ok := v.p.Templates[s.Template]
+	if !ok {
+		return
+	}
+	for _, re := range v.errs[before:] {
+		re.Message = fmt.Sprintf("%s (template %q at %s)", re.Message, s.Template, t.Source)
+	}
+}
+
+func (v *validator) checkStepFields(s Step, scope stepScope) {
+	p, path := v.p, scope.path
 
-		// Exactly one of run, action, or http must be set
-		hasRun := s.Run != ""
-		hasAction := s.Action != ""
-		hasHTTP := s.HTTP != nil
-		count := 0
-		if hasRun {
+	// Exactly one of run, exec, action, http or uses must be set
+	hasRun := s.Run != ""
+	hasExec := len(s.Exec) > 0
+	hasAction := s.Action != ""
+	hasHTTP := s.HTTP != nil
+	hasUses := s.Uses != ""
+	count := 0
+	for _, has := range []bool{hasRun, hasExec, hasAction, hasHTTP, hasUses} {
+		if has {
 			count++
 		}
+	}
+	if count > 1 {
+		v.add(path, &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q has multiple of run/exec/action/http/uses", s.ID),
+			Hint:    "A step must have exactly one of: run, exec, action, http or uses",
+		})
+	}
+	if count == 0 {
+		v.add(path, &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q has none of run/exec/action/http/uses", s.ID),
+			Hint:    "A step must have exactly one of: run, exec, action, http or uses",
+		})
+	}
+
+	// The outputs of a uses step are those of the plan it calls
+	if hasUses && len(s.Outputs) > 0 {
+		v.add(path+".outputs", &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: outputs is not allowed with uses", s.ID),
+			Hint:    fmt.Sprintf("Declare outputs: in %s; they become the outputs of step %q", s.Uses, s.ID),
+		})
+	}
+
+	if s.Exec != nil && !hasExec {
+		v.add(path+".exec", &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: exec needs at least the program to run", s.ID),
+			Hint:    "List the program and its arguments, e.g. exec: [git, commit, -m, \"${{ inputs.msg }}\"]",
+		})
+	}
+	v.checkProcess(s, path, hasRun || hasExec)
+
+	// Validate HTTP step fields
+	if hasHTTP && s.HTTP.URL == "" {
+		v.add(path+".http", &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: http requires a url", s.ID),
+		})
+	}
+
+	if s.Timeout < 0 {
+		v.add(path+".timeout", &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: timeout must not be negative", s.ID),
+		})
+	}
+
+	if s.Retry != nil {
+		v.checkRetry(s, path)
+	}
+
+	// Check action name
+	if hasAction && !v.actions.Known(s.Action) {
+		v.add(path+".action", &dagerrors.RunError{
+			Type:    dagerrors.ToolNotFound,
+			Message: fmt.Sprintf("step %q: unknown action %q", s.ID, s.Action),
+			Hint:    "Known actions: " + strings.Join(v.actions.Names(), ", "),
+		})
+	} else if count == 1 && !hasUses {
+		// Output sources depend on what kind of step s is
+		v.checkOutputs(s, path)
 		if hasAction {
-			count++
+			v.checkActionParams(s, path)
 		}
-		if hasHTTP {
-			count++
+	}
+
+	v.checkExpansion(s, path)
+	v.checkParams(s, path)
+
+	// Check condition syntax
+	if s.If != "" {
+		if err := template.CheckCondition(s.If, listRefs(p)); err != nil {
+			v.add(path+".if", &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: invalid if: condition: %v", s.ID, err),
+				Hint:    "Conditions combine ${{...}} expressions and quoted literals with ==, !=, <, <=, >, >=, !, && and ||",
+			})
+		}
+	}
+
+	where := fmt.Sprintf("step %q", s.ID)
+	for _, f := range stepStrings(s) {
+		if f.path != ".if" {
+			v.checkTemplates(path+f.path, where, f.value)
+		}
+	}
+	refs := stepRefs(s)
+	for _, ref := range refs {
+		v.checkRefNames(&s, path+ref.path, where, []template.Ref{ref.Ref})
+	}
+
+	// A referenced step must be guaranteed to finish first
+	ancestors := scope.ancestors
+	for _, ref := range refs {
+		if ref.Namespace != "steps" || !knownStepFields[ref.Field] {
+			continue
 		}
-		if count > 1 {
-			return &dagerrors.RunError{
+		at := path + ref.path
+		id, field := ref.Step, ref.Field
+		if _, exists := v.seen[id]; !exists {
+			v.add(at, &dagerrors.RunError{
 				Type:    dagerrors.ValidationError,
-				Message: fmt.Sprintf("step %q has multiple of run/action/http", s.ID),
-				Hint:    "A step must have exactly one of: run, action, or http",
+				Message: fmt.Sprintf("step %q references %s of unknown step %q", s.ID, field, id),
+			})
+			continue
+		}
+		if !ancestors[id] {
+			if scope.isForward(p, v.seen[id]) {
+				v.add(at, &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q has forward reference to %s of step %q", s.ID, field, id),
+				})
+				continue
 			}
+			v.add(at, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q references %s of step %q, which it does not depend on", s.ID, field, id),
+				Hint:    fmt.Sprintf("Add %q to the needs: list of step %q", id, s.ID),
+			})
+		}
+	}
+	for _, ref := range refs {
+		if ref.Namespace != "steps" || ref.Field != "outputs" {
+			continue
 		}
-		if count == 0 {
-			return &dagerrors.RunError{
+		at := path + ref.path
+		idx, exists := v.seen[ref.Step]
+		if !exists {
+			v.add(at, &dagerrors.RunError{
 				Type:    dagerrors.ValidationError,
-				Message: fmt.Sprintf("step %q has none of run/action/http", s.ID),
-				Hint:    "A step must have exactly one of: run, action, or http",
+				Message: fmt.Sprintf("step %q references unknown step %q", s.ID, ref.Step),
+			})
+			continue
+		}
+		if !ancestors[ref.Step] {
+			if scope.isForward(p, idx) {
+				v.add(at, &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q has forward reference to step %q", s.ID, ref.Step),
+				})
+				continue
 			}
+			v.add(at, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q references step %q, which it does not depend on", s.ID, ref.Step),
+				Hint:    fmt.Sprintf("Add %q to the needs: list of step %q", ref.Step, s.ID),
+			})
+			continue
+		}
+		// Check output name exists
+		if outs, ok := v.stepOutputs[ref.Step]; !ok {
+			v.add(at, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q references step %q which has no outputs", s.ID, ref.Step),
+			})
+		} else if !outs[ref.Name] {
+			v.add(at, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q references non-existent output %q on step %q", s.ID, ref.Name, ref.Step),
+			})
+		}
+	}
+
+	// Check input refs
+	for _, ref := range refs {
+		if ref.Namespace != "inputs" {
+			continue
+		}
+		if _, ok := p.Inputs[ref.Name]; !ok {
+			v.add(path+ref.path, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q references unknown input %q", s.ID, ref.Name),
+			})
 		}
+	}
+
+	for _, ref := range refs {
+		if ref.Namespace != "run" {
+			continue
+		}
+		name := ref.Name
+		if !knownRunFields[name] {
+			v.add(path+ref.path, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q references unknown run field %q", s.ID, name),
+				Hint:    runFieldsHint,
+			})
+			continue
+		}
+		// The outcome of the main steps is only known to finally steps
+		if outcomeRunFields[name] && !scope.finally {
+			v.add(path+ref.path, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q references run.%s outside finally", s.ID, name),
+				Hint:    "run.status and run.failed_step are only available in finally steps",
+			})
+		}
+	}
+}
 
-		// Validate HTTP step fields
-		if hasHTTP && s.HTTP.URL == "" {
-			return &dagerrors.RunError{
+// checkActionParams checks the with: of an action step against the params
+// its action declares. Values with templates are only checked at run time.
+func (v *validator) checkActionParams(s Step, path string) {
+	act, err := v.actions.Get(s.Action)
+	if err != nil {
+		return
+	}
+	spec := act.Spec()
+	for _, key := range slices.Sorted(maps.Keys(s.Params)) {
+		at := path + ".with." + key
+		param, ok := spec.Param(key)
+		if !ok {
+			v.add(at, &dagerrors.RunError{
 				Type:    dagerrors.ValidationError,
-				Message: fmt.Sprintf("step %q: http requires a url", s.ID),
+				Message: fmt.Sprintf("step %q: action %s has no param %q", s.ID, s.Action, key),
+				Hint:    fmt.Sprintf("Params of %s: %s", s.Action, strings.Join(spec.ParamNames(), ", ")),
+			})
+			continue
+		}
+		if value := s.Params[key]; !strings.Contains(value, "${{") {
+			if err := param.CheckValue(value); err != nil {
+				v.add(at, &dagerrors.RunError{
+					Type:    dagerrors.ValidationError,
+					Message: fmt.Sprintf("step %q: param %q of %s: %v", s.ID, key, s.Action, err),
+				})
 			}
 		}
+	}
+	for _, param := range spec.Params {
+		if _, ok := s.Params[param.Name]; !ok && param.Required && !param.Prefix {
+			v.add(path+".with", &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: action %s requires param %q", s.ID, s.Action, param.Name),
+				Hint:    fmt.Sprintf("Add %s to the with: of step %q: %s", param.Name, s.ID, param.Description),
+			})
+		}
+	}
+}
+
+// checkTemplates parses and type-checks the ${{ }} expressions in strs,
+// found at path.
+func (v *validator) checkTemplates(path, where string, strs ...string) {
+	for _, str := range strs {
+		if err := template.Check(str, listRefs(v.p)); err != nil {
+			v.add(path, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s: %v", where, err),
+				Hint:    "Expressions use references, 'quoted' literals, ||, &&, comparisons, ! and filters, e.g. ${{ inputs.tag || 'latest' }} or ${{ inputs.name | upper }}",
+			})
+		}
+	}
+}
 
-		// Check action name
-		if hasAction {
-			if !knownActions[s.Action] {
-				return &dagerrors.RunError{
-					Type:    dagerrors.ToolNotFound,
-					Message: fmt.Sprintf("step %q: unknown action %q", s.ID, s.Action),
-					Hint:    "Known actions: file.write, file.append, json.get, json.set, env.get",
+// listRefs returns the references of p that hold JSON arrays: inputs of
+// type array and the outputs of foreach and matrix steps.
+func listRefs(p *Plan) map[string]bool {
+	lists := map[string]bool{}
+	for name, inp := range p.Inputs {
+		if inp.InputType() == TypeArray {
+			lists["inputs."+name] = true
+		}
+	}
+	for _, s := range append(slices.Clone(p.Steps), p.Finally...) {
+		if !s.Expanded() {
+			continue
+		}
+		for name := range s.Outputs {
+			lists["steps."+s.ID+".outputs."+name] = true
+		}
+	}
+	return lists
+}
+
+// checkRefNames reports references outside the known namespaces, unknown
+// step and plan fields, environment variables the plan does not allow, item
+// and matrix.* references outside the foreach or matrix step s, if any, and
+// params.* its template does not declare. refs are found at path.
+func (v *validator) checkRefNames(s *Step, path, where string, refs []template.Ref) {
+	p := v.p
+	for _, ref := range refs {
+		var err *dagerrors.RunError
+		switch ref.Namespace {
+		case "inputs", "run":
+			continue
+		case "item":
+			if ref.Name == "" && s != nil && s.Foreach != nil {
+				continue
+			}
+			err = &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s references item outside a foreach step", where),
+				Hint:    "item is the current item of a step with foreach:; matrix steps use matrix.<name>",
+			}
+		case "matrix":
+			if s != nil && s.Matrix != nil {
+				if _, ok := s.Matrix[ref.Name]; ok {
+					continue
+				}
+			}
+			err = &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s references unknown matrix value %q", where, ref.Name),
+				Hint:    "matrix.<name> is available in a step whose matrix: has a list called <name>",
+			}
+		case "steps":
+			if knownStepFields[ref.Field] && ref.Name == "" || ref.Field == "outputs" && ref.Name != "" {
+				continue
+			}
+			field := ref.Field
+			if ref.Name != "" {
+				field += "." + ref.Name
+			}
+			err = &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s references unknown field %q of step %q", where, field, ref.Step),
+				Hint:    fmt.Sprintf("Use steps.%[1]s.outputs.<name>, steps.%[1]s.status, steps.%[1]s.exit_code or steps.%[1]s.duration", ref.Step),
+			}
+		case "params":
+			if s != nil {
+				if _, ok := p.Templates[s.Template].Params[ref.Name]; ok {
+					continue
 				}
 			}
+			err = &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s references unknown param %q", where, ref.Name),
+				Hint:    "params.<name> is available in steps based on a template that declares <name> under params:",
+			}
+		case "plan":
+			if knownPlanFields[ref.Name] {
+				continue
+			}
+			err = &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s references unknown plan field %q", where, ref.Name),
+				Hint:    "Known fields: plan.name",
+			}
+		case "env":
+			if slices.Contains(p.EnvNames(), ref.Name) {
+				continue
+			}
+			err = &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s references environment variable %q, which the plan does not allow", where, ref.Name),
+				Hint:    fmt.Sprintf("Add %s to allow_env:, or to secret_env: if its value is secret", ref.Name),
+			}
+		default:
+			err = &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s references unknown name %q at position %d", where, ref.Namespace, ref.Pos),
+				Hint:    "References start with inputs., steps., run., plan. or env.; quote string literals",
+			}
+		}
+		v.add(path, err)
+	}
+}
+
+func (v *validator) checkRetry(s Step, path string) {
+	r := s.Retry
+	var problem, field string
+	switch {
+	case r.MaxAttempts < 1:
+		problem, field = "max_attempts must be at least 1", "max_attempts"
+	case r.InitialBackoff < 0:
+		problem, field = "backoff durations must not be negative", "initial_backoff"
+	case r.MaxBackoff < 0:
+		problem, field = "backoff durations must not be negative", "max_backoff"
+	case r.MaxBackoff != 0 && r.InitialBackoff > r.MaxBackoff:
+		problem, field = "initial_backoff must not exceed max_backoff", "initial_backoff"
+	case r.Multiplier != 0 && r.Multiplier < 1:
+		problem, field = "multiplier must be at least 1", "multiplier"
+	case r.Jitter < 0 || r.Jitter > 1:
+		problem, field = "jitter must be between 0 and 1", "jitter"
+	case len(r.OnExitCodes) > 0 && s.Run == "" && len(s.Exec) == 0:
+		problem, field = "on_exit_codes only applies to run and exec steps", "on_exit_codes"
+	case len(r.OnHTTPStatus) > 0 && !s.SendsHTTP():
+		problem, field = "on_http_status only applies to http and action: http steps", "on_http_status"
+	}
+	if problem == "" {
+		for _, code := range r.OnHTTPStatus {
+			if code < 100 || code > 599 {
+				problem, field = fmt.Sprintf("on_http_status has invalid status %d", code), "on_http_status"
+				break
+			}
+		}
+	}
+	if problem != "" {
+		v.add(path+".retry."+field, &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: retry: %s", s.ID, problem),
+		})
+	}
+}
+
+// checkProcess validates the env:, dir: and stdin: of s, which only run
+// and exec steps take. A dir: without templates must stay inside the
+// working directory unless the step allows otherwise; templated ones are
+// checked at run time.
+func (v *validator) checkProcess(s Step, path string, isProcess bool) {
+	fields := map[string]bool{
+		"env":                   s.Env != nil,
+		"dir":                   s.Dir != "",
+		"allow_outside_workdir": s.AllowOutsideWorkdir,
+		"stdin":                 s.Stdin != "",
+	}
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		if fields[field] && !isProcess {
+			v.add(path+"."+field, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: %s only applies to run and exec steps", s.ID, field),
+			})
+		}
+	}
+	if s.AllowOutsideWorkdir && s.Dir == "" {
+		v.add(path+".allow_outside_workdir", &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: allow_outside_workdir needs a dir", s.ID),
+		})
+	}
+	if s.Dir != "" && !s.AllowOutsideWorkdir && !strings.Contains(s.Dir, "${{") && !filepath.IsLocal(s.Dir) {
+		v.add(path+".dir", &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: dir %q is outside the working directory", s.ID, s.Dir),
+			Hint:    "Use a relative path without .., or set allow_outside_workdir: true",
+		})
+	}
+	v.checkEnvNames(s.Env, path+".env", fmt.Sprintf("step %q", s.ID))
+}
+
+// checkEnvNames reports names of env, found at path, that cannot be
+// environment variables.
+func (v *validator) checkEnvNames(env map[string]string, path, where string) {
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			v.add(path+"."+name, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("%s: invalid environment variable name %q", where, name),
+			})
 		}
+	}
+}
 
-		// Collect template refs from run, params, outputs
-		refs := collectTemplateRefs(s)
+// checkPlanEnv validates the plan-level env:. It is resolved for each run
+// and exec step, so it may use inputs, plan.*, env.* and the run.* fields
+// known from the start, but not the outputs or status of steps.
+func (v *validator) checkPlanEnv() {
+	p := v.p
+	v.checkEnvNames(p.Env, "env", "plan env")
+	for _, name := range slices.Sorted(maps.Keys(p.Env)) {
+		path := "env." + name
+		where := fmt.Sprintf("plan env %q", name)
+		v.checkTemplates(path, where, p.Env[name])
+		refs := template.Refs(p.Env[name])
+		v.checkRefNames(nil, path, where, refs)
 		for _, ref := range refs {
-			// Check forward references
-			idx, exists := seen[ref.stepID]
-			if !exists {
-				return &dagerrors.RunError{
-					Type:    dagerrors.ValidationError,
-					Message: fmt.Sprintf("step %q references unknown step %q", s.ID, ref.stepID),
+			var problem string
+			switch {
+			case ref.Namespace == "steps":
+				problem = fmt.Sprintf("references step %q", ref.Step)
+			case ref.Namespace == "run" && outcomeRunFields[ref.Name]:
+				problem = "references run." + ref.Name
+			case ref.Namespace == "run" && !knownRunFields[ref.Name]:
+				problem = fmt.Sprintf("references unknown run field %q", ref.Name)
+			case ref.Namespace == "inputs":
+				if _, ok := p.Inputs[ref.Name]; !ok {
+					problem = fmt.Sprintf("references unknown input %q", ref.Name)
 				}
 			}
-			if idx >= i {
-				return &dagerrors.RunError{
+			if problem != "" {
+				v.add(path, &dagerrors.RunError{
 					Type:    dagerrors.ValidationError,
-					Message: fmt.Sprintf("step %q has forward reference to step %q", s.ID, ref.stepID),
-				}
+					Message: fmt.Sprintf("%s %s", where, problem),
+					Hint:    "Plan env may use inputs, plan.*, env.* and run.id, run.workdir or run.started_at; set step values in the step's env:",
+				})
 			}
-			// Check output name exists
-			if outs, ok := stepOutputs[ref.stepID]; ok {
-				if !outs[ref.outputName] {
-					return &dagerrors.RunError{
-						Type:    dagerrors.ValidationError,
-						Message: fmt.Sprintf("step %q references non-existent output %q on step %q", s.ID, ref.outputName, ref.stepID),
-					}
-				}
-			} else {
-				return &dagerrors.RunError{
+		}
+	}
+}
+
+// checkParams checks the values s gives the params of its template. They
+// are resolved before a foreach or matrix step expands, so they cannot use
+// item, matrix.* or other params.
+func (v *validator) checkParams(s Step, path string) {
+	t := v.p.Templates[s.Template]
+	if len(t.Params) == 0 {
+		return
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Args)) {
+		at := path + ".with." + name
+		param, ok := t.Params[name]
+		if !ok {
+			v.add(at, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q passes unknown param %q", s.ID, name),
+				Hint:    fmt.Sprintf("Params of template %q: %s", s.Template, strings.Join(slices.Sorted(maps.Keys(t.Params)), ", ")),
+			})
+			continue
+		}
+		value := s.Args[name]
+		for _, ref := range template.Refs(value) {
+			if ref.Namespace == "item" || ref.Namespace == "matrix" || ref.Namespace == "params" {
+				v.add(at, &dagerrors.RunError{
 					Type:    dagerrors.ValidationError,
-					Message: fmt.Sprintf("step %q references step %q which has no outputs", s.ID, ref.stepID),
-				}
+					Message: fmt.Sprintf("step %q: param %q cannot reference %s", s.ID, name, ref.Namespace),
+					Hint:    "Params are resolved once, before the step runs or expands",
+				})
+				break
 			}
 		}
-
-		// Check input refs
-		inputRefs := collectInputRefs(s)
-		for _, name := range inputRefs {
-			if _, ok := p.Inputs[name]; !ok {
-				return &dagerrors.RunError{
+		if !strings.Contains(value, "${{") && param.checkDecl() == nil {
+			if err := param.Check(value); err != nil {
+				v.add(at, &dagerrors.RunError{
 					Type:    dagerrors.ValidationError,
-					Message: fmt.Sprintf("step %q references unknown input %q", s.ID, name),
-				}
+					Message: fmt.Sprintf("step %q: invalid value for param %q: %v", s.ID, name, err),
+					Hint:    inputHint(name, param),
+				})
 			}
 		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(t.Params)) {
+		if err := t.Params[name].checkDecl(); err != nil {
+			v.add(path, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q: param %q: %v", s.ID, name, err),
+			})
+		}
+		if _, ok := s.Args[name]; !ok && t.Params[name].Required {
+			v.add(path, &dagerrors.RunError{
+				Type:    dagerrors.ValidationError,
+				Message: fmt.Sprintf("step %q does not pass required param %q", s.ID, name),
+				Hint:    fmt.Sprintf("Add %s to the with: of step %q", name, s.ID),
+			})
+		}
+	}
+}
 
-		// Register outputs
-		if len(s.Outputs) > 0 {
-			stepOutputs[s.ID] = map[string]bool{}
-			for k := range s.Outputs {
-				stepOutputs[s.ID][k] = true
+// checkExpansion validates the foreach:, matrix: and parallel: fields of s.
+// The lists are resolved before the step runs, so they cannot use item or
+// matrix.* themselves.
+func (v *validator) checkExpansion(s Step, path string) {
+	var problem, field string
+	lists := map[string]ItemList{}
+	switch {
+	case s.Foreach != nil && s.Matrix != nil:
+		problem, field = "foreach and matrix cannot be combined", "matrix"
+	case s.Parallel && !s.Expanded():
+		problem, field = "parallel only applies to steps with foreach or matrix", "parallel"
+	case s.Foreach != nil:
+		lists["foreach"] = *s.Foreach
+	case s.Matrix != nil && len(s.Matrix) == 0:
+		problem, field = "matrix needs at least one list", "matrix"
+	default:
+		for _, name := range slices.Sorted(maps.Keys(s.Matrix)) {
+			if !matrixNameRe.MatchString(name) {
+				problem, field = fmt.Sprintf("matrix name %q must be a letter or _ followed by letters, digits, _ or -", name), "matrix."+name
+				break
 			}
+			lists["matrix "+name] = s.Matrix[name]
 		}
 	}
-
-	return nil
+	for _, name := range slices.Sorted(maps.Keys(lists)) {
+		if problem != "" {
+			break
+		}
+		list := lists[name]
+		field = strings.Replace(name, " ", ".", 1)
+		switch {
+		case list.Template == "" && len(list.Items) == 0:
+			problem = name + " is empty"
+		case list.Template != "" && !strings.Contains(list.Template, "${{"):
+			problem = name + " must be a list or a ${{ }} template"
+		default:
+			for _, ref := range template.Refs(list.Template + "\n" + strings.Join(list.Items, "\n")) {
+				if ref.Namespace == "item" || ref.Namespace == "matrix" {
+					problem = fmt.Sprintf("%s cannot reference %s", name, ref.Namespace)
+					break
+				}
+			}
+		}
+	}
+	if problem != "" {
+		v.add(path+"."+field, &dagerrors.RunError{
+			Type:    dagerrors.ValidationError,
+			Message: fmt.Sprintf("step %q: %s", s.ID, problem),
+			Hint:    "Use foreach: [a, b] or foreach: ${{ steps.<id>.outputs.<name> }} with ${{ item }}, or matrix: {<name>: [a, b]} with ${{ matrix.<name> }}",
+		})
+	}
 }
 
-type templateRef struct {
-	stepID     string
-	outputName string
+// stepRef is a reference made by a step, with the path of the field it is
+// in relative to the step, e.g. .http.url.
+type stepRef struct {
+	template.Ref
+	path string
 }
 
-func collectTemplateRefs(s Step) []templateRef {
-	var refs []templateRef
-	for _, str := range stepStrings(s) {
-		for _, m := range templateRefRe.FindAllStringSubmatch(str, -1) {
-			refs = append(refs, templateRef{stepID: m[1], outputName: m[2]})
+// stepRefs returns the references made by the templates and condition of s.
+func stepRefs(s Step) []stepRef {
+	var refs []stepRef
+	for _, f := range stepStrings(s) {
+		for _, ref := range template.Refs(f.value) {
+			refs = append(refs, stepRef{ref, f.path})
 		}
 	}
 	return refs
 }
 
-func collectInputRefs(s Step) []string {
-	var refs []string
-	for _, str := range stepStrings(s) {
-		for _, m := range templateInputRe.FindAllStringSubmatch(str, -1) {
-			refs = append(refs, m[1])
-		}
-	}
-	return refs
+// stepField is a string field of a step that may hold templates.
+type stepField struct {
+	path  string // relative to the step, e.g. .with.name
+	value string
 }
 
-func stepStrings(s Step) []string {
-	var strs []string
-	strs = append(strs, s.Run)
-	for _, v := range s.Params {
-		strs = append(strs, v)
+func stepStrings(s Step) []stepField {
+	fields := []stepField{{".run", s.Run}, {".if", s.If}}
+	for i, arg := range s.Exec {
+		fields = append(fields, stepField{fmt.Sprintf(".exec[%d]", i), arg})
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.Env)) {
+		fields = append(fields, stepField{".env." + k, s.Env[k]})
+	}
+	fields = append(fields, stepField{".dir", s.Dir}, stepField{".stdin", s.Stdin})
+	if s.Foreach != nil {
+		fields = append(fields, stepField{".foreach", s.Foreach.Template})
+		for _, item := range s.Foreach.Items {
+			fields = append(fields, stepField{".foreach", item})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Matrix)) {
+		list := s.Matrix[name]
+		fields = append(fields, stepField{".matrix." + name, list.Template})
+		for _, item := range list.Items {
+			fields = append(fields, stepField{".matrix." + name, item})
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.Params)) {
+		fields = append(fields, stepField{".with." + k, s.Params[k]})
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.Args)) {
+		fields = append(fields, stepField{".with." + k, s.Args[k]})
 	}
 	if s.HTTP != nil {
-		strs = append(strs, s.HTTP.URL, s.HTTP.Body)
-		for _, v := range s.HTTP.Headers {
-			strs = append(strs, v)
+		fields = append(fields, stepField{".http.url", s.HTTP.URL}, stepField{".http.body", s.HTTP.Body})
+		for _, k := range slices.Sorted(maps.Keys(s.HTTP.Headers)) {
+			fields = append(fields, stepField{".http.headers." + k, s.HTTP.Headers[k]})
 		}
 	}
-	return strs
+	return fields
 }
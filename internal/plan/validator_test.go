@@ -1,7 +1,13 @@
 package plan
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
 )
 
 func validPlan() *Plan {
@@ -34,6 +40,25 @@ func TestValidateRejectsDuplicateStepIDs(t *testing.T) {
 	}
 }
 
+func TestValidateDuplicateStepIDsAreNoCycle(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "s1", Run: "echo a"},
+			{ID: "s1", Run: "echo b", Needs: []string{"s1"}},
+		},
+	}
+	problems := dagerrors.All(Validate(p, map[string]string{}))
+	if len(problems) == 0 {
+		t.Fatal("expected error for duplicate step IDs")
+	}
+	for _, e := range problems {
+		if strings.Contains(e.Message, "cycle") {
+			t.Errorf("unexpected cycle error %q", e.Message)
+		}
+	}
+}
+
 func TestValidateRejectsBothRunAndAction(t *testing.T) {
 	p := &Plan{
 		Name: "test",
@@ -145,3 +170,734 @@ func TestValidateAcceptsOptionalInputWithDefault(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func TestValidateAcceptsNeedsDAG(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "build", Run: "echo build", Outputs: map[string]string{"artifact": "stdout"}, Needs: []string{}},
+			{ID: "test", Run: "echo ${{steps.build.outputs.artifact}}", Needs: []string{"build"}},
+			{ID: "lint", Run: "echo lint", Needs: []string{"build"}},
+			{ID: "ship", Run: "echo ${{steps.build.outputs.artifact}}", Needs: []string{"test", "lint"}},
+		},
+	}
+	if err := Validate(p, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateAcceptsRefToLaterListedNeed(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "use", Run: "echo ${{steps.make.outputs.v}}", Needs: []string{"make"}},
+			{ID: "make", Run: "echo v", Outputs: map[string]string{"v": "stdout"}},
+		},
+	}
+	if err := Validate(p, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateRejectsUnknownNeed(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "s1", Run: "echo a", Needs: []string{"nope"}},
+		},
+	}
+	if err := Validate(p, map[string]string{}); err == nil {
+		t.Fatal("expected error for unknown need")
+	}
+}
+
+func TestValidateRejectsDependencyCycle(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "a", Run: "echo a", Needs: []string{"c"}},
+			{ID: "b", Run: "echo b", Needs: []string{"a"}},
+			{ID: "c", Run: "echo c", Needs: []string{"b"}},
+		},
+	}
+	err := Validate(p, map[string]string{})
+	if err == nil {
+		t.Fatal("expected error for dependency cycle")
+	}
+	if !strings.Contains(err.Error(), "a -> c -> b -> a") {
+		t.Errorf("expected cycle path in error, got %q", err.Error())
+	}
+}
+
+func TestValidateRejectsRefToStepNotInNeeds(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "s1", Run: "echo hi", Outputs: map[string]string{"msg": "stdout"}, Needs: []string{}},
+			{ID: "s2", Run: "echo ${{steps.s1.outputs.msg}}", Needs: []string{}},
+		},
+	}
+	err := Validate(p, map[string]string{})
+	if err == nil {
+		t.Fatal("expected error for reference to a step that is not a dependency")
+	}
+	if !strings.Contains(err.Error(), "does not depend on") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateRejectsBadCondition(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "s1", Run: "echo hi", If: "${{inputs.branch}} == main"},
+		},
+		Inputs: map[string]Input{"branch": {}},
+	}
+	if err := Validate(p, map[string]string{}); err == nil {
+		t.Fatal("expected error for unquoted literal in condition")
+	}
+}
+
+func TestValidateConditionRefsMustBeDependencies(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "s1", Run: "echo hi", If: "${{steps.s2.status}} == 'success'"},
+			{ID: "s2", Run: "echo there"},
+		},
+	}
+	if err := Validate(p, map[string]string{}); err == nil {
+		t.Fatal("expected error for condition on a later step's status")
+	}
+
+	p.Steps[0], p.Steps[1] = p.Steps[1], p.Steps[0]
+	p.Steps[0].If, p.Steps[1].If = "", "${{steps.s2.status}} == 'success'"
+	p.Steps[0].ID, p.Steps[1].ID = "s2", "s1"
+	if err := Validate(p, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	good := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "s1", Run: "make", Retry: &RetryPolicy{MaxAttempts: 3, OnExitCodes: []int{75}}},
+		},
+	}
+	if err := Validate(good, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, r := range map[string]*RetryPolicy{
+		"zero attempts":     {MaxAttempts: 0},
+		"bad jitter":        {MaxAttempts: 2, Jitter: 1.5},
+		"initial over max":  {MaxAttempts: 2, InitialBackoff: time.Minute, MaxBackoff: time.Second},
+		"http status w/run": {MaxAttempts: 2, OnHTTPStatus: []int{500}},
+	} {
+		p := &Plan{Name: "test", Steps: []Step{{ID: "s1", Run: "make", Retry: r}}}
+		if err := Validate(p, map[string]string{}); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestValidateRejectsNegativeTimeouts(t *testing.T) {
+	p := validPlan()
+	p.Steps[0].Timeout = -time.Second
+	if err := Validate(p, map[string]string{}); err == nil {
+		t.Error("expected error for negative step timeout")
+	}
+
+	p = validPlan()
+	p.Timeout = -time.Second
+	if err := Validate(p, map[string]string{}); err == nil {
+		t.Error("expected error for negative plan timeout")
+	}
+}
+
+func TestRetryDelayBackoff(t *testing.T) {
+	r := &RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 3}
+	want := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second}
+	for i, w := range want {
+		if got := r.Delay(i + 1); got != w {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, w, got)
+		}
+	}
+}
+
+func TestValidateFinallySteps(t *testing.T) {
+	p := validPlan()
+	p.Finally = []Step{
+		{ID: "cleanup", Run: "echo ${{run.status}} ${{steps.s1.outputs.msg}}", Outputs: map[string]string{"out": "stdout"}},
+		{ID: "report", Run: "echo ${{steps.cleanup.outputs.out}}"},
+	}
+	if err := Validate(p, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, finally := range map[string][]Step{
+		"duplicate id":  {{ID: "s1", Run: "echo"}},
+		"needs":         {{ID: "f1", Run: "echo", Needs: []string{"s1"}}},
+		"forward ref":   {{ID: "f1", Run: "echo ${{steps.f2.outputs.x}}"}, {ID: "f2", Run: "echo", Outputs: map[string]string{"x": "stdout"}}},
+		"unknown field": {{ID: "f1", Run: "echo ${{run.duration}}"}},
+	} {
+		p := validPlan()
+		p.Finally = finally
+		if err := Validate(p, map[string]string{}); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestValidateRejectsRunRefOutsideFinally(t *testing.T) {
+	p := validPlan()
+	p.Steps[0].Run = "echo ${{run.status}}"
+	err := Validate(p, map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "outside finally") {
+		t.Fatalf("expected run ref error, got %v", err)
+	}
+}
+
+func TestValidateRollback(t *testing.T) {
+	p := validPlan()
+	p.Steps[0].Rollback = &Step{Run: "undo ${{steps.s1.outputs.msg}}"}
+	if err := Validate(p, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, rb := range map[string]*Step{
+		"with id":     {ID: "undo", Run: "undo"},
+		"empty":       {},
+		"nested":      {Run: "undo", Rollback: &Step{Run: "redo"}},
+		"later step":  {Run: "undo ${{steps.s2.outputs.out}}"},
+		"bad outputs": {Run: "undo ${{steps.s1.outputs.nope}}"},
+	} {
+		p := validPlan()
+		p.Steps = append(p.Steps, Step{ID: "s2", Run: "echo", Outputs: map[string]string{"out": "stdout"}})
+		p.Steps[0].Rollback = rb
+		if err := Validate(p, map[string]string{}); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	p = validPlan()
+	p.Steps[0].Foreach = &ItemList{Items: []string{"a", "b"}}
+	p.Steps[0].Rollback = &Step{Run: "undo ${{ item }}"}
+	err := Validate(p, map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "foreach and matrix steps cannot have a rollback") {
+		t.Errorf("expected rollback on a foreach step to be rejected, got %v", err)
+	}
+}
+
+func TestValidatePlanOutputs(t *testing.T) {
+	p := validPlan()
+	p.Inputs = map[string]Input{"env": {}}
+	p.Outputs = map[string]string{"greeting": "${{steps.s1.outputs.msg}} in ${{inputs.env}} (${{run.status}})"}
+	if err := Validate(p, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, tmpl := range map[string]string{
+		"unknown step":   "${{steps.nope.outputs.msg}}",
+		"unknown output": "${{steps.s1.outputs.nope}}",
+		"unknown input":  "${{inputs.nope}}",
+		"unknown run":    "${{run.nope}}",
+	} {
+		p := validPlan()
+		p.Outputs = map[string]string{"out": tmpl}
+		if err := Validate(p, map[string]string{}); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestValidateOutputSources(t *testing.T) {
+	good := map[string]Step{
+		"run pipes":     {ID: "s1", Run: "make", Outputs: map[string]string{"a": "stderr | lines[-1]", "b": "exit_code", "c": "stdout | json:$.x"}},
+		"http status":   {ID: "s1", HTTP: &HTTPRequest{URL: "http://x"}, Outputs: map[string]string{"a": "status_code"}},
+		"action output": {ID: "s1", Action: "json.get", Params: map[string]string{"file": "f", "path": "a"}, Outputs: map[string]string{"a": "value | regex:\\d+"}},
+	}
+	for name, s := range good {
+		p := &Plan{Name: "test", Steps: []Step{s}}
+		if err := Validate(p, map[string]string{}); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	bad := map[string]Step{
+		"unknown run source":    {ID: "s1", Run: "make", Outputs: map[string]string{"a": "status_code"}},
+		"unknown action source": {ID: "s1", Action: "env.get", Params: map[string]string{"name": "X"}, Outputs: map[string]string{"a": "stdout"}},
+		"bad regex":             {ID: "s1", Run: "make", Outputs: map[string]string{"a": "stdout | regex:("}},
+		"unknown pipe":          {ID: "s1", Run: "make", Outputs: map[string]string{"a": "stdout | grep x"}},
+	}
+	for name, s := range bad {
+		p := &Plan{Name: "test", Steps: []Step{s}}
+		if err := Validate(p, map[string]string{}); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestValidateExecSteps(t *testing.T) {
+	good := &Plan{
+		Name:   "test",
+		Inputs: map[string]Input{"msg": {Default: "hi"}},
+		Steps: []Step{{
+			ID:      "s1",
+			Exec:    []string{"git", "commit", "-m", "${{ inputs.msg }}"},
+			Env:     map[string]string{"GIT_AUTHOR_NAME": "${{ plan.name }}"},
+			Dir:     "repo",
+			Stdin:   "${{ inputs.msg }}",
+			Retry:   &RetryPolicy{MaxAttempts: 2, OnExitCodes: []int{128}},
+			Outputs: map[string]string{"code": "exit_code"},
+		}},
+	}
+	if err := Validate(good, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bad := map[string]Step{
+		"exec and run":      {ID: "s1", Exec: []string{"make"}, Run: "make"},
+		"empty exec":        {ID: "s1", Exec: []string{}},
+		"env on http":       {ID: "s1", HTTP: &HTTPRequest{URL: "http://x"}, Env: map[string]string{"A": "b"}},
+		"stdin on action":   {ID: "s1", Action: "env.get", Params: map[string]string{"name": "X"}, Stdin: "x"},
+		"bad env name":      {ID: "s1", Exec: []string{"make"}, Env: map[string]string{"A=B": "c"}},
+		"unknown input arg": {ID: "s1", Exec: []string{"echo", "${{ inputs.nope }}"}},
+	}
+	for name, s := range bad {
+		p := &Plan{Name: "test", Steps: []Step{s}}
+		if err := Validate(p, map[string]string{}); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestValidateProcessFields(t *testing.T) {
+	good := &Plan{
+		Name:      "test",
+		Inputs:    map[string]Input{"region": {Default: "eu"}},
+		AllowEnv:  []string{"CI"},
+		SecretEnv: []string{"TOKEN"},
+		Env:       map[string]string{"REGION": "${{ inputs.region }}", "RUN": "${{ run.id }}", "CI": "${{ env.CI }}", "AUTH": "${{ env.TOKEN }}"},
+		CleanEnv:  true,
+		Steps: []Step{
+			{ID: "s1", Run: "make", Dir: "sub/dir", Stdin: "${{ plan.name }}", Env: map[string]string{"A": "b"}},
+			{ID: "s2", Run: "make", Dir: "/srv/app", AllowOutsideWorkdir: true},
+			{ID: "s3", Run: "make", Dir: "${{ inputs.region }}"},
+		},
+	}
+	if err := Validate(good, map[string]string{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bad := map[string]*Plan{
+		"absolute dir":        {Steps: []Step{{ID: "s1", Run: "make", Dir: "/srv/app"}}},
+		"dir leaving workdir": {Steps: []Step{{ID: "s1", Run: "make", Dir: "sub/../../x"}}},
+		"allow without dir":   {Steps: []Step{{ID: "s1", Run: "make", AllowOutsideWorkdir: true}}},
+		"plan env step ref":   {Env: map[string]string{"V": "${{ steps.s1.outputs.v }}"}, Steps: []Step{{ID: "s1", Run: "make", Outputs: map[string]string{"v": "stdout"}}}},
+		"plan env run status": {Env: map[string]string{"V": "${{ run.status }}"}, Steps: []Step{{ID: "s1", Run: "make"}}},
+		"plan env unknown":    {Env: map[string]string{"V": "${{ inputs.nope }}"}, Steps: []Step{{ID: "s1", Run: "make"}}},
+		"plan env bad name":   {Env: map[string]string{"A=B": "c"}, Steps: []Step{{ID: "s1", Run: "make"}}},
+		"plan env disallowed": {Env: map[string]string{"V": "${{ env.HOME }}"}, Steps: []Step{{ID: "s1", Run: "make"}}},
+	}
+	for name, p := range bad {
+		p.Name = "test"
+		if err := Validate(p, map[string]string{}); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestValidateTypedInputs(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Inputs: map[string]Input{
+			"replicas": {Type: TypeInteger, Min: ptr(1), Max: ptr(5)},
+			"env":      {Enum: []string{"dev", "prod"}},
+		},
+		Steps: []Step{{ID: "s1", Run: "deploy ${{inputs.env}} ${{inputs.replicas}}"}},
+	}
+	if err := Validate(p, map[string]string{"replicas": "3", "env": "prod"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := Validate(p, map[string]string{"replicas": "9", "env": "prod"})
+	re, ok := err.(*dagerrors.RunError)
+	if !ok || re.Type != dagerrors.ValidationError {
+		t.Fatalf("expected ValidationError, got %v", err)
+	}
+	if !strings.Contains(re.Message, `input "replicas"`) || !strings.Contains(re.Hint, "type integer, min 1, max 5") {
+		t.Errorf("unexpected error %q / hint %q", re.Message, re.Hint)
+	}
+
+	err = Validate(p, map[string]string{"env": "qa"})
+	if re, ok := err.(*dagerrors.RunError); !ok || !strings.Contains(re.Hint, "one of dev, prod") {
+		t.Errorf("expected enum hint, got %v", err)
+	}
+}
+
+func TestValidateRejectsBadInputDeclaration(t *testing.T) {
+	p := &Plan{
+		Name:   "test",
+		Inputs: map[string]Input{"n": {Type: "int"}},
+		Steps:  []Step{{ID: "s1", Run: "echo"}},
+	}
+	if err := Validate(p, nil); err == nil || !strings.Contains(err.Error(), `unknown type "int"`) {
+		t.Fatalf("expected unknown type error, got %v", err)
+	}
+}
+
+func TestValidateDoesNotEchoSecretInput(t *testing.T) {
+	p := &Plan{
+		Name:   "test",
+		Inputs: map[string]Input{"token": {Secret: true, Pattern: "^ghp_"}},
+		Steps:  []Step{{ID: "s1", Run: "echo ${{inputs.token}}"}},
+	}
+	err := Validate(p, map[string]string{"token": "hunter2"})
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("expected error without the secret value, got %v", err)
+	}
+
+	for _, secret := range []string{`hun"ter2`, `hun\ter2`, "hun\tter2\x00"} {
+		err := Validate(p, map[string]string{"token": secret})
+		if err == nil || strings.Contains(err.Error(), "hun") || !strings.Contains(err.Error(), `"***" does not match`) {
+			t.Errorf("%q: expected error without the secret value, got %v", secret, err)
+		}
+	}
+}
+
+func TestValidateTemplateFilters(t *testing.T) {
+	p := &Plan{
+		Name:   "test",
+		Inputs: map[string]Input{"args": {}},
+		Steps:  []Step{{ID: "s1", Run: "ls ${{ inputs.args | raw }}"}},
+	}
+	if err := Validate(p, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.Steps[0].Run = "ls ${{ inputs.args | shout }}"
+	if err := Validate(p, nil); err == nil || !strings.Contains(err.Error(), `unknown filter "shout"`) {
+		t.Fatalf("expected unknown filter error, got %v", err)
+	}
+	p.Steps[0].Run = "ls ${{ inputs.nope | raw }}"
+	if err := Validate(p, nil); err == nil || !strings.Contains(err.Error(), `unknown input "nope"`) {
+		t.Fatalf("expected unknown input error, got %v", err)
+	}
+}
+
+func TestValidateTemplateExpressions(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Inputs: map[string]Input{
+			"tag":  {},
+			"tags": {Type: TypeArray},
+		},
+		Steps: []Step{{ID: "s1", Run: "echo ${{ inputs.tag || 'latest' }} ${{ inputs.tags | join(' ') }} ${{ upper(inputs.tag) }}"}},
+	}
+	if err := Validate(p, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		run  string
+		want string
+	}{
+		{"echo ${{ inputs.tag | join }}", "join expects a list, got a string at position 22"},
+		{"echo ${{ inputs.tags | upper }}", "upper expects a string, got a list"},
+		{"echo ${{ inputs.tag | replace('a') }}", "replace takes 2 arguments"},
+		{"echo ${{ inputs.tag || }}", "unexpected end of expression at position 22"},
+		{"echo ${{ inputs.tag | raw | upper }}", "raw must be the last filter"},
+		{"echo ${{ inputs.nope || 'x' }}", `unknown input "nope"`},
+		{"echo ${{ latest || inputs.tag }}", `unknown name "latest" at position 9`},
+		{"echo ${{ steps.s0.result }}", `unknown field "result" of step "s0"`},
+	}
+	for _, tt := range tests {
+		p.Steps[0].Run = tt.run
+		err := Validate(p, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.run, tt.want, err)
+		}
+	}
+}
+
+func TestValidatePlanOutputExpression(t *testing.T) {
+	p := &Plan{
+		Name:    "test",
+		Steps:   []Step{{ID: "s1", Run: "echo hi", Outputs: map[string]string{"out": "stdout"}}},
+		Outputs: map[string]string{"greeting": "${{ steps.s1.outputs.out | trim | upper }}"},
+	}
+	if err := Validate(p, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.Outputs["greeting"] = "${{ steps.s1.outputs.other || 'none' }}"
+	if err := Validate(p, nil); err == nil || !strings.Contains(err.Error(), `non-existent output "other"`) {
+		t.Fatalf("expected non-existent output error, got %v", err)
+	}
+}
+
+func TestValidateContextNamespaces(t *testing.T) {
+	p := &Plan{
+		Name:     "test",
+		AllowEnv: []string{"HOME"},
+		Steps: []Step{
+			{ID: "build", Run: "make"},
+			{ID: "report", Run: "echo ${{plan.name}} ${{run.id}} ${{run.workdir}} ${{run.started_at}} ${{env.HOME}} ${{steps.build.exit_code}} ${{steps.build.duration}}"},
+		},
+	}
+	if err := Validate(p, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		run  string
+		want string
+	}{
+		{"echo ${{env.TOKEN}}", `environment variable "TOKEN", which the plan does not allow`},
+		{"echo ${{plan.owner}}", `unknown plan field "owner"`},
+		{"echo ${{run.status}}", "references run.status outside finally"},
+		{"echo ${{run.nope}}", `unknown run field "nope"`},
+		{"echo ${{steps.later.exit_code}}", `forward reference to exit_code of step "later"`},
+		{"echo ${{steps.ghost.duration}}", `duration of unknown step "ghost"`},
+	}
+	p.Steps = append(p.Steps, Step{ID: "later", Run: "true"})
+	for _, tt := range tests {
+		p.Steps[1].Run = tt.run
+		err := Validate(p, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.run, tt.want, err)
+		}
+	}
+}
+
+func TestValidateForeachAndMatrix(t *testing.T) {
+	p := &Plan{
+		Name: "test",
+		Steps: []Step{
+			{ID: "list", Run: "ls", Outputs: map[string]string{"files": "stdout"}},
+			{ID: "each", Foreach: &ItemList{Template: "${{ steps.list.outputs.files }}"}, Run: "cat ${{ item }}", If: "${{ item }} != 'skip'", Outputs: map[string]string{"out": "stdout"}},
+			{ID: "grid", Matrix: map[string]ItemList{"env": {Items: []string{"dev", "prod"}}}, Parallel: true, Run: "echo ${{ matrix.env }}", Outputs: map[string]string{"env": "stdout"}},
+			{ID: "joined", Run: "echo ${{ steps.each.outputs.out | join('-') }}"},
+		},
+		Finally: []Step{
+			{ID: "report", Run: "echo ${{ steps.grid.outputs.env | join(' ') }}"},
+		},
+	}
+	if err := Validate(p, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.Finally = nil
+
+	tests := []struct {
+		step Step
+		want string
+	}{
+		{Step{ID: "x", Run: "echo ${{ item }}"}, "references item outside a foreach step"},
+		{Step{ID: "x", Foreach: &ItemList{Items: []string{"a"}}, Run: "echo ${{ matrix.env }}"}, `unknown matrix value "env"`},
+		{Step{ID: "x", Matrix: map[string]ItemList{"env": {Items: []string{"a"}}}, Run: "echo ${{ item }}"}, "references item outside a foreach step"},
+		{Step{ID: "x", Foreach: &ItemList{}, Run: "echo"}, "foreach is empty"},
+		{Step{ID: "x", Foreach: &ItemList{Template: "a,b"}, Run: "echo"}, "foreach must be a list or a ${{ }} template"},
+		{Step{ID: "x", Foreach: &ItemList{Items: []string{"${{ item }}"}}, Run: "echo"}, "foreach cannot reference item"},
+		{Step{ID: "x", Foreach: &ItemList{Items: []string{"a"}}, Matrix: map[string]ItemList{"b": {Items: []string{"c"}}}, Run: "echo"}, "cannot be combined"},
+		{Step{ID: "x", Parallel: true, Run: "echo"}, "parallel only applies"},
+		{Step{ID: "x", Matrix: map[string]ItemList{"a b": {Items: []string{"c"}}}, Run: "echo"}, `matrix name "a b"`},
+		{Step{ID: "x", Foreach: &ItemList{Template: "${{ steps.later.outputs.files }}"}, Run: "echo"}, `forward reference to step "later"`},
+	}
+	for _, tt := range tests {
+		p.Steps = []Step{tt.step, {ID: "later", Run: "ls", Outputs: map[string]string{"files": "stdout"}}}
+		err := Validate(p, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: expected error containing %q, got %v", tt.step, tt.want, err)
+		}
+	}
+}
+
+func TestValidateUses(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("clean.yaml", `
+name: clean
+inputs:
+  branch: {required: true}
+  depth: {type: integer, default: "1"}
+steps:
+  - id: check
+    run: git status --porcelain
+    outputs:
+      dirty: stdout
+outputs:
+  dirty: ${{ steps.check.outputs.dirty }}
+`)
+	write("loop_a.yaml", "name: a\nsteps:\n  - id: b\n    uses: loop_b.yaml\n")
+	write("loop_b.yaml", "name: b\nsteps:\n  - id: a\n    uses: loop_a.yaml\n")
+	write("broken.yaml", "name: broken\nsteps:\n  - id: x\n")
+
+	p, err := LoadFile(write("main.yaml", `
+name: main
+steps:
+  - id: clean
+    uses: ./clean.yaml
+    with:
+      branch: main
+  - id: report
+    run: echo ${{ steps.clean.outputs.dirty }}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(p, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		step Step
+		want string
+	}{
+		{Step{ID: "x", Uses: "clean.yaml", Params: map[string]string{"branch": "main", "force": "yes"}}, `passes unknown input "force"`},
+		{Step{ID: "x", Uses: "clean.yaml"}, `does not pass required input "branch"`},
+		{Step{ID: "x", Uses: "clean.yaml", Params: map[string]string{"branch": "main", "depth": "deep"}}, `invalid value for input "depth"`},
+		{Step{ID: "x", Uses: "clean.yaml", Params: map[string]string{"branch": "main"}, Outputs: map[string]string{"o": "stdout"}}, "outputs is not allowed with uses"},
+		{Step{ID: "x", Uses: "clean.yaml", Params: map[string]string{"branch": "main"}, Run: "echo"}, "multiple of run/exec/action/http/uses"},
+		{Step{ID: "x", Uses: "missing.yaml"}, "uses: reading plan file"},
+		{Step{ID: "x", Uses: "broken.yaml"}, `step "x": broken.yaml: step "x" has none of run/exec/action/http/uses`},
+		{Step{ID: "x", Uses: "loop_a.yaml"}, "plan cycle loop_a.yaml -> loop_b.yaml -> loop_a.yaml"},
+		{Step{ID: "x", Uses: "main.yaml"}, "plan cycle main.yaml -> main.yaml"},
+	}
+	for _, tt := range tests {
+		q := *p
+		q.Steps = []Step{tt.step}
+		err := Validate(&q, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: expected error containing %q, got %v", tt.step, tt.want, err)
+		}
+	}
+
+	// Outputs of the called plan are the step's outputs
+	q := *p
+	q.Steps = []Step{p.Steps[0], {ID: "report", Run: "echo ${{ steps.clean.outputs.missing }}"}}
+	if err := Validate(&q, nil); err == nil || !strings.Contains(err.Error(), `non-existent output "missing"`) {
+		t.Errorf("expected unknown output error, got %v", err)
+	}
+}
+
+func TestValidateTemplateParams(t *testing.T) {
+	lib := `
+templates:
+  notify:
+    params:
+      channel: {required: true}
+      level: {type: integer, default: "1"}
+    run: ./notify.sh ${{ params.channel }} ${{ params.level }}
+`
+	tests := []struct {
+		with string
+		want string
+	}{
+		{"channel: ops", ""},
+		{"level: 2", `step "n" does not pass required param "channel" (template "notify" at lib.yaml:3)`},
+		{"channel: ops\n      color: red", `passes unknown param "color"`},
+		{"channel: ops\n      level: high", `invalid value for param "level"`},
+		{"channel: ${{ params.level }}", `param "channel" cannot reference params`},
+	}
+	for _, tt := range tests {
+		dir := writeFiles(t, map[string]string{
+			"lib.yaml":  lib,
+			"plan.yaml": "name: p\nimports: [lib.yaml]\nsteps:\n  - id: n\n    template: notify\n    with:\n      " + tt.with + "\n",
+		})
+		p, err := LoadFile(filepath.Join(dir, "plan.yaml"))
+		if err != nil {
+			t.Fatalf("unexpected load error: %v", err)
+		}
+		err = Validate(p, nil)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.with, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.with, tt.want, err)
+		}
+	}
+
+	p := validPlan()
+	p.Steps[0].Run = "echo ${{ params.channel }}"
+	if err := Validate(p, nil); err == nil || !strings.Contains(err.Error(), `references unknown param "channel"`) {
+		t.Errorf("expected unknown param error, got %v", err)
+	}
+}
+
+func TestValidateReportsAllProblemsWithPositions(t *testing.T) {
+	p, err := Load([]byte(`
+name: broken
+steps:
+  - id: build
+    run: make ${{ inputs.target }}
+    retry:
+      max_attempts: 0
+  - id: deploy
+    needs: [buld]
+    action: file.wrte
+  - id: notify
+    run: echo
+    if: ${{ steps.deploy.status == }}
+outputs:
+  v: ${{ steps.build.outputs.version }}
+`))
+	if err != nil {
+		t.Fatalf("unexpected load error: %v", err)
+	}
+	err = Validate(p, nil)
+	want := []string{
+		`line 5:5: [VALIDATION_ERROR] step "build" references unknown input "target"`,
+		`line 7:7: [VALIDATION_ERROR] step "build": retry: max_attempts must be at least 1`,
+		`line 9:13: [VALIDATION_ERROR] step "deploy" needs unknown step "buld"`,
+		`line 10:5: [TOOL_NOT_FOUND] step "deploy": unknown action "file.wrte"`,
+		`line 13:5: [VALIDATION_ERROR] step "notify": invalid if: condition`,
+		`line 15:3: [VALIDATION_ERROR] plan output "v" references non-existent output "version" on step "build"`,
+	}
+	problems := dagerrors.All(err)
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got:\n%v", len(want), err)
+	}
+	for i, w := range want {
+		if got := problems[i].Error(); !strings.HasPrefix(got, w) {
+			t.Errorf("problem %d: got %q, want prefix %q", i, got, w)
+		}
+	}
+}
+
+func TestValidateActionParams(t *testing.T) {
+	tests := []struct {
+		step Step
+		want string
+	}{
+		{Step{ID: "s", Action: "file.write", Params: map[string]string{"path": "out.txt", "content": "${{ inputs.x }}"}}, ""},
+		{Step{ID: "s", Action: "http", Params: map[string]string{"url": "https://example.com", "header_Accept": "text/plain"}}, ""},
+		{Step{ID: "s", Action: "file.write", Params: map[string]string{"path": "out.txt"}}, `step "s": action file.write requires param "content"`},
+		{Step{ID: "s", Action: "json.get", Params: map[string]string{"file": "a.json", "path": "x", "key": "y"}}, `step "s": action json.get has no param "key"`},
+		{Step{ID: "s", Action: "env.get", Params: map[string]string{"name": "HOME", "secret": "maybe"}}, `step "s": param "secret" of env.get: "maybe" is not a valid boolean`},
+		{Step{ID: "s", Action: "env.get", Params: map[string]string{"name": "HOME"}, Outputs: map[string]string{"v": "path"}}, `step "s": output "v" has unknown source "path"`},
+	}
+	for _, tt := range tests {
+		p := &Plan{Name: "test", Inputs: map[string]Input{"x": {}}, Steps: []Step{tt.step}}
+		err := Validate(p, nil)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error: %v", tt.step, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: expected %q, got %v", tt.step, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package runner
+
+import "os/exec"
+
+// killProcessGroup is a no-op where process groups are unavailable; context
+// cancellation kills only the shell itself.
+func killProcessGroup(cmd *exec.Cmd) {}
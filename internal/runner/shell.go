@@ -2,39 +2,160 @@ package runner
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 )
 
+// waitDelay bounds how long Run waits for output pipes to close after the
+// command is killed.
+const waitDelay = 2 * time.Second
+
+// MaxOutput is how many bytes of the end of stdout, and of stderr, a
+// ShellResult keeps. Options.OnLine sees all of it.
+const MaxOutput = 1 << 20
+
+// maxLine is the longest piece of a line passed to Options.OnLine.
+const maxLine = 64 << 10
+
 // ShellResult holds the output of a shell command.
 type ShellResult struct {
-	Stdout   string
-	Stderr   string
-	ExitCode int
+	Stdout    string
+	Stderr    string
+	ExitCode  int
+	Truncated []string // the streams, "stdout" or "stderr", that lost their beginning to MaxOutput
+}
+
+// Options sets up the process a command runs in.
+type Options struct {
+	Dir   string   // working directory; empty means the current one
+	Env   []string // KEY=value pairs; nil inherits the environment
+	Stdin string   // piped to the process; empty means no input
+
+	// OnLine, if set, is called with each line the command prints as it
+	// arrives, ending with its newline unless it is the last line or longer
+	// than 64 KiB, in which case it comes in pieces. stream is "stdout" or
+	// "stderr". Calls are made one at a time and hold up the command while
+	// they run.
+	OnLine func(stream, line string)
 }
 
 // Run executes a command via sh -c and captures output.
-func Run(command, workDir string) *ShellResult {
-	cmd := exec.Command("sh", "-c", command)
-	if workDir != "" {
-		cmd.Dir = workDir
+// When ctx is done the command and every process it started are killed.
+func Run(ctx context.Context, command string, opts Options) *ShellResult {
+	return run(Command(ctx, "sh", "-c", command), opts)
+}
+
+// Exec runs argv directly, without a shell, and captures output like Run.
+// A program that cannot be found or started exits with 127, as it would in
+// a shell, with the reason on stderr.
+func Exec(ctx context.Context, argv []string, opts Options) *ShellResult {
+	if len(argv) == 0 {
+		return &ShellResult{Stderr: "exec: no program given", ExitCode: 127}
 	}
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	return run(Command(ctx, argv[0], argv[1:]...), opts)
+}
+
+// Command returns the command to run name with args, set up like those of
+// Run and Exec: when ctx is done it is killed with every process it started.
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	killProcessGroup(cmd)
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
+
+func run(cmd *exec.Cmd, opts Options) *ShellResult {
+	cmd.Dir = opts.Dir
+	cmd.Env = opts.Env
+	if opts.Stdin != "" {
+		cmd.Stdin = strings.NewReader(opts.Stdin)
+	}
+
+	var mu sync.Mutex
+	stdout := &output{stream: "stdout", onLine: opts.OnLine, mu: &mu}
+	stderr := &output{stream: "stderr", onLine: opts.OnLine, mu: &mu}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	err := cmd.Run()
 	exitCode := 0
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
 			exitCode = exitErr.ExitCode()
-		} else {
+		} else if cmd.Process == nil {
+			// Never started, e.g. not found or not executable
+			exitCode = 127
+			stderr.Write([]byte(err.Error() + "\n"))
+		}
+		if exitCode <= 0 {
 			exitCode = 1
 		}
 	}
 
-	return &ShellResult{
-		Stdout:   stdout.String(),
-		Stderr:   stderr.String(),
-		ExitCode: exitCode,
+	stdout.flush()
+	stderr.flush()
+
+	r := &ShellResult{Stdout: string(stdout.tail), Stderr: string(stderr.tail), ExitCode: exitCode}
+	for _, o := range []*output{stdout, stderr} {
+		if o.dropped {
+			r.Truncated = append(r.Truncated, o.stream)
+		}
+	}
+	return r
+}
+
+// output is one output stream of a command. It keeps the last MaxOutput
+// bytes written to it and passes each complete line to onLine. The streams
+// of a command share mu, so onLine is called for one line at a time.
+type output struct {
+	stream  string
+	onLine  func(stream, line string)
+	mu      *sync.Mutex
+	tail    []byte
+	dropped bool   // tail lost bytes from its beginning
+	partial []byte // the start of a line not yet passed to onLine
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.tail = append(o.tail, p...)
+	if extra := len(o.tail) - MaxOutput; extra > 0 {
+		o.tail = o.tail[:copy(o.tail, o.tail[extra:])]
+		o.dropped = true
+	}
+
+	if o.onLine == nil {
+		return len(p), nil
+	}
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		switch {
+		case i >= 0 && i < maxLine:
+			o.onLine(o.stream, string(o.partial[:i+1]))
+			o.partial = o.partial[i+1:]
+		case len(o.partial) >= maxLine:
+			o.onLine(o.stream, string(o.partial[:maxLine]))
+			o.partial = o.partial[maxLine:]
+		default:
+			return len(p), nil
+		}
+	}
+}
+
+// flush passes a last line that did not end with a newline to onLine.
+func (o *output) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.onLine != nil && len(o.partial) > 0 {
+		o.onLine(o.stream, string(o.partial))
 	}
+	o.partial = nil
 }
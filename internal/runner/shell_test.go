@@ -1,12 +1,16 @@
 package runner
 
 import (
+	"context"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestRunEchoHello(t *testing.T) {
-	r := Run("echo hello", "")
+	r := Run(context.Background(), "echo hello", Options{})
 	if r.ExitCode != 0 {
 		t.Fatalf("expected exit code 0, got %d", r.ExitCode)
 	}
@@ -16,7 +20,7 @@ func TestRunEchoHello(t *testing.T) {
 }
 
 func TestRunCaptureStderr(t *testing.T) {
-	r := Run("echo error >&2", "")
+	r := Run(context.Background(), "echo error >&2", Options{})
 	if r.ExitCode != 0 {
 		t.Fatalf("expected exit code 0, got %d", r.ExitCode)
 	}
@@ -26,14 +30,14 @@ func TestRunCaptureStderr(t *testing.T) {
 }
 
 func TestRunNonZeroExitCode(t *testing.T) {
-	r := Run("exit 42", "")
+	r := Run(context.Background(), "exit 42", Options{})
 	if r.ExitCode != 42 {
 		t.Errorf("expected exit code 42, got %d", r.ExitCode)
 	}
 }
 
 func TestRunPipesWork(t *testing.T) {
-	r := Run("echo hello world | wc -w", "")
+	r := Run(context.Background(), "echo hello world | wc -w", Options{})
 	if r.ExitCode != 0 {
 		t.Fatalf("expected exit code 0, got %d", r.ExitCode)
 	}
@@ -43,7 +47,7 @@ func TestRunPipesWork(t *testing.T) {
 }
 
 func TestRunMultiLineStdout(t *testing.T) {
-	r := Run("printf 'line1\nline2\nline3'", "")
+	r := Run(context.Background(), "printf 'line1\nline2\nline3'", Options{})
 	if r.ExitCode != 0 {
 		t.Fatalf("expected exit code 0, got %d", r.ExitCode)
 	}
@@ -52,3 +56,115 @@ func TestRunMultiLineStdout(t *testing.T) {
 		t.Errorf("expected 3 lines, got %d: %q", len(lines), r.Stdout)
 	}
 }
+
+func TestRunKilledWhenContextExpires(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	r := Run(ctx, "sleep 5; echo done", Options{})
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("expected command to be killed promptly, took %s", elapsed)
+	}
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code for killed command")
+	}
+	if strings.Contains(r.Stdout, "done") {
+		t.Error("expected command not to complete")
+	}
+}
+
+func TestRunKillsBackgroundChildren(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The subshell inherits stdout; if it survived, Run would wait for it.
+	start := time.Now()
+	Run(ctx, "(sleep 5; echo late) & wait", Options{})
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("expected process group to be killed, took %s", elapsed)
+	}
+}
+
+func TestExecPassesArgsVerbatim(t *testing.T) {
+	r := Exec(context.Background(), []string{"printf", "%s|", "a b", "$HOME", "'; rm -rf /"}, Options{})
+	if r.ExitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", r.ExitCode, r.Stderr)
+	}
+	if r.Stdout != "a b|$HOME|'; rm -rf /|" {
+		t.Errorf("expected arguments untouched, got %q", r.Stdout)
+	}
+}
+
+func TestExecOptions(t *testing.T) {
+	dir := t.TempDir()
+	r := Exec(context.Background(), []string{"sh", "-c", `pwd; echo "$GREETING"; cat`}, Options{
+		Dir:   dir,
+		Env:   []string{"GREETING=hi"},
+		Stdin: "from stdin",
+	})
+	if r.ExitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", r.ExitCode, r.Stderr)
+	}
+	lines := strings.Split(r.Stdout, "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], filepath.Base(dir)) || lines[1] != "hi" || lines[2] != "from stdin" {
+		t.Errorf("unexpected output %q", r.Stdout)
+	}
+}
+
+func TestExecProgramNotFound(t *testing.T) {
+	r := Exec(context.Background(), []string{"declaragent-no-such-program"}, Options{})
+	if r.ExitCode != 127 {
+		t.Errorf("expected exit code 127, got %d", r.ExitCode)
+	}
+	if !strings.Contains(r.Stderr, "declaragent-no-such-program") {
+		t.Errorf("expected the reason on stderr, got %q", r.Stderr)
+	}
+}
+
+func TestRunStreamsLines(t *testing.T) {
+	type line struct {
+		stream, text string
+		at           time.Time
+	}
+	var lines []line
+	start := time.Now()
+	r := Run(context.Background(), "echo one; sleep 0.5; echo two >&2; printf three", Options{
+		OnLine: func(stream, text string) {
+			lines = append(lines, line{stream, text, time.Now()})
+		},
+	})
+	if r.ExitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d", r.ExitCode)
+	}
+	if len(lines) != 3 || lines[0] != (line{"stdout", "one\n", lines[0].at}) || lines[1].stream != "stderr" || lines[1].text != "two\n" || lines[2].text != "three" {
+		t.Fatalf("unexpected lines %+v", lines)
+	}
+	if lines[0].at.Sub(start) > 400*time.Millisecond {
+		t.Errorf("expected the first line before the command finished, got it after %s", lines[0].at.Sub(start))
+	}
+	if r.Stdout != "one\nthree" || r.Stderr != "two\n" {
+		t.Errorf("unexpected output %q, %q", r.Stdout, r.Stderr)
+	}
+}
+
+func TestRunKeepsTailOfOutput(t *testing.T) {
+	var longest, count int
+	var all strings.Builder
+	r := Run(context.Background(), "head -c 1100000 /dev/zero | tr '\\0' a; echo; echo end", Options{
+		OnLine: func(_, text string) {
+			longest = max(longest, len(text))
+			count++
+			all.WriteString(text)
+		},
+	})
+	if r.ExitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d", r.ExitCode)
+	}
+	if len(r.Stdout) != MaxOutput || !strings.HasSuffix(r.Stdout, "a\nend\n") || !slices.Equal(r.Truncated, []string{"stdout"}) {
+		t.Errorf("expected the last %d bytes, got %d ending %q (truncated %v)", MaxOutput, len(r.Stdout), r.Stdout[len(r.Stdout)-10:], r.Truncated)
+	}
+	if longest != maxLine || count != 1100000/maxLine+2 || all.Len() != 1100005 {
+		t.Errorf("expected the long line in pieces of %d, got %d lines of up to %d", maxLine, count, longest)
+	}
+}
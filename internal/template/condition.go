@@ -0,0 +1,49 @@
+package template
+
+// A condition is an expression written outside ${{ }}, with references
+// inside it, e.g.
+//
+//	${{ inputs.branch }} == 'main' && ${{ steps.build.status }} != 'failed'
+//
+// It has the same operators, literals and filters as a template expression,
+// and ${{ }} groups like parentheses, so the whole condition may also be a
+// single ${{ }}. The condition holds unless its value is false, 0, empty,
+// "false" or "0".
+
+// CheckCondition reports syntax and type errors in a condition without
+// evaluating it. lists is as for Check.
+func CheckCondition(expr string, lists map[string]bool) error {
+	n, err := parseExpr(expr, 0, true)
+	if err != nil {
+		return err
+	}
+	return checkTop(n, lists)
+}
+
+// EvalCondition evaluates a condition against ctx.
+func EvalCondition(expr string, ctx *Context) (bool, error) {
+	n, err := parseExpr(expr, 0, true)
+	if err != nil {
+		return false, err
+	}
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	v, err := ctx.eval(n)
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+// StepRefs returns the IDs of all steps whose outputs or status s references.
+func StepRefs(s string) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, ref := range Refs(s) {
+		if ref.Namespace == "steps" && !seen[ref.Step] {
+			seen[ref.Step] = true
+			ids = append(ids, ref.Step)
+		}
+	}
+	return ids
+}
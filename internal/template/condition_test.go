@@ -0,0 +1,70 @@
+package template
+
+import (
+	"testing"
+)
+
+func condCtx() *Context {
+	return &Context{
+		Inputs: map[string]string{"branch": "main", "empty": ""},
+		StepOutputs: map[string]map[string]string{
+			"build": {"log": "compiled 3 files"},
+		},
+		StepStatus: map[string]string{"build": "success"},
+	}
+}
+
+func TestEvalConditionComparisons(t *testing.T) {
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`${{inputs.branch}} == 'main'`, true},
+		{`${{inputs.branch}} != "main"`, false},
+		{`${{steps.build.status}} == 'success' && ${{inputs.branch}} == 'main'`, true},
+		{`${{inputs.branch}} == 'dev' || ${{steps.build.outputs.log}}`, true},
+		{`!${{inputs.empty}}`, true},
+		{`${{inputs.empty}}`, false},
+		{`!(${{inputs.branch}} == 'main' || false)`, false},
+		{`true`, true},
+		{`0`, false},
+	}
+	for _, tc := range cases {
+		got, err := EvalCondition(tc.expr, condCtx())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.expr, tc.want, got)
+		}
+	}
+}
+
+func TestEvalConditionUnresolvedRef(t *testing.T) {
+	_, err := EvalCondition(`${{steps.nope.status}} == 'success'`, condCtx())
+	if err == nil {
+		t.Fatal("expected error for unresolved status ref")
+	}
+}
+
+func TestCheckConditionSyntaxErrors(t *testing.T) {
+	for _, expr := range []string{
+		`${{inputs.branch}} == main`,
+		`${{inputs.branch}} ==`,
+		`(${{inputs.branch}} == 'main'`,
+		`'unterminated`,
+		`${{inputs.branch`,
+	} {
+		if err := CheckCondition(expr, nil); err == nil {
+			t.Errorf("%s: expected syntax error", expr)
+		}
+	}
+}
+
+func TestStepRefs(t *testing.T) {
+	refs := StepRefs(`${{steps.a.outputs.x}} == ${{steps.b.status}} && ${{steps.a.status}} != ''`)
+	if len(refs) != 2 || refs[0] != "a" || refs[1] != "b" {
+		t.Errorf("expected [a b], got %v", refs)
+	}
+}
@@ -0,0 +1,733 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// An expression is what appears inside ${{ }}:
+//
+//	inputs.tag || 'latest'
+//	steps.build.outputs.image | split(':') | join('@')
+//	upper(inputs.env) == 'PROD' && steps.test.status == 'success'
+//
+// Operands are references (inputs.x, steps.a.outputs.b, ...), quoted
+// strings, numbers, true and false. Operators, loosest first, are | filter,
+// ||, &&, comparisons (== != < <= > >=) and !, with parentheses for
+// grouping. || yields its left operand unless that is false or missing, so
+// it doubles as a default. Filters can also be called as functions:
+// upper(x) is x | upper.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPath
+	tokString
+	tokNumber
+	tokBool
+	tokOp
+	tokOpen  // ${{ in a condition
+	tokClose // }} in a condition
+)
+
+type token struct {
+	kind tokenKind
+	text string // path, literal value or operator
+	pos  int
+}
+
+// lex splits src into tokens; positions are offset by base. In a condition,
+// ${{ and }} delimit references, and paths may only appear between them.
+func lex(src string, base int, condition bool) ([]token, error) {
+	var toks []token
+	depth := 0
+	for i := 0; i < len(src); {
+		c := src[i]
+		pos := base + i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case condition && strings.HasPrefix(src[i:], "${{"):
+			toks = append(toks, token{kind: tokOpen, text: "${{", pos: pos})
+			depth++
+			i += 3
+		case condition && depth > 0 && strings.HasPrefix(src[i:], "}}"):
+			toks = append(toks, token{kind: tokClose, text: "}}", pos: pos})
+			depth--
+			i += 2
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", pos)
+			}
+			toks = append(toks, token{kind: tokString, text: src[i+1 : i+1+end], pos: pos})
+			i += end + 2
+		case strings.HasPrefix(src[i:], "||") || strings.HasPrefix(src[i:], "&&") ||
+			strings.HasPrefix(src[i:], "==") || strings.HasPrefix(src[i:], "!=") ||
+			strings.HasPrefix(src[i:], "<=") || strings.HasPrefix(src[i:], ">="):
+			toks = append(toks, token{kind: tokOp, text: src[i : i+2], pos: pos})
+			i += 2
+		case strings.IndexByte("!()<>,|", c) >= 0:
+			toks = append(toks, token{kind: tokOp, text: string(c), pos: pos})
+			i++
+		case c == '-' || c >= '0' && c <= '9':
+			start := i
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			word := src[start:i]
+			if !isNumber(word) {
+				return nil, fmt.Errorf("unexpected %q at position %d", word, pos)
+			}
+			toks = append(toks, token{kind: tokNumber, text: word, pos: pos})
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && (isIdentChar(src[i]) || src[i] == '.' && i+1 < len(src) && isIdentChar(src[i+1])) {
+				i++
+			}
+			word := src[start:i]
+			if word == "true" || word == "false" {
+				toks = append(toks, token{kind: tokBool, text: word, pos: pos})
+				break
+			}
+			if condition && depth == 0 {
+				return nil, fmt.Errorf("unexpected %q at position %d (quote string literals and put references in ${{ }})", word, pos)
+			}
+			toks = append(toks, token{kind: tokPath, text: word, pos: pos})
+		default:
+			if condition && strings.HasPrefix(src[i:], "}}") {
+				return nil, fmt.Errorf("unexpected }} at position %d", pos)
+			}
+			return nil, fmt.Errorf("unexpected %q at position %d", c, pos)
+		}
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unterminated ${{ in condition")
+	}
+	return append(toks, token{kind: tokEOF, pos: base + len(src)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9' || c == '-'
+}
+
+func isNumber(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	if s == "" {
+		return false
+	}
+	dot := false
+	for _, c := range s {
+		switch {
+		case c == '.' && !dot:
+			dot = true
+		case c < '0' || c > '9':
+			return false
+		}
+	}
+	return true
+}
+
+// Expression syntax tree.
+type (
+	node interface{ position() int }
+
+	pathNode struct {
+		pos  int
+		path string
+	}
+	literalNode struct {
+		pos   int
+		value any
+	}
+	notNode struct {
+		pos int
+		x   node
+	}
+	binaryNode struct {
+		pos  int
+		op   string
+		l, r node
+	}
+	filterNode struct {
+		pos  int
+		name string
+		x    node
+		args []node
+	}
+)
+
+func (n *pathNode) position() int    { return n.pos }
+func (n *literalNode) position() int { return n.pos }
+func (n *notNode) position() int     { return n.pos }
+func (n *binaryNode) position() int  { return n.pos }
+func (n *filterNode) position() int  { return n.pos }
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	t := p.next()
+	if t.kind != kind || t.text != text {
+		if t.kind == tokEOF {
+			return fmt.Errorf("expected %s at end of expression", text)
+		}
+		return fmt.Errorf("expected %s at position %d, got %q", text, t.pos, t.text)
+	}
+	return nil
+}
+
+// parseExpr parses a whole expression. base is the position of src within
+// the string reported in errors.
+func parseExpr(src string, base int, condition bool) (node, error) {
+	toks, err := lex(src, base, condition)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+	return n, nil
+}
+
+func (p *parser) parsePipeline() (node, error) {
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("|") {
+		p.next()
+		t := p.next()
+		if t.kind != tokPath {
+			return nil, fmt.Errorf("expected filter name at position %d", t.pos)
+		}
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		n = &filterNode{pos: t.pos, name: t.text, x: n, args: args}
+	}
+	return n, nil
+}
+
+// parseArgs parses an optional parenthesised argument list.
+func (p *parser) parseArgs() ([]node, error) {
+	if !p.isOp("(") {
+		return nil, nil
+	}
+	p.next()
+	var args []node
+	for !p.isOp(")") {
+		if len(args) > 0 {
+			if err := p.expect(tokOp, ","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		t := p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryNode{pos: t.pos, op: t.text, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		t := p.next()
+		r, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryNode{pos: t.pos, op: t.text, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseComparison() (node, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=") {
+		t := p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{pos: t.pos, op: t.text, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		t := p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{pos: t.pos, x: x}, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literalNode{pos: t.pos, value: t.text}, nil
+	case tokBool:
+		return &literalNode{pos: t.pos, value: t.text == "true"}, nil
+	case tokNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return &literalNode{pos: t.pos, value: f}, nil
+	case tokPath:
+		if !p.isOp("(") {
+			return &pathNode{pos: t.pos, path: t.text}, nil
+		}
+		// A function call: f(x, args...) is x | f(args...)
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s() needs an argument at position %d", t.text, t.pos)
+		}
+		return &filterNode{pos: t.pos, name: t.text, x: args[0], args: args[1:]}, nil
+	case tokOpen:
+		x, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(tokClose, "}}")
+	case tokOp:
+		if t.text == "(" {
+			x, err := p.parsePipeline()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(tokOp, ")")
+		}
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	default:
+		return nil, fmt.Errorf("unexpected end of expression at position %d", t.pos)
+	}
+}
+
+// Static types of expression values.
+type valueType int
+
+const (
+	typeAny valueType = iota
+	typeString
+	typeBool
+	typeNumber
+	typeList
+)
+
+func (t valueType) String() string {
+	return [...]string{"any", "string", "boolean", "number", "list"}[t]
+}
+
+// check reports unknown filters, wrong argument counts and filters applied
+// to values of the wrong type, and returns the type of n. References are
+// strings, except those in lists, which hold JSON arrays.
+func check(n node, lists map[string]bool) (valueType, error) {
+	switch n := n.(type) {
+	case *pathNode:
+		if lists[n.path] {
+			return typeList, nil
+		}
+		return typeString, nil
+	case *literalNode:
+		switch n.value.(type) {
+		case bool:
+			return typeBool, nil
+		case float64:
+			return typeNumber, nil
+		}
+		return typeString, nil
+	case *notNode:
+		_, err := check(n.x, lists)
+		return typeBool, err
+	case *binaryNode:
+		lt, err := check(n.l, lists)
+		if err != nil {
+			return typeAny, err
+		}
+		rt, err := check(n.r, lists)
+		if err != nil {
+			return typeAny, err
+		}
+		switch n.op {
+		case "||", "&&":
+			if lt == rt {
+				return lt, nil
+			}
+			return typeAny, nil
+		}
+		return typeBool, nil
+	case *filterNode:
+		f, ok := filters[n.name]
+		if !ok {
+			return typeAny, fmt.Errorf("unknown filter %q at position %d (filters: %s)", n.name, n.pos, filterNames())
+		}
+		if len(n.args) < f.minArgs || len(n.args) > f.maxArgs {
+			return typeAny, fmt.Errorf("%s takes %s at position %d", n.name, f.argsText(), n.pos)
+		}
+		in, err := check(n.x, lists)
+		if err != nil {
+			return typeAny, err
+		}
+		if in != typeAny && f.in != typeAny && (in == typeList) != (f.in == typeList) {
+			return typeAny, fmt.Errorf("%s expects a %s, got a %s at position %d", n.name, f.in, in, n.pos)
+		}
+		for _, arg := range n.args {
+			if _, err := check(arg, lists); err != nil {
+				return typeAny, err
+			}
+		}
+		if f.out == typeAny {
+			return in, nil
+		}
+		return f.out, nil
+	}
+	return typeAny, nil
+}
+
+// errUnresolved marks a reference with no value, which || treats as empty.
+type errUnresolved struct{ msg string }
+
+func (e *errUnresolved) Error() string { return e.msg }
+
+// eval computes the value of n: a string, bool, float64 or []any.
+func (c *Context) eval(n node) (any, error) {
+	switch n := n.(type) {
+	case *pathNode:
+		v, ok, err := c.lookup(n.path)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown reference %q at position %d", n.path, n.pos)
+		}
+		return v, nil
+	case *literalNode:
+		return n.value, nil
+	case *notNode:
+		v, err := c.eval(n.x)
+		if err != nil {
+			return nil, err
+		}
+		return !truthy(v), nil
+	case *binaryNode:
+		l, err := c.eval(n.l)
+		var unresolved *errUnresolved
+		if n.op == "||" && errors.As(err, &unresolved) {
+			l, err = "", nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case n.op == "||" && truthy(l), n.op == "&&" && !truthy(l):
+			return l, nil
+		}
+		r, err := c.eval(n.r)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "||" || n.op == "&&" {
+			return r, nil
+		}
+		return compare(n.op, l, r), nil
+	case *filterNode:
+		x, err := c.eval(n.x)
+		if err != nil {
+			return nil, err
+		}
+		args := make([]string, len(n.args))
+		for i, arg := range n.args {
+			v, err := c.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = toString(v)
+		}
+		f, ok := filters[n.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q at position %d", n.name, n.pos)
+		}
+		v, err := f.apply(x, args)
+		if err != nil {
+			return nil, fmt.Errorf("%s at position %d: %w", n.name, n.pos, err)
+		}
+		if hook := c.filtered(); hook != nil {
+			hook(toString(x), toString(v))
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("invalid expression")
+}
+
+// filtered returns the Filtered hook of c, or of the context it is a scope of.
+func (c *Context) filtered() func(in, out string) {
+	for ; c != nil; c = c.parent {
+		if c.Filtered != nil {
+			return c.Filtered
+		}
+	}
+	return nil
+}
+
+// compare applies a comparison operator. Ordering compares numbers when
+// both sides are numbers and strings otherwise.
+func compare(op string, l, r any) bool {
+	ls, rs := toString(l), toString(r)
+	switch op {
+	case "==":
+		return ls == rs
+	case "!=":
+		return ls != rs
+	}
+	cmp := strings.Compare(ls, rs)
+	lf, lerr := strconv.ParseFloat(ls, 64)
+	rf, rerr := strconv.ParseFloat(rs, 64)
+	if lerr == nil && rerr == nil {
+		switch {
+		case lf < rf:
+			cmp = -1
+		case lf > rf:
+			cmp = 1
+		default:
+			cmp = 0
+		}
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// truthy is false for false, 0, "", "false", "0" and empty lists.
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case []any:
+		return len(v) > 0
+	case string:
+		return v != "" && v != "false" && v != "0"
+	}
+	return false
+}
+
+// toString renders a value for insertion into a template. Lists become
+// JSON arrays.
+func toString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		s, _ := toJSON(v)
+		return s
+	}
+	return ""
+}
+
+// isRaw reports whether n ends in the raw filter.
+func isRaw(n node) bool {
+	f, ok := n.(*filterNode)
+	return ok && f.name == FilterRaw
+}
+
+// Ref is a reference to a value in a template, such as
+// steps.build.outputs.image.
+type Ref struct {
+	Namespace string // inputs, steps, run, plan, env, item, matrix, ...
+	Step      string // the step ID, for steps references
+	Field     string // outputs, status, exit_code or duration, for steps references
+	Name      string // the output, input or field name
+	Pos       int    // offset of the reference in the template string
+}
+
+func newRef(path string, pos int) Ref {
+	ns, rest, _ := strings.Cut(path, ".")
+	r := Ref{Namespace: ns, Name: rest, Pos: pos}
+	if ns == "steps" {
+		r.Step, r.Name, _ = strings.Cut(rest, ".")
+		r.Field, r.Name, _ = strings.Cut(r.Name, ".")
+	}
+	return r
+}
+
+// namespaces are the reference roots that templates resolve. A template
+// that is only a reference into any other namespace, such as
+// ${{ github.sha }}, is left untouched.
+var namespaces = map[string]bool{"inputs": true, "steps": true, "run": true, "plan": true, "env": true, "item": true, "matrix": true, "params": true}
+
+// passThrough reports whether n is a lone reference outside the known
+// namespaces.
+func passThrough(n node) bool {
+	p, ok := n.(*pathNode)
+	if !ok {
+		return false
+	}
+	ns, _, _ := strings.Cut(p.path, ".")
+	return !namespaces[ns]
+}
+
+func collectRefs(n node, refs []Ref) []Ref {
+	switch n := n.(type) {
+	case *pathNode:
+		refs = append(refs, newRef(n.path, n.pos))
+	case *notNode:
+		refs = collectRefs(n.x, refs)
+	case *binaryNode:
+		refs = collectRefs(n.r, collectRefs(n.l, refs))
+	case *filterNode:
+		refs = collectRefs(n.x, refs)
+		for _, arg := range n.args {
+			refs = collectRefs(arg, refs)
+		}
+	}
+	return refs
+}
+
+// Check parses and type-checks every ${{ }} expression in s. lists holds
+// the references, such as inputs.tags, whose values are JSON arrays.
+func Check(s string, lists map[string]bool) error {
+	for _, loc := range templateRe.FindAllStringSubmatchIndex(s, -1) {
+		n, err := parseExpr(s[loc[2]:loc[3]], loc[2], false)
+		if err == nil {
+			err = checkTop(n, lists)
+		}
+		if err != nil {
+			return fmt.Errorf("in %s: %w", s[loc[0]:loc[1]], err)
+		}
+	}
+	return nil
+}
+
+// checkTop type-checks a whole expression, where raw may only be the last
+// filter.
+func checkTop(n node, lists map[string]bool) error {
+	if isRaw(n) {
+		n = n.(*filterNode).x
+	}
+	if raw := findRaw(n); raw != nil {
+		return fmt.Errorf("raw must be the last filter, at position %d", raw.pos)
+	}
+	_, err := check(n, lists)
+	return err
+}
+
+func findRaw(n node) *filterNode {
+	switch n := n.(type) {
+	case *notNode:
+		return findRaw(n.x)
+	case *binaryNode:
+		if f := findRaw(n.l); f != nil {
+			return f
+		}
+		return findRaw(n.r)
+	case *filterNode:
+		if n.name == FilterRaw {
+			return n
+		}
+		for _, arg := range n.args {
+			if f := findRaw(arg); f != nil {
+				return f
+			}
+		}
+		return findRaw(n.x)
+	}
+	return nil
+}
+
+// Refs returns the references made by the ${{ }} expressions in s, which
+// may be a template or a condition. Expressions that do not parse are
+// skipped; Check and CheckCondition report them.
+func Refs(s string) []Ref {
+	var refs []Ref
+	for _, loc := range templateRe.FindAllStringSubmatchIndex(s, -1) {
+		n, err := parseExpr(s[loc[2]:loc[3]], loc[2], false)
+		if err != nil || passThrough(n) {
+			continue
+		}
+		refs = collectRefs(n, refs)
+	}
+	return refs
+}
@@ -0,0 +1,157 @@
+package template
+
+import (
+	"strings"
+	"testing"
+)
+
+func exprCtx() *Context {
+	return &Context{
+		Inputs: map[string]string{"name": " Ada Lovelace ", "tags": `["a","b c"]`, "count": "10", "empty": ""},
+		StepOutputs: map[string]map[string]string{
+			"build": {"image": "app:1.2"},
+		},
+		StepStatus: map[string]string{"build": "success"},
+	}
+}
+
+func TestResolveExpressions(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		{"${{ inputs.tag || 'latest' }}", "latest"},
+		{"${{ inputs.empty || 'latest' }}", "latest"},
+		{"${{ inputs.count || 'latest' }}", "10"},
+		{"${{ inputs.name | trim | upper }}", "ADA LOVELACE"},
+		{"${{ lower(trim(inputs.name)) }}", "ada lovelace"},
+		{"${{ inputs.name | trim | replace(' ', '-') }}", "Ada-Lovelace"},
+		{"${{ steps.build.outputs.image | split(':') | join('@') }}", "app@1.2"},
+		{"${{ steps.build.outputs.image | split(':') }}", `["app","1.2"]`},
+		{"${{ inputs.tags | join }}", "a,b c"},
+		{"${{ inputs.tags | join(' + ') }}", "a + b c"},
+		{"${{ inputs.name | json }}", `" Ada Lovelace "`},
+		{"${{ 'hi' | base64 }}", "aGk="},
+		{"${{ 'abc' | sha256 }}", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"${{ 'a b&c' | urlencode }}", "a+b%26c"},
+		{"${{ inputs.count > 9 }}", "true"},
+		{"${{ inputs.count > '9' && steps.build.status == 'success' }}", "true"},
+		{"${{ !inputs.empty }}", "true"},
+		{"${{ github.sha }}", "${{ github.sha }}"},
+	}
+	for _, tc := range cases {
+		got, err := Resolve(tc.tmpl, exprCtx())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.tmpl, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.tmpl, tc.want, got)
+		}
+	}
+}
+
+func TestResolveExpressionErrors(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		{"x ${{ inputs.name | }}", "expected filter name at position 19"},
+		{"${{ inputs.name == }}", "unexpected end of expression at position 18"},
+		{"${{ 'open }}", "unterminated string at position 4"},
+		{"${{ inputs.tag }}", `unresolved input "tag"`},
+		{"${{ inputs.name | join }}", "join at position 18: expects a list"},
+	}
+	for _, tc := range cases {
+		_, err := Resolve(tc.tmpl, exprCtx())
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.tmpl, tc.want, err)
+		}
+	}
+}
+
+func TestCheckExpressions(t *testing.T) {
+	lists := map[string]bool{"inputs.tags": true}
+	for _, ok := range []string{
+		"${{ inputs.tags | join(' ') }}",
+		"${{ inputs.a | split(',') | join }}",
+		"${{ inputs.a || 'x' | raw }}",
+	} {
+		if err := Check(ok, lists); err != nil {
+			t.Errorf("%s: unexpected error: %v", ok, err)
+		}
+	}
+
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		{"${{ inputs.a | shout }}", `unknown filter "shout" at position 15`},
+		{"${{ inputs.tags | upper }}", "upper expects a string, got a list at position 18"},
+		{"${{ inputs.a | join }}", "join expects a list, got a string"},
+		{"${{ inputs.a | split }}", "split takes 1 argument"},
+		{"${{ inputs.a | trim(' ') }}", "trim takes no arguments"},
+		{"${{ upper() }}", "upper() needs an argument at position 4"},
+		{"${{ inputs.a | raw | trim }}", "raw must be the last filter, at position 15"},
+	}
+	for _, tc := range cases {
+		err := Check(tc.tmpl, lists)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.tmpl, tc.want, err)
+		}
+	}
+}
+
+func TestFilteredHookSeesEveryFilter(t *testing.T) {
+	ctx := exprCtx()
+	var calls []string
+	ctx.Filtered = func(in, out string) { calls = append(calls, in+" -> "+out) }
+	got, err := Resolve("${{ inputs.name | trim | upper }}", ctx.Scope("x", nil))
+	if err != nil || got != "ADA LOVELACE" {
+		t.Fatalf("expected ADA LOVELACE, got %q, %v", got, err)
+	}
+	want := []string{" Ada Lovelace  -> Ada Lovelace", "Ada Lovelace -> ADA LOVELACE"}
+	if strings.Join(calls, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, calls)
+	}
+}
+
+func TestRefs(t *testing.T) {
+	refs := Refs("${{ inputs.tag || steps.build.outputs.image | upper }} ${{ github.sha }} ${{ steps.test.status }}")
+	want := []Ref{
+		{Namespace: "inputs", Name: "tag", Pos: 4},
+		{Namespace: "steps", Step: "build", Field: "outputs", Name: "image", Pos: 18},
+		{Namespace: "steps", Step: "test", Field: "status", Pos: 77},
+	}
+	if len(refs) != len(want) {
+		t.Fatalf("expected %d refs, got %+v", len(want), refs)
+	}
+	for i := range want {
+		if refs[i] != want[i] {
+			t.Errorf("ref %d: expected %+v, got %+v", i, want[i], refs[i])
+		}
+	}
+}
+
+func TestEvalConditionExpressions(t *testing.T) {
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`${{ inputs.count >= 10 && inputs.count < 11 }}`, true},
+		{`${{ upper(inputs.name | trim) }} == 'ADA LOVELACE'`, true},
+		{`${{ inputs.missing || 'main' }} == 'main'`, true},
+		{`${{ inputs.count }} > 9`, true},
+		{`'b' > 'a'`, true},
+	}
+	for _, tc := range cases {
+		got, err := EvalCondition(tc.expr, exprCtx())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.expr, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package template
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// FilterRaw inserts a value into run: commands without shell quoting. It
+// must be the last filter of the expression.
+const FilterRaw = "raw"
+
+type filter struct {
+	minArgs, maxArgs int
+	in, out          valueType // typeAny out keeps the input type
+	apply            func(x any, args []string) (any, error)
+}
+
+func (f filter) argsText() string {
+	switch {
+	case f.maxArgs == 0:
+		return "no arguments"
+	case f.minArgs == f.maxArgs && f.maxArgs == 1:
+		return "1 argument"
+	case f.minArgs == f.maxArgs:
+		return fmt.Sprintf("%d arguments", f.maxArgs)
+	default:
+		return fmt.Sprintf("%d to %d arguments", f.minArgs, f.maxArgs)
+	}
+}
+
+func stringFilter(fn func(s string, args []string) string) func(any, []string) (any, error) {
+	return func(x any, args []string) (any, error) {
+		if _, ok := x.([]any); ok {
+			return nil, fmt.Errorf("expects a string, got a list")
+		}
+		return fn(toString(x), args), nil
+	}
+}
+
+var filters = map[string]filter{
+	FilterRaw: {in: typeAny, out: typeAny, apply: func(x any, _ []string) (any, error) { return x, nil }},
+	"upper": {in: typeString, out: typeString, apply: stringFilter(func(s string, _ []string) string {
+		return strings.ToUpper(s)
+	})},
+	"lower": {in: typeString, out: typeString, apply: stringFilter(func(s string, _ []string) string {
+		return strings.ToLower(s)
+	})},
+	"trim": {in: typeString, out: typeString, apply: stringFilter(func(s string, _ []string) string {
+		return strings.TrimSpace(s)
+	})},
+	"replace": {minArgs: 2, maxArgs: 2, in: typeString, out: typeString, apply: stringFilter(func(s string, args []string) string {
+		return strings.ReplaceAll(s, args[0], args[1])
+	})},
+	"split": {minArgs: 1, maxArgs: 1, in: typeString, out: typeList, apply: func(x any, args []string) (any, error) {
+		if _, ok := x.([]any); ok {
+			return nil, fmt.Errorf("expects a string, got a list")
+		}
+		var list []any
+		for _, part := range strings.Split(toString(x), args[0]) {
+			list = append(list, part)
+		}
+		return list, nil
+	}},
+	"join": {maxArgs: 1, in: typeList, out: typeString, apply: func(x any, args []string) (any, error) {
+		list, ok := x.([]any)
+		if !ok {
+			// Array inputs arrive as JSON text
+			if err := json.Unmarshal([]byte(toString(x)), &list); err != nil {
+				return nil, fmt.Errorf("expects a list, got %q", toString(x))
+			}
+		}
+		sep := ","
+		if len(args) > 0 {
+			sep = args[0]
+		}
+		parts := make([]string, len(list))
+		for i, v := range list {
+			parts[i] = toString(v)
+		}
+		return strings.Join(parts, sep), nil
+	}},
+	"json": {in: typeAny, out: typeString, apply: func(x any, _ []string) (any, error) {
+		return toJSON(x)
+	}},
+	"base64": {in: typeString, out: typeString, apply: stringFilter(func(s string, _ []string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	})},
+	"sha256": {in: typeString, out: typeString, apply: stringFilter(func(s string, _ []string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	})},
+	"urlencode": {in: typeString, out: typeString, apply: stringFilter(func(s string, _ []string) string {
+		return url.QueryEscape(s)
+	})},
+}
+
+func filterNames() string {
+	return strings.Join(slices.Sorted(maps.Keys(filters)), ", ")
+}
+
+// toJSON encodes v compactly, without escaping HTML characters.
+func toJSON(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(buf.String(), "\n"), nil
+}
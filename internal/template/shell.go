@@ -0,0 +1,176 @@
+package template
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Quoting contexts of a position in a shell command.
+const (
+	quoteNone   byte = 0
+	quoteSingle byte = '\''
+	quoteDouble byte = '"'
+)
+
+var shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// ShellQuote quotes value as a single shell word. Values made only of
+// characters the shell treats literally are returned as they are.
+func ShellQuote(value string) string {
+	if shellSafeRe.MatchString(value) {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// quoteFor escapes value for insertion at a position with the given quoting
+// context, so that it is taken literally.
+func quoteFor(quote byte, value string) string {
+	switch quote {
+	case quoteSingle:
+		// Close the quotes, add an escaped ', and reopen them
+		return strings.ReplaceAll(value, "'", `'\''`)
+	case quoteDouble:
+		var b strings.Builder
+		for _, r := range value {
+			switch r {
+			case '\\', '"', '$', '`':
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	default:
+		return ShellQuote(value)
+	}
+}
+
+// ShellForms returns the ways value can appear in a command resolved by
+// ResolveShell, other than as itself.
+func ShellForms(value string) []string {
+	var forms []string
+	for _, q := range []byte{quoteNone, quoteSingle, quoteDouble} {
+		if f := quoteFor(q, value); f != value {
+			forms = append(forms, f)
+		}
+	}
+	return forms
+}
+
+// ShellRef is a ${{...}} reference in a shell command.
+type ShellRef struct {
+	Source     string // the reference as written
+	Raw        bool   // uses the raw filter
+	Quote      byte   // ' or " when inside quotes, 0 otherwise
+	QuoteStart int    // offset of the opening quote, when Quote is set
+}
+
+// ShellRefs returns the references in cmd with their quoting context.
+// unterminated is set when cmd ends inside quotes, in which case the
+// contexts may be wrong.
+func ShellRefs(cmd string) (refs []ShellRef, unterminated bool) {
+	states, starts, final := scanShellQuotes(cmd)
+	for _, loc := range templateRe.FindAllStringSubmatchIndex(cmd, -1) {
+		ref := ShellRef{
+			Source: cmd[loc[0]:loc[1]],
+			Quote:  states[loc[0]],
+		}
+		if n, err := parseExpr(cmd[loc[2]:loc[3]], loc[2], false); err == nil {
+			ref.Raw = isRaw(n)
+		}
+		if ref.Quote != quoteNone {
+			ref.QuoteStart = starts[loc[0]]
+		}
+		refs = append(refs, ref)
+	}
+	return refs, final != quoteNone
+}
+
+// shellQuoteStates returns the quoting context at the start of each
+// reference in cmd.
+func shellQuoteStates(cmd string) map[int]byte {
+	states, _, _ := scanShellQuotes(cmd)
+	return states
+}
+
+// shellFrame is the quoting state of the command being scanned, or of a
+// $(...) or `...` substitution within it, whose contents the shell parses as
+// a command of its own.
+type shellFrame struct {
+	quote      byte
+	quoteStart int
+	backtick   bool // ends at the next `, rather than at the ) closing $(
+	parens     int  // ( opened in the substitution and not yet closed
+}
+
+// scanShellQuotes walks cmd as sh would tokenize quotes, recording for each
+// reference the quoting context it starts in and where that quote opened.
+// Inside $(...) and `...`, even within double quotes, quoting starts over,
+// so a reference there is unquoted unless quoted inside the substitution.
+// References are skipped over, since their text is replaced. final is
+// quoteNone only if cmd ends outside quotes and substitutions.
+func scanShellQuotes(cmd string) (states map[int]byte, starts map[int]int, final byte) {
+	states = map[int]byte{}
+	starts = map[int]int{}
+	refs := templateRe.FindAllStringIndex(cmd, -1)
+	stack := []shellFrame{{}}
+	for i := 0; i < len(cmd); i++ {
+		f := &stack[len(stack)-1]
+		if len(refs) > 0 && i >= refs[0][0] {
+			states[refs[0][0]] = f.quote
+			starts[refs[0][0]] = f.quoteStart
+			i = refs[0][1] - 1
+			refs = refs[1:]
+			continue
+		}
+		c := cmd[i]
+		switch f.quote {
+		case quoteNone:
+			switch {
+			case c == '\\':
+				i++
+			case c == '\'' || c == '"':
+				f.quote, f.quoteStart = c, i
+			case c == '$' && i+1 < len(cmd) && cmd[i+1] == '(':
+				stack = append(stack, shellFrame{})
+				i++
+			case c == '`' && f.backtick:
+				stack = stack[:len(stack)-1]
+			case c == '`':
+				stack = append(stack, shellFrame{backtick: true})
+			case c == '(' && len(stack) > 1:
+				f.parens++
+			case c == ')' && len(stack) > 1 && !f.backtick:
+				if f.parens == 0 {
+					stack = stack[:len(stack)-1]
+				} else {
+					f.parens--
+				}
+			}
+		case quoteSingle:
+			if c == '\'' {
+				f.quote = quoteNone
+			}
+		case quoteDouble:
+			switch {
+			case c == '\\':
+				i++
+			case c == '"':
+				f.quote = quoteNone
+			case c == '$' && i+1 < len(cmd) && cmd[i+1] == '(':
+				stack = append(stack, shellFrame{})
+				i++
+			case c == '`' && f.backtick:
+				// Closes the substitution this double-quoted text is in
+				stack = stack[:len(stack)-1]
+			case c == '`':
+				stack = append(stack, shellFrame{backtick: true})
+			}
+		}
+	}
+	final = stack[len(stack)-1].quote
+	if len(stack) > 1 && final == quoteNone {
+		final = '('
+	}
+	return states, starts, final
+}
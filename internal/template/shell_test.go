@@ -0,0 +1,88 @@
+package template
+
+import (
+	"testing"
+)
+
+func TestResolveShellQuotesByContext(t *testing.T) {
+	ctx := &Context{
+		Inputs: map[string]string{
+			"safe":   "v1.2.3",
+			"evil":   `x"; rm -rf ~; echo "`,
+			"single": "it's $(id)",
+			"empty":  "",
+			"x":      "a; echo PWNED",
+		},
+		StepOutputs: map[string]map[string]string{},
+	}
+	cases := []struct {
+		cmd  string
+		want string
+	}{
+		{"deploy ${{inputs.safe}}", "deploy v1.2.3"},
+		{"echo ${{inputs.evil}}", `echo 'x"; rm -rf ~; echo "'`},
+		{`echo "got ${{inputs.evil}}"`, `echo "got x\"; rm -rf ~; echo \""`},
+		{"echo 'got ${{inputs.single}}'", `echo 'got it'\''s $(id)'`},
+		{"echo ${{inputs.single}}", `echo 'it'\''s $(id)'`},
+		{"echo [${{inputs.empty}}]", "echo ['']"},
+		{"echo ${{ inputs.evil | raw }}", `echo x"; rm -rf ~; echo "`},
+		{`echo "\"" ${{inputs.single}}`, `echo "\"" 'it'\''s $(id)'`},
+		// Substitutions start quoting over, even inside double quotes
+		{`echo "$(printf %s ${{inputs.x}})"`, `echo "$(printf %s 'a; echo PWNED')"`},
+		{"echo \"`printf %s ${{inputs.x}}`\"", "echo \"`printf %s 'a; echo PWNED'`\""},
+		{`echo "$(printf "%s" "${{inputs.evil}}") ${{inputs.evil}}"`, `echo "$(printf "%s" "x\"; rm -rf ~; echo \"") x\"; rm -rf ~; echo \""`},
+		{`echo $( (echo) ) ${{inputs.x}}`, `echo $( (echo) ) 'a; echo PWNED'`},
+	}
+	for _, c := range cases {
+		got, err := ResolveShell(c.cmd, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.cmd, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s:\n  expected %s\n  got      %s", c.cmd, c.want, got)
+		}
+	}
+}
+
+func TestResolveDoesNotReresolveValues(t *testing.T) {
+	ctx := &Context{
+		Inputs: map[string]string{"a": "${{inputs.b}}", "b": "secret"},
+	}
+	got, err := Resolve("${{inputs.a}}", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "${{inputs.b}}" {
+		t.Errorf("expected value to be inserted literally, got %q", got)
+	}
+}
+
+func TestResolveRejectsUnknownFilter(t *testing.T) {
+	ctx := &Context{Inputs: map[string]string{"a": "x"}}
+	if _, err := Resolve("${{ inputs.a | shout }}", ctx); err == nil {
+		t.Fatal("expected error for unknown filter")
+	}
+}
+
+func TestShellRefs(t *testing.T) {
+	refs, unterminated := ShellRefs(`sh -c "echo ${{inputs.a}}" && echo ${{ inputs.b | raw }} '${{inputs.c}}'`)
+	if unterminated || len(refs) != 3 {
+		t.Fatalf("unexpected refs %+v (unterminated=%v)", refs, unterminated)
+	}
+	if refs[0].Quote != '"' || refs[0].QuoteStart != 6 {
+		t.Errorf("expected first ref inside double quotes at 6, got %+v", refs[0])
+	}
+	if refs[1].Quote != 0 || !refs[1].Raw {
+		t.Errorf("expected bare raw ref, got %+v", refs[1])
+	}
+	if refs[2].Quote != '\'' {
+		t.Errorf("expected single-quoted ref, got %+v", refs[2])
+	}
+	if _, unterminated := ShellRefs(`echo "${{inputs.a}}`); !unterminated {
+		t.Error("expected unterminated quote to be reported")
+	}
+	if _, unterminated := ShellRefs(`echo "$(echo ${{inputs.a}}"`); !unterminated {
+		t.Error("expected unterminated substitution to be reported")
+	}
+}
@@ -3,53 +3,264 @@ package template
 import (
 	"fmt"
 	"regexp"
+	"strings"
+	"sync"
 )
 
-var stepRefRe = regexp.MustCompile(`\$\{\{steps\.([^.}]+)\.outputs\.([^}]+)\}\}`)
-var inputRefRe = regexp.MustCompile(`\$\{\{inputs\.([^}]+)\}\}`)
+// templateRe finds ${{ expression }} templates.
+var templateRe = regexp.MustCompile(`\$\{\{\s*(.*?)\s*\}\}`)
 
 // Context holds available values for template resolution.
+// It is safe to resolve templates while other goroutines call SetOutput.
 type Context struct {
 	Inputs      map[string]string
 	StepOutputs map[string]map[string]string // stepID → outputName → value
+	StepStatus  map[string]string            // stepID → status of a finished step
+	StepFields  map[string]map[string]string // stepID → exit_code and duration of a finished step
+	Run         map[string]string            // run.* fields; status and failed_step are set once the main steps are done
+	Plan        map[string]string            // plan.* fields
+	Env         map[string]string            // environment variables the plan allows templates to read
+
+	// Filtered, if set, is called with the input and result of every filter
+	// applied, so values derived from secrets can be masked as well.
+	Filtered func(in, out string)
+
+	mu     sync.RWMutex
+	parent *Context          // set for the scope of one foreach or matrix item, or of a step's params
+	item   string            // item, in a foreach scope
+	matrix map[string]string // matrix.* values, in a matrix scope
+	params map[string]string // params.* values, in the scope of a step using a template
 }
 
-// Resolve replaces all ${{steps.X.outputs.Y}} and ${{inputs.Z}} in s.
-func Resolve(s string, ctx *Context) (string, error) {
-	var resolveErr error
-
-	result := stepRefRe.ReplaceAllStringFunc(s, func(match string) string {
-		m := stepRefRe.FindStringSubmatch(match)
-		stepID, outputName := m[1], m[2]
-		outs, ok := ctx.StepOutputs[stepID]
-		if !ok {
-			resolveErr = fmt.Errorf("unresolved step reference %q", stepID)
-			return match
-		}
-		val, ok := outs[outputName]
-		if !ok {
-			resolveErr = fmt.Errorf("unresolved output %q on step %q", outputName, stepID)
-			return match
-		}
-		return val
-	})
-	if resolveErr != nil {
-		return "", resolveErr
+// Scope returns a context for one expansion of a foreach or matrix step, in
+// which item and matrix.* resolve to the given values. Everything else is
+// read from and recorded in c.
+func (c *Context) Scope(item string, matrix map[string]string) *Context {
+	return &Context{Inputs: c.Inputs, parent: c, item: item, matrix: matrix}
+}
+
+// WithParams returns a context for a step based on a template, in which
+// params.* resolve to the given values. Everything else is read from and
+// recorded in c.
+func (c *Context) WithParams(params map[string]string) *Context {
+	if params == nil {
+		params = map[string]string{}
+	}
+	return &Context{Inputs: c.Inputs, parent: c, params: params}
+}
+
+// SetOutput records the value of a step output.
+func (c *Context) SetOutput(stepID, name, value string) {
+	if c.parent != nil {
+		c.parent.SetOutput(stepID, name, value)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.StepOutputs == nil {
+		c.StepOutputs = map[string]map[string]string{}
+	}
+	if c.StepOutputs[stepID] == nil {
+		c.StepOutputs[stepID] = map[string]string{}
+	}
+	c.StepOutputs[stepID][name] = value
+}
+
+// SetStatus records the status of a finished step.
+func (c *Context) SetStatus(stepID, status string) {
+	if c.parent != nil {
+		c.parent.SetStatus(stepID, status)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.StepStatus == nil {
+		c.StepStatus = map[string]string{}
 	}
+	c.StepStatus[stepID] = status
+}
 
-	result = inputRefRe.ReplaceAllStringFunc(result, func(match string) string {
-		m := inputRefRe.FindStringSubmatch(match)
-		name := m[1]
-		val, ok := ctx.Inputs[name]
-		if !ok {
-			resolveErr = fmt.Errorf("unresolved input %q", name)
-			return match
+// SetStepField records a field such as exit_code of a finished step.
+func (c *Context) SetStepField(stepID, name, value string) {
+	if c.parent != nil {
+		c.parent.SetStepField(stepID, name, value)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.StepFields == nil {
+		c.StepFields = map[string]map[string]string{}
+	}
+	if c.StepFields[stepID] == nil {
+		c.StepFields[stepID] = map[string]string{}
+	}
+	c.StepFields[stepID][name] = value
+}
+
+// SetRun records a run.* field.
+func (c *Context) SetRun(name, value string) {
+	if c.parent != nil {
+		c.parent.SetRun(name, value)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Run == nil {
+		c.Run = map[string]string{}
+	}
+	c.Run[name] = value
+}
+
+// UsesRunOutcome reports whether s references run.status or
+// run.failed_step, which are only known once the main steps are done.
+func UsesRunOutcome(s string) bool {
+	for _, ref := range Refs(s) {
+		if ref.Namespace == "run" && (ref.Name == "status" || ref.Name == "failed_step") {
+			return true
 		}
-		return val
+	}
+	return false
+}
+
+// Resolve evaluates every ${{ expression }} in s and replaces it with the
+// result. Resolved values are inserted as they are and are not themselves
+// resolved again. A template that is only a reference outside the known
+// namespaces is left untouched.
+func Resolve(s string, ctx *Context) (string, error) {
+	return resolve(s, ctx, nil)
+}
+
+// ResolveShell resolves s like Resolve, for use as a shell command: every
+// value is quoted for the place it appears in, bare, inside '...' or inside
+// "...", so it reaches the command as a single literal word. Expressions
+// ending in the raw filter are inserted unquoted.
+func ResolveShell(s string, ctx *Context) (string, error) {
+	quotes := shellQuoteStates(s)
+	return resolve(s, ctx, func(start int, value string) string {
+		return quoteFor(quotes[start], value)
 	})
-	if resolveErr != nil {
-		return "", resolveErr
+}
+
+// resolve replaces each template in s with its value, passed through quote
+// unless quote is nil or the expression is raw.
+func resolve(s string, ctx *Context, quote func(start int, value string) string) (string, error) {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range templateRe.FindAllStringSubmatchIndex(s, -1) {
+		n, err := parseExpr(s[loc[2]:loc[3]], loc[2], false)
+		if err != nil {
+			return "", fmt.Errorf("in %s: %w", s[loc[0]:loc[1]], err)
+		}
+		if passThrough(n) {
+			continue
+		}
+		v, err := ctx.eval(n)
+		if err != nil {
+			return "", err
+		}
+		value := toString(v)
+		if quote != nil && !isRaw(n) {
+			value = quote(loc[0], value)
+		}
+		b.WriteString(s[last:loc[0]])
+		b.WriteString(value)
+		last = loc[1]
+	}
+	if last == 0 {
+		return s, nil
 	}
+	b.WriteString(s[last:])
+	return b.String(), nil
+}
 
-	return result, nil
+// lookup returns the value of a reference such as steps.build.outputs.image.
+// ok is false for references outside the known namespaces.
+func (c *Context) lookup(expr string) (value string, ok bool, err error) {
+	ns, rest, _ := strings.Cut(expr, ".")
+	if c.parent != nil {
+		switch {
+		case c.params != nil:
+			if ns == "params" {
+				val, found := c.params[rest]
+				if !found {
+					return "", false, &errUnresolved{fmt.Sprintf("unresolved param %q", rest)}
+				}
+				return val, true, nil
+			}
+		case expr == "item" && c.matrix == nil:
+			return c.item, true, nil
+		case ns == "matrix":
+			val, found := c.matrix[rest]
+			if !found {
+				return "", false, &errUnresolved{fmt.Sprintf("unresolved matrix value %q", rest)}
+			}
+			return val, true, nil
+		}
+		c.parent.mu.RLock()
+		defer c.parent.mu.RUnlock()
+		return c.parent.lookup(expr)
+	}
+	switch ns {
+	case "steps":
+		stepID, field, _ := strings.Cut(rest, ".")
+		if field == "status" {
+			status, found := c.StepStatus[stepID]
+			if !found {
+				return "", false, &errUnresolved{fmt.Sprintf("unresolved status of step %q", stepID)}
+			}
+			return status, true, nil
+		}
+		if field == "exit_code" || field == "duration" {
+			val, found := c.StepFields[stepID][field]
+			if !found {
+				return "", false, &errUnresolved{fmt.Sprintf("unresolved %s of step %q", field, stepID)}
+			}
+			return val, true, nil
+		}
+		outputName, isOutput := strings.CutPrefix(field, "outputs.")
+		if !isOutput {
+			return "", false, nil
+		}
+		outs, found := c.StepOutputs[stepID]
+		if !found {
+			return "", false, &errUnresolved{fmt.Sprintf("unresolved step reference %q", stepID)}
+		}
+		val, found := outs[outputName]
+		if !found {
+			return "", false, &errUnresolved{fmt.Sprintf("unresolved output %q on step %q", outputName, stepID)}
+		}
+		return val, true, nil
+	case "run":
+		val, found := c.Run[rest]
+		if !found {
+			return "", false, &errUnresolved{fmt.Sprintf("unresolved run field %q", rest)}
+		}
+		return val, true, nil
+	case "inputs":
+		val, found := c.Inputs[rest]
+		if !found {
+			return "", false, &errUnresolved{fmt.Sprintf("unresolved input %q", rest)}
+		}
+		return val, true, nil
+	case "plan":
+		val, found := c.Plan[rest]
+		if !found {
+			return "", false, &errUnresolved{fmt.Sprintf("unresolved plan field %q", rest)}
+		}
+		return val, true, nil
+	case "item", "matrix":
+		return "", false, &errUnresolved{fmt.Sprintf("%s is only available in foreach and matrix steps", expr)}
+	case "params":
+		return "", false, &errUnresolved{fmt.Sprintf("%s is only available in steps based on a template with params", expr)}
+	case "env":
+		val, found := c.Env[rest]
+		if !found {
+			return "", false, &errUnresolved{fmt.Sprintf("environment variable %q is not allowed", rest)}
+		}
+		return val, true, nil
+	}
+	return "", false, nil
 }
@@ -1,6 +1,7 @@
 package template
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -99,3 +100,74 @@ func TestResolveEmptyString(t *testing.T) {
 		t.Errorf("expected empty string, got %q", result)
 	}
 }
+
+func TestResolveStepStatus(t *testing.T) {
+	ctx := &Context{
+		Inputs:      map[string]string{},
+		StepOutputs: map[string]map[string]string{},
+	}
+	ctx.SetStatus("build", "failed")
+	result, err := Resolve("build was ${{steps.build.status}}", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result != "build was failed" {
+		t.Errorf("expected 'build was failed', got %q", result)
+	}
+}
+
+func TestResolveRunFields(t *testing.T) {
+	ctx := &Context{}
+	ctx.SetRun("status", "failed")
+	ctx.SetRun("failed_step", "deploy")
+	got, err := Resolve("${{run.status}} at ${{run.failed_step}}", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "failed at deploy" {
+		t.Errorf("expected 'failed at deploy', got %q", got)
+	}
+	if _, err := Resolve("${{run.status}}", &Context{}); err == nil {
+		t.Error("expected error for unset run field")
+	}
+}
+
+func TestResolveContextNamespaces(t *testing.T) {
+	ctx := &Context{
+		Plan: map[string]string{"name": "deploy"},
+		Env:  map[string]string{"HOME": "/home/ci"},
+	}
+	ctx.SetStepField("build", "exit_code", "3")
+	ctx.SetStepField("build", "duration", "1.5s")
+	got, err := Resolve("${{plan.name}} ${{ env.HOME }} ${{steps.build.exit_code}} ${{steps.build.duration}}", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "deploy /home/ci 3 1.5s" {
+		t.Errorf("unexpected result %q", got)
+	}
+	if _, err := Resolve("${{env.SECRET}}", ctx); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expected error for env variable outside the allowlist, got %v", err)
+	}
+}
+
+func TestScopeResolvesItemAndRecordsInParent(t *testing.T) {
+	ctx := &Context{Inputs: map[string]string{"env": "prod"}}
+	item := ctx.Scope("api", nil)
+	got, err := Resolve("${{ item }}@${{ inputs.env }}", item)
+	if err != nil || got != "api@prod" {
+		t.Fatalf("expected api@prod, got %q, %v", got, err)
+	}
+	item.SetOutput("deploy[api]", "url", "https://api")
+	if ctx.StepOutputs["deploy[api]"]["url"] != "https://api" {
+		t.Errorf("expected output to be recorded in the parent context")
+	}
+
+	cell := ctx.Scope("", map[string]string{"region": "eu"})
+	if got, err := Resolve("${{ matrix.region }}", cell); err != nil || got != "eu" {
+		t.Errorf("expected eu, got %q, %v", got, err)
+	}
+	if _, err := Resolve("${{ item }}", ctx); err == nil || !strings.Contains(err.Error(), "only available in foreach") {
+		t.Errorf("expected item to be unavailable outside a scope, got %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package declaragent
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/stevehiehn/declaragent/internal/action"
+	"github.com/stevehiehn/declaragent/internal/artifact"
+	"github.com/stevehiehn/declaragent/internal/engine"
+	dagerrors "github.com/stevehiehn/declaragent/internal/errors"
+	"github.com/stevehiehn/declaragent/internal/plan"
+)
+
+// The types plans, results and actions are made of
+type (
+	Plan            = plan.Plan
+	Step            = plan.Step
+	Warning         = plan.Warning
+	Result          = engine.Result
+	StepResult      = engine.StepResult
+	PreviousRun     = engine.PreviousRun
+	Event           = engine.Event
+	EventType       = engine.EventType
+	Observer        = engine.Observer
+	ApprovalRequest = engine.ApprovalRequest
+	Approver        = engine.Approver
+	Action          = action.Action
+	ActionSpec      = action.Spec
+	Param           = action.Param
+	SecretOutputs   = action.SecretOutputs
+	RunError        = dagerrors.RunError
+	ErrorList       = dagerrors.ErrorList
+)
+
+// Events of a run, in the order they happen
+const (
+	EventRunStarted   = engine.EventRunStarted
+	EventStepStarted  = engine.EventStepStarted
+	EventStepOutput   = engine.EventStepOutput
+	EventStepFinished = engine.EventStepFinished
+	EventRunFinished  = engine.EventRunFinished
+)
+
+// Types of RunError
+const (
+	ErrorValidation         = dagerrors.ValidationError
+	ErrorPreconditionFailed = dagerrors.PreconditionFailed
+	ErrorToolNotFound       = dagerrors.ToolNotFound
+	ErrorPermissionDenied   = dagerrors.PermissionDenied
+	ErrorTransient          = dagerrors.Transient
+	ErrorStepFailed         = dagerrors.StepFailed
+	ErrorTimeout            = dagerrors.Timeout
+	ErrorCancelled          = dagerrors.Cancelled
+	ErrorSideEffectBlocked  = dagerrors.SideEffectBlocked
+)
+
+// Param types
+const (
+	ParamString  = action.TypeString
+	ParamFile    = action.TypeFile
+	ParamBoolean = action.TypeBoolean
+	ParamInteger = action.TypeInteger
+	ParamNumber  = action.TypeNumber
+)
+
+// DefaultMaxParallel is the number of steps an Engine runs at once unless
+// WithMaxParallel says otherwise.
+const DefaultMaxParallel = engine.DefaultMaxParallel
+
+// Engine loads, validates and runs plans. Each Engine has its own actions,
+// starting with the built-in ones, so engines with different actions can
+// live side by side. Register actions before running plans; an Engine is
+// then safe for concurrent use.
+type Engine struct {
+	workDir      string
+	artifactRoot string
+	approver     Approver
+	observers    []Observer
+	maxParallel  int
+	actions      *action.Registry
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithWorkDir runs steps in dir. Relative plan files and file params are
+// taken from it too. The default is the current directory.
+func WithWorkDir(dir string) Option {
+	return func(e *Engine) { e.workDir = dir }
+}
+
+// WithArtifactRoot keeps the artifacts of each run in <dir>/<run_id>
+// rather than in .declaragent/runs of the working directory.
+func WithArtifactRoot(dir string) Option {
+	return func(e *Engine) { e.artifactRoot = dir }
+}
+
+// WithApprover asks approve before each destructive step runs; the step is
+// blocked if it returns false. Without an approver, destructive steps are
+// always blocked.
+func WithApprover(approve Approver) Option {
+	return func(e *Engine) { e.approver = approve }
+}
+
+// ApproveAll is an Approver allowing every destructive step, like
+// declaragent run --approve.
+func ApproveAll(context.Context, ApprovalRequest) bool {
+	return true
+}
+
+// WithObserver tells o about the progress of every run. It can be given
+// more than once.
+func WithObserver(o Observer) Option {
+	return func(e *Engine) { e.observers = append(e.observers, o) }
+}
+
+// WithMaxParallel runs at most n steps at once; 0 means no limit.
+func WithMaxParallel(n int) Option {
+	return func(e *Engine) { e.maxParallel = n }
+}
+
+// New returns an Engine with the built-in actions.
+func New(opts ...Option) *Engine {
+	wd, _ := os.Getwd()
+	e := &Engine{
+		workDir:     wd,
+		maxParallel: DefaultMaxParallel,
+		actions:     action.NewRegistry(),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// With returns a copy of e with opts applied, e.g. to approve destructive
+// steps for one run. The copy shares the actions of e.
+func (e *Engine) With(opts ...Option) *Engine {
+	c := *e
+	c.observers = slices.Clone(e.observers)
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
+
+// RegisterAction makes a available to the action: steps of plans e runs,
+// under the name its spec gives.
+func (e *Engine) RegisterAction(a Action) error {
+	return e.actions.Register(a)
+}
+
+// LoadPlugins registers the plugin actions found in dirs: executables
+// named declaragent-action-<name> that describe themselves when run with
+// describe. A name found in an earlier directory hides the same name in
+// later ones. Plugins that cannot be loaded are reported in the error; the
+// others are registered regardless.
+func (e *Engine) LoadPlugins(ctx context.Context, dirs ...string) error {
+	return e.actions.LoadPlugins(ctx, dirs)
+}
+
+// Actions returns the specs of the actions of e, sorted by name.
+func (e *Engine) Actions() []ActionSpec {
+	return e.actions.Specs()
+}
+
+// WorkDir returns the directory steps run in.
+func (e *Engine) WorkDir() string {
+	return e.workDir
+}
+
+// ArtifactRoot returns the directory holding the artifacts of each run.
+func (e *Engine) ArtifactRoot() string {
+	if e.artifactRoot != "" {
+		return e.artifactRoot
+	}
+	return artifact.DefaultRoot(e.workDir)
+}
+
+// LoadPlan reads the plan in file, taken from the working directory when
+// relative, with its imports and templates applied. When the file has
+// problems, such as unknown fields, the error lists them together with
+// those Validate finds in the rest of the plan.
+func (e *Engine) LoadPlan(file string) (*Plan, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(e.workDir, file)
+	}
+	p, err := plan.LoadFile(file)
+	if err != nil && p != nil {
+		return nil, e.Validate(p, nil)
+	}
+	return p, err
+}
+
+// Validate checks p against the actions of e. With inputs, required inputs
+// must be among them; a nil map skips that check. It reports every problem
+// found: one as a *RunError, several as an ErrorList.
+func (e *Engine) Validate(p *Plan, inputs map[string]string) error {
+	return plan.ValidateWith(p, inputs, e.actions)
+}
+
+// JSONSchema returns a JSON Schema of plan files, with the params of the
+// actions of e.
+func (e *Engine) JSONSchema() map[string]any {
+	return plan.JSONSchema(e.actions)
+}
+
+// Explain resolves the steps of p with inputs without running anything.
+func (e *Engine) Explain(ctx context.Context, p *Plan, inputs map[string]string) (*Result, error) {
+	return e.execute(ctx, p, inputs, engine.ModeExplain)
+}
+
+// DryRun shows what running p with inputs would do. Destructive steps are
+// shown as blocked unless e has an Approver.
+func (e *Engine) DryRun(ctx context.Context, p *Plan, inputs map[string]string) (*Result, error) {
+	return e.execute(ctx, p, inputs, engine.ModeDryRun)
+}
+
+// Run runs p with inputs, after filling in input defaults and validating
+// it. Cancelling ctx stops running steps. A step failing is reported in the
+// Result; errors are for plans that cannot run.
+func (e *Engine) Run(ctx context.Context, p *Plan, inputs map[string]string) (*Result, error) {
+	return e.execute(ctx, p, inputs, engine.ModeRun)
+}
+
+// LoadRun reads back run runID from the artifact root of e.
+func (e *Engine) LoadRun(runID string) (*PreviousRun, error) {
+	return engine.LoadRun(e.ArtifactRoot(), runID)
+}
+
+// Resume continues the failed run prev of p, skipping the steps that
+// succeeded. inputs adds to the inputs of the run, which lack its secret
+// inputs.
+func (e *Engine) Resume(ctx context.Context, p *Plan, prev *PreviousRun, inputs map[string]string) (*Result, error) {
+	merged := maps.Clone(prev.Meta.Inputs)
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, inputs)
+	merged = withDefaults(p, merged)
+	if err := e.Validate(p, merged); err != nil {
+		return nil, err
+	}
+	return engine.Resume(ctx, p, e.runContext(merged), prev)
+}
+
+// Lint returns warnings about steps of p that are valid but likely wrong.
+func Lint(p *Plan) []Warning {
+	return plan.Lint(p)
+}
+
+// Errors returns the problems in err, an error returned by Validate, Run and
+// the other methods of Engine, or nil if it holds none.
+func Errors(err error) []*RunError {
+	return dagerrors.All(err)
+}
+
+func (e *Engine) execute(ctx context.Context, p *Plan, inputs map[string]string, mode engine.Mode) (*Result, error) {
+	inputs = withDefaults(p, inputs)
+	if err := e.Validate(p, inputs); err != nil {
+		return nil, err
+	}
+	return engine.ExecuteContext(ctx, p, e.runContext(inputs), mode)
+}
+
+// runContext returns the context of a new run of e.
+func (e *Engine) runContext(inputs map[string]string) *engine.RunContext {
+	rc := engine.NewRunContext(e.workDir, inputs, false)
+	rc.ArtifactRoot = e.artifactRoot
+	rc.Approver = e.approver
+	rc.Observers = e.observers
+	rc.MaxParallel = e.maxParallel
+	rc.Actions = e.actions
+	return rc
+}
+
+// withDefaults returns a copy of inputs with the defaults of p's inputs
+// filled in.
+func withDefaults(p *Plan, inputs map[string]string) map[string]string {
+	filled := maps.Clone(inputs)
+	if filled == nil {
+		filled = map[string]string{}
+	}
+	for name, inp := range p.Inputs {
+		if _, ok := filled[name]; !ok && inp.Default != "" {
+			filled[name] = inp.Default
+		}
+	}
+	return filled
+}
@@ -0,0 +1,148 @@
+package declaragent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// transition is an action an embedding program defines.
+type transition struct{}
+
+func (transition) Execute(ctx context.Context, params map[string]string) (map[string]string, error) {
+	return map[string]string{"state": params["issue"] + "=" + params["to"]}, nil
+}
+
+func (transition) DryRun(params map[string]string) string {
+	return "Would move " + params["issue"] + " to " + params["to"]
+}
+
+func (transition) Spec() ActionSpec {
+	return ActionSpec{
+		Name:        "jira.transition",
+		Description: "Move an issue to another state",
+		Params: []Param{
+			{Name: "issue", Required: true, Description: "Issue key"},
+			{Name: "to", Required: true, Description: "State to move to"},
+		},
+		Outputs: []string{"state"},
+	}
+}
+
+// writePlan writes plan.yaml into a new working directory.
+func writePlan(t *testing.T, data string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "plan.yaml"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+const transitionPlan = `
+name: release
+inputs:
+  issue: {required: true}
+steps:
+  - id: move
+    action: jira.transition
+    with:
+      issue: ${{ inputs.issue }}
+      to: Done
+    outputs:
+      state: state
+  - id: tag
+    run: echo tagged
+    destructive: true
+outputs:
+  state: ${{ steps.move.outputs.state }}
+`
+
+func TestEngineRunsRegisteredAction(t *testing.T) {
+	dir := writePlan(t, transitionPlan)
+	var events []string
+	var asked []ApprovalRequest
+	root := filepath.Join(t.TempDir(), "runs")
+	eng := New(
+		WithWorkDir(dir),
+		WithArtifactRoot(root),
+		WithObserver(func(e Event) { events = append(events, string(e.Type)+" "+e.StepID) }),
+		WithApprover(func(ctx context.Context, req ApprovalRequest) bool {
+			asked = append(asked, req)
+			return true
+		}),
+	)
+	if err := eng.RegisterAction(transition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := eng.LoadPlan("plan.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = New().Validate(p, nil)
+	if problems := Errors(err); len(problems) != 1 || problems[0].Type != ErrorToolNotFound || !strings.Contains(err.Error(), `unknown action "jira.transition"`) {
+		t.Errorf("expected other engines not to know the action, got %v", err)
+	}
+
+	result, err := eng.Run(context.Background(), p, map[string]string{"issue": "OPS-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Success || result.Outputs["state"] != "OPS-1=Done" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	want := []string{"run_started ", "step_started move", "step_finished move", "step_started tag", "step_output tag", "step_finished tag", "run_finished "}
+	if !slices.Equal(events, want) {
+		t.Errorf("unexpected events %q", events)
+	}
+	if len(asked) != 1 || asked[0].Step.ID != "tag" || asked[0].Command != "echo tagged" || asked[0].Plan != "release" {
+		t.Errorf("expected approval to be asked for tag, got %+v", asked)
+	}
+	if _, err := os.Stat(filepath.Join(root, result.RunID, "result.json")); err != nil {
+		t.Errorf("expected artifacts under the artifact root: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".declaragent")); err == nil {
+		t.Error("expected nothing written to the working directory")
+	}
+	if _, err := eng.LoadRun(result.RunID); err != nil {
+		t.Errorf("expected the run to load back: %v", err)
+	}
+}
+
+func TestEngineBlocksDestructiveStepsWithoutApproval(t *testing.T) {
+	dir := writePlan(t, transitionPlan)
+	eng := New(WithWorkDir(dir))
+	if err := eng.RegisterAction(transition{}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := eng.LoadPlan("plan.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := map[string]string{"issue": "OPS-2"}
+
+	result, err := eng.Run(context.Background(), p, inputs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Success || result.Steps[1].Status != "blocked" {
+		t.Errorf("expected tag to be blocked, got %+v", result.Steps[1])
+	}
+
+	refuse := eng.With(WithApprover(func(context.Context, ApprovalRequest) bool { return false }))
+	if result, _ := refuse.Run(context.Background(), p, inputs); result.Steps[1].Status != "blocked" {
+		t.Errorf("expected a refused step to be blocked, got %+v", result.Steps[1])
+	}
+	approved := eng.With(WithApprover(ApproveAll))
+	if result, _ := approved.Run(context.Background(), p, inputs); !result.Success {
+		t.Errorf("expected the approved run to succeed, got %+v", result.Errors)
+	}
+
+	if _, err := eng.Run(context.Background(), p, nil); err == nil || !strings.Contains(err.Error(), `missing required input "issue"`) {
+		t.Errorf("expected validation error, got %v", err)
+	}
+}